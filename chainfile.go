@@ -0,0 +1,671 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ChainDefinition is the declarative, shareable form of a CommandChain.
+// Commands and dependencies are referenced by text or name instead of by
+// the numeric IDs of one user's store.
+type ChainDefinition struct {
+	Name        string            `json:"name" yaml:"name" toml:"name"`
+	Description string            `json:"description,omitempty" yaml:"description,omitempty" toml:"description,omitempty"`
+	DependsOn   []string          `json:"depends_on,omitempty" yaml:"depends_on,omitempty" toml:"depends_on,omitempty"`    // Chain names
+	WaitPolicy  string            `json:"wait_policy,omitempty" yaml:"wait_policy,omitempty" toml:"wait_policy,omitempty"` // "all" (default) or "any"
+	Vars        map[string]string `json:"vars,omitempty" yaml:"vars,omitempty" toml:"vars,omitempty"`                      // Default values of chain variables
+	Steps       []StepDefinition  `json:"steps" yaml:"steps" toml:"steps"`
+}
+
+// CommandRef points at a command either inline (Run) or by reference to a
+// saved command (Ref). Exactly one of the two must be set.
+type CommandRef struct {
+	Run   string `json:"run,omitempty" yaml:"run,omitempty" toml:"run,omitempty"`       // Inline command text
+	Ref   string `json:"ref,omitempty" yaml:"ref,omitempty" toml:"ref,omitempty"`       // "<id>", "<name>", "<library>/<name>" or "tag:<tag>"
+	Shell string `json:"shell,omitempty" yaml:"shell,omitempty" toml:"shell,omitempty"` // Shell or interpreter for run
+}
+
+type StepDefinition struct {
+	CommandRef `yaml:",inline"`
+	Conditions []CommandCondition `json:"conditions,omitempty" yaml:"conditions,omitempty" toml:"conditions,omitempty"`
+	Parallel   []CommandRef       `json:"parallel,omitempty" yaml:"parallel,omitempty" toml:"parallel,omitempty"`
+	OnSuccess  []CommandRef       `json:"on_success,omitempty" yaml:"on_success,omitempty" toml:"on_success,omitempty"`
+	OnFailure  []CommandRef       `json:"on_failure,omitempty" yaml:"on_failure,omitempty" toml:"on_failure,omitempty"`
+	Policy     string             `json:"policy,omitempty" yaml:"policy,omitempty" toml:"policy,omitempty"`          // all_must_succeed (default), main_only, any_succeeds or best_effort
+	FailFast   bool               `json:"fail_fast,omitempty" yaml:"fail_fast,omitempty" toml:"fail_fast,omitempty"` // Stop parallel commands once the step has failed
+	Capture    []VariableCapture  `json:"capture,omitempty" yaml:"capture,omitempty" toml:"capture,omitempty"`
+}
+
+// chainPlan is the result of resolving a ChainDefinition against the store.
+// Nothing is written until apply is called.
+type chainPlan struct {
+	chain       CommandChain
+	existing    *CommandChain
+	newCommands []Command
+}
+
+// isDefinitionFile reports whether path has an extension handled by
+// decodeDefinitionFile.
+func isDefinitionFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".toml", ".json":
+		return true
+	}
+	return false
+}
+
+// decodeDefinitionFile decodes a definition file into v, picking the format
+// from the file extension (.yaml/.yml, .toml or .json). Unknown keys are
+// rejected so typos don't silently drop settings.
+func decodeDefinitionFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(v); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), v)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("failed to parse %s: unknown key %q", path, undecoded[0].String())
+		}
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(v); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("unsupported file extension %q (use .yaml, .yml, .toml or .json)", filepath.Ext(path))
+	}
+	return nil
+}
+
+// encodeDefinitionFile writes v using the format implied by the file
+// extension.
+func encodeDefinitionFile(path string, v any) error {
+	var data []byte
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		data, err = yaml.Marshal(v)
+	case ".toml":
+		var buf bytes.Buffer
+		err = toml.NewEncoder(&buf).Encode(v)
+		data = buf.Bytes()
+	case ".json":
+		data, err = json.MarshalIndent(v, "", "    ")
+	default:
+		return fmt.Errorf("unsupported file extension %q (use .yaml, .yml, .toml or .json)", filepath.Ext(path))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", path, err)
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// parseChainDefinition reads and validates a chain definition file.
+func parseChainDefinition(path string) (*ChainDefinition, error) {
+	var def ChainDefinition
+	if err := decodeDefinitionFile(path, &def); err != nil {
+		return nil, err
+	}
+
+	if err := def.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &def, nil
+}
+
+func (def *ChainDefinition) validate() error {
+	if err := validateName(def.Name); err != nil {
+		return fmt.Errorf("chain name: %w", err)
+	}
+	if def.WaitPolicy != "" && def.WaitPolicy != "all" && def.WaitPolicy != "any" {
+		return fmt.Errorf("invalid wait_policy %q, expected \"all\" or \"any\"", def.WaitPolicy)
+	}
+	if len(def.Steps) == 0 {
+		return fmt.Errorf("chain %q has no steps", def.Name)
+	}
+	for name := range def.Vars {
+		if err := validateVarName(name); err != nil {
+			return fmt.Errorf("vars: %w", err)
+		}
+	}
+	for i, step := range def.Steps {
+		if err := step.CommandRef.validate(); err != nil {
+			return fmt.Errorf("step %d: %w", i+1, err)
+		}
+		for _, group := range [][]CommandRef{step.Parallel, step.OnSuccess, step.OnFailure} {
+			for _, ref := range group {
+				if err := ref.validate(); err != nil {
+					return fmt.Errorf("step %d: %w", i+1, err)
+				}
+			}
+		}
+		if step.Policy != "" && !slices.Contains(parallelPolicies, step.Policy) {
+			return fmt.Errorf("step %d: invalid policy %q, expected one of %s", i+1, step.Policy, strings.Join(parallelPolicies, ", "))
+		}
+		if (step.Policy != "" || step.FailFast) && len(step.Parallel) == 0 {
+			return fmt.Errorf("step %d: policy and fail_fast only apply to steps with parallel commands", i+1)
+		}
+		for _, cond := range step.Conditions {
+			if err := validateCondition(cond); err != nil {
+				return fmt.Errorf("step %d: %w", i+1, err)
+			}
+		}
+		for _, capture := range step.Capture {
+			if err := capture.validate(); err != nil {
+				return fmt.Errorf("step %d: %w", i+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (ref CommandRef) validate() error {
+	switch {
+	case ref.Run == "" && ref.Ref == "":
+		return fmt.Errorf("either run or ref must be set")
+	case ref.Run != "" && ref.Ref != "":
+		return fmt.Errorf("only one of run or ref may be set (got run %q and ref %q)", ref.Run, ref.Ref)
+	case ref.Shell != "" && ref.Run == "":
+		return fmt.Errorf("shell can only be set with run (got ref %q)", ref.Ref)
+	}
+	return nil
+}
+
+func (ref CommandRef) String() string {
+	if ref.Run != "" {
+		return ref.Run
+	}
+	return ref.Ref
+}
+
+// planChain resolves a chain definition against the store without
+// modifying it. Inline commands reuse a saved command with identical text
+// when one exists, so applying the same file twice is a no-op.
+func (cs *CommandStore) planChain(def *ChainDefinition) (*chainPlan, error) {
+	plan := &chainPlan{existing: cs.findChainByName(def.Name)}
+	nextID := cs.lastID
+
+	resolve := func(ref CommandRef) (int, error) {
+		// Library commands are copied in as inline commands
+		if strings.Contains(ref.Ref, "/") {
+			libCmd, err := cs.findLibraryCommand(ref.Ref)
+			if err != nil {
+				return 0, err
+			}
+			ref = CommandRef{Run: libCmd.Command, Shell: libCmd.Shell}
+		}
+		if ref.Run != "" {
+			for _, cmd := range cs.commands {
+				if cmd.Raw == ref.Run && cmd.Shell == ref.Shell {
+					return cmd.ID, nil
+				}
+			}
+			for _, cmd := range plan.newCommands {
+				if cmd.Raw == ref.Run && cmd.Shell == ref.Shell {
+					return cmd.ID, nil
+				}
+			}
+			if err := checkShell(ref.Shell); err != nil {
+				return 0, err
+			}
+			if err := validateScript(ref.Shell, ref.Run); err != nil {
+				return 0, fmt.Errorf("invalid command %q: %v", ref.Run, err)
+			}
+			nextID++
+			plan.newCommands = append(plan.newCommands, Command{
+				Raw:         ref.Run,
+				Timestamp:   time.Now(),
+				ID:          nextID,
+				Description: fmt.Sprintf("Added by chain %s", def.Name),
+				Shell:       ref.Shell,
+			})
+			return nextID, nil
+		}
+		return cs.resolveCommandRef(ref.Ref)
+	}
+
+	resolveAll := func(refs []CommandRef) ([]int, error) {
+		var ids []int
+		for _, ref := range refs {
+			id, err := resolve(ref)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		return ids, nil
+	}
+
+	chain := CommandChain{
+		Name:        def.Name,
+		Description: def.Description,
+		Vars:        def.Vars,
+		CreatedAt:   time.Now(),
+	}
+	if plan.existing != nil {
+		// Keep identity and history of the chain being updated
+		chain.ID = plan.existing.ID
+		chain.CreatedAt = plan.existing.CreatedAt
+		chain.LastRun = plan.existing.LastRun
+		chain.SuccessRate = plan.existing.SuccessRate
+		chain.RunCount = plan.existing.RunCount
+	} else {
+		chain.ID = cs.lastChainID + 1
+	}
+
+	for i, stepDef := range def.Steps {
+		var step ChainStep
+		var err error
+		if step.CommandID, err = resolve(stepDef.CommandRef); err != nil {
+			return nil, fmt.Errorf("step %d: %w", i+1, err)
+		}
+		if step.ParallelWith, err = resolveAll(stepDef.Parallel); err != nil {
+			return nil, fmt.Errorf("step %d parallel: %w", i+1, err)
+		}
+		if step.OnSuccess, err = resolveAll(stepDef.OnSuccess); err != nil {
+			return nil, fmt.Errorf("step %d on_success: %w", i+1, err)
+		}
+		if step.OnFailure, err = resolveAll(stepDef.OnFailure); err != nil {
+			return nil, fmt.Errorf("step %d on_failure: %w", i+1, err)
+		}
+		step.Conditions = stepDef.Conditions
+		step.Policy = stepDef.Policy
+		step.FailFast = stepDef.FailFast
+		step.Capture = stepDef.Capture
+		chain.Steps = append(chain.Steps, step)
+	}
+
+	if len(def.DependsOn) > 0 {
+		dep := ChainDependency{ChainID: chain.ID, WaitPolicy: def.WaitPolicy}
+		if dep.WaitPolicy == "" {
+			dep.WaitPolicy = "all"
+		}
+		for _, name := range def.DependsOn {
+			if name == def.Name {
+				return nil, fmt.Errorf("chain %q cannot depend on itself", name)
+			}
+			depChain := cs.findChainByName(name)
+			if depChain == nil {
+				return nil, fmt.Errorf("dependency chain %q not found", name)
+			}
+			dep.DependsOn = append(dep.DependsOn, depChain.ID)
+		}
+		chain.Dependencies = []ChainDependency{dep}
+		if cycle := cs.dependencyCycle(chain.ID, chain.Dependencies); cycle != nil {
+			names := make([]string, len(cycle))
+			for i, id := range cycle {
+				names[i] = def.Name
+				if other := cs.findChain(id); id != chain.ID && other != nil {
+					names[i] = chainLabel(other)
+				}
+			}
+			return nil, fmt.Errorf("dependency cycle: %s", strings.Join(names, " -> "))
+		}
+	}
+
+	plan.chain = chain
+	return plan, nil
+}
+
+// dependencyCycle returns the IDs along a dependency cycle reachable from
+// chainID, which is about to have deps as its dependencies, or nil if there
+// is none. The first ID is repeated at the end.
+func (cs *CommandStore) dependencyCycle(chainID int, deps []ChainDependency) []int {
+	dependsOn := func(id int) []int {
+		list := deps
+		if id != chainID {
+			chain := cs.findChain(id)
+			if chain == nil {
+				return nil
+			}
+			list = chain.Dependencies
+		}
+		var ids []int
+		for _, dep := range list {
+			ids = append(ids, dep.DependsOn...)
+		}
+		return ids
+	}
+
+	var path []int
+	done := make(map[int]bool)
+	var visit func(id int) bool
+	visit = func(id int) bool {
+		if i := slices.Index(path, id); i >= 0 {
+			path = append(path[i:], id)
+			return true
+		}
+		if done[id] {
+			return false
+		}
+		path = append(path, id)
+		for _, dep := range dependsOn(id) {
+			if visit(dep) {
+				return true
+			}
+		}
+		path = path[:len(path)-1]
+		done[id] = true
+		return false
+	}
+	if visit(chainID) {
+		return path
+	}
+	return nil
+}
+
+// describeChain renders a chain as one line per attribute/step so two
+// versions can be compared with a line diff.
+func (cs *CommandStore) describeChain(chain *CommandChain, pending []Command) []string {
+	if chain == nil {
+		return nil
+	}
+
+	cmdText := func(id int) string {
+		if cmd := cs.findCommand(id); cmd != nil {
+			return fmt.Sprintf("#%d %s", id, cmd.Raw)
+		}
+		for _, cmd := range pending {
+			if cmd.ID == id {
+				return fmt.Sprintf("#%d %s (new)", id, cmd.Raw)
+			}
+		}
+		return fmt.Sprintf("#%d <missing>", id)
+	}
+	cmdList := func(ids []int) string {
+		parts := make([]string, len(ids))
+		for i, id := range ids {
+			parts[i] = cmdText(id)
+		}
+		return strings.Join(parts, "; ")
+	}
+
+	lines := []string{fmt.Sprintf("description: %s", chain.Description)}
+	for _, name := range slices.Sorted(maps.Keys(chain.Vars)) {
+		lines = append(lines, fmt.Sprintf("var %s = %s", name, chain.Vars[name]))
+	}
+	for _, dep := range chain.Dependencies {
+		names := make([]string, 0, len(dep.DependsOn))
+		for _, id := range dep.DependsOn {
+			name := fmt.Sprintf("#%d", id)
+			for _, c := range cs.chains {
+				if c.ID == id {
+					name = c.Name
+				}
+			}
+			names = append(names, name)
+		}
+		lines = append(lines, fmt.Sprintf("depends on (%s): %s", dep.WaitPolicy, strings.Join(names, ", ")))
+	}
+	for i, step := range chain.Steps {
+		lines = append(lines, fmt.Sprintf("step %d: %s", i+1, cmdText(step.CommandID)))
+		for _, cond := range step.Conditions {
+			lines = append(lines, "  if "+describeCondition(cond))
+		}
+		if len(step.ParallelWith) > 0 {
+			lines = append(lines, fmt.Sprintf("  parallel: %s", cmdList(step.ParallelWith)))
+		}
+		if step.Policy != "" {
+			lines = append(lines, fmt.Sprintf("  policy: %s", step.Policy))
+		}
+		if step.FailFast {
+			lines = append(lines, "  fail fast")
+		}
+		for _, capture := range step.Capture {
+			switch {
+			case capture.Regex != "":
+				lines = append(lines, fmt.Sprintf("  capture %s: regex %q", capture.Name, capture.Regex))
+			case capture.JSONPath != "":
+				lines = append(lines, fmt.Sprintf("  capture %s: json_path %s", capture.Name, capture.JSONPath))
+			default:
+				lines = append(lines, fmt.Sprintf("  capture %s: output", capture.Name))
+			}
+		}
+		if len(step.OnSuccess) > 0 {
+			lines = append(lines, fmt.Sprintf("  on success: %s", cmdList(step.OnSuccess)))
+		}
+		if len(step.OnFailure) > 0 {
+			lines = append(lines, fmt.Sprintf("  on failure: %s", cmdList(step.OnFailure)))
+		}
+	}
+	return lines
+}
+
+// diffLines returns a unified-style line diff of a and b based on their
+// longest common subsequence. Each line is prefixed with "  ", "- " or "+ ".
+func diffLines(a, b []string) []string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, "  "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "- "+a[i])
+			i++
+		default:
+			out = append(out, "+ "+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, "- "+a[i])
+	}
+	for ; j < len(b); j++ {
+		out = append(out, "+ "+b[j])
+	}
+	return out
+}
+
+// preview prints the changes the plan would make. It returns false when
+// applying the plan would not change anything.
+func (cs *CommandStore) preview(plan *chainPlan) bool {
+	before := cs.describeChain(plan.existing, nil)
+	after := cs.describeChain(&plan.chain, plan.newCommands)
+
+	changed := plan.existing == nil || len(plan.newCommands) > 0
+	diff := diffLines(before, after)
+	for _, line := range diff {
+		if !strings.HasPrefix(line, "  ") {
+			changed = true
+		}
+	}
+	if !changed {
+		fmt.Printf("Chain #%d %s is up to date\n", plan.chain.ID, plan.chain.Name)
+		return false
+	}
+
+	if plan.existing == nil {
+		fmt.Printf("Create chain #%d: %s\n", plan.chain.ID, plan.chain.Name)
+	} else {
+		fmt.Printf("Update chain #%d: %s\n", plan.chain.ID, plan.chain.Name)
+	}
+	for _, line := range diff {
+		fmt.Printf("  %s\n", line)
+	}
+	if len(plan.newCommands) > 0 {
+		fmt.Println("\nNew commands:")
+		for _, cmd := range plan.newCommands {
+			fmt.Printf("  + #%d %s\n", cmd.ID, cmd.Raw)
+		}
+	}
+	return true
+}
+
+// applyPlan writes the resolved chain and any new commands to the store.
+func (cs *CommandStore) applyPlan(plan *chainPlan) error {
+	for _, cmd := range plan.newCommands {
+		cs.commands = append(cs.commands, cmd)
+		if cmd.ID > cs.lastID {
+			cs.lastID = cmd.ID
+		}
+	}
+
+	if plan.existing != nil {
+		*plan.existing = plan.chain
+	} else {
+		cs.chains = append(cs.chains, plan.chain)
+		cs.lastChainID = plan.chain.ID
+	}
+
+	cs.updateStats()
+	return cs.save()
+}
+
+// ApplyChainFile creates or updates the chain described by a definition
+// file. Changes are previewed first; unless assumeYes is set the user is
+// asked to confirm. With dryRun the preview is printed and nothing is saved.
+func (cs *CommandStore) ApplyChainFile(path string, assumeYes, dryRun bool) error {
+	def, err := parseChainDefinition(path)
+	if err != nil {
+		return err
+	}
+
+	plan, err := cs.planChain(def)
+	if err != nil {
+		return fmt.Errorf("chain %q: %w", def.Name, err)
+	}
+
+	if !cs.preview(plan) || dryRun {
+		return nil
+	}
+
+	if !assumeYes {
+		fmt.Print("\nApply these changes? [y/N]: ")
+		input, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		input = strings.ToLower(strings.TrimSpace(input))
+		if input != "y" && input != "yes" {
+			fmt.Println("Aborted")
+			return nil
+		}
+	}
+
+	if err := cs.applyPlan(plan); err != nil {
+		return fmt.Errorf("failed to save chain: %w", err)
+	}
+	fmt.Printf("Applied chain #%d: %s\n", plan.chain.ID, plan.chain.Name)
+	return nil
+}
+
+// ExportChainDefinition converts a stored chain to a definition with inline
+// commands and named dependencies, suitable for sharing.
+func (cs *CommandStore) ExportChainDefinition(chainID int) (*ChainDefinition, error) {
+	var chain *CommandChain
+	for i := range cs.chains {
+		if cs.chains[i].ID == chainID {
+			chain = &cs.chains[i]
+			break
+		}
+	}
+	if chain == nil {
+		return nil, fmt.Errorf("chain with ID %d not found", chainID)
+	}
+
+	inline := func(id int) (CommandRef, error) {
+		cmd := cs.findCommand(id)
+		if cmd == nil {
+			return CommandRef{}, fmt.Errorf("chain %d references non-existent command %d", chain.ID, id)
+		}
+		return CommandRef{Run: cmd.Raw, Shell: cmd.Shell}, nil
+	}
+	inlineAll := func(ids []int) ([]CommandRef, error) {
+		var refs []CommandRef
+		for _, id := range ids {
+			ref, err := inline(id)
+			if err != nil {
+				return nil, err
+			}
+			refs = append(refs, ref)
+		}
+		return refs, nil
+	}
+
+	def := &ChainDefinition{Name: chain.Name, Description: chain.Description, Vars: chain.Vars}
+	for _, dep := range chain.Dependencies {
+		if def.WaitPolicy == "" && dep.WaitPolicy != "all" {
+			def.WaitPolicy = dep.WaitPolicy
+		}
+		for _, id := range dep.DependsOn {
+			found := false
+			for _, c := range cs.chains {
+				if c.ID == id {
+					def.DependsOn = append(def.DependsOn, c.Name)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("chain %d depends on non-existent chain %d", chain.ID, id)
+			}
+		}
+	}
+
+	for _, step := range chain.Steps {
+		var stepDef StepDefinition
+		var err error
+		if stepDef.CommandRef, err = inline(step.CommandID); err != nil {
+			return nil, err
+		}
+		if stepDef.Parallel, err = inlineAll(step.ParallelWith); err != nil {
+			return nil, err
+		}
+		if stepDef.OnSuccess, err = inlineAll(step.OnSuccess); err != nil {
+			return nil, err
+		}
+		if stepDef.OnFailure, err = inlineAll(step.OnFailure); err != nil {
+			return nil, err
+		}
+		stepDef.Conditions = step.Conditions
+		stepDef.Policy = step.Policy
+		stepDef.FailFast = step.FailFast
+		stepDef.Capture = step.Capture
+		def.Steps = append(def.Steps, stepDef)
+	}
+	return def, nil
+}
@@ -0,0 +1,739 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Exit codes: 0 on success, 1 when save itself fails and exitUsage for
+// invalid arguments. Commands that run a saved command exit with its status.
+const (
+	exitOK    = 0
+	exitUsage = 2
+)
+
+// usageError reports invalid arguments and exits with exitUsage.
+func usageError(usage, format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "Error: %s\n", fmt.Sprintf(format, args...))
+	if usage != "" {
+		fmt.Fprintf(os.Stderr, "Usage: %s\n", usage)
+	}
+	os.Exit(exitUsage)
+}
+
+// joinCommandArgs turns the words after "--" back into a command line. A
+// single word is taken as a complete shell command; several words are
+// quoted so each one reaches the command unchanged.
+func joinCommandArgs(args []string) string {
+	if len(args) == 1 {
+		return args[0]
+	}
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// subcommand is one "save <name> ..." command. Subcommands parse their own
+// flags and translate them to the flag form handled by main, so both
+// spellings share one implementation.
+type subcommand struct {
+	name    string
+	usage   string
+	summary string
+	parse   func(fs *flag.FlagSet, args []string) ([]string, error)
+}
+
+var subcommands []subcommand
+
+func init() {
+	subcommands = []subcommand{
+		{"exec", "[--tag <tags>] [--desc <text>] [--dir] [--shell <shell>] [--script <file|->] [--] <command...>", "Run a command and save it", parseExec},
+		{"run", "<name|id> [--] [args...]", "Run a saved command, appending args", parseRun},
+		{"rerun", "<name|id>", "Run a saved command again", oneArg("--rerun", "name|id")},
+		{"list", "[n] [--all] [--tag <tag>] [--dir <dir>] [--favorites]", "List saved commands", parseList},
+		{"search", "<query>", "Search saved and library commands", readCommand("--search", 1, 1)},
+		{"tags", "", "List tags and how often they are used", readCommand("--list-tags", 0, 0)},
+		{"stats", "[--since <time>] [--until <time>] [--by day|week|tag|dir]", "Show run statistics", parseStats},
+		{"insights", "[--recent <age>]", "Find flaky, failing and slowing commands", parseInsights},
+		{"favorite", "<name|id>", "Mark a command as favorite", oneArg("--favorite", "name|id")},
+		{"protect", "<name|id> [--off]", "Always confirm before running a command", parseProtect},
+		{"tag", "add|remove <name|id> <tags>", "Add or remove tags", parseTag},
+		{"edit", "<name|id>", "Edit a command interactively", oneArg("--interactive-edit", "name|id")},
+		{"undo", "<name|id>", "Undo the last edit of a command", oneArg("--undo", "name|id")},
+		{"remove", "<name|id>...", "Remove commands", parseRemove},
+		{"name", "<name> <name|id>", "Name a command", fixedArgs("--name", 2)},
+		{"chain", "list|run|resume|create|create-with-deps|apply|export|name ...", "Manage command chains", parseChain},
+		{"library", "add|remove|list|sync|promote ...", "Manage shared libraries", passThrough("--library")},
+		{"sync", "[remote <url>]", "Sync history through a git remote", parseSync},
+		{"serve", "[addr]", "Share this store over HTTP", parseServe},
+		{"watch", "<name|id|chain:<chain>> <path|glob>... [--debounce <duration>] [--ignore <pattern>]...", "Run a command or chain when files change", parseWatch},
+		{"test-notify", "[--failure]", "Send a test notification through the notify channels", parseTestNotify},
+		{"schedule", "add <name|id|chain:<chain>> <cron> [--catch-up once|skip|all] | list | remove <id> | daemon | run-due", "Run commands and chains on a schedule", parseSchedule},
+		{"import", "<file>", "Import commands", oneArg("--import", "file")},
+		{"export", "<file>", "Export commands", oneArg("--export", "file")},
+		{"backup", "[create|restore <file>|list]", "Create, restore or list backups", parseBackup},
+		{"verify", "[--repair]", "Check (and repair) data integrity", parseVerify},
+		{"completion", "<bash|zsh|fish|powershell> | install [shell]", "Print or install shell completion", parseCompletion},
+		{"config", "get <key>|set <key> <value...>|unset <key>|list|edit", "Show or change settings", passThrough("--config")},
+		{"config-path", "", "Show the history file location", fixedArgs("--config-path", 0)},
+		{"version", "", "Show version information", fixedArgs("--version", 0)},
+		{"help", "[command]", "Show help", parseHelp},
+	}
+}
+
+func findSubcommand(name string) *subcommand {
+	for i := range subcommands {
+		if subcommands[i].name == name {
+			return &subcommands[i]
+		}
+	}
+	return nil
+}
+
+// translate parses a subcommand's arguments and returns the equivalent
+// flag-form arguments. Invalid arguments exit with exitUsage.
+func (sub *subcommand) translate(args []string) []string {
+	fs := flag.NewFlagSet("save "+sub.name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() { sub.printUsage(fs) }
+
+	legacy, err := sub.parse(fs, args)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(exitOK)
+	}
+	if err != nil {
+		// The flag package has already reported its own errors
+		if !isFlagError(err) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			sub.printUsage(fs)
+		}
+		os.Exit(exitUsage)
+	}
+	return legacy
+}
+
+func (sub *subcommand) printUsage(fs *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: save %s %s\n", sub.name, sub.usage)
+	fmt.Fprintf(os.Stderr, "%s\n", sub.summary)
+	hasFlags := false
+	fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+	if hasFlags {
+		fmt.Fprintln(os.Stderr, "\nOptions:")
+		fs.PrintDefaults()
+	}
+}
+
+// flagError marks errors returned by FlagSet.Parse, which prints them.
+type flagError struct{ err error }
+
+func (e flagError) Error() string { return e.err.Error() }
+func (e flagError) Unwrap() error { return e.err }
+
+func isFlagError(err error) bool {
+	var fe flagError
+	return errors.As(err, &fe)
+}
+
+// parseFlags parses flags anywhere among the arguments and returns the
+// positional ones. Everything after "--" is positional.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, err
+			}
+			return nil, flagError{err}
+		}
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		// Parse stops at "--" (which it consumes) or at a positional argument
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+func checkArgs(positional []string, min, max int) error {
+	if len(positional) < min {
+		return fmt.Errorf("missing arguments")
+	}
+	if max >= 0 && len(positional) > max {
+		return fmt.Errorf("unexpected argument '%s'", positional[max])
+	}
+	return nil
+}
+
+// outputFlags registers --output and --format on a read command and
+// returns a function that renders them back as arguments.
+func outputFlags(fs *flag.FlagSet) func() []string {
+	format := fs.String("output", "", "output format: "+strings.Join(outputFormats, ", "))
+	fs.StringVar(format, "o", "", "shorthand for --output")
+	tmpl := fs.String("format", "", "Go template applied to each record")
+	return func() []string {
+		var args []string
+		if *format != "" {
+			args = append(args, "--output", *format)
+		}
+		if *tmpl != "" {
+			args = append(args, "--format", *tmpl)
+		}
+		return args
+	}
+}
+
+// fixedArgs translates a command taking exactly n positional arguments.
+func fixedArgs(flagName string, n int) func(*flag.FlagSet, []string) ([]string, error) {
+	return func(fs *flag.FlagSet, args []string) ([]string, error) {
+		positional, err := parseFlags(fs, args)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkArgs(positional, n, n); err != nil {
+			return nil, err
+		}
+		return append([]string{flagName}, positional...), nil
+	}
+}
+
+// oneArg translates a command taking a single argument.
+func oneArg(flagName, what string) func(*flag.FlagSet, []string) ([]string, error) {
+	return func(fs *flag.FlagSet, args []string) ([]string, error) {
+		positional, err := parseFlags(fs, args)
+		if err != nil {
+			return nil, err
+		}
+		if len(positional) == 0 {
+			return nil, fmt.Errorf("missing <%s>", what)
+		}
+		if err := checkArgs(positional, 1, 1); err != nil {
+			return nil, err
+		}
+		return []string{flagName, positional[0]}, nil
+	}
+}
+
+// readCommand translates a read command that supports --output.
+func readCommand(flagName string, min, max int) func(*flag.FlagSet, []string) ([]string, error) {
+	return func(fs *flag.FlagSet, args []string) ([]string, error) {
+		output := outputFlags(fs)
+		positional, err := parseFlags(fs, args)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkArgs(positional, min, max); err != nil {
+			return nil, err
+		}
+		return append(append([]string{flagName}, positional...), output()...), nil
+	}
+}
+
+// passThrough hands the arguments to the flag form unparsed.
+func passThrough(flagName string) func(*flag.FlagSet, []string) ([]string, error) {
+	return func(fs *flag.FlagSet, args []string) ([]string, error) {
+		if isHelp(fs, args) {
+			return nil, flag.ErrHelp
+		}
+		return append([]string{flagName}, args...), nil
+	}
+}
+
+func parseExec(fs *flag.FlagSet, args []string) ([]string, error) {
+	tags := fs.String("tag", "", "comma separated tags")
+	desc := fs.String("desc", "", "description")
+	dir := fs.Bool("dir", false, "save the current directory with the command")
+	shell := fs.String("shell", "", "shell or interpreter to run the command with, or exec for none")
+	script := fs.String("script", "", "read a multi-line script from a file, or - for stdin")
+
+	// Flags only come before the command; its own arguments are never parsed
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, err
+		}
+		return nil, flagError{err}
+	}
+	if fs.NArg() == 0 && *script == "" {
+		return nil, fmt.Errorf("no command given")
+	}
+	if fs.NArg() > 0 && *script != "" {
+		return nil, fmt.Errorf("--script cannot be combined with a command")
+	}
+
+	var legacy []string
+	if *tags != "" {
+		legacy = append(legacy, "--tag", *tags)
+	}
+	if *desc != "" {
+		legacy = append(legacy, "--desc", *desc)
+	}
+	if *dir {
+		legacy = append(legacy, "--dir")
+	}
+	if *shell != "" {
+		legacy = append(legacy, "--shell", *shell)
+	}
+	if *script != "" {
+		return append(legacy, "--script", *script), nil
+	}
+	return append(append(legacy, "--"), fs.Args()...), nil
+}
+
+func parseRun(fs *flag.FlagSet, args []string) ([]string, error) {
+	if isHelp(fs, args) {
+		return nil, flag.ErrHelp
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("missing <name|id>")
+	}
+	// Arguments after the reference belong to the command
+	extra := args[1:]
+	if len(extra) > 0 && extra[0] == "--" {
+		extra = extra[1:]
+	}
+	return append([]string{"run", args[0]}, extra...), nil
+}
+
+func parseList(fs *flag.FlagSet, args []string) ([]string, error) {
+	output := outputFlags(fs)
+	all := fs.Bool("all", false, "list every command")
+	tag := fs.String("tag", "", "only commands with this tag")
+	dir := fs.String("dir", "", "only commands saved in this directory")
+	favorites := fs.Bool("favorites", false, "only favorite commands")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkArgs(positional, 0, 1); err != nil {
+		return nil, err
+	}
+
+	filters := 0
+	for _, set := range []bool{*tag != "", *dir != "", *favorites} {
+		if set {
+			filters++
+		}
+	}
+	if filters > 1 {
+		return nil, fmt.Errorf("--tag, --dir and --favorites cannot be combined")
+	}
+	if filters == 1 && (len(positional) > 0 || *all) {
+		return nil, fmt.Errorf("a count or --all cannot be combined with a filter")
+	}
+
+	var legacy []string
+	switch {
+	case *tag != "":
+		legacy = []string{"--filter-tag", *tag}
+	case *dir != "":
+		legacy = []string{"--filter-dir", *dir}
+	case *favorites:
+		legacy = []string{"--list-favorites"}
+	case *all:
+		legacy = []string{"--list", "all"}
+	default:
+		legacy = append([]string{"--list"}, positional...)
+	}
+	return append(legacy, output()...), nil
+}
+
+func parseStats(fs *flag.FlagSet, args []string) ([]string, error) {
+	output := outputFlags(fs)
+	since := fs.String("since", "", "only runs after this time (7d, 12h, 2006-01-02, ...)")
+	until := fs.String("until", "", "only runs before this time")
+	by := fs.String("by", "", "group by day, week, tag or dir")
+	asJSON := fs.Bool("json", false, "shorthand for --output json")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkArgs(positional, 0, 0); err != nil {
+		return nil, err
+	}
+
+	legacy := []string{"--stats"}
+	for _, opt := range []struct{ name, value string }{{"--since", *since}, {"--until", *until}, {"--by", *by}} {
+		if opt.value != "" {
+			legacy = append(legacy, opt.name, opt.value)
+		}
+	}
+	if *asJSON {
+		legacy = append(legacy, "--json")
+	}
+	return append(legacy, output()...), nil
+}
+
+func parseInsights(fs *flag.FlagSet, args []string) ([]string, error) {
+	recent := fs.String("recent", "", "how far back runs count as recent (default 7d)")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkArgs(positional, 0, 0); err != nil {
+		return nil, err
+	}
+	if *recent != "" {
+		return []string{"--insights", "--recent", *recent}, nil
+	}
+	return []string{"--insights"}, nil
+}
+
+func parseTag(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkArgs(positional, 3, 3); err != nil {
+		return nil, err
+	}
+	switch positional[0] {
+	case "add":
+		return []string{"--add-tags", positional[1], positional[2]}, nil
+	case "remove":
+		return []string{"--remove-tags", positional[1], positional[2]}, nil
+	}
+	return nil, fmt.Errorf("unknown tag action '%s'", positional[0])
+}
+
+func parseRemove(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(positional) == 0 {
+		return nil, fmt.Errorf("missing <name|id>")
+	}
+	return []string{"--remove", strings.Join(positional, ",")}, nil
+}
+
+// isHelp reports whether args ask for help before any action.
+func isHelp(fs *flag.FlagSet, args []string) bool {
+	if len(args) > 0 && (args[0] == "-h" || args[0] == "-help" || args[0] == "--help") {
+		fs.Usage()
+		return true
+	}
+	return false
+}
+
+func parseChain(fs *flag.FlagSet, args []string) ([]string, error) {
+	if isHelp(fs, args) {
+		return nil, flag.ErrHelp
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("missing chain action")
+	}
+	action, args := args[0], args[1:]
+
+	switch action {
+	case "list":
+		return readCommand("--list-chains", 0, 0)(fs, args)
+	case "run", "resume":
+		continueOnError := fs.Bool("continue-on-error", false, "don't fail when the chain has errors")
+		maxParallel := fs.Int("max-parallel", 0, "run at most `n` commands of a parallel step at once")
+		dashboard := fs.Bool("dashboard", false, "show parallel steps as a live status board")
+		fromStep := fs.Int("from-step", 0, "start at step `n`, without running dependencies")
+		onlyStep := fs.Int("only-step", 0, "run only step `n`, without running dependencies")
+		confirmed := fs.Bool("confirmed", false, "run dangerous steps without asking to confirm them")
+		var dryRun, explain, markFixed *bool
+		if action == "run" {
+			dryRun = fs.Bool("dry-run", false, "show what would run without running it")
+			explain = fs.Bool("explain", false, "like --dry-run, and show why steps run or are skipped")
+		} else {
+			markFixed = fs.Bool("mark-fixed", false, "treat the failed step as fixed and continue after it")
+		}
+		var vars []string
+		fs.Func("var", "set a chain variable, as `name=value` (repeatable)", func(v string) error {
+			vars = append(vars, v)
+			return nil
+		})
+		positional, err := parseFlags(fs, args)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkArgs(positional, 1, 1); err != nil {
+			return nil, err
+		}
+		legacy := []string{"--run-chain", positional[0]}
+		if action == "resume" {
+			legacy[0] = "--resume"
+		}
+		if *continueOnError {
+			legacy = append(legacy, "--continue-on-error")
+		}
+		if *maxParallel != 0 {
+			legacy = append(legacy, "--max-parallel", strconv.Itoa(*maxParallel))
+		}
+		if *dashboard {
+			legacy = append(legacy, "--dashboard")
+		}
+		for _, v := range vars {
+			legacy = append(legacy, "--var", v)
+		}
+		if *fromStep != 0 {
+			legacy = append(legacy, "--from-step", strconv.Itoa(*fromStep))
+		}
+		if *onlyStep != 0 {
+			legacy = append(legacy, "--only-step", strconv.Itoa(*onlyStep))
+		}
+		if *confirmed {
+			legacy = append(legacy, "--confirmed")
+		}
+		if action == "run" {
+			if *dryRun {
+				legacy = append(legacy, "--dry-run")
+			}
+			if *explain {
+				legacy = append(legacy, "--explain")
+			}
+		} else if *markFixed {
+			legacy = append(legacy, "--mark-fixed")
+		}
+		return legacy, nil
+	case "create":
+		return fixedArgs("--create-chain", 2)(fs, args)
+	case "create-with-deps":
+		return fixedArgs("--create-chain-with-deps", 4)(fs, args)
+	case "apply":
+		yes := fs.Bool("yes", false, "apply without asking")
+		fs.BoolVar(yes, "y", false, "shorthand for --yes")
+		dryRun := fs.Bool("dry-run", false, "only show the changes")
+		positional, err := parseFlags(fs, args)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkArgs(positional, 1, 1); err != nil {
+			return nil, err
+		}
+		legacy := []string{"--apply-chain", positional[0]}
+		if *yes {
+			legacy = append(legacy, "--yes")
+		}
+		if *dryRun {
+			legacy = append(legacy, "--dry-run")
+		}
+		return legacy, nil
+	case "export":
+		return fixedArgs("--export-chain", 2)(fs, args)
+	case "name":
+		return fixedArgs("--name-chain", 2)(fs, args)
+	}
+	return nil, fmt.Errorf("unknown chain action '%s'", action)
+}
+
+func parseSync(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(positional) == 0 {
+		return []string{"--sync"}, nil
+	}
+	if positional[0] != "remote" {
+		return nil, fmt.Errorf("unknown sync action '%s'", positional[0])
+	}
+	if err := checkArgs(positional, 2, 2); err != nil {
+		return nil, err
+	}
+	return []string{"--sync-remote", positional[1]}, nil
+}
+
+func parseServe(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkArgs(positional, 0, 1); err != nil {
+		return nil, err
+	}
+	return append([]string{"--serve"}, positional...), nil
+}
+
+func parseWatch(fs *flag.FlagSet, args []string) ([]string, error) {
+	debounce := fs.Duration("debounce", 0, "wait until files are unchanged for `duration` before running")
+	var ignore []string
+	fs.Func("ignore", "skip files matching `pattern`, as in .gitignore (repeatable)", func(v string) error {
+		ignore = append(ignore, v)
+		return nil
+	})
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkArgs(positional, 2, -1); err != nil {
+		return nil, err
+	}
+	legacy := append([]string{"--watch"}, positional...)
+	if *debounce != 0 {
+		legacy = append(legacy, "--debounce", debounce.String())
+	}
+	for _, pattern := range ignore {
+		legacy = append(legacy, "--ignore", pattern)
+	}
+	return legacy, nil
+}
+
+func parseTestNotify(fs *flag.FlagSet, args []string) ([]string, error) {
+	failure := fs.Bool("failure", false, "notify about a failed run")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkArgs(positional, 0, 0); err != nil {
+		return nil, err
+	}
+	if *failure {
+		return []string{"--test-notify", "--failure"}, nil
+	}
+	return []string{"--test-notify"}, nil
+}
+
+func parseProtect(fs *flag.FlagSet, args []string) ([]string, error) {
+	off := fs.Bool("off", false, "stop protecting the command")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(positional) == 0 {
+		return nil, fmt.Errorf("missing <name|id>")
+	}
+	if err := checkArgs(positional, 1, 1); err != nil {
+		return nil, err
+	}
+	if *off {
+		return []string{"--protect", positional[0], "--off"}, nil
+	}
+	return []string{"--protect", positional[0]}, nil
+}
+
+func parseSchedule(fs *flag.FlagSet, args []string) ([]string, error) {
+	if isHelp(fs, args) {
+		return nil, flag.ErrHelp
+	}
+	if len(args) == 0 || args[0] == "list" {
+		return readCommand("--list-schedules", 0, 0)(fs, args[min(len(args), 1):])
+	}
+	catchUp := fs.String("catch-up", "", "what to do about missed runs: "+strings.Join(catchUpPolicies, ", "))
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(positional) == 0 {
+		return nil, fmt.Errorf("missing schedule action")
+	}
+	switch positional[0] {
+	case "add":
+		if err := checkArgs(positional, 3, 3); err != nil {
+			return nil, err
+		}
+		legacy := []string{"--schedule", positional[1], positional[2]}
+		if *catchUp != "" {
+			legacy = append(legacy, "--catch-up", *catchUp)
+		}
+		return legacy, nil
+	case "remove":
+		if err := checkArgs(positional, 2, 2); err != nil {
+			return nil, err
+		}
+		return []string{"--unschedule", positional[1]}, nil
+	case "daemon", "run-due":
+		if err := checkArgs(positional, 1, 1); err != nil {
+			return nil, err
+		}
+		return []string{"--" + positional[0]}, nil
+	}
+	return nil, fmt.Errorf("unknown schedule action '%s'", positional[0])
+}
+
+func parseBackup(fs *flag.FlagSet, args []string) ([]string, error) {
+	if isHelp(fs, args) {
+		return nil, flag.ErrHelp
+	}
+	if len(args) > 0 && args[0] == "list" {
+		return readCommand("--list-backups", 0, 0)(fs, args[1:])
+	}
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(positional) == 0 || positional[0] == "create" {
+		if err := checkArgs(positional, 0, 1); err != nil {
+			return nil, err
+		}
+		return []string{"--backup"}, nil
+	}
+	if positional[0] != "restore" {
+		return nil, fmt.Errorf("unknown backup action '%s'", positional[0])
+	}
+	if err := checkArgs(positional, 2, 2); err != nil {
+		return nil, err
+	}
+	return []string{"--restore", positional[1]}, nil
+}
+
+func parseVerify(fs *flag.FlagSet, args []string) ([]string, error) {
+	repair := fs.Bool("repair", false, "repair the issues found")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkArgs(positional, 0, 0); err != nil {
+		return nil, err
+	}
+	if *repair {
+		return []string{"--repair"}, nil
+	}
+	return []string{"--verify"}, nil
+}
+
+func parseCompletion(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(positional) > 0 && positional[0] == "install" {
+		if err := checkArgs(positional, 1, 2); err != nil {
+			return nil, err
+		}
+		return append([]string{"--install-completion"}, positional[1:]...), nil
+	}
+	if err := checkArgs(positional, 1, 1); err != nil {
+		return nil, err
+	}
+	return []string{"--generate-completion", positional[0]}, nil
+}
+
+func parseHelp(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkArgs(positional, 0, 1); err != nil {
+		return nil, err
+	}
+	if len(positional) == 1 {
+		if findPlugin(positional[0]) != "" {
+			// Plugins document themselves
+			return []string{positional[0], "--help"}, nil
+		}
+		sub := findSubcommand(positional[0])
+		if sub == nil {
+			return nil, fmt.Errorf("unknown command '%s'", positional[0])
+		}
+		// Show the command's own usage, including its flags
+		sub.translate([]string{"--help"})
+	}
+	return []string{"--help"}, nil
+}
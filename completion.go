@@ -0,0 +1,702 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Completion kinds name what an argument completes to. Any other non-empty
+// kind is a list of literal choices separated by "|"; an empty kind is free
+// text and completes to nothing.
+const (
+	kindCommand    = "command"    // Saved command IDs and names
+	kindRunnable   = "runnable"   // Saved commands and lib/name references
+	kindChain      = "chain"      // Chain IDs and names, including library chains
+	kindChainRun   = "chainrun"   // IDs of chain runs that can be resumed
+	kindSchedule   = "schedule"   // Schedule IDs
+	kindTag        = "tag"        // Tags, completing each part of a comma separated list
+	kindLibrary    = "library"    // Library names
+	kindBackup     = "backup"     // Backup files
+	kindShell      = "shell"      // Shells with a completion script
+	kindSubcommand = "subcommand" // Subcommand names
+	kindSetting    = "setting"    // Config file keys
+	kindFile       = "file"       // Left to the shell's file completion
+	kindDir        = "dir"        // Left to the shell's directory completion
+)
+
+var completionShells = []string{"bash", "zsh", "fish", "powershell"}
+
+// flagSpec describes one flag form accepted by main. Completion scripts and
+// validCommandFlags are both derived from flagRegistry.
+type flagSpec struct {
+	name    string
+	args    []string            // Kind of each positional argument
+	options []string            // Options accepted after the arguments
+	actions map[string][]string // With actions, args[0] picks the action and these kinds follow it
+	repeat  bool                // The last argument may be given any number of times
+	option  bool                // Modifies another command instead of being one
+	desc    string
+}
+
+var flagRegistry = []flagSpec{
+	// Options for the command being saved, and global options
+	{name: "--tag", args: []string{kindTag}, option: true, desc: "Add comma-separated tags"},
+	{name: "--desc", args: []string{""}, option: true, desc: "Add a description"},
+	{name: "--dir", option: true, desc: "Save with the current directory"},
+	{name: "--no-dir", option: true, desc: "Don't save the directory, even if save_dir is set"},
+	{name: "--shell", args: []string{strings.Join(shellChoices, "|")}, option: true, desc: "Run with this shell or interpreter"},
+	{name: "--script", args: []string{kindFile}, option: true, desc: "Save a multi-line script from a file"},
+	{name: "--no-color", option: true, desc: "Disable colour output"},
+	{name: "--remote", args: []string{""}, option: true, desc: "Use the store served at a URL"},
+	{name: "--output", args: []string{strings.Join(outputFormats, "|")}, option: true, desc: "Output format for read commands"},
+	{name: "--format", args: []string{""}, option: true, desc: "Go template for each record"},
+
+	{name: "run", args: []string{kindRunnable}, desc: "Run a command with extra arguments"},
+	{name: "--rerun", args: []string{kindRunnable}, desc: "Re-run a command"},
+	{name: "--list", args: []string{"all"}, desc: "List the last commands"},
+	{name: "--search", args: []string{""}, desc: "Search commands"},
+	{name: "--filter-dir", args: []string{kindDir}, desc: "Filter by directory"},
+	{name: "--filter-tag", args: []string{kindTag}, desc: "Filter by tag"},
+	{name: "--list-tags", desc: "List all tags"},
+	{name: "--list-favorites", desc: "List favorite commands"},
+	{name: "--stats", options: []string{"--since", "--until", "--by", "--json"}, desc: "Show statistics"},
+	{name: "--insights", options: []string{"--recent"}, desc: "Find flaky, failing and slowing commands"},
+	{name: "--favorite", args: []string{kindCommand}, desc: "Mark as favorite"},
+	{name: "--protect", args: []string{kindCommand}, options: []string{"--off"}, desc: "Always confirm before running"},
+	{name: "--name", args: []string{"", kindCommand}, desc: "Name a command"},
+	{name: "--remove", args: []string{kindCommand}, repeat: true, desc: "Remove commands"},
+	{name: "--interactive-edit", args: []string{kindCommand}, desc: "Edit a command interactively"},
+	{name: "--add-tags", args: []string{kindCommand, kindTag}, desc: "Add tags to a command"},
+	{name: "--remove-tags", args: []string{kindCommand, kindTag}, desc: "Remove tags from a command"},
+	{name: "--undo", args: []string{kindCommand}, desc: "Undo the last edit"},
+	{name: "--export", args: []string{kindFile}, desc: "Export history"},
+	{name: "--import", args: []string{kindFile}, desc: "Import commands"},
+	{name: "--create-chain", args: []string{"", ""}, desc: "Create a command chain"},
+	{name: "--create-chain-with-deps", args: []string{"", "", kindFile, kindFile}, desc: "Create a chain with dependencies"},
+	{name: "--list-chains", desc: "List all chains"},
+	{name: "--run-chain", args: []string{kindChain}, options: []string{"--continue-on-error", "--max-parallel", "--dashboard", "--var", "--from-step", "--only-step", "--confirmed", "--dry-run", "--explain"}, desc: "Run a command chain"},
+	{name: "--resume", args: []string{kindChainRun}, options: []string{"--mark-fixed", "--continue-on-error", "--max-parallel", "--dashboard", "--var", "--from-step", "--only-step", "--confirmed"}, desc: "Resume a failed chain run"},
+	{name: "--name-chain", args: []string{"", kindChain}, desc: "Rename a chain"},
+	{name: "--apply-chain", args: []string{kindFile}, options: []string{"--yes", "--dry-run"}, desc: "Create or update a chain from a file"},
+	{name: "--export-chain", args: []string{kindChain, kindFile}, desc: "Export a chain definition"},
+	{name: "--library", args: []string{"add|remove|list|sync|promote"}, actions: map[string][]string{
+		"add":     {"", kindDir},
+		"remove":  {kindLibrary},
+		"sync":    {kindLibrary},
+		"promote": {kindCommand, kindLibrary, kindFile},
+	}, desc: "Manage shared libraries"},
+	{name: "--sync", desc: "Sync history through git"},
+	{name: "--sync-remote", args: []string{""}, desc: "Set the sync git remote"},
+	{name: "--serve", args: []string{""}, desc: "Share this store over HTTP"},
+	{name: "--schedule", args: []string{kindRunnable, ""}, options: []string{"--catch-up"}, desc: "Run a command or chain:<chain> on a cron schedule"},
+	{name: "--unschedule", args: []string{kindSchedule}, desc: "Remove a schedule"},
+	{name: "--list-schedules", desc: "List schedules with their next run"},
+	{name: "--run-due", desc: "Run the scheduled jobs that are due"},
+	{name: "--daemon", desc: "Run scheduled jobs until interrupted"},
+	{name: "--watch", args: []string{kindRunnable, kindFile}, repeat: true, options: []string{"--debounce", "--ignore"}, desc: "Run a command or chain:<chain> when files change"},
+	{name: "--test-notify", options: []string{"--failure"}, desc: "Send a test notification"},
+	{name: "--backup", desc: "Create a backup"},
+	{name: "--restore", args: []string{kindBackup}, desc: "Restore a backup"},
+	{name: "--list-backups", desc: "List backups"},
+	{name: "--verify", desc: "Check data integrity"},
+	{name: "--repair", desc: "Repair data integrity issues"},
+	{name: "--generate-completion", args: []string{kindShell}, desc: "Print a completion script"},
+	{name: "--install-completion", args: []string{kindShell}, desc: "Install shell completion"},
+	{name: "--config", args: []string{"edit|get|list|set|unset"}, actions: map[string][]string{
+		"get":   {kindSetting},
+		"set":   {kindSetting},
+		"unset": {kindSetting},
+	}, desc: "Show or change settings"},
+	{name: "--config-path", desc: "Show the history file location"},
+	{name: "--version", desc: "Show version information"},
+	{name: "--help", args: []string{kindSubcommand}, desc: "Show help"},
+}
+
+// validCommandFlags are the flags that are commands of their own and so
+// can't start a command being saved.
+var validCommandFlags = commandFlags()
+
+func commandFlags() map[string]bool {
+	flags := make(map[string]bool)
+	for _, spec := range flagRegistry {
+		if !spec.option && strings.HasPrefix(spec.name, "--") {
+			flags[spec.name] = true
+		}
+	}
+	return flags
+}
+
+func findFlagSpec(name string) *flagSpec {
+	if name == "-o" {
+		name = "--output"
+	}
+	for i := range flagRegistry {
+		if flagRegistry[i].name == name {
+			return &flagRegistry[i]
+		}
+	}
+	return nil
+}
+
+// subcommandFlags maps subcommands to the flag form whose arguments they
+// share. Subcommands with actions map each action instead; an action
+// without a flag takes no further arguments.
+var (
+	subcommandFlags = map[string]string{
+		"run":      "run",
+		"rerun":    "--rerun",
+		"search":   "--search",
+		"favorite": "--favorite",
+		"protect":  "--protect",
+		"edit":     "--interactive-edit",
+		"undo":     "--undo",
+		"remove":   "--remove",
+		"name":     "--name",
+		"library":  "--library",
+		"config":   "--config",
+		"serve":    "--serve",
+		"watch":    "--watch",
+		"import":   "--import",
+		"export":   "--export",
+		"help":     "--help",
+	}
+	subcommandActions = map[string]map[string]string{
+		"tag": {"add": "--add-tags", "remove": "--remove-tags"},
+		"chain": {
+			"list":             "--list-chains",
+			"run":              "--run-chain",
+			"resume":           "--resume",
+			"create":           "--create-chain",
+			"create-with-deps": "--create-chain-with-deps",
+			"apply":            "--apply-chain",
+			"export":           "--export-chain",
+			"name":             "--name-chain",
+		},
+		"sync":       {"remote": "--sync-remote"},
+		"backup":     {"create": "--backup", "restore": "--restore", "list": "--list-backups"},
+		"completion": {"bash": "", "zsh": "", "fish": "", "powershell": "", "install": "--install-completion"},
+		"schedule": {
+			"add":     "--schedule",
+			"list":    "--list-schedules",
+			"remove":  "--unschedule",
+			"daemon":  "--daemon",
+			"run-due": "--run-due",
+		},
+	}
+)
+
+// optionValueKinds lists the options that take a value, by name without
+// dashes, and what the value completes to.
+var optionValueKinds = map[string]string{
+	"tag":          kindTag,
+	"desc":         "",
+	"dir":          kindDir,
+	"since":        "",
+	"until":        "",
+	"by":           "day|week|tag|dir",
+	"recent":       "",
+	"max-parallel": "",
+	"var":          "",
+	"from-step":    "",
+	"only-step":    "",
+	"catch-up":     strings.Join(catchUpPolicies, "|"),
+	"debounce":     "",
+	"ignore":       "",
+	"output":       strings.Join(outputFormats, "|"),
+	"o":            strings.Join(outputFormats, "|"),
+	"format":       "",
+	"shell":        strings.Join(shellChoices, "|"),
+	"script":       kindFile,
+}
+
+// completion is one candidate printed by "save __complete".
+type completion struct {
+	Value       string
+	Description string
+}
+
+// Complete returns the candidates for the word at position (counted from 1)
+// among words, the arguments after "save". Files and directories are left
+// to the shell: the returned directive is then kindFile or kindDir.
+func (cs *CommandStore) Complete(position int, words []string) ([]completion, string) {
+	position = max(position, 1)
+	prev := words[:min(position-1, len(words))]
+	cur := ""
+	if position <= len(words) {
+		cur = words[position-1]
+	}
+
+	// Options for the command being saved and global options come first
+	for len(prev) > 0 {
+		spec := findFlagSpec(prev[0])
+		if spec == nil || !spec.option {
+			break
+		}
+		if len(prev) <= len(spec.args) {
+			return cs.completeKind(spec.args[len(prev)-1], cur)
+		}
+		prev = prev[1+len(spec.args):]
+	}
+
+	if len(prev) == 0 {
+		var candidates []completion
+		if strings.HasPrefix(cur, "-") {
+			for _, spec := range flagRegistry {
+				if strings.HasPrefix(spec.name, "-") {
+					candidates = append(candidates, completion{spec.name, spec.desc})
+				}
+			}
+		} else {
+			for _, sub := range subcommands {
+				candidates = append(candidates, completion{sub.name, sub.summary})
+			}
+			for _, plugin := range listPlugins(cs) {
+				candidates = append(candidates, completion{plugin, "plugin"})
+			}
+		}
+		return filterCompletions(candidates, cur), ""
+	}
+
+	if sub := findSubcommand(prev[0]); sub != nil {
+		return cs.completeSubcommand(sub, prev[1:], cur)
+	}
+	if spec := findFlagSpec(prev[0]); spec != nil {
+		positional, pending := splitCompletionArgs(prev[1:], func(name string) bool {
+			_, ok := optionValueKinds[name]
+			return ok
+		})
+		if pending != "" {
+			return cs.completeKind(optionValueKinds[pending], cur)
+		}
+		if strings.HasPrefix(cur, "-") {
+			var candidates []completion
+			for _, opt := range spec.options {
+				candidates = append(candidates, completion{opt, ""})
+			}
+			if readCommands[spec.name] {
+				candidates = append(candidates, completion{"--output", "Output format"}, completion{"--format", "Go template for each record"})
+			}
+			return filterCompletions(candidates, cur), ""
+		}
+		return cs.completePositional(spec, positional, cur)
+	}
+
+	// Anything else is the text of a command being saved
+	return nil, ""
+}
+
+func (cs *CommandStore) completeSubcommand(sub *subcommand, rest []string, cur string) ([]completion, string) {
+	actions, hasActions := subcommandActions[sub.name]
+	action := ""
+	if hasActions && len(rest) > 0 {
+		action = rest[0]
+	}
+
+	fs := sub.completionFlags(action)
+	positional, pending := splitCompletionArgs(rest, func(name string) bool {
+		f := fs.Lookup(name)
+		return f != nil && !isBoolFlag(f)
+	})
+	if pending != "" {
+		return cs.completeKind(optionValueKinds[pending], cur)
+	}
+
+	if strings.HasPrefix(cur, "-") {
+		var candidates []completion
+		fs.VisitAll(func(f *flag.Flag) {
+			// Single letter shorthands only clutter the list
+			if len(f.Name) > 1 {
+				candidates = append(candidates, completion{"--" + f.Name, f.Usage})
+			}
+		})
+		return filterCompletions(candidates, cur), ""
+	}
+
+	if hasActions {
+		if len(positional) == 0 {
+			return cs.completeKind(strings.Join(slices.Sorted(maps.Keys(actions)), "|"), cur)
+		}
+		spec := findFlagSpec(actions[positional[0]])
+		if spec == nil {
+			return nil, ""
+		}
+		return cs.completePositional(spec, positional[1:], cur)
+	}
+
+	spec := findFlagSpec(subcommandFlags[sub.name])
+	if spec == nil {
+		return nil, ""
+	}
+	return cs.completePositional(spec, positional, cur)
+}
+
+// completionFlags returns the subcommand's flags for an action. Parsing a
+// help request registers the flags without doing anything else.
+func (sub *subcommand) completionFlags(action string) *flag.FlagSet {
+	fs := flag.NewFlagSet("save "+sub.name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Usage = func() {}
+	args := []string{"-h"}
+	if action != "" {
+		args = []string{action, "-h"}
+	}
+	sub.parse(fs, args)
+	return fs
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// splitCompletionArgs separates positional words from options. When the
+// last word is an option still waiting for its value, its name is returned.
+func splitCompletionArgs(words []string, takesValue func(name string) bool) (positional []string, pending string) {
+	for i := 0; i < len(words); i++ {
+		word := words[i]
+		if word == "--" {
+			return append(positional, words[i+1:]...), ""
+		}
+		if !strings.HasPrefix(word, "-") || word == "-" {
+			positional = append(positional, word)
+			continue
+		}
+		name := strings.TrimLeft(word, "-")
+		if strings.Contains(name, "=") || !takesValue(name) {
+			continue
+		}
+		if i == len(words)-1 {
+			return positional, name
+		}
+		i++
+	}
+	return positional, ""
+}
+
+func (cs *CommandStore) completePositional(spec *flagSpec, positional []string, cur string) ([]completion, string) {
+	args := spec.args
+	if spec.actions != nil && len(positional) > 0 {
+		args = append([]string{args[0]}, spec.actions[positional[0]]...)
+	}
+	switch {
+	case len(positional) < len(args):
+		return cs.completeKind(args[len(positional)], cur)
+	case spec.repeat && len(args) > 0:
+		return cs.completeKind(args[len(args)-1], cur)
+	}
+	return nil, ""
+}
+
+// completeKind lists the values of a completion kind that start with cur.
+func (cs *CommandStore) completeKind(kind, cur string) ([]completion, string) {
+	var candidates []completion
+	switch kind {
+	case "":
+		return nil, ""
+
+	case kindFile, kindDir:
+		return nil, kind
+
+	case kindCommand, kindRunnable:
+		for _, cmd := range cs.commands {
+			desc := cmd.Raw
+			if cmd.Description != "" {
+				desc += " (" + cmd.Description + ")"
+			}
+			candidates = append(candidates, completion{strconv.Itoa(cmd.ID), desc})
+			if cmd.Name != "" {
+				candidates = append(candidates, completion{cmd.Name, desc})
+			}
+		}
+		if kind == kindRunnable {
+			for _, lib := range cs.loadedLibraries() {
+				for _, name := range slices.Sorted(maps.Keys(lib.commands)) {
+					candidates = append(candidates, completion{lib.Name + "/" + name, lib.commands[name].Command})
+				}
+			}
+		}
+
+	case kindChain:
+		for _, chain := range cs.chains {
+			desc := chain.Name
+			if chain.Description != "" {
+				desc = chain.Description
+			}
+			candidates = append(candidates, completion{strconv.Itoa(chain.ID), desc})
+			if chain.Name != "" {
+				candidates = append(candidates, completion{chain.Name, desc})
+			}
+		}
+		for _, lib := range cs.loadedLibraries() {
+			for _, name := range slices.Sorted(maps.Keys(lib.chains)) {
+				candidates = append(candidates, completion{lib.Name + "/" + name, lib.chains[name].Description})
+			}
+		}
+
+	case kindChainRun:
+		for _, run := range cs.chainRuns {
+			if run.Success || run.Checkpoint == nil {
+				continue
+			}
+			desc := fmt.Sprintf("%s at step %d, %s", run.Chain, run.Checkpoint.NextStep+1, run.StartedAt.Format("2006-01-02 15:04"))
+			candidates = append(candidates, completion{strconv.Itoa(run.ID), desc})
+		}
+
+	case kindSchedule:
+		for _, s := range cs.schedules {
+			candidates = append(candidates, completion{strconv.Itoa(s.ID), s.Cron + " " + cs.runTargetLabel(s.CommandID, s.ChainID)})
+		}
+
+	case kindTag:
+		// Complete the last entry of a comma separated list
+		prefix := cur[:strings.LastIndex(cur, ",")+1]
+		given := strings.Split(prefix, ",")
+		for _, tag := range cs.tagCounts() {
+			if slices.Contains(given, tag.Tag) {
+				continue
+			}
+			desc := fmt.Sprintf("%d commands", tag.Count)
+			if tag.Count == 1 {
+				desc = "1 command"
+			}
+			candidates = append(candidates, completion{prefix + tag.Tag, desc})
+		}
+
+	case kindLibrary:
+		for _, lib := range cs.libraries {
+			candidates = append(candidates, completion{lib.Name, lib.Path})
+		}
+
+	case kindBackup:
+		backups, _ := cs.listBackupFiles()
+		for _, backup := range backups {
+			candidates = append(candidates, completion{backup.Path, backup.Modified.Format("2006-01-02 15:04:05")})
+		}
+
+	case kindShell:
+		for _, shell := range completionShells {
+			candidates = append(candidates, completion{shell, ""})
+		}
+
+	case kindSubcommand:
+		for _, sub := range subcommands {
+			candidates = append(candidates, completion{sub.name, sub.summary})
+		}
+		for _, plugin := range listPlugins(cs) {
+			candidates = append(candidates, completion{plugin, "plugin"})
+		}
+
+	case kindSetting:
+		for _, s := range configSettings {
+			candidates = append(candidates, completion{s.key, s.desc})
+		}
+
+	default:
+		for _, choice := range strings.Split(kind, "|") {
+			candidates = append(candidates, completion{choice, ""})
+		}
+	}
+
+	return filterCompletions(candidates, cur), ""
+}
+
+func filterCompletions(candidates []completion, cur string) []completion {
+	var matching []completion
+	for _, c := range candidates {
+		if strings.HasPrefix(c.Value, cur) {
+			matching = append(matching, c)
+		}
+	}
+	return matching
+}
+
+// printCompletions writes candidates as "value<TAB>description" lines, or
+// the directive on a line of its own as ":file" or ":dir".
+func printCompletions(candidates []completion, directive string) {
+	if directive != "" {
+		fmt.Printf(":%s\n", directive)
+		return
+	}
+	for _, c := range candidates {
+		desc := strings.Join(strings.Fields(c.Description), " ")
+		if runes := []rune(desc); len(runes) > 60 {
+			desc = string(runes[:57]) + "..."
+		}
+		if desc == "" {
+			fmt.Println(c.Value)
+		} else {
+			fmt.Printf("%s\t%s\n", c.Value, desc)
+		}
+	}
+}
+
+// normalizeShell maps shell program names to completion script names.
+func normalizeShell(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".exe")
+	if name == "pwsh" {
+		return "powershell"
+	}
+	return name
+}
+
+// detectShell guesses the user's shell for --install-completion.
+func detectShell() string {
+	if shell := os.Getenv("SHELL"); shell != "" {
+		return normalizeShell(filepath.Base(shell))
+	}
+	if runtime.GOOS == "windows" || os.Getenv("PSModulePath") != "" {
+		return "powershell"
+	}
+	return ""
+}
+
+// completionInstallPath returns where --install-completion writes the
+// script for a shell and what is left for the user to do.
+func completionInstallPath(shell string) (path, hint string, err error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", "", err
+	}
+	switch shell {
+	case "bash":
+		path = filepath.Join(home, ".bash_completion.d", "save")
+		return path, fmt.Sprintf("Add 'source %s' to your ~/.bashrc", path), nil
+	case "zsh":
+		dir := filepath.Join(home, ".zsh", "completions")
+		return filepath.Join(dir, "_save"), fmt.Sprintf("Add 'fpath=(%s $fpath)' before compinit in your ~/.zshrc", dir), nil
+	case "fish":
+		configHome := os.Getenv("XDG_CONFIG_HOME")
+		if configHome == "" {
+			configHome = filepath.Join(home, ".config")
+		}
+		return filepath.Join(configHome, "fish", "completions", "save.fish"), "Fish loads it in new shells", nil
+	case "powershell":
+		dir := filepath.Join(home, ".config", "powershell")
+		if runtime.GOOS == "windows" {
+			dir = filepath.Join(home, "Documents", "WindowsPowerShell", "Completions")
+		}
+		path = filepath.Join(dir, "save.ps1")
+		return path, fmt.Sprintf("Add '. %s' to your $PROFILE", path), nil
+	}
+	return "", "", fmt.Errorf("unsupported shell '%s', expected one of %s", shell, strings.Join(completionShells, ", "))
+}
+
+// installCompletion writes the completion script for a shell and returns
+// its path and what is left for the user to do.
+func installCompletion(shell string) (path, hint string, err error) {
+	path, hint, err = completionInstallPath(shell)
+	if err != nil {
+		return "", "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", "", fmt.Errorf("failed to create completion directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(generateShellCompletion(shell)), 0644); err != nil {
+		return "", "", fmt.Errorf("failed to write completion script: %w", err)
+	}
+	return path, hint, nil
+}
+
+// generateShellCompletion returns the completion script for a shell, or ""
+// for unsupported shells. The scripts ask "save __complete" for candidates,
+// so they never go stale as flags, commands and chains change.
+func generateShellCompletion(shell string) string {
+	switch normalizeShell(shell) {
+	case "bash":
+		return `# bash completion for save
+_save_completion() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    local IFS=$'\n'
+    local out
+    out=$(save __complete "$COMP_CWORD" "${COMP_WORDS[@]:1}" 2>/dev/null)
+    case "$out" in
+        :file) COMPREPLY=( $(compgen -f -- "$cur") ) ;;
+        :dir) COMPREPLY=( $(compgen -d -- "$cur") ) ;;
+        *) COMPREPLY=( $(compgen -W "$(printf '%s\n' "$out" | cut -f1)" -- "$cur") ) ;;
+    esac
+}
+
+complete -F _save_completion save
+`
+
+	case "zsh":
+		return `#compdef save
+
+# zsh completion for save
+_save() {
+    local -a completions
+    local out line
+    out=$(save __complete $((CURRENT - 1)) "${(@)words[2,-1]}" 2>/dev/null)
+    case $out in
+        :file) _files; return ;;
+        :dir) _path_files -/; return ;;
+    esac
+    for line in "${(@f)out}"; do
+        [[ -z $line ]] && continue
+        if [[ $line == *$'\t'* ]]; then
+            completions+=("${${line%%$'\t'*}//:/\\:}:${line#*$'\t'}")
+        else
+            completions+=("${line//:/\\:}")
+        fi
+    done
+    _describe 'save' completions
+}
+
+if [[ $funcstack[1] == _save ]]; then
+    _save "$@"
+else
+    compdef _save save
+fi
+`
+
+	case "fish":
+		return `# fish completion for save
+function __save_complete
+    set -l tokens (commandline -opc)
+    set -e tokens[1]
+    set -l out (save __complete (math (count $tokens) + 1) $tokens (commandline -ct) 2>/dev/null)
+    switch "$out"
+        case ':file'
+            __fish_complete_path (commandline -ct)
+        case ':dir'
+            __fish_complete_directories (commandline -ct)
+        case '*'
+            printf '%s\n' $out
+    end
+end
+
+complete -c save -f -a '(__save_complete)'
+`
+
+	case "powershell":
+		return `# PowerShell completion for save
+Register-ArgumentCompleter -Native -CommandName save -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+    $elements = @($commandAst.CommandElements | Select-Object -Skip 1)
+    $words = @($elements | ForEach-Object { $_.Extent.Text })
+    $position = @($elements | Where-Object { $_.Extent.EndOffset -lt $cursorPosition }).Count + 1
+    $out = @(& save __complete $position @words 2>$null)
+    # Returning nothing falls back to path completion
+    if ($out.Count -eq 1 -and ($out[0] -eq ':file' -or $out[0] -eq ':dir')) { return }
+    foreach ($line in $out) {
+        $value, $desc = $line -split [char]9, 2
+        if (-not $desc) { $desc = $value }
+        [System.Management.Automation.CompletionResult]::new($value, $value, 'ParameterValue', $desc)
+    }
+}
+`
+	}
+	return ""
+}
@@ -0,0 +1,568 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Composite conditions combine the conditions they hold instead of
+// checking a value.
+const (
+	condAnyOf = "any_of"
+	condAllOf = "all_of"
+	condNot   = "not"
+)
+
+// conditionOperations lists the operations each condition type supports.
+var conditionOperations = map[string][]string{
+	"exit_code":                   {"equals", "not_equals", "less_than", "greater_than", "less_equals", "greater_equals"},
+	"output_contains":             {"contains", "not_contains", "starts_with", "ends_with", "matches"},
+	"env_var":                     {"exists", "not_exists", "equals", "contains"},
+	"time_window":                 {"within", "outside"},
+	"file_exists":                 {"exists", "not_exists"},
+	"day_of_week":                 {"in", "not_in"},
+	"git_branch":                  {"equals", "not_equals", "matches"},
+	"git_clean":                   {"clean", "dirty"},
+	"command_succeeds":            {"succeeds", "fails"},
+	"port_open":                   {"open", "closed"},
+	"file_changed_since_last_run": {"changed", "unchanged"},
+	"file_age":                    {"older_than", "newer_than"},
+	"host_matches":                {"matches", "not_matches"},
+	"chain_last_result":           {"succeeded", "failed"},
+}
+
+// probeTimeout bounds command_succeeds probes, dialTimeout port_open
+// checks.
+const (
+	probeTimeout = 30 * time.Second
+	dialTimeout  = time.Second
+)
+
+// evaluateConditions reports whether all conditions hold. A condition that
+// can't be checked is reported and counts as not met.
+func (cs *CommandStore) evaluateConditions(conditions []CommandCondition, execContext *ExecutionContext) bool {
+	satisfied, err := cs.allConditions(conditions, execContext)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		return false
+	}
+	return satisfied
+}
+
+func (cs *CommandStore) allConditions(conditions []CommandCondition, execContext *ExecutionContext) (bool, error) {
+	for _, cond := range conditions {
+		satisfied, err := cs.evaluateCondition(cond, execContext)
+		if err != nil || !satisfied {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (cs *CommandStore) evaluateCondition(cond CommandCondition, execContext *ExecutionContext) (bool, error) {
+	switch cond.Type {
+	case condAllOf:
+		return cs.allConditions(cond.Conditions, execContext)
+
+	case condAnyOf:
+		for _, sub := range cond.Conditions {
+			satisfied, err := cs.evaluateCondition(sub, execContext)
+			if err != nil || satisfied {
+				return satisfied, err
+			}
+		}
+		return false, nil
+
+	case condNot:
+		satisfied, err := cs.allConditions(cond.Conditions, execContext)
+		return !satisfied, err
+	}
+
+	operations, ok := conditionOperations[cond.Type]
+	if !ok {
+		return false, fmt.Errorf("unknown condition type '%s'", cond.Type)
+	}
+	if !slices.Contains(operations, cond.Operation) {
+		return false, fmt.Errorf("unknown operation '%s' for %s condition", cond.Operation, cond.Type)
+	}
+	// The first operation of each type is the positive one
+	positive := cond.Operation == operations[0]
+
+	switch cond.Type {
+	case "exit_code":
+		exitCode, err := strconv.Atoi(cond.Value)
+		if err != nil {
+			return false, fmt.Errorf("invalid exit code value '%s', condition will fail", cond.Value)
+		}
+		switch cond.Operation {
+		case "equals":
+			return execContext.LastExitCode == exitCode, nil
+		case "not_equals":
+			return execContext.LastExitCode != exitCode, nil
+		case "less_than":
+			return execContext.LastExitCode < exitCode, nil
+		case "greater_than":
+			return execContext.LastExitCode > exitCode, nil
+		case "less_equals":
+			return execContext.LastExitCode <= exitCode, nil
+		default:
+			return execContext.LastExitCode >= exitCode, nil
+		}
+
+	case "output_contains":
+		switch cond.Operation {
+		case "contains":
+			return strings.Contains(execContext.LastOutput, cond.Value), nil
+		case "not_contains":
+			return !strings.Contains(execContext.LastOutput, cond.Value), nil
+		case "starts_with":
+			return strings.HasPrefix(execContext.LastOutput, cond.Value), nil
+		case "ends_with":
+			return strings.HasSuffix(execContext.LastOutput, cond.Value), nil
+		default:
+			matched, err := regexp.MatchString(cond.Value, execContext.LastOutput)
+			if err != nil {
+				return false, fmt.Errorf("invalid regex pattern '%s': %v", cond.Value, err)
+			}
+			return matched, nil
+		}
+
+	case "env_var":
+		switch cond.Operation {
+		case "exists":
+			return os.Getenv(cond.Value) != "", nil
+		case "not_exists":
+			return os.Getenv(cond.Value) == "", nil
+		}
+		key, value, ok := strings.Cut(cond.Value, "=")
+		if !ok {
+			return false, fmt.Errorf("invalid env_var condition format, expected KEY=VALUE")
+		}
+		if cond.Operation == "equals" {
+			return os.Getenv(key) == value, nil
+		}
+		return strings.Contains(os.Getenv(key), value), nil
+
+	case "time_window":
+		window, err := parseTimeWindow(cond)
+		if err != nil {
+			return false, err
+		}
+		return window.contains(execContext.now()) == positive, nil
+
+	case "file_exists":
+		_, err := os.Stat(cond.Value)
+		if positive {
+			return err == nil, nil
+		}
+		return os.IsNotExist(err), nil
+
+	case "day_of_week":
+		days, err := parseDays(cond.Value)
+		if err != nil {
+			return false, err
+		}
+		return days[execContext.now().Weekday()] == positive, nil
+
+	case "git_branch":
+		branch, err := git(".", "branch", "--show-current")
+		if err != nil {
+			return false, err
+		}
+		switch cond.Operation {
+		case "equals":
+			return branch == cond.Value, nil
+		case "not_equals":
+			return branch != cond.Value, nil
+		default:
+			matched, err := regexp.MatchString(cond.Value, branch)
+			if err != nil {
+				return false, fmt.Errorf("invalid regex pattern '%s': %v", cond.Value, err)
+			}
+			return matched, nil
+		}
+
+	case "git_clean":
+		dir := cond.Value
+		if dir == "" {
+			dir = "."
+		}
+		status, err := git(dir, "status", "--porcelain")
+		if err != nil {
+			return false, err
+		}
+		return (status == "") == positive, nil
+
+	case "command_succeeds":
+		ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+		defer cancel()
+		probe, err := buildCommandContext(ctx, "", cond.Value, nil)
+		if err != nil {
+			return false, err
+		}
+		return (probe.Run() == nil) == positive, nil
+
+	case "port_open":
+		port, err := parsePort(cond.Value)
+		if err != nil {
+			return false, err
+		}
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)), dialTimeout)
+		if err == nil {
+			conn.Close()
+		}
+		return (err == nil) == positive, nil
+
+	case "file_changed_since_last_run":
+		modified, err := lastModified(cond.Value)
+		if err != nil {
+			return false, err
+		}
+		// Everything is new to a chain's first run
+		changed := execContext.PreviousRun.IsZero() || modified.After(execContext.PreviousRun)
+		return changed == positive, nil
+
+	case "file_age":
+		file, age, err := parseFileAge(cond.Value)
+		if err != nil {
+			return false, err
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		return (execContext.now().Sub(info.ModTime()) > age) == positive, nil
+
+	case "host_matches":
+		hostname, err := os.Hostname()
+		if err != nil {
+			return false, err
+		}
+		matched, err := matchHost(cond.Value, hostname)
+		if err != nil {
+			return false, err
+		}
+		return matched == positive, nil
+
+	default: // chain_last_result
+		chainID := execContext.ChainID
+		if cond.Value != "" {
+			id, err := cs.resolveChainRef(cond.Value)
+			if err != nil {
+				return false, err
+			}
+			chainID = id
+		}
+		// A chain that never ran has neither succeeded nor failed
+		last := cs.lastChainRun(chainID)
+		return last != nil && last.Success == positive, nil
+	}
+}
+
+// validateCondition checks a condition from a chain file, including the
+// values that can be checked before the chain runs.
+func validateCondition(cond CommandCondition) error {
+	switch cond.Type {
+	case condAnyOf, condAllOf, condNot:
+		if len(cond.Conditions) == 0 {
+			return fmt.Errorf("%s condition needs conditions", cond.Type)
+		}
+		if cond.Value != "" || cond.Operation != "" {
+			return fmt.Errorf("%s condition takes conditions, not a value or operation", cond.Type)
+		}
+		for _, sub := range cond.Conditions {
+			if err := validateCondition(sub); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	operations, ok := conditionOperations[cond.Type]
+	if !ok {
+		return fmt.Errorf("unknown condition type %q", cond.Type)
+	}
+	if !slices.Contains(operations, cond.Operation) {
+		return fmt.Errorf("invalid operation %q for %s condition, expected one of %s", cond.Operation, cond.Type, strings.Join(operations, ", "))
+	}
+	if len(cond.Conditions) > 0 {
+		return fmt.Errorf("%s condition can't hold conditions, use any_of, all_of or not", cond.Type)
+	}
+	if cond.Type != "time_window" && (cond.Timezone != "" || cond.Days != "" || cond.Bounds != "") {
+		return fmt.Errorf("%s condition: timezone, days and bounds only apply to time_window", cond.Type)
+	}
+	// Values with placeholders are only known once the chain runs
+	if varPlaceholder.MatchString(cond.Value) {
+		return nil
+	}
+
+	var err error
+	switch cond.Type {
+	case "exit_code":
+		_, err = strconv.Atoi(cond.Value)
+	case "time_window":
+		_, err = parseTimeWindow(cond)
+	case "day_of_week":
+		_, err = parseDays(cond.Value)
+	case "port_open":
+		_, err = parsePort(cond.Value)
+	case "file_age":
+		_, _, err = parseFileAge(cond.Value)
+	case "host_matches":
+		_, err = matchHost(cond.Value, "")
+	case "output_contains", "git_branch":
+		if cond.Operation == "matches" {
+			_, err = regexp.Compile(cond.Value)
+		}
+	case "env_var", "file_exists", "command_succeeds", "file_changed_since_last_run":
+		if cond.Value == "" {
+			err = fmt.Errorf("value must be set")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s condition: %v", cond.Type, err)
+	}
+	return nil
+}
+
+// describeCondition renders a condition for chain descriptions and plans.
+func describeCondition(cond CommandCondition) string {
+	switch cond.Type {
+	case condAnyOf, condAllOf, condNot:
+		parts := make([]string, len(cond.Conditions))
+		for i, sub := range cond.Conditions {
+			parts[i] = describeCondition(sub)
+		}
+		return cond.Type + "(" + strings.Join(parts, ", ") + ")"
+	}
+	text := cond.Type + " " + cond.Operation
+	if cond.Value != "" {
+		text += fmt.Sprintf(" %q", cond.Value)
+	}
+	if cond.Days != "" {
+		text += " on " + cond.Days
+	}
+	if cond.Timezone != "" {
+		text += " in " + cond.Timezone
+	}
+	if cond.Bounds != "" {
+		text += " " + cond.Bounds
+	}
+	return text
+}
+
+// now returns the current time of the context's clock.
+func (c *ExecutionContext) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+// timeWindow is a daily window of time. A window that ends before it
+// starts wraps past midnight, and one that ends when it starts lasts all
+// day. Times are compared to the minute.
+type timeWindow struct {
+	start, end int // Minutes after midnight
+	startIn    bool
+	endIn      bool
+	days       [7]bool // Days the window may start on
+	location   *time.Location
+}
+
+// parseTimeWindow parses a time_window condition: a value of "HH:MM-HH:MM"
+// and its timezone, days and bounds.
+func parseTimeWindow(cond CommandCondition) (*timeWindow, error) {
+	first, last, ok := strings.Cut(cond.Value, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid time window format, expected HH:MM-HH:MM")
+	}
+	clock := func(value string) (int, error) {
+		t, err := time.Parse("15:04", strings.TrimSpace(value))
+		if err != nil {
+			return 0, fmt.Errorf("invalid time %q in time window, expected HH:MM", value)
+		}
+		return t.Hour()*60 + t.Minute(), nil
+	}
+
+	window := &timeWindow{location: time.Local, days: [7]bool{true, true, true, true, true, true, true}}
+	var err error
+	if window.start, err = clock(first); err != nil {
+		return nil, err
+	}
+	if window.end, err = clock(last); err != nil {
+		return nil, err
+	}
+	if cond.Timezone != "" {
+		if window.location, err = time.LoadLocation(cond.Timezone); err != nil {
+			return nil, fmt.Errorf("unknown timezone %q", cond.Timezone)
+		}
+	}
+	if cond.Days != "" {
+		if window.days, err = parseDays(cond.Days); err != nil {
+			return nil, err
+		}
+	}
+
+	switch bounds := cmp.Or(cond.Bounds, "[)"); bounds {
+	case "[)", "[]", "(]", "()":
+		window.startIn = bounds[0] == '['
+		window.endIn = bounds[1] == ']'
+	default:
+		return nil, fmt.Errorf("invalid bounds %q, expected [), [], (] or ()", cond.Bounds)
+	}
+	return window, nil
+}
+
+// contains reports whether t falls inside the window. Overnight windows
+// count for the day they start on.
+func (w *timeWindow) contains(t time.Time) bool {
+	t = t.In(w.location)
+	minute := t.Hour()*60 + t.Minute()
+	startDay := t.Weekday()
+
+	afterStart := minute > w.start || (w.startIn && minute == w.start)
+	beforeEnd := minute < w.end || (w.endIn && minute == w.end)
+
+	var inside bool
+	switch {
+	case w.start == w.end:
+		inside = true
+	case w.start < w.end:
+		inside = afterStart && beforeEnd
+	case afterStart:
+		inside = true
+	case beforeEnd:
+		// The early hours of an overnight window started yesterday
+		inside = true
+		startDay = (startDay + 6) % 7
+	}
+	return inside && w.days[startDay]
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseDays parses a list of days such as "mon-fri" or "sat,sun". Full
+// day names are accepted too, and ranges may wrap around the week.
+func parseDays(value string) ([7]bool, error) {
+	var days [7]bool
+	day := func(name string) (int, error) {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for i, short := range weekdays {
+			if name == short || name == strings.ToLower(time.Weekday(i).String()) {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("invalid day %q, expected e.g. mon or monday", name)
+	}
+
+	for _, part := range strings.Split(value, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := day(first)
+		if err != nil {
+			return days, err
+		}
+		end := start
+		if isRange {
+			if end, err = day(last); err != nil {
+				return days, err
+			}
+		}
+		for i := start; ; i = (i + 1) % 7 {
+			days[i] = true
+			if i == end {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parsePort(value string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", value)
+	}
+	return port, nil
+}
+
+// parseFileAge parses a file_age value, "PATH=AGE" with an age such as
+// 30m, 12h or 7d.
+func parseFileAge(value string) (string, time.Duration, error) {
+	i := strings.LastIndex(value, "=")
+	if i <= 0 {
+		return "", 0, fmt.Errorf("invalid file_age value %q, expected PATH=AGE", value)
+	}
+	age, err := parseAge(value[i+1:])
+	if err != nil {
+		return "", 0, err
+	}
+	return value[:i], age, nil
+}
+
+// matchHost reports whether hostname matches one of a comma-separated list
+// of glob patterns, ignoring case.
+func matchHost(patterns, hostname string) (bool, error) {
+	for _, pattern := range strings.Split(patterns, ",") {
+		matched, err := path.Match(strings.ToLower(strings.TrimSpace(pattern)), strings.ToLower(hostname))
+		if err != nil {
+			return false, fmt.Errorf("invalid host pattern %q", pattern)
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// lastModified returns the latest modification time of the files matching
+// a glob pattern; directories count with everything inside them, except
+// .git directories.
+func lastModified(pattern string) (time.Time, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid file pattern %q", pattern)
+	}
+	if len(matches) == 0 {
+		return time.Time{}, fmt.Errorf("no files match %q", pattern)
+	}
+
+	var latest time.Time
+	for _, match := range matches {
+		err := filepath.WalkDir(match, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() && entry.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			if info.ModTime().After(latest) {
+				latest = info.ModTime()
+			}
+			return nil
+		})
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata" // Timezones must not depend on the machine running the tests
+)
+
+// clockAt returns a context whose clock stops at value, "2006-01-02 15:04"
+// in UTC. October 16th 2026 is a Friday.
+func clockAt(t *testing.T, value string) *ExecutionContext {
+	t.Helper()
+	now, err := time.Parse("2006-01-02 15:04", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ExecutionContext{Now: func() time.Time { return now }}
+}
+
+type conditionCase struct {
+	at   string
+	want bool
+}
+
+func checkCondition(t *testing.T, cond CommandCondition, cases []conditionCase) {
+	t.Helper()
+	cs := &CommandStore{}
+	for _, c := range cases {
+		got, err := cs.evaluateCondition(cond, clockAt(t, c.at))
+		if err != nil {
+			t.Fatalf("%+v: %v", cond, err)
+		}
+		if got != c.want {
+			t.Errorf("%s %s at %s: got %v, want %v", cond.Value, cond.Operation, c.at, got, c.want)
+		}
+	}
+}
+
+func TestTimeWindowAcrossMidnight(t *testing.T) {
+	cond := CommandCondition{Type: "time_window", Operation: "within", Value: "22:00-06:00", Timezone: "UTC"}
+	checkCondition(t, cond, []conditionCase{
+		{"2026-10-16 12:00", false},
+		{"2026-10-16 21:59", false},
+		{"2026-10-16 22:00", true},
+		{"2026-10-16 23:59", true},
+		{"2026-10-17 00:00", true},
+		{"2026-10-17 05:59", true},
+		{"2026-10-17 06:00", false},
+	})
+
+	cond.Operation = "outside"
+	checkCondition(t, cond, []conditionCase{
+		{"2026-10-16 12:00", true},
+		{"2026-10-17 03:00", false},
+	})
+}
+
+func TestTimeWindowBounds(t *testing.T) {
+	tests := []struct {
+		value, bounds string
+		cases         []conditionCase
+	}{
+		{"09:00-17:00", "", []conditionCase{{"2026-10-16 09:00", true}, {"2026-10-16 17:00", false}}},
+		{"09:00-17:00", "[)", []conditionCase{{"2026-10-16 09:00", true}, {"2026-10-16 16:59", true}, {"2026-10-16 17:00", false}}},
+		{"09:00-17:00", "[]", []conditionCase{{"2026-10-16 09:00", true}, {"2026-10-16 17:00", true}, {"2026-10-16 17:01", false}}},
+		{"09:00-17:00", "(]", []conditionCase{{"2026-10-16 09:00", false}, {"2026-10-16 09:01", true}, {"2026-10-16 17:00", true}}},
+		{"09:00-17:00", "()", []conditionCase{{"2026-10-16 09:00", false}, {"2026-10-16 12:00", true}, {"2026-10-16 17:00", false}}},
+		{"22:00-06:00", "[]", []conditionCase{{"2026-10-16 22:00", true}, {"2026-10-17 06:00", true}}},
+		{"22:00-06:00", "()", []conditionCase{{"2026-10-16 22:00", false}, {"2026-10-16 22:01", true}, {"2026-10-17 06:00", false}}},
+	}
+	for _, tt := range tests {
+		cond := CommandCondition{Type: "time_window", Operation: "within", Value: tt.value, Bounds: tt.bounds, Timezone: "UTC"}
+		checkCondition(t, cond, tt.cases)
+	}
+}
+
+func TestTimeWindowTimezones(t *testing.T) {
+	// New York is UTC-4 in October
+	checkCondition(t, CommandCondition{Type: "time_window", Operation: "within", Value: "09:00-17:00", Timezone: "America/New_York"}, []conditionCase{
+		{"2026-10-16 12:59", false},
+		{"2026-10-16 13:00", true},
+		{"2026-10-16 20:59", true},
+		{"2026-10-16 21:00", false},
+	})
+	// Tokyo is UTC+9, so its morning is the previous day in UTC
+	checkCondition(t, CommandCondition{Type: "time_window", Operation: "within", Value: "09:00-17:00", Timezone: "Asia/Tokyo"}, []conditionCase{
+		{"2026-10-15 23:30", false},
+		{"2026-10-16 00:30", true},
+	})
+	// An overnight window in Berlin, UTC+2 until the end of October
+	checkCondition(t, CommandCondition{Type: "time_window", Operation: "within", Value: "22:00-06:00", Timezone: "Europe/Berlin"}, []conditionCase{
+		{"2026-10-16 19:59", false},
+		{"2026-10-16 20:00", true},
+		{"2026-10-17 03:59", true},
+		{"2026-10-17 04:00", false},
+	})
+
+	cs := &CommandStore{}
+	_, err := cs.evaluateCondition(CommandCondition{Type: "time_window", Operation: "within", Value: "09:00-17:00", Timezone: "Mars/Olympus"}, clockAt(t, "2026-10-16 12:00"))
+	if err == nil {
+		t.Error("unknown timezone accepted")
+	}
+}
+
+func TestOvernightWindowDays(t *testing.T) {
+	// The early hours belong to the day the window started on
+	checkCondition(t, CommandCondition{Type: "time_window", Operation: "within", Value: "22:00-06:00", Days: "fri", Timezone: "UTC"}, []conditionCase{
+		{"2026-10-16 02:00", false}, // Friday, but the window started on Thursday
+		{"2026-10-16 23:00", true},
+		{"2026-10-17 02:00", true}, // Saturday, in Friday's window
+		{"2026-10-17 23:00", false},
+	})
+	checkCondition(t, CommandCondition{Type: "time_window", Operation: "within", Value: "22:00-06:00", Days: "mon-fri", Timezone: "UTC"}, []conditionCase{
+		{"2026-10-19 01:00", false}, // Monday, in Sunday's window
+		{"2026-10-19 23:00", true},
+		{"2026-10-17 05:00", true}, // Saturday, in Friday's window
+		{"2026-10-17 22:00", false},
+	})
+}
+
+func TestDayOfWeek(t *testing.T) {
+	checkCondition(t, CommandCondition{Type: "day_of_week", Operation: "in", Value: "sat,sun"}, []conditionCase{
+		{"2026-10-16 12:00", false},
+		{"2026-10-17 12:00", true},
+		{"2026-10-18 12:00", true},
+	})
+	// Ranges may wrap around the week
+	checkCondition(t, CommandCondition{Type: "day_of_week", Operation: "not_in", Value: "friday-monday"}, []conditionCase{
+		{"2026-10-18 12:00", false},
+		{"2026-10-19 12:00", false},
+		{"2026-10-20 12:00", true},
+	})
+}
@@ -0,0 +1,749 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+)
+
+// Config holds user settings. They are layered: built-in defaults, then the
+// config file, then SAVE_* environment variables, then command-line flags,
+// which main applies where it handles them.
+type Config struct {
+	HistoryPath          string
+	DefaultTags          []string
+	SaveDir              bool
+	ListSize             int
+	Color                string
+	Shell                string
+	PTY                  string
+	Redact               []string
+	RetentionDays        int
+	MaxCommands          int
+	BackupKeep           int
+	BackupInterval       string
+	Output               string
+	Notify               []string
+	NotifyAfter          string
+	NotifyOn             string
+	NotifyWebhook        string
+	NotifyHook           string
+	NotifyTemplate       string
+	Hooks                []string
+	DangerRules          []string
+	DangerNonInteractive string
+
+	path           string            // Config file the settings were read from
+	sources        map[string]string // Where each setting came from
+	redact         []*regexp.Regexp
+	backupInterval time.Duration
+	notifyAfter    time.Duration
+	notifyTemplate *template.Template
+	dangerRules    []dangerRule
+}
+
+// config is the configuration of this process.
+var config = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		ListSize:             10,
+		Color:                "auto",
+		Shell:                "sh",
+		PTY:                  "auto",
+		NotifyAfter:          "30s",
+		NotifyOn:             "always",
+		NotifyTemplate:       defaultNotifyTemplate,
+		DangerRules:          slices.Clone(defaultDangerRules),
+		DangerNonInteractive: "block",
+		sources:              make(map[string]string),
+	}
+}
+
+// configSetting is one key of the config file. ptr returns the field the
+// setting is stored in.
+type configSetting struct {
+	key  string
+	env  string
+	desc string
+	ptr  func(c *Config) any
+}
+
+var configSettings = []configSetting{
+	{"history_path", "SAVE_HISTORY_PATH", "History file", func(c *Config) any { return &c.HistoryPath }},
+	{"default_tags", "SAVE_DEFAULT_TAGS", "Tags for commands saved without --tag", func(c *Config) any { return &c.DefaultTags }},
+	{"save_dir", "SAVE_DIR", "Save the current directory as if --dir were given", func(c *Config) any { return &c.SaveDir }},
+	{"list_size", "SAVE_LIST_SIZE", "Commands shown by --list", func(c *Config) any { return &c.ListSize }},
+	{"color", "SAVE_COLOR", "Colour output: auto, always or never", func(c *Config) any { return &c.Color }},
+	{"shell", "SAVE_SHELL", "Shell or interpreter commands run with (sh, bash, zsh, fish, exec, python3, ...)", func(c *Config) any { return &c.Shell }},
+	{"pty", "SAVE_PTY", "Run chain steps in a pseudo-terminal: auto (when stdout is one), always or never", func(c *Config) any { return &c.PTY }},
+	{"redact", "", "Patterns replaced with [REDACTED] before a command is saved", func(c *Config) any { return &c.Redact }},
+	{"retention_days", "SAVE_RETENTION_DAYS", "Forget commands unused for this many days (0 keeps them)", func(c *Config) any { return &c.RetentionDays }},
+	{"max_commands", "SAVE_MAX_COMMANDS", "Keep at most this many commands (0 for no limit)", func(c *Config) any { return &c.MaxCommands }},
+	{"backup_keep", "SAVE_BACKUP_KEEP", "Backups kept in the backup directory (0 keeps all)", func(c *Config) any { return &c.BackupKeep }},
+	{"backup_interval", "SAVE_BACKUP_INTERVAL", "Back up automatically this often, e.g. 1d (empty disables)", func(c *Config) any { return &c.BackupInterval }},
+	{"output", "SAVE_OUTPUT", "Default --output format of read commands", func(c *Config) any { return &c.Output }},
+	{"notify", "SAVE_NOTIFY", "Notify about long runs through: bell, desktop, webhook, hook", func(c *Config) any { return &c.Notify }},
+	{"notify_after", "SAVE_NOTIFY_AFTER", "Only notify about runs that take at least this long, e.g. 30s or 5m", func(c *Config) any { return &c.NotifyAfter }},
+	{"notify_on", "SAVE_NOTIFY_ON", "Notify about every long run (always) or only failed ones (failure)", func(c *Config) any { return &c.NotifyOn }},
+	{"notify_webhook", "SAVE_NOTIFY_WEBHOOK", "URL the webhook channel posts the run to as JSON", func(c *Config) any { return &c.NotifyWebhook }},
+	{"notify_hook", "SAVE_NOTIFY_HOOK", "Command the hook channel runs, with SAVE_NOTIFY_* set", func(c *Config) any { return &c.NotifyHook }},
+	{"notify_template", "SAVE_NOTIFY_TEMPLATE", "Go template of the notification message", func(c *Config) any { return &c.NotifyTemplate }},
+	{"hooks", "", "Commands that get each event as JSON on stdin and can veto or annotate it", func(c *Config) any { return &c.Hooks }},
+	{"danger_rules", "", "Commands that need typed confirmation: words or /regexp/, then 'if <key>=<glob>' for branch, kube, dir or host", func(c *Config) any { return &c.DangerRules }},
+	{"danger_noninteractive", "SAVE_DANGER_NONINTERACTIVE", "Dangerous commands without a terminal to confirm on: block or allow (protected ones are always blocked)", func(c *Config) any { return &c.DangerNonInteractive }},
+}
+
+func findConfigSetting(key string) *configSetting {
+	for i := range configSettings {
+		if configSettings[i].key == key {
+			return &configSettings[i]
+		}
+	}
+	return nil
+}
+
+// configFilePath returns the config file location, SAVE_CONFIG_PATH if set.
+func configFilePath() (string, error) {
+	if path := os.Getenv("SAVE_CONFIG_PATH"); path != "" {
+		return expandHome(path), nil
+	}
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config.json"), nil
+}
+
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[1:])
+		}
+	}
+	return path
+}
+
+// loadConfig reads the config file and environment. On error the returned
+// config holds the defaults and whatever was valid.
+func loadConfig() (*Config, error) {
+	c := defaultConfig()
+	path, err := configFilePath()
+	if err != nil {
+		return c, err
+	}
+	c.path = path
+
+	values, err := readConfigFile(path)
+	if err != nil {
+		return c, err
+	}
+	if err := c.applyFile(values); err != nil {
+		return c, err
+	}
+
+	for _, s := range configSettings {
+		value := os.Getenv(s.env)
+		if s.env == "" || value == "" {
+			continue
+		}
+		args := []string{value}
+		if _, isList := s.ptr(c).(*[]string); isList {
+			args = strings.Split(value, ",")
+		}
+		if err := setConfigValue(s.ptr(c), args); err != nil {
+			return c, fmt.Errorf("%s: %w", s.env, err)
+		}
+		c.sources[s.key] = s.env
+	}
+	// NO_COLOR is the cross-tool convention, see no-color.org
+	for _, env := range []string{"SAVE_NO_COLOR", "NO_COLOR"} {
+		if os.Getenv(env) != "" {
+			c.Color = "never"
+			c.sources["color"] = env
+		}
+	}
+
+	return c, c.validate()
+}
+
+// readConfigFile returns the settings in the config file by key. A missing
+// file has no settings.
+func readConfigFile(path string) (map[string]json.RawMessage, error) {
+	values := make(map[string]json.RawMessage)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return values, nil
+		}
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return values, nil
+	}
+	if err := json.Unmarshal(data, &values); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line := 1 + strings.Count(string(data[:syntaxErr.Offset]), "\n")
+			return nil, fmt.Errorf("%s:%d: invalid JSON: %v", path, line, err)
+		}
+		return nil, fmt.Errorf("%s: expected a JSON object of settings", path)
+	}
+	return values, nil
+}
+
+func writeConfigFile(path string, values map[string]json.RawMessage) error {
+	data, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// applyFile applies settings read from the config file.
+func (c *Config) applyFile(values map[string]json.RawMessage) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := findConfigSetting(key)
+		if s == nil {
+			return fmt.Errorf("%s: unknown setting '%s'%s", c.path, key, suggestSetting(key))
+		}
+		if err := json.Unmarshal(values[key], s.ptr(c)); err != nil {
+			return fmt.Errorf("%s: %s must be %s", c.path, key, configTypeName(s.ptr(c)))
+		}
+		c.sources[key] = "file"
+	}
+	return nil
+}
+
+// validate checks values that have the right type but make no sense.
+func (c *Config) validate() error {
+	invalid := func(key, format string, args ...any) error {
+		origin := c.path
+		if source := c.sources[key]; source != "file" {
+			origin = source
+		}
+		return fmt.Errorf("%s: %s %s", origin, key, fmt.Sprintf(format, args...))
+	}
+
+	if c.ListSize < 1 {
+		return invalid("list_size", "must be at least 1")
+	}
+	if !slices.Contains([]string{"auto", "always", "never"}, c.Color) {
+		return invalid("color", "must be auto, always or never, not '%s'", c.Color)
+	}
+	if strings.TrimSpace(c.Shell) == "" {
+		return invalid("shell", "must not be empty")
+	}
+	if !slices.Contains([]string{"auto", "always", "never"}, c.PTY) {
+		return invalid("pty", "must be auto, always or never, not '%s'", c.PTY)
+	}
+	for _, key := range []string{"retention_days", "max_commands", "backup_keep"} {
+		if *findConfigSetting(key).ptr(c).(*int) < 0 {
+			return invalid(key, "must not be negative")
+		}
+	}
+	if c.Output != "" && (c.Output == "template" || !slices.Contains(outputFormats, c.Output)) {
+		return invalid("output", "must be one of json, jsonl, table or plain, not '%s'", c.Output)
+	}
+
+	c.redact = nil
+	for _, pattern := range c.Redact {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return invalid("redact", "has an invalid pattern '%s': %v", pattern, err)
+		}
+		c.redact = append(c.redact, re)
+	}
+
+	c.backupInterval = 0
+	if c.BackupInterval != "" {
+		interval, err := parseAge(c.BackupInterval)
+		if err != nil || interval <= 0 {
+			return invalid("backup_interval", "must be an age such as 12h, 1d or 2w, not '%s'", c.BackupInterval)
+		}
+		c.backupInterval = interval
+	}
+
+	for _, channel := range c.Notify {
+		if !slices.Contains(notifyChannels, channel) {
+			return invalid("notify", "has an unknown channel '%s', expected %s", channel, strings.Join(notifyChannels, ", "))
+		}
+	}
+	after, err := time.ParseDuration(c.NotifyAfter)
+	if err != nil || after < 0 {
+		return invalid("notify_after", "must be a duration such as 30s or 5m, not '%s'", c.NotifyAfter)
+	}
+	c.notifyAfter = after
+	if !slices.Contains([]string{"always", "failure"}, c.NotifyOn) {
+		return invalid("notify_on", "must be always or failure, not '%s'", c.NotifyOn)
+	}
+	if c.NotifyWebhook != "" {
+		if u, err := url.Parse(c.NotifyWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return invalid("notify_webhook", "must be an http or https URL, not '%s'", c.NotifyWebhook)
+		}
+	}
+	tmpl, err := template.New("notify_template").Parse(c.NotifyTemplate)
+	if err != nil {
+		return invalid("notify_template", "is not a valid template: %v", err)
+	}
+	c.notifyTemplate = tmpl
+
+	c.dangerRules = nil
+	for _, text := range c.DangerRules {
+		rule, err := parseDangerRule(text)
+		if err != nil {
+			return invalid("danger_rules", "has an invalid rule '%s': %v", text, err)
+		}
+		c.dangerRules = append(c.dangerRules, rule)
+	}
+	if !slices.Contains([]string{"block", "allow"}, c.DangerNonInteractive) {
+		return invalid("danger_noninteractive", "must be block or allow, not '%s'", c.DangerNonInteractive)
+	}
+	return nil
+}
+
+// parseAge parses a relative age such as 12h, 7d or 2w.
+func parseAge(value string) (time.Duration, error) {
+	now := time.Now()
+	t, err := parseTimeArg(value, now)
+	// Dates are points in time, not ages
+	if err != nil || strings.Contains(value, "-") {
+		return 0, fmt.Errorf("invalid age '%s', expected e.g. 12h, 7d or 2w", value)
+	}
+	return now.Sub(t), nil
+}
+
+// setConfigValue parses command-line or environment values into a field.
+func setConfigValue(ptr any, args []string) error {
+	if _, isList := ptr.(*[]string); !isList && len(args) != 1 {
+		return fmt.Errorf("expected a single value")
+	}
+	switch p := ptr.(type) {
+	case *string:
+		*p = args[0]
+	case *int:
+		n, err := strconv.Atoi(strings.TrimSpace(args[0]))
+		if err != nil {
+			return fmt.Errorf("expected a whole number, not '%s'", args[0])
+		}
+		*p = n
+	case *bool:
+		switch strings.ToLower(strings.TrimSpace(args[0])) {
+		case "true", "yes", "on", "1":
+			*p = true
+		case "false", "no", "off", "0":
+			*p = false
+		default:
+			return fmt.Errorf("expected true or false, not '%s'", args[0])
+		}
+	case *[]string:
+		var values []string
+		for _, arg := range args {
+			if arg = strings.TrimSpace(arg); arg != "" {
+				values = append(values, arg)
+			}
+		}
+		*p = values
+	}
+	return nil
+}
+
+func configTypeName(ptr any) string {
+	switch ptr.(type) {
+	case *int:
+		return "a whole number"
+	case *bool:
+		return "true or false"
+	case *[]string:
+		return "a list of strings"
+	}
+	return "a string"
+}
+
+func formatConfigValue(ptr any) string {
+	switch p := ptr.(type) {
+	case *string:
+		return *p
+	case *int:
+		return strconv.Itoa(*p)
+	case *bool:
+		return strconv.FormatBool(*p)
+	case *[]string:
+		return strings.Join(*p, ", ")
+	}
+	return ""
+}
+
+// suggestSetting returns a "did you mean" hint for a mistyped key.
+func suggestSetting(key string) string {
+	best, bestDistance := "", 4
+	for _, s := range configSettings {
+		if d := editDistance(key, s.key); d < bestDistance {
+			best, bestDistance = s.key, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (did you mean '%s'?)", best)
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// useColor reports whether output may contain ANSI colours.
+func (c *Config) useColor() bool {
+	switch c.Color {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// redactCommand replaces the parts of a command matched by the redact
+// patterns. Patterns with groups only replace what the groups matched.
+func (c *Config) redactCommand(command string) string {
+	for _, re := range c.redact {
+		var b strings.Builder
+		last := 0
+		for _, match := range re.FindAllStringSubmatchIndex(command, -1) {
+			spans := [][]int{match[:2]}
+			if len(match) > 2 {
+				spans = nil
+				for i := 2; i+1 < len(match); i += 2 {
+					if match[i] >= 0 {
+						spans = append(spans, match[i:i+2])
+					}
+				}
+			}
+			for _, span := range spans {
+				if span[0] < last {
+					continue
+				}
+				b.WriteString(command[last:span[0]])
+				b.WriteString("[REDACTED]")
+				last = span[1]
+			}
+		}
+		b.WriteString(command[last:])
+		command = b.String()
+	}
+	return command
+}
+
+// applyRetention forgets the commands retention_days and max_commands no
+// longer allow, least recently used first, along with run history older
+// than retention_days. Favorites, named commands and commands used by
+// chains are always kept.
+func (cs *CommandStore) applyRetention(now time.Time) {
+	if config.RetentionDays == 0 && config.MaxCommands == 0 {
+		return
+	}
+
+	lastUsed := make(map[int]time.Time)
+	for _, cmd := range cs.commands {
+		lastUsed[cmd.ID] = cmd.Timestamp
+	}
+	for _, run := range cs.runs {
+		if used, ok := lastUsed[run.CommandID]; ok && run.StartedAt.After(used) {
+			lastUsed[run.CommandID] = run.StartedAt
+		}
+	}
+	pinned := make(map[int]bool)
+	for _, chain := range cs.chains {
+		for _, step := range chain.Steps {
+			for _, id := range append(append(append([]int{step.CommandID}, step.ParallelWith...), step.OnSuccess...), step.OnFailure...) {
+				pinned[id] = true
+			}
+		}
+	}
+
+	var candidates []Command
+	for _, cmd := range cs.commands {
+		if !cmd.IsFavorite && cmd.Name == "" && !pinned[cmd.ID] {
+			candidates = append(candidates, cmd)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return lastUsed[candidates[i].ID].Before(lastUsed[candidates[j].ID])
+	})
+
+	remove := make(map[int]bool)
+	cutoff := now.AddDate(0, 0, -config.RetentionDays)
+	for _, cmd := range candidates {
+		if config.RetentionDays > 0 && lastUsed[cmd.ID].Before(cutoff) {
+			remove[cmd.ID] = true
+		}
+	}
+	if config.MaxCommands > 0 {
+		excess := len(cs.commands) - len(remove) - config.MaxCommands
+		for _, cmd := range candidates {
+			if excess <= 0 {
+				break
+			}
+			if !remove[cmd.ID] {
+				remove[cmd.ID] = true
+				excess--
+			}
+		}
+	}
+
+	if len(remove) > 0 {
+		kept := make([]Command, 0, len(cs.commands)-len(remove))
+		for _, cmd := range cs.commands {
+			if !remove[cmd.ID] {
+				kept = append(kept, cmd)
+			}
+		}
+		cs.commands = kept
+	}
+
+	if config.RetentionDays > 0 {
+		runs := cs.runs[:0]
+		for _, run := range cs.runs {
+			if !run.StartedAt.Before(cutoff) {
+				runs = append(runs, run)
+			}
+		}
+		cs.runs = runs
+		chainRuns := cs.chainRuns[:0]
+		for _, run := range cs.chainRuns {
+			if !run.StartedAt.Before(cutoff) {
+				chainRuns = append(chainRuns, run)
+			}
+		}
+		cs.chainRuns = chainRuns
+	}
+}
+
+// pruneBackups removes the oldest backups beyond backup_keep.
+func (cs *CommandStore) pruneBackups() error {
+	if config.BackupKeep == 0 {
+		return nil
+	}
+	backups, err := cs.listBackupFiles()
+	if err != nil {
+		return err
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Modified.After(backups[j].Modified) })
+	for _, backup := range backups[min(config.BackupKeep, len(backups)):] {
+		if err := os.Remove(backup.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupIfDue creates a backup when the newest one is older than
+// backup_interval.
+func (cs *CommandStore) backupIfDue(now time.Time) error {
+	if config.backupInterval == 0 {
+		return nil
+	}
+	backups, err := cs.listBackupFiles()
+	if err != nil {
+		return err
+	}
+	for _, backup := range backups {
+		if now.Sub(backup.Modified) < config.backupInterval {
+			return nil
+		}
+	}
+	return cs.createBackup("")
+}
+
+// runConfigCommand implements "save config get|set|unset|list|edit".
+func runConfigCommand(args []string) error {
+	const usage = "save config get <key> | set <key> <value...> | unset <key> | list | edit"
+	if len(args) == 0 {
+		usageError(usage, "missing config action")
+	}
+	action, args := args[0], args[1:]
+
+	setting := func() *configSetting {
+		if len(args) == 0 {
+			usageError(usage, "config %s requires a setting name", action)
+		}
+		s := findConfigSetting(args[0])
+		if s == nil {
+			usageError(usage, "unknown setting '%s'%s", args[0], suggestSetting(args[0]))
+		}
+		return s
+	}
+
+	switch action {
+	case "list":
+		if len(args) > 0 {
+			usageError(usage, "unexpected argument '%s'", args[0])
+		}
+		fmt.Printf("Config file: %s\n\n", config.path)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tVALUE\tSOURCE\tDESCRIPTION")
+		for _, s := range configSettings {
+			source := config.sources[s.key]
+			if source == "" {
+				source = "default"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.key, formatConfigValue(s.ptr(config)), source, s.desc)
+		}
+		return w.Flush()
+
+	case "get":
+		s := setting()
+		if len(args) > 1 {
+			usageError(usage, "unexpected argument '%s'", args[1])
+		}
+		if list, ok := s.ptr(config).(*[]string); ok {
+			for _, value := range *list {
+				fmt.Println(value)
+			}
+			return nil
+		}
+		fmt.Println(formatConfigValue(s.ptr(config)))
+		return nil
+
+	case "set", "unset":
+		values, err := readConfigFile(config.path)
+		if err != nil {
+			return fmt.Errorf("%w (fix it with 'save config edit')", err)
+		}
+		// Unknown keys can still be removed from the file
+		if _, inFile := values[strings.Join(args, " ")]; action == "unset" && len(args) == 1 && inFile && findConfigSetting(args[0]) == nil {
+			delete(values, args[0])
+			if err := writeConfigFile(config.path, values); err != nil {
+				return err
+			}
+			fmt.Printf("Removed %s\n", args[0])
+			return nil
+		}
+		s := setting()
+
+		if action == "unset" {
+			if len(args) > 1 {
+				usageError(usage, "unexpected argument '%s'", args[1])
+			}
+			delete(values, s.key)
+		} else {
+			if len(args) < 2 {
+				usageError(usage, "config set %s requires a value", s.key)
+			}
+			value := args[1:]
+			if s.key == "default_tags" {
+				// Like --tag; redact patterns may contain commas
+				value = strings.Split(strings.Join(value, ","), ",")
+			}
+			updated := defaultConfig()
+			if err := setConfigValue(s.ptr(updated), value); err != nil {
+				return fmt.Errorf("%s: %w", s.key, err)
+			}
+			raw, err := json.Marshal(s.ptr(updated))
+			if err != nil {
+				return err
+			}
+			values[s.key] = raw
+		}
+
+		// Check the file as it will be read before writing it
+		candidate := defaultConfig()
+		candidate.path = config.path
+		if err := candidate.applyFile(values); err != nil {
+			return err
+		}
+		if err := candidate.validate(); err != nil {
+			return err
+		}
+		if err := writeConfigFile(config.path, values); err != nil {
+			return err
+		}
+
+		fmt.Printf("%s = %s\n", s.key, formatConfigValue(s.ptr(candidate)))
+		if s.env != "" && os.Getenv(s.env) != "" {
+			fmt.Fprintf(os.Stderr, "Note: %s is set and overrides this setting\n", s.env)
+		}
+		return nil
+
+	case "edit":
+		if len(args) > 0 {
+			usageError(usage, "unexpected argument '%s'", args[0])
+		}
+		if _, err := os.Stat(config.path); os.IsNotExist(err) {
+			if err := writeConfigFile(config.path, map[string]json.RawMessage{}); err != nil {
+				return err
+			}
+		}
+
+		editor := os.Getenv("VISUAL")
+		if editor == "" {
+			editor = os.Getenv("EDITOR")
+		}
+		if editor == "" {
+			editor = "vi"
+			if runtime.GOOS == "windows" {
+				editor = "notepad"
+			}
+		}
+		// Run the editor directly, the configured shell may not be one
+		cmd, err := buildCommand(execShell, editor, []string{config.path})
+		if err != nil {
+			return fmt.Errorf("invalid editor %q: %w", editor, err)
+		}
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("editor failed: %w", err)
+		}
+
+		if _, err := loadConfig(); err != nil {
+			return fmt.Errorf("the config file has problems: %w", err)
+		}
+		fmt.Printf("Saved %s\n", config.path)
+		return nil
+	}
+
+	usageError(usage, "unknown config action '%s'", action)
+	return nil
+}
@@ -0,0 +1,387 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultDangerRules are the danger_rules of a fresh configuration.
+var defaultDangerRules = []string{
+	`rm -rf /`,
+	`rm -rf /\*`,
+	`rm -rf ~`,
+	`rm -rf $HOME`,
+	`chmod -R 777 /`,
+	`mkfs*`,
+	`dd of=/dev/*`,
+	// Force pushes name the branch, or push the current one
+	`git push --force* main|master|*:main|*:master`,
+	`git push -f main|master|*:main|*:master`,
+	`git push +main|+master|+*:main|+*:master`,
+	`git push --force* if branch=main|master`,
+	`git push -f if branch=main|master`,
+	`kubectl delete if kube=*prod*`,
+	`/(?i)\bdrop\s+(table|database)\b/`,
+}
+
+// dangerContextKeys are what the "if" part of a danger rule can test.
+var dangerContextKeys = []string{
+	"branch", // Git branch of the current directory
+	"kube",   // Current kubectl context
+	"dir",    // Current directory
+	"host",   // Host name
+}
+
+// dangerRule is one entry of the danger_rules setting:
+//
+//	<words or /regexp/> [if <key>=<glob>[|<glob>...]...]
+//
+// Words match the words of one command in a pipeline or list, in order and
+// starting with the program. Each word is a glob, or globs separated by |.
+// Flags may come anywhere after the program, and a word of short flags such
+// as -rf matches those flags however they are given.
+type dangerRule struct {
+	text    string
+	re      *regexp.Regexp
+	words   []string
+	context map[string][]string // Globs by context key, all keys must match
+}
+
+func parseDangerRule(text string) (dangerRule, error) {
+	rule := dangerRule{text: text}
+	pattern, conditions := text, ""
+	if strings.HasPrefix(text, "/") {
+		if i := strings.Index(text, "/ if "); i > 0 {
+			pattern, conditions = text[:i+1], text[i+5:]
+		}
+		if len(pattern) < 3 || !strings.HasSuffix(pattern, "/") {
+			return rule, fmt.Errorf("regular expression must end with /")
+		}
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return rule, err
+		}
+		rule.re = re
+	} else {
+		pattern, conditions, _ = strings.Cut(text, " if ")
+		rule.words = strings.Fields(pattern)
+		if len(rule.words) == 0 {
+			return rule, fmt.Errorf("no words to match")
+		}
+		for _, word := range rule.words {
+			for _, glob := range strings.Split(word, "|") {
+				if _, err := path.Match(glob, ""); err != nil {
+					return rule, fmt.Errorf("invalid pattern '%s'", word)
+				}
+			}
+		}
+	}
+
+	for _, condition := range strings.Fields(conditions) {
+		key, globs, ok := strings.Cut(condition, "=")
+		if !ok || !slices.Contains(dangerContextKeys, key) {
+			return rule, fmt.Errorf("condition '%s' must be <key>=<glob> with a key of %s", condition, strings.Join(dangerContextKeys, ", "))
+		}
+		if rule.context == nil {
+			rule.context = make(map[string][]string)
+		}
+		rule.context[key] = append(rule.context[key], strings.Split(globs, "|")...)
+	}
+	return rule, nil
+}
+
+// commandSeparators split a command line into the commands it runs.
+var commandSeparators = regexp.MustCompile(`&&|\|\||[;|&\n]|\$\(|` + "`")
+
+// matches reports whether the rule matches a command line.
+func (r dangerRule) matches(text string, ctx *dangerContext) bool {
+	if r.re != nil {
+		if !r.re.MatchString(text) {
+			return false
+		}
+	} else if !slices.ContainsFunc(commandSeparators.Split(text, -1), r.matchesWords) {
+		return false
+	}
+	for key, globs := range r.context {
+		value := ctx.get(key)
+		if value == "" || !slices.ContainsFunc(globs, func(glob string) bool {
+			ok, _ := path.Match(glob, value)
+			return ok
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesWords matches the rule's words against a single command.
+func (r dangerRule) matchesWords(command string) bool {
+	words := strings.Fields(command)
+	// Skip what runs the command rather than being it
+	for len(words) > 0 && (words[0] == "sudo" || words[0] == "env" || words[0] == "(" || words[0] == "{" || strings.Contains(words[0], "=")) {
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		return false
+	}
+	if !matchWord(r.words[0], path.Base(words[0])) {
+		return false
+	}
+
+	var shortFlags string
+	for _, word := range words[1:] {
+		if isShortFlags(word) {
+			shortFlags += word[1:]
+		}
+	}
+	next := 1
+	for _, want := range r.words[1:] {
+		switch {
+		case isShortFlags(want):
+			if strings.ContainsFunc(want[1:], func(flag rune) bool { return !strings.ContainsRune(shortFlags, flag) }) {
+				return false
+			}
+		case strings.HasPrefix(want, "--"):
+			if !slices.ContainsFunc(words[1:], func(word string) bool { return matchWord(want, word) }) {
+				return false
+			}
+		default:
+			found := false
+			for ; next < len(words) && !found; next++ {
+				found = matchWord(want, words[next])
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchWord matches a word against a rule word, globs separated by |.
+func matchWord(globs, word string) bool {
+	for _, glob := range strings.Split(globs, "|") {
+		if ok, _ := path.Match(glob, word); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isShortFlags reports whether a word is one or more short flags, like -rf.
+func isShortFlags(word string) bool {
+	if len(word) < 2 || word[0] != '-' || word[1] == '-' {
+		return false
+	}
+	return !strings.ContainsFunc(word[1:], func(c rune) bool {
+		return !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z')
+	})
+}
+
+// dangerContext looks up context values as rules ask for them, once each.
+type dangerContext struct {
+	values map[string]string
+}
+
+func (c *dangerContext) get(key string) string {
+	if value, ok := c.values[key]; ok {
+		return value
+	}
+	var value string
+	switch key {
+	case "branch":
+		// Unlike rev-parse, symbolic-ref knows the branch before its first commit
+		value = contextCommandOutput("git", "symbolic-ref", "--short", "-q", "HEAD")
+	case "kube":
+		value = contextCommandOutput("kubectl", "config", "current-context")
+	case "dir":
+		value, _ = os.Getwd()
+	case "host":
+		value, _ = os.Hostname()
+	}
+	if c.values == nil {
+		c.values = make(map[string]string)
+	}
+	c.values[key] = value
+	return value
+}
+
+// contextCommandOutput returns what a command prints, or "" if it fails.
+func contextCommandOutput(name string, args ...string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, name, args...).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// riskyCommand is a command that needs confirmation before it runs.
+type riskyCommand struct {
+	cmd    Command
+	text   string // What runs, after arguments and variables
+	reason string
+}
+
+func (r riskyCommand) label() string {
+	if r.cmd.ID == 0 && r.cmd.Name != "" {
+		return r.cmd.Name // A library command
+	}
+	if r.cmd.ID == 0 {
+		return "the command" // Not saved yet
+	}
+	return commandLabel(r.cmd)
+}
+
+// checkDanger returns why a command needs confirmation, or "" if it
+// doesn't.
+func checkDanger(cmd Command, text string, ctx *dangerContext) string {
+	if cmd.Protected {
+		return "is protected"
+	}
+	for _, rule := range config.dangerRules {
+		if rule.matches(text, ctx) {
+			return fmt.Sprintf("matches danger rule '%s'", rule.text)
+		}
+	}
+	return ""
+}
+
+// confirmRisky has the user type word before risky commands run. Runs
+// without a terminal are refused, except for commands that are only
+// dangerous when danger_noninteractive is allow.
+func confirmRisky(risky []riskyCommand, word string) error {
+	if len(risky) == 0 {
+		return nil
+	}
+	if !isTerminal(os.Stdin) {
+		for _, r := range risky {
+			if r.cmd.Protected || config.DangerNonInteractive != "allow" {
+				return fmt.Errorf("refusing to run %s without confirmation, it %s: %s", r.label(), r.reason, r.text)
+			}
+		}
+		for _, r := range risky {
+			fmt.Fprintf(os.Stderr, "Warning: running %s, it %s: %s\n", r.label(), r.reason, r.text)
+		}
+		return nil
+	}
+
+	for _, r := range risky {
+		fmt.Fprintf(os.Stderr, "%s %s: %s\n", r.label(), r.reason, r.text)
+	}
+	fmt.Fprintf(os.Stderr, "Type %s to run it: ", strconv.Quote(word))
+	input, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if strings.TrimSpace(input) != word {
+		return fmt.Errorf("not confirmed")
+	}
+	return nil
+}
+
+// confirmCommand confirms running a saved command with args, if it needs
+// it. The word to type is the command's name, or its ID.
+func confirmCommand(cmd Command, args []string) error {
+	text := strings.Join(append([]string{cmd.Raw}, args...), " ")
+	reason := checkDanger(cmd, text, &dangerContext{})
+	if reason == "" {
+		return nil
+	}
+	word := cmd.Name
+	if word == "" {
+		word = strconv.Itoa(cmd.ID)
+	}
+	return confirmRisky([]riskyCommand{{cmd, text, reason}}, word)
+}
+
+// confirmChain confirms a run of chain with opts, if any command it may run
+// needs it. Unless the run selects steps, that includes the chains it
+// depends on, directly or not, as they run first and must not run before
+// the user has agreed to all of it. Variables are those the run starts
+// with. The word to type is the chain's name, or its ID.
+func (cs *CommandStore) confirmChain(chain *CommandChain, opts ChainRunOptions) error {
+	if opts.Confirmed {
+		return nil
+	}
+	first, last, err := stepRange(chain, opts)
+	if err != nil {
+		return err
+	}
+	vars := make(map[string]string)
+	maps.Copy(vars, chain.Vars)
+	if opts.Resume != nil {
+		maps.Copy(vars, opts.Resume.Vars)
+	}
+	maps.Copy(vars, opts.Vars)
+	ctx := &dangerContext{}
+	risky := cs.chainRisks(nil, chain, first, last, vars, ctx)
+
+	if !opts.selectsSteps() {
+		seen := map[int]bool{chain.ID: true}
+		queue := chainDependencyIDs(chain)
+		for len(queue) > 0 {
+			dep := cs.findChain(queue[0])
+			queue = queue[1:]
+			if dep == nil || seen[dep.ID] {
+				continue
+			}
+			seen[dep.ID] = true
+			// Dependencies run with their own defaults and --var
+			vars := make(map[string]string)
+			maps.Copy(vars, dep.Vars)
+			maps.Copy(vars, opts.Vars)
+			risky = cs.chainRisks(risky, dep, 0, len(dep.Steps)-1, vars, ctx)
+			queue = append(queue, chainDependencyIDs(dep)...)
+		}
+	}
+
+	word := chain.Name
+	if word == "" {
+		word = strconv.Itoa(chain.ID)
+	}
+	return confirmRisky(risky, word)
+}
+
+// chainDependencyIDs returns the IDs of the chains chain depends on.
+func chainDependencyIDs(chain *CommandChain) []int {
+	var ids []int
+	for _, dep := range chain.Dependencies {
+		ids = append(ids, dep.DependsOn...)
+	}
+	return ids
+}
+
+// chainRisks adds the commands of steps first to last of chain that need
+// confirmation to risky, with vars expanded. Commands already in risky are
+// not added again.
+func (cs *CommandStore) chainRisks(risky []riskyCommand, chain *CommandChain, first, last int, vars map[string]string, ctx *dangerContext) []riskyCommand {
+	for i := first; i <= last && i < len(chain.Steps); i++ {
+		step := chain.Steps[i]
+		ids := append([]int{step.CommandID}, step.ParallelWith...)
+		ids = append(append(ids, step.OnSuccess...), step.OnFailure...)
+		for _, id := range ids {
+			cmd := cs.findCommand(id)
+			if cmd == nil || slices.ContainsFunc(risky, func(r riskyCommand) bool { return r.cmd.ID == id }) {
+				continue
+			}
+			text, _ := expandVars(cmd.Raw, vars)
+			if reason := checkDanger(*cmd, text, ctx); reason != "" {
+				risky = append(risky, riskyCommand{*cmd, text, reason})
+			}
+		}
+	}
+	return risky
+}
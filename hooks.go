@@ -0,0 +1,190 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Hook events, sent to every command in the hooks setting.
+const (
+	hookBeforeExecute = "before_execute"  // A command is about to run; a veto stops it
+	hookAfterExecute  = "after_execute"   // A command finished
+	hookBeforeSave    = "before_save"     // A new command is about to be added to the history; a veto keeps it out
+	hookChainStepDone = "chain_step_done" // A chain step finished; a veto stops the chain
+)
+
+// hookTimeout bounds each hook, so that a stuck hook can't hang save.
+const hookTimeout = 30 * time.Second
+
+// HookEvent is the JSON a hook reads on stdin.
+type HookEvent struct {
+	Event      string   `json:"event"`
+	CommandID  int      `json:"command_id,omitempty"` // 0 for commands not saved yet
+	Name       string   `json:"name,omitempty"`
+	Command    string   `json:"command"`
+	Shell      string   `json:"shell,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+	Dir        string   `json:"dir"`
+	ExitCode   *int     `json:"exit_code,omitempty"` // Once the command ran
+	DurationMs int64    `json:"duration_ms,omitempty"`
+	ChainID    int      `json:"chain_id,omitempty"` // For chain_step_done
+	Chain      string   `json:"chain,omitempty"`
+	Step       int      `json:"step,omitempty"` // 1-based
+}
+
+// HookReply is what a hook may print on stdout. Printing nothing agrees
+// to the event.
+type HookReply struct {
+	Veto        bool              `json:"veto"`
+	Reason      string            `json:"reason,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`        // Added to the command
+	Annotations map[string]string `json:"annotations,omitempty"` // Set on the command; "" removes one
+}
+
+// hookVetoable reports whether hooks can veto an event. Vetoes of other
+// events are ignored with a warning, since it is too late to stop anything.
+func hookVetoable(event string) bool {
+	return event != hookAfterExecute
+}
+
+// newHookEvent returns an event about cmd, run in the current directory.
+func newHookEvent(event string, cmd Command) HookEvent {
+	e := HookEvent{
+		Event:     event,
+		CommandID: cmd.ID,
+		Name:      cmd.Name,
+		Command:   cmd.Raw,
+		Shell:     cmd.Shell,
+		Tags:      cmd.Tags,
+	}
+	e.Dir, _ = os.Getwd()
+	return e
+}
+
+// withResult adds the outcome of a run to the event.
+func (e HookEvent) withResult(exitCode int, duration time.Duration) HookEvent {
+	e.ExitCode = &exitCode
+	e.DurationMs = duration.Milliseconds()
+	return e
+}
+
+// runHooks sends an event to the hooks in order and collects their tags
+// and annotations. It returns an error if one of them vetoes a vetoable
+// event; later hooks don't see the event then. Hooks that fail to run or
+// reply with something other than JSON only give warnings.
+func runHooks(event HookEvent) (HookReply, error) {
+	var result HookReply
+	if len(config.Hooks) == 0 {
+		return result, nil
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return result, err
+	}
+	for _, hook := range config.Hooks {
+		reply, err := runHook(hook, event.Event, payload)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: hook '%s' failed on %s: %v\n", hook, event.Event, err)
+			continue
+		}
+		if reply.Veto {
+			if !hookVetoable(event.Event) {
+				fmt.Fprintf(os.Stderr, "Warning: hook '%s' cannot veto %s, ignored\n", hook, event.Event)
+			} else if reply.Reason != "" {
+				return result, fmt.Errorf("vetoed by hook '%s': %s", hook, reply.Reason)
+			} else {
+				return result, fmt.Errorf("vetoed by hook '%s'", hook)
+			}
+		}
+		for _, tag := range reply.Tags {
+			if tag = strings.TrimSpace(tag); tag != "" && !slices.Contains(result.Tags, tag) {
+				result.Tags = append(result.Tags, tag)
+			}
+		}
+		if len(reply.Annotations) > 0 {
+			if result.Annotations == nil {
+				result.Annotations = make(map[string]string)
+			}
+			maps.Copy(result.Annotations, reply.Annotations)
+		}
+	}
+	return result, nil
+}
+
+// runHook runs one hook with the event on stdin. A hook that exits
+// non-zero vetoes the event, with what it wrote to stderr as the reason.
+func runHook(hook, event string, payload []byte) (HookReply, error) {
+	var reply HookReply
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	cmd, err := buildCommandContext(ctx, "", hook, nil)
+	if err != nil {
+		return reply, err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	cmd.Env = append(os.Environ(), "SAVE_EVENT="+event, "SAVE_VERSION="+Version)
+
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return reply, fmt.Errorf("timed out after %s", hookTimeout)
+	}
+	if stepExitCode(err) > 0 {
+		return HookReply{Veto: true, Reason: strings.TrimSpace(stderr.String())}, nil
+	}
+	if err != nil {
+		return reply, err
+	}
+	// Anything on stderr is the hook talking to the user
+	os.Stderr.Write(stderr.Bytes())
+
+	if out := bytes.TrimSpace(stdout.Bytes()); len(out) > 0 {
+		if err := json.Unmarshal(out, &reply); err != nil {
+			return HookReply{}, fmt.Errorf("invalid reply: %v", err)
+		}
+	}
+	return reply, nil
+}
+
+// annotate adds the tags and annotations hooks replied with to a command.
+func (cmd *Command) annotate(reply HookReply) {
+	for _, tag := range reply.Tags {
+		if !slices.Contains(cmd.Tags, tag) {
+			cmd.Tags = append(cmd.Tags, tag)
+		}
+	}
+	for key, value := range reply.Annotations {
+		if value == "" {
+			delete(cmd.Annotations, key)
+			continue
+		}
+		if cmd.Annotations == nil {
+			cmd.Annotations = make(map[string]string)
+		}
+		cmd.Annotations[key] = value
+	}
+	if len(cmd.Annotations) == 0 {
+		cmd.Annotations = nil
+	}
+}
+
+// formatAnnotations returns annotations as "key=value" pairs sorted by key.
+func formatAnnotations(annotations map[string]string) string {
+	var pairs []string
+	for _, key := range slices.Sorted(maps.Keys(annotations)) {
+		pairs = append(pairs, key+"="+annotations[key])
+	}
+	return strings.Join(pairs, ", ")
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ignoreRule is one pattern of a .gitignore file.
+type ignoreRule struct {
+	segments []string // The pattern split at "/"
+	negate   bool     // "!pattern" includes the path again
+	dirOnly  bool     // "pattern/" only matches directories
+	anchored bool     // Matched against the path from the .gitignore's directory, not the name alone
+}
+
+// ignoreMatcher decides which paths the .gitignore files of the current
+// repository exclude, following git's rules: later and deeper patterns
+// win, and nothing inside an ignored directory is included again. .git
+// directories are always ignored.
+type ignoreMatcher struct {
+	base  string // Top of the repository, or the current directory outside one
+	extra []ignoreRule
+	mu    sync.Mutex
+	rules map[string][]ignoreRule // By directory, loaded as needed
+}
+
+// newIgnoreMatcher returns a matcher for the repository around the current
+// directory, with extra patterns relative to the current directory.
+func newIgnoreMatcher(extra []string) (*ignoreMatcher, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	m := &ignoreMatcher{base: wd, rules: make(map[string][]ignoreRule)}
+	for dir := wd; ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			m.base = dir
+			break
+		}
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	for _, pattern := range extra {
+		if rule, ok := parseIgnoreRule(pattern); ok {
+			if rel, err := filepath.Rel(m.base, wd); err == nil && rel != "." {
+				// Anchor the pattern at the current directory
+				if !rule.anchored {
+					rule.segments = append([]string{"**"}, rule.segments...)
+				}
+				rule.segments = append(strings.Split(filepath.ToSlash(rel), "/"), rule.segments...)
+				rule.anchored = true
+			}
+			m.extra = append(m.extra, rule)
+		}
+	}
+	return m, nil
+}
+
+// parseIgnoreRule parses a line of a .gitignore file. Blank lines and
+// comments give no rule.
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	var rule ignoreRule
+	if rest, ok := strings.CutPrefix(line, "!"); ok {
+		rule.negate, line = true, rest
+	} else {
+		line = strings.TrimPrefix(line, `\`) // "\#" and "\!" are literal
+	}
+	if rest, ok := strings.CutSuffix(line, "/"); ok {
+		rule.dirOnly, line = true, rest
+	}
+	rule.anchored = strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return ignoreRule{}, false
+	}
+	rule.segments = strings.Split(line, "/")
+	return rule, true
+}
+
+// matches reports whether the rule matches a path, given as its segments
+// relative to the rule's directory.
+func (r ignoreRule) matches(segments []string, dir bool) bool {
+	if r.dirOnly && !dir {
+		return false
+	}
+	if !r.anchored {
+		ok, _ := path.Match(r.segments[0], segments[len(segments)-1])
+		return ok
+	}
+	return matchSegments(r.segments, segments)
+}
+
+// matchSegments matches a path against a pattern segment by segment, where
+// a "**" segment matches any number of segments.
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], segments[0])
+	return ok && matchSegments(pattern[1:], segments[1:])
+}
+
+// dirRules returns the rules of the .gitignore file in dir.
+func (m *ignoreMatcher) dirRules(dir string) []ignoreRule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if rules, ok := m.rules[dir]; ok {
+		return rules
+	}
+	var rules []ignoreRule
+	if f, err := os.Open(filepath.Join(dir, ".gitignore")); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if rule, ok := parseIgnoreRule(scanner.Text()); ok {
+				rules = append(rules, rule)
+			}
+		}
+		f.Close()
+	}
+	m.rules[dir] = rules
+	return rules
+}
+
+// ignored reports whether path, a directory if dir is set, is ignored.
+func (m *ignoreMatcher) ignored(p string, dir bool) bool {
+	rel, err := filepath.Rel(m.base, p)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return filepath.Base(p) == ".git"
+	}
+	segments := strings.Split(filepath.ToSlash(rel), "/")
+
+	// A path is ignored if it or any directory above it is
+	for i := range segments {
+		if segments[i] == ".git" {
+			return true
+		}
+		isDir := dir || i < len(segments)-1
+		ignored := false
+		current := m.base
+		for j := 0; j <= i; j++ {
+			for _, rule := range m.dirRules(current) {
+				if rule.matches(segments[j:i+1], isDir) {
+					ignored = !rule.negate
+				}
+			}
+			current = filepath.Join(current, segments[j])
+		}
+		for _, rule := range m.extra {
+			if rule.matches(segments[:i+1], isDir) {
+				ignored = !rule.negate
+			}
+		}
+		if ignored {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,280 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Thresholds used by --insights. They are deliberately conservative so the
+// report only shows patterns backed by a handful of runs.
+const (
+	insightMinRuns        = 4    // Runs needed before a command is judged at all
+	insightRecentRuns     = 20   // Flakiness looks at this many latest runs
+	insightFlipRatio      = 0.3  // Share of consecutive runs that change outcome
+	insightRateIncrease   = 20.0 // Failure rate points a command must rise by
+	insightSlowdownFactor = 1.5  // Recent median must be this much slower
+	insightSlowdownMinMs  = 500  // ... and at least this many ms slower
+)
+
+// Insight is one pattern found in the run history.
+type Insight struct {
+	Kind      string `json:"kind"` // "flaky", "rising_failures", "dir_failures", "slowdown" or "failing_step"
+	CommandID int    `json:"command_id,omitempty"`
+	ChainID   int    `json:"chain_id,omitempty"`
+	Subject   string `json:"subject"`
+	Detail    string `json:"detail"`
+}
+
+var insightTitles = []struct{ kind, title string }{
+	{"flaky", "Flaky commands"},
+	{"rising_failures", "Failing more often recently"},
+	{"dir_failures", "Failing in specific directories"},
+	{"slowdown", "Getting slower"},
+	{"failing_step", "Failing chain steps"},
+}
+
+// Insights analyses the run history. Runs after now-recent count as
+// recent when comparing against older runs.
+func (cs *CommandStore) Insights(now time.Time, recent time.Duration) []Insight {
+	byCommand := make(map[int][]RunRecord)
+	for _, run := range cs.runs {
+		byCommand[run.CommandID] = append(byCommand[run.CommandID], run)
+	}
+	ids := make([]int, 0, len(byCommand))
+	for id, runs := range byCommand {
+		sort.SliceStable(runs, func(i, j int) bool { return runs[i].StartedAt.Before(runs[j].StartedAt) })
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	cutoff := now.Add(-recent)
+	var insights []Insight
+	for _, id := range ids {
+		runs := byCommand[id]
+		if len(runs) < insightMinRuns {
+			continue
+		}
+		subject := fmt.Sprintf("#%d %s", id, runs[len(runs)-1].Command)
+		if cmd := cs.findCommand(id); cmd != nil {
+			subject = commandLabel(*cmd) + " " + cmd.Raw
+		}
+		add := func(kind, detail string) {
+			insights = append(insights, Insight{Kind: kind, CommandID: id, Subject: subject, Detail: detail})
+		}
+
+		if detail, ok := flakiness(runs); ok {
+			add("flaky", detail)
+		}
+
+		var older, newer []RunRecord
+		for _, run := range runs {
+			if run.StartedAt.Before(cutoff) {
+				older = append(older, run)
+			} else {
+				newer = append(newer, run)
+			}
+		}
+		if detail, ok := risingFailures(older, newer); ok {
+			add("rising_failures", detail)
+		}
+		if detail, ok := slowdown(older, newer); ok {
+			add("slowdown", detail)
+		}
+		for _, detail := range directoryFailures(runs) {
+			add("dir_failures", detail)
+		}
+	}
+
+	return append(insights, cs.failingSteps()...)
+}
+
+// flakiness reports commands whose latest runs keep alternating between
+// success and failure.
+func flakiness(runs []RunRecord) (string, bool) {
+	if len(runs) > insightRecentRuns {
+		runs = runs[len(runs)-insightRecentRuns:]
+	}
+	flips, failures := 0, 0
+	for i, run := range runs {
+		if run.ExitCode != 0 {
+			failures++
+		}
+		if i > 0 && (run.ExitCode == 0) != (runs[i-1].ExitCode == 0) {
+			flips++
+		}
+	}
+	if failures == 0 || failures == len(runs) {
+		return "", false
+	}
+	ratio := float64(flips) / float64(len(runs)-1)
+	if ratio < insightFlipRatio {
+		return "", false
+	}
+	return fmt.Sprintf("%d of the last %d runs failed, outcome changed %d times", failures, len(runs), flips), true
+}
+
+func failureRate(runs []RunRecord) float64 {
+	failures := 0
+	for _, run := range runs {
+		if run.ExitCode != 0 {
+			failures++
+		}
+	}
+	return float64(failures) / float64(len(runs)) * 100
+}
+
+// risingFailures compares the failure rate of recent runs with older ones.
+func risingFailures(older, newer []RunRecord) (string, bool) {
+	if len(older) < insightMinRuns/2 || len(newer) < insightMinRuns/2 {
+		return "", false
+	}
+	before, after := failureRate(older), failureRate(newer)
+	if after-before < insightRateIncrease {
+		return "", false
+	}
+	return fmt.Sprintf("failure rate rose from %.0f%% (%d runs) to %.0f%% (%d recent runs)", before, len(older), after, len(newer)), true
+}
+
+// slowdown compares the median duration of recent runs with older ones.
+func slowdown(older, newer []RunRecord) (string, bool) {
+	if len(older) < insightMinRuns/2 || len(newer) < insightMinRuns/2 {
+		return "", false
+	}
+	before, after := summarizeRuns("", older).MedianMs, summarizeRuns("", newer).MedianMs
+	if after-before < insightSlowdownMinMs || float64(after) < float64(before)*insightSlowdownFactor {
+		return "", false
+	}
+	return fmt.Sprintf("median duration went from %s to %s", formatDuration(before), formatDuration(after)), true
+}
+
+// directoryFailures finds directories where a command always fails while
+// it succeeds elsewhere.
+func directoryFailures(runs []RunRecord) []string {
+	type outcome struct{ runs, failures int }
+	byDir := make(map[string]*outcome)
+	var dirs []string
+	succeeded := false
+	for _, run := range runs {
+		dir := runDir(run)
+		o, ok := byDir[dir]
+		if !ok {
+			o = &outcome{}
+			byDir[dir] = o
+			dirs = append(dirs, dir)
+		}
+		o.runs++
+		if run.ExitCode != 0 {
+			o.failures++
+		} else {
+			succeeded = true
+		}
+	}
+	if !succeeded || len(dirs) < 2 {
+		return nil
+	}
+
+	sort.Strings(dirs)
+	var details []string
+	for _, dir := range dirs {
+		o := byDir[dir]
+		if o.runs >= 2 && o.failures == o.runs {
+			details = append(details, fmt.Sprintf("failed all %d runs in %s but succeeds elsewhere", o.runs, dir))
+		}
+	}
+	return details
+}
+
+// failingSteps reports the main steps of each chain that fail most often.
+func (cs *CommandStore) failingSteps() []Insight {
+	type stepKey struct{ chain, step int }
+	type outcome struct {
+		runs, failures int
+		command        string
+		chain          string
+	}
+	byStep := make(map[stepKey]*outcome)
+	for _, run := range cs.chainRuns {
+		for _, step := range run.Steps {
+			if step.Role != "main" {
+				continue
+			}
+			key := stepKey{run.ChainID, step.Step}
+			o, ok := byStep[key]
+			if !ok {
+				o = &outcome{}
+				byStep[key] = o
+			}
+			o.runs++
+			o.command = step.Command
+			o.chain = run.Chain
+			if step.ExitCode != 0 {
+				o.failures++
+			}
+		}
+	}
+
+	keys := make([]stepKey, 0, len(byStep))
+	for key, o := range byStep {
+		if o.failures > 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := byStep[keys[i]], byStep[keys[j]]
+		if a.failures != b.failures {
+			return a.failures > b.failures
+		}
+		if keys[i].chain != keys[j].chain {
+			return keys[i].chain < keys[j].chain
+		}
+		return keys[i].step < keys[j].step
+	})
+
+	var insights []Insight
+	for _, key := range keys {
+		o := byStep[key]
+		insights = append(insights, Insight{
+			Kind:    "failing_step",
+			ChainID: key.chain,
+			Subject: fmt.Sprintf("chain #%d %s, step %d: %s", key.chain, o.chain, key.step+1, o.command),
+			Detail:  fmt.Sprintf("failed %d of %d runs (%.0f%%)", o.failures, o.runs, float64(o.failures)/float64(o.runs)*100),
+		})
+	}
+	return insights
+}
+
+// printInsights prints insights grouped by kind.
+func printInsights(insights []Insight) {
+	if len(insights) == 0 {
+		fmt.Println("No issues found in the run history")
+		return
+	}
+
+	first := true
+	for _, section := range insightTitles {
+		var matching []Insight
+		for _, insight := range insights {
+			if insight.Kind == section.kind {
+				matching = append(matching, insight)
+			}
+		}
+		if len(matching) == 0 {
+			continue
+		}
+		if !first {
+			fmt.Println()
+		}
+		first = false
+
+		fmt.Printf("%s:\n", section.title)
+		for _, insight := range matching {
+			fmt.Printf("  %s\n", insight.Subject)
+			fmt.Printf("    %s\n", insight.Detail)
+		}
+	}
+}
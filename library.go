@@ -0,0 +1,494 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Library is a read-only source of shared command and chain definitions,
+// either a local directory or a git repository cloned into the config
+// directory.
+type Library struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	URL  string `json:"url,omitempty"` // Set when the library is a managed git clone
+}
+
+// LibraryFile is the layout of a definition file inside a library.
+type LibraryFile struct {
+	Commands []LibraryCommand  `json:"commands,omitempty" yaml:"commands,omitempty" toml:"commands,omitempty"`
+	Chains   []ChainDefinition `json:"chains,omitempty" yaml:"chains,omitempty" toml:"chains,omitempty"`
+}
+
+type LibraryCommand struct {
+	Name        string   `json:"name" yaml:"name" toml:"name"`
+	Command     string   `json:"command" yaml:"command" toml:"command"`
+	Description string   `json:"description,omitempty" yaml:"description,omitempty" toml:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty" yaml:"tags,omitempty" toml:"tags,omitempty"`
+	Shell       string   `json:"shell,omitempty" yaml:"shell,omitempty" toml:"shell,omitempty"` // Empty for the user's default
+}
+
+// loadedLibrary holds the parsed contents of a library. Definitions are
+// keyed by their unqualified name.
+type loadedLibrary struct {
+	Library
+	commands map[string]LibraryCommand
+	chains   map[string]ChainDefinition
+	err      error
+}
+
+// configDir returns the directory for save's own files (libraries, sync
+// checkout, ...). Development builds keep everything under ConfigPath.
+func configDir() (string, error) {
+	if ConfigPath != "" {
+		return ConfigPath, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get config directory: %w", err)
+	}
+	return filepath.Join(dir, "save"), nil
+}
+
+// isGitURL reports whether source looks like something to `git clone`
+// rather than a local directory.
+func isGitURL(source string) bool {
+	return strings.Contains(source, "://") || strings.HasPrefix(source, "git@") || strings.HasSuffix(source, ".git")
+}
+
+// splitLibraryRef splits "team/deploy-api" into its library and item names.
+func splitLibraryRef(ref string) (string, string, bool) {
+	lib, name, ok := strings.Cut(ref, "/")
+	if !ok || lib == "" || name == "" {
+		return "", "", false
+	}
+	return lib, name, true
+}
+
+func (cs *CommandStore) findLibrary(name string) *Library {
+	for i := range cs.libraries {
+		if cs.libraries[i].Name == name {
+			return &cs.libraries[i]
+		}
+	}
+	return nil
+}
+
+// AddLibrary registers a library. A git URL is cloned into the config
+// directory; anything else must be an existing local directory.
+func (cs *CommandStore) AddLibrary(name, source string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	if cs.findLibrary(name) != nil {
+		return fmt.Errorf("library '%s' already exists", name)
+	}
+
+	lib := Library{Name: name}
+	if isGitURL(source) {
+		dir, err := configDir()
+		if err != nil {
+			return err
+		}
+		lib.URL = source
+		lib.Path = filepath.Join(dir, "libraries", name)
+		if err := os.MkdirAll(filepath.Dir(lib.Path), 0755); err != nil {
+			return fmt.Errorf("failed to create library directory: %w", err)
+		}
+		clone := exec.Command("git", "clone", "--quiet", source, lib.Path)
+		if output, err := clone.CombinedOutput(); err != nil {
+			return fmt.Errorf("git clone failed: %s: %v", strings.TrimSpace(string(output)), err)
+		}
+	} else {
+		path, err := filepath.Abs(source)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("library path: %w", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("library path %s is not a directory", path)
+		}
+		lib.Path = path
+	}
+
+	loaded := loadLibrary(lib)
+	if loaded.err != nil {
+		return fmt.Errorf("library '%s' is invalid: %w", name, loaded.err)
+	}
+
+	cs.libraries = append(cs.libraries, lib)
+	cs.libraryCache = nil
+	return cs.save()
+}
+
+// RemoveLibrary unregisters a library and deletes its clone if save manages it.
+func (cs *CommandStore) RemoveLibrary(name string) error {
+	lib := cs.findLibrary(name)
+	if lib == nil {
+		return fmt.Errorf("library '%s' not found", name)
+	}
+	if lib.URL != "" {
+		if err := os.RemoveAll(lib.Path); err != nil {
+			return fmt.Errorf("failed to remove library checkout: %w", err)
+		}
+	}
+
+	newLibraries := make([]Library, 0, len(cs.libraries))
+	for _, l := range cs.libraries {
+		if l.Name != name {
+			newLibraries = append(newLibraries, l)
+		}
+	}
+	cs.libraries = newLibraries
+	cs.libraryCache = nil
+	return cs.save()
+}
+
+// SyncLibraries pulls the latest definitions for git-backed libraries. With
+// an empty name all libraries are synced.
+func (cs *CommandStore) SyncLibraries(name string) error {
+	if name != "" && cs.findLibrary(name) == nil {
+		return fmt.Errorf("library '%s' not found", name)
+	}
+
+	var failed []string
+	for _, lib := range cs.libraries {
+		if name != "" && lib.Name != name {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(lib.Path, ".git")); err != nil {
+			fmt.Printf("%s: not a git checkout, nothing to sync\n", lib.Name)
+			continue
+		}
+		upstream := exec.Command("git", "-C", lib.Path, "rev-parse", "--abbrev-ref", "@{upstream}")
+		if err := upstream.Run(); err != nil {
+			fmt.Printf("%s: no upstream branch, nothing to sync\n", lib.Name)
+			continue
+		}
+		pull := exec.Command("git", "-C", lib.Path, "pull", "--ff-only", "--quiet")
+		if output, err := pull.CombinedOutput(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: git pull failed: %s\n", lib.Name, strings.TrimSpace(string(output)))
+			failed = append(failed, lib.Name)
+			continue
+		}
+		fmt.Printf("%s: up to date\n", lib.Name)
+	}
+	cs.libraryCache = nil
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to sync: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// loadLibrary parses every definition file under the library path. Names
+// must be unique within a library.
+func loadLibrary(lib Library) *loadedLibrary {
+	loaded := &loadedLibrary{
+		Library:  lib,
+		commands: make(map[string]LibraryCommand),
+		chains:   make(map[string]ChainDefinition),
+	}
+	sources := make(map[string]string)
+
+	loaded.err = filepath.WalkDir(lib.Path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != lib.Path && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isDefinitionFile(path) {
+			return nil
+		}
+
+		var file LibraryFile
+		if err := decodeDefinitionFile(path, &file); err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(lib.Path, path)
+
+		for _, cmd := range file.Commands {
+			if err := validateName(cmd.Name); err != nil {
+				return fmt.Errorf("%s: %w", rel, err)
+			}
+			if strings.TrimSpace(cmd.Command) == "" {
+				return fmt.Errorf("%s: command '%s' has no command text", rel, cmd.Name)
+			}
+			if other, ok := sources["command:"+cmd.Name]; ok {
+				return fmt.Errorf("command '%s' is defined in both %s and %s", cmd.Name, other, rel)
+			}
+			sources["command:"+cmd.Name] = rel
+			loaded.commands[cmd.Name] = cmd
+		}
+		for _, chain := range file.Chains {
+			if err := chain.validate(); err != nil {
+				return fmt.Errorf("%s: %w", rel, err)
+			}
+			if other, ok := sources["chain:"+chain.Name]; ok {
+				return fmt.Errorf("chain '%s' is defined in both %s and %s", chain.Name, other, rel)
+			}
+			sources["chain:"+chain.Name] = rel
+			loaded.chains[chain.Name] = chain
+		}
+		return nil
+	})
+	return loaded
+}
+
+// loadedLibraries parses all registered libraries once per process.
+func (cs *CommandStore) loadedLibraries() []*loadedLibrary {
+	if cs.libraryCache == nil {
+		for _, lib := range cs.libraries {
+			cs.libraryCache = append(cs.libraryCache, loadLibrary(lib))
+		}
+	}
+	return cs.libraryCache
+}
+
+func (cs *CommandStore) loadedLibrary(name string) (*loadedLibrary, error) {
+	for _, loaded := range cs.loadedLibraries() {
+		if loaded.Name == name {
+			if loaded.err != nil {
+				return nil, fmt.Errorf("library '%s': %w", name, loaded.err)
+			}
+			return loaded, nil
+		}
+	}
+	return nil, fmt.Errorf("library '%s' not found", name)
+}
+
+// findLibraryCommand resolves a namespaced reference such as "team/deploy-api".
+func (cs *CommandStore) findLibraryCommand(ref string) (*LibraryCommand, error) {
+	libName, name, ok := splitLibraryRef(ref)
+	if !ok {
+		return nil, fmt.Errorf("invalid library reference %q, expected <library>/<name>", ref)
+	}
+	loaded, err := cs.loadedLibrary(libName)
+	if err != nil {
+		return nil, err
+	}
+	cmd, ok := loaded.commands[name]
+	if !ok {
+		return nil, fmt.Errorf("library '%s' has no command '%s'", libName, name)
+	}
+	return &cmd, nil
+}
+
+// findLibraryChain resolves a namespaced chain reference. The returned
+// definition is renamed to the qualified name.
+func (cs *CommandStore) findLibraryChain(ref string) (*ChainDefinition, error) {
+	libName, name, ok := splitLibraryRef(ref)
+	if !ok {
+		return nil, fmt.Errorf("invalid library reference %q, expected <library>/<name>", ref)
+	}
+	loaded, err := cs.loadedLibrary(libName)
+	if err != nil {
+		return nil, err
+	}
+	chain, ok := loaded.chains[name]
+	if !ok {
+		return nil, fmt.Errorf("library '%s' has no chain '%s'", libName, name)
+	}
+	chain.Name = ref
+	return &chain, nil
+}
+
+// materializeLibraryChain creates or updates a local copy of a library
+// chain so it can be run like any other chain. The copy is named after the
+// qualified reference and is refreshed every time it is run.
+func (cs *CommandStore) materializeLibraryChain(ref string) (int, error) {
+	def, err := cs.findLibraryChain(ref)
+	if err != nil {
+		return 0, err
+	}
+	plan, err := cs.planChain(def)
+	if err != nil {
+		return 0, fmt.Errorf("chain %q: %w", ref, err)
+	}
+	if err := cs.applyPlan(plan); err != nil {
+		return 0, err
+	}
+	return plan.chain.ID, nil
+}
+
+// ExecuteLibraryCommand runs a library command. Library commands are
+// read-only, so nothing is recorded in the personal history.
+func (cs *CommandStore) ExecuteLibraryCommand(ref string, args []string) error {
+	libCmd, err := cs.findLibraryCommand(ref)
+	if err != nil {
+		return err
+	}
+
+	// Dangerous library commands are confirmed like saved ones, by typing
+	// their qualified name
+	if err := confirmCommand(Command{Raw: libCmd.Command, Shell: libCmd.Shell, Name: ref}, args); err != nil {
+		return err
+	}
+	cmd, err := buildCommand(libCmd.Shell, libCmd.Command, args)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+	if err := cmd.Run(); err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return err
+		}
+		cs.lastExitCode = exitErr.ExitCode()
+	}
+	return nil
+}
+
+// searchLibraries returns the qualified names of library commands whose
+// name, text, description or tags contain query.
+func (cs *CommandStore) searchLibraries(query string) []string {
+	query = strings.ToLower(query)
+	var results []string
+	for _, loaded := range cs.loadedLibraries() {
+		if loaded.err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipping library '%s': %v\n", loaded.Name, loaded.err)
+			continue
+		}
+		for name, cmd := range loaded.commands {
+			if strings.Contains(strings.ToLower(name), query) ||
+				strings.Contains(strings.ToLower(cmd.Command), query) ||
+				strings.Contains(strings.ToLower(cmd.Description), query) ||
+				containsTag(cmd.Tags, query) {
+				results = append(results, loaded.Name+"/"+name)
+			}
+		}
+	}
+	sort.Strings(results)
+	return results
+}
+
+// ListLibraries prints every library with its commands and chains.
+func (cs *CommandStore) ListLibraries() {
+	if len(cs.libraries) == 0 {
+		fmt.Println("No libraries configured")
+		fmt.Println("\nTip: Add one using:")
+		fmt.Println("  save --library add <name> <directory|git-url>")
+		return
+	}
+
+	for _, loaded := range cs.loadedLibraries() {
+		source := loaded.Path
+		if loaded.URL != "" {
+			source = fmt.Sprintf("%s (%s)", loaded.URL, loaded.Path)
+		}
+		fmt.Printf("%s: %s\n", loaded.Name, source)
+		if loaded.err != nil {
+			fmt.Printf("    Error: %v\n", loaded.err)
+			fmt.Println()
+			continue
+		}
+
+		names := make([]string, 0, len(loaded.commands))
+		for name := range loaded.commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			cmd := loaded.commands[name]
+			fmt.Printf("    %s/%s: %s\n", loaded.Name, name, cmd.Command)
+		}
+
+		names = names[:0]
+		for name := range loaded.chains {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("    %s/%s (chain, %d steps)\n", loaded.Name, name, len(loaded.chains[name].Steps))
+		}
+		fmt.Println()
+	}
+}
+
+// PromoteCommand copies a named personal command into a library file,
+// replacing an existing definition with the same name in that file.
+func (cs *CommandStore) PromoteCommand(id int, libName, fileName string) (string, error) {
+	cmd := cs.findCommand(id)
+	if cmd == nil {
+		return "", fmt.Errorf("command with ID %d not found", id)
+	}
+	if cmd.Name == "" {
+		return "", fmt.Errorf("command #%d has no name, set one first with: save --name <name> %d", id, id)
+	}
+	lib := cs.findLibrary(libName)
+	if lib == nil {
+		return "", fmt.Errorf("library '%s' not found", libName)
+	}
+
+	if fileName == "" {
+		fileName = "commands.yaml"
+	}
+	if !isDefinitionFile(fileName) {
+		return "", fmt.Errorf("unsupported file extension %q (use .yaml, .yml, .toml or .json)", filepath.Ext(fileName))
+	}
+	path := filepath.Join(lib.Path, fileName)
+
+	var file LibraryFile
+	if _, err := os.Stat(path); err == nil {
+		if err := decodeDefinitionFile(path, &file); err != nil {
+			return "", err
+		}
+	}
+
+	// Refuse to shadow a definition that lives in another file
+	if loaded, err := cs.loadedLibrary(libName); err == nil {
+		if _, exists := loaded.commands[cmd.Name]; exists {
+			found := false
+			for _, c := range file.Commands {
+				if c.Name == cmd.Name {
+					found = true
+				}
+			}
+			if !found {
+				return "", fmt.Errorf("library '%s' already defines '%s' in another file", libName, cmd.Name)
+			}
+		}
+	}
+
+	entry := LibraryCommand{
+		Name:        cmd.Name,
+		Command:     cmd.Raw,
+		Description: cmd.Description,
+		Tags:        cmd.Tags,
+		Shell:       cmd.Shell,
+	}
+	replaced := false
+	for i := range file.Commands {
+		if file.Commands[i].Name == entry.Name {
+			file.Commands[i] = entry
+			replaced = true
+		}
+	}
+	if !replaced {
+		file.Commands = append(file.Commands, entry)
+	}
+
+	if err := encodeDefinitionFile(path, &file); err != nil {
+		return "", err
+	}
+	cs.libraryCache = nil
+	return path, nil
+}
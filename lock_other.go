@@ -0,0 +1,51 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tryLock creates the file at path, holding the current process ID, unless
+// it exists. A lock left behind by a process that is gone is taken over.
+func tryLock(path string) (unlock func(), ok bool, err error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			f.WriteString(strconv.Itoa(os.Getpid()))
+			f.Close()
+			return func() { os.Remove(path) }, true, nil
+		}
+		if !os.IsExist(err) {
+			return nil, false, err
+		}
+
+		data, _ := os.ReadFile(path)
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil {
+			if _, err := os.FindProcess(pid); err == nil {
+				return nil, false, nil
+			}
+		}
+		os.Remove(path)
+	}
+	return nil, false, nil
+}
+
+// lock takes the lock at path, waiting for its holder to release it.
+func lock(path string) (unlock func(), err error) {
+	for {
+		unlock, ok, err := tryLock(path)
+		if err != nil || ok {
+			return unlock, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
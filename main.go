@@ -8,14 +8,15 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -25,11 +26,19 @@ type Command struct {
 	Dir         string    `json:"working_dir,omitempty"`
 	ExitCode    int      `json:"exit_code"`
 	ID          int      `json:"id"`
+	Name        string    `json:"name,omitempty"`
 	Tags        []string  `json:"tags,omitempty"`
 	Description string    `json:"description,omitempty"`
+	Shell       string    `json:"shell,omitempty"`      // Shell or interpreter, empty for the configured default
 	IsFavorite  bool     `json:"is_favorite"`
 	RunCount    int      `json:"run_count"`
 	SuccessCount int     `json:"success_count"`
+	UID         string    `json:"uid,omitempty"`        // Stable identity across machines
+	UpdatedAt   time.Time `json:"updated_at,omitempty"` // Last edit, used when merging synced copies
+	Origin      string    `json:"origin,omitempty"`     // Machine the command was first saved on
+	Version     int64     `json:"version,omitempty"`    // Store version of the last change
+	Annotations map[string]string `json:"annotations,omitempty"` // Set by hooks
+	Protected   bool      `json:"protected,omitempty"`  // Always confirm before running it again
 }
 
 type Statistics struct {
@@ -49,9 +58,13 @@ type ChainDependency struct {
 }
 
 type CommandCondition struct {
-    Type      string `json:"type"`      // "exit_code", "output_contains", "env_var"
-    Value     string `json:"value"`     // The value to check against
-    Operation string `json:"operation"` // "equals", "not_equals", "contains", "greater_than", etc.
+    Type      string `json:"type" yaml:"type" toml:"type"`                // See conditionOperations, or "any_of", "all_of", "not"
+    Value     string `json:"value,omitempty" yaml:"value,omitempty" toml:"value,omitempty"`             // The value to check against
+    Operation string `json:"operation,omitempty" yaml:"operation,omitempty" toml:"operation,omitempty"` // "equals", "not_equals", "contains", "greater_than", etc.
+    Conditions []CommandCondition `json:"conditions,omitempty" yaml:"conditions,omitempty" toml:"conditions,omitempty"` // Combined by "any_of", "all_of" and "not"
+    Timezone  string `json:"timezone,omitempty" yaml:"timezone,omitempty" toml:"timezone,omitempty"` // time_window: IANA name, default local time
+    Days      string `json:"days,omitempty" yaml:"days,omitempty" toml:"days,omitempty"`             // time_window: days the window starts on, e.g. "mon-fri"
+    Bounds    string `json:"bounds,omitempty" yaml:"bounds,omitempty" toml:"bounds,omitempty"`       // time_window: "[)" (default), "[]", "(]" or "()"
 }
 
 type ChainStep struct {
@@ -60,6 +73,9 @@ type ChainStep struct {
     ParallelWith []int            `json:"parallel_with,omitempty"` // Command IDs to run in parallel
     OnSuccess   []int            `json:"on_success,omitempty"`    // Command IDs to run if successful
     OnFailure   []int            `json:"on_failure,omitempty"`    // Command IDs to run if failed
+    Policy      string           `json:"policy,omitempty"`        // When parallel commands fail the step, see parallelPolicies
+    FailFast    bool             `json:"fail_fast,omitempty"`     // Stop parallel commands once the step has failed
+    Capture     []VariableCapture `json:"capture,omitempty"`      // Chain variables set from the main command's output
 }
 
 type CommandChain struct {
@@ -68,20 +84,57 @@ type CommandChain struct {
     Description string           `json:"description,omitempty"`
     Steps       []ChainStep      `json:"steps"`
     Dependencies []ChainDependency `json:"dependencies,omitempty"`
+    Vars        map[string]string `json:"vars,omitempty"`       // Default values of chain variables
     CreatedAt   time.Time        `json:"created_at"`
     LastRun     time.Time        `json:"last_run,omitempty"`
     SuccessRate float64          `json:"success_rate"`
     RunCount    int              `json:"run_count"`
+    UID         string           `json:"uid,omitempty"`
+    UpdatedAt   time.Time        `json:"updated_at,omitempty"`
+    Origin      string           `json:"origin,omitempty"`
+    Version     int64            `json:"version,omitempty"`
 }
 
 type CommandStore struct {
     filepath    string
     commands    []Command
     chains      []CommandChain
+    libraries   []Library
+    tombstones  []Tombstone
+    runs        []RunRecord
+    chainRuns   []ChainRunRecord
+    schedules   []Schedule
+    remoteCursors map[string]int64
     lastID      int
     lastChainID int
+    version     int64
     stats       Statistics
     editHistory []EditHistory
+
+    libraryCache []*loadedLibrary
+    fingerprints map[string]string // Record contents as of the last load/save
+    remote       *remoteClient     // Set when running against a --remote server
+    lastExitCode int               // Exit status of the last command run
+}
+
+// SaveData is the on-disk layout of the history file
+type SaveData struct {
+    Commands  []Command      `json:"commands"`
+    Chains    []CommandChain `json:"chains"`
+    Libraries []Library      `json:"libraries,omitempty"`
+    Tombstones []Tombstone   `json:"tombstones,omitempty"`
+    Runs      []RunRecord    `json:"runs,omitempty"`
+    ChainRuns []ChainRunRecord `json:"chain_runs,omitempty"`
+    Schedules []Schedule     `json:"schedules,omitempty"`
+    RemoteCursors map[string]int64 `json:"remote_cursors,omitempty"`
+}
+
+// Tombstone records a deletion so it can be propagated to other machines
+type Tombstone struct {
+    UID       string    `json:"uid"`
+    Kind      string    `json:"kind"` // "command" or "chain"
+    Version   int64     `json:"version"`
+    DeletedAt time.Time `json:"deleted_at"`
 }
 
 type EditHistory struct {
@@ -95,22 +148,9 @@ type ExecutionContext struct {
     LastExitCode int
     LastOutput   string
     ExecError    error
-}
-
-// Add method to validate commands
-func validateCommand(cmd string) error {
-    // Test if command is empty
-    if strings.TrimSpace(cmd) == "" {
-        return fmt.Errorf("command cannot be empty")
-    }
-
-    // Test if command can be parsed by shell
-    testCmd := exec.Command("sh", "-n", "-c", cmd)
-    if err := testCmd.Run(); err != nil {
-        return fmt.Errorf("invalid shell syntax: %v", err)
-    }
-
-    return nil
+    ChainID      int       // The running chain
+    PreviousRun  time.Time // Start of the chain's previous run, if any
+    Now          func() time.Time // Clock for time conditions; nil means time.Now
 }
 
 
@@ -128,6 +168,9 @@ func NewCommandStore() (*CommandStore, error) {
 		// For development builds, always append the history filename
 		configPath = filepath.Join(configPath, "history.json")
 	}
+	if config.HistoryPath != "" {
+		configPath = expandHome(config.HistoryPath)
+	}
 
 	return &CommandStore{
 		filepath: configPath,
@@ -136,22 +179,57 @@ func NewCommandStore() (*CommandStore, error) {
 }
 
 func (cs *CommandStore) save() error {
-    // Create a structure to hold both commands and chains
-    type SaveData struct {
-        Commands []Command      `json:"commands"`
-        Chains   []CommandChain `json:"chains"`
-    }
-    
+    cs.stampChanges()
+
     data := SaveData{
-        Commands: cs.commands,
-        Chains:   cs.chains,
+        Commands:  cs.commands,
+        Chains:    cs.chains,
+        Libraries: cs.libraries,
+        Tombstones: cs.tombstones,
+        Runs:      cs.runs,
+        ChainRuns: cs.chainRuns,
+        Schedules: cs.schedules,
+        RemoteCursors: cs.remoteCursors,
     }
     
     jsonData, err := json.MarshalIndent(data, "", "    ")
     if err != nil {
         return err
     }
-    return os.WriteFile(cs.filepath, jsonData, 0644)
+    if err := writeFileAtomic(cs.filepath, jsonData, 0644); err != nil {
+        return err
+    }
+    cs.snapshotRecords()
+    if err := cs.backupIfDue(time.Now()); err != nil {
+        fmt.Fprintf(os.Stderr, "Warning: automatic backup failed: %v\n", err)
+    }
+    if cs.remote != nil {
+        return cs.remote.Push(cs)
+    }
+    return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it over path, so that other processes never read a half-written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+    f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+    if err != nil {
+        return err
+    }
+    _, err = f.Write(data)
+    if closeErr := f.Close(); err == nil {
+        err = closeErr
+    }
+    if err == nil {
+        err = os.Chmod(f.Name(), perm)
+    }
+    if err == nil {
+        err = os.Rename(f.Name(), path)
+    }
+    if err != nil {
+        os.Remove(f.Name())
+    }
+    return err
 }
 
 // Add method for tag manipulation
@@ -217,12 +295,27 @@ func (cs *CommandStore) InteractiveEdit(id int) error {
     reader := bufio.NewReader(os.Stdin)
 
     fmt.Printf("\nInteractive Command Editor\n")
+    fmt.Printf("Current shell: %s\n", effectiveShell(cmd.Shell))
+    fmt.Print("Enter new shell (or press Enter to keep current): ")
+    if input, err := reader.ReadString('\n'); err == nil {
+        input = strings.TrimSpace(input)
+        if input != "" {
+            if err := checkShell(input); err != nil {
+                return err
+            }
+            if err := validateScript(input, cmd.Raw); err != nil {
+                return fmt.Errorf("command is not valid for %s: %v", input, err)
+            }
+            cmd.Shell = input
+        }
+    }
+
     fmt.Printf("Current command: %s\n", cmd.Raw)
     fmt.Print("Enter new command (or press Enter to keep current): ")
     if input, err := reader.ReadString('\n'); err == nil {
         input = strings.TrimSpace(input)
         if input != "" {
-            if err := validateCommand(input); err != nil {
+            if err := validateScript(cmd.Shell, input); err != nil {
                 return fmt.Errorf("invalid command: %v", err)
             }
             cmd.Raw = input
@@ -325,12 +418,6 @@ func (cs *CommandStore) load() error {
         return err
     }
 
-    // Create a structure to hold both commands and chains
-    type SaveData struct {
-        Commands []Command      `json:"commands"`
-        Chains   []CommandChain `json:"chains"`
-    }
-
     var saveData SaveData
     if err := json.Unmarshal(data, &saveData); err != nil {
         // Try loading legacy format (just commands)
@@ -340,6 +427,12 @@ func (cs *CommandStore) load() error {
     } else {
         cs.commands = saveData.Commands
         cs.chains = saveData.Chains
+        cs.libraries = saveData.Libraries
+        cs.tombstones = saveData.Tombstones
+        cs.runs = saveData.Runs
+        cs.chainRuns = saveData.ChainRuns
+        cs.schedules = saveData.Schedules
+        cs.remoteCursors = saveData.RemoteCursors
     }
 
     // Update lastID and lastChainID
@@ -354,7 +447,19 @@ func (cs *CommandStore) load() error {
         }
     }
 
+    // The store version is the newest change it has seen
+    for _, cmd := range cs.commands {
+        cs.version = max(cs.version, cmd.Version)
+    }
+    for _, chain := range cs.chains {
+        cs.version = max(cs.version, chain.Version)
+    }
+    for _, t := range cs.tombstones {
+        cs.version = max(cs.version, t.Version)
+    }
+
     cs.updateStats()
+    cs.snapshotRecords()
     return nil
 }
 
@@ -459,7 +564,9 @@ func getTopKeys(m map[string]int, n int) []string {
 	return result
 }
 
-func (cs *CommandStore) Execute(cmdString string, saveDir bool, tags []string, description string, existingID int) error {
+// Execute runs cmdString with shell ("" for the configured default) and
+// args, recording the run against existingID or as a new command.
+func (cs *CommandStore) Execute(cmdString, shell string, args []string, saveDir bool, tags []string, description string, existingID int) error {
     var dir string
     if saveDir {
         var err error
@@ -469,34 +576,67 @@ func (cs *CommandStore) Execute(cmdString string, saveDir bool, tags []string, d
         }
     }
 
-    cmd := exec.Command("sh", "-c", cmdString)
+    cmd, err := buildCommand(shell, cmdString, args)
+    if err != nil {
+        return err
+    }
     cmd.Stdout = os.Stdout
     cmd.Stderr = os.Stderr
     cmd.Stdin = os.Stdin
 
-    err := cmd.Run()
+    // Saved commands may need typed confirmation; one typed in just now
+    // only without a terminal, when it can't have been typed
+    if existing := cs.findCommand(existingID); existing != nil {
+        if err := confirmCommand(*existing, args); err != nil {
+            return err
+        }
+    } else if !isTerminal(os.Stdin) {
+        if err := confirmCommand(Command{Raw: cmdString, Shell: shell}, args); err != nil {
+            return err
+        }
+    }
+
+    // Hooks see the command as it will run, before redaction
+    event := newHookEvent(hookBeforeExecute, Command{Raw: cmdString, Shell: shell, Tags: tags})
+    if existing := cs.findCommand(existingID); existing != nil {
+        event = newHookEvent(hookBeforeExecute, *existing)
+    }
+    if _, err := runHooks(event); err != nil {
+        return fmt.Errorf("not running the command: %w", err)
+    }
+
+    start := time.Now()
+    err = cmd.Run()
+    duration := time.Since(start)
     exitCode := 0
     if err != nil {
         if exitError, ok := err.(*exec.ExitError); ok {
             exitCode = exitError.ExitCode()
         }
     }
+    cs.lastExitCode = exitCode
+    event.Event = hookAfterExecute
+    annotations, _ := runHooks(event.withResult(exitCode, duration))
 
     if existingID > 0 {
         // Update existing command stats
+        if existing := cs.findCommand(existingID); existing != nil {
+            existing.annotate(annotations)
+            cs.recordRun(*existing, exitCode, start, duration)
+            notifyCommandRun(*existing, exitCode, start, duration)
+        }
         return cs.updateCommandStats(existingID, exitCode)
     }
 
     // Create new command
-    cs.lastID++
     command := Command{
-        Raw:         cmdString,
+        Raw:         config.redactCommand(cmdString),
         Timestamp:   time.Now(),
         Dir:         dir,
         ExitCode:    exitCode,
-        ID:          cs.lastID,
         Tags:        tags,
         Description: description,
+        Shell:       shell,
         RunCount:    1,
         SuccessCount: func() int {
             if exitCode == 0 {
@@ -505,8 +645,24 @@ func (cs *CommandStore) Execute(cmdString string, saveDir bool, tags []string, d
             return 0
         }(),
     }
+    command.annotate(annotations)
+
+    // Hooks can keep a command out of the history; it ran all the same
+    saveEvent := newHookEvent(hookBeforeSave, command)
+    reply, err := runHooks(saveEvent.withResult(exitCode, duration))
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Not saving the command: %v\n", err)
+        notifyCommandRun(command, exitCode, start, duration)
+        return nil
+    }
+    command.annotate(reply)
+    cs.lastID++
+    command.ID = cs.lastID
 
     cs.commands = append(cs.commands, command)
+    cs.recordRun(command, exitCode, start, duration)
+    notifyCommandRun(command, exitCode, start, duration)
+    cs.applyRetention(time.Now())
     cs.updateStats()
     return cs.save()
 }
@@ -529,6 +685,20 @@ func (cs *CommandStore) ImportCommands(filename string) error {
         // Update ID to avoid conflicts
         cs.lastID++
         cmd.ID = cs.lastID
+
+        // Importing the same export twice must not duplicate identities
+        for _, existing := range cs.commands {
+            if cmd.UID != "" && existing.UID == cmd.UID {
+                cmd.UID = ""
+                break
+            }
+        }
+
+        // Names must stay unique, existing commands keep theirs
+        if cmd.Name != "" && (validateName(cmd.Name) != nil || cs.findCommandByName(cmd.Name) != nil) {
+            fmt.Fprintf(os.Stderr, "Warning: name '%s' is invalid or already in use, imported as #%d without a name\n", cmd.Name, cmd.ID)
+            cmd.Name = ""
+        }
         cs.commands = append(cs.commands, cmd)
     }
 
@@ -547,6 +717,16 @@ func (cs *CommandStore) SetFavorite(id int, favorite bool) error {
 	return fmt.Errorf("command with ID %d not found", id)
 }
 
+func (cs *CommandStore) SetProtected(id int, protected bool) error {
+	for i := range cs.commands {
+		if cs.commands[i].ID == id {
+			cs.commands[i].Protected = protected
+			return cs.save()
+		}
+	}
+	return fmt.Errorf("command with ID %d not found", id)
+}
+
 func (cs *CommandStore) AddTags(id int, tags []string) error {
 	for i := range cs.commands {
 		if cs.commands[i].ID == id {
@@ -582,7 +762,7 @@ func (cs *CommandStore) GetStats() Statistics {
 }
 
 // Add methods for advanced chain execution
-func (cs *CommandStore) ExecuteChainWithDependencies(chainID int) error {
+func (cs *CommandStore) ExecuteChainWithDependencies(chainID int, opts ChainRunOptions) error {
     var chain *CommandChain
     for i := range cs.chains {
         if cs.chains[i].ID == chainID {
@@ -593,12 +773,27 @@ func (cs *CommandStore) ExecuteChainWithDependencies(chainID int) error {
     if chain == nil {
         return fmt.Errorf("chain with ID %d not found", chainID)
     }
+    // A cycle saved before cycles were rejected must not recurse forever
+    if slices.Contains(opts.dependents, chainID) {
+        return fmt.Errorf("chain %s depends on itself through its dependencies", chainLabel(chain))
+    }
+    // Dangerous steps of the chain and all its dependencies are confirmed
+    // together, before anything runs
+    if err := cs.confirmChain(chain, opts); err != nil {
+        return err
+    }
+    opts.Confirmed = true
+    depOpts := opts
+    depOpts.dependents = append(slices.Clone(opts.dependents), chainID)
 
-    // Check and execute dependencies first
+    // Check and execute dependencies first, unless only some steps run
     for _, dep := range chain.Dependencies {
+        if opts.selectsSteps() {
+            break
+        }
         if dep.WaitPolicy == "all" {
             for _, depChainID := range dep.DependsOn {
-                if err := cs.ExecuteChainWithDependencies(depChainID); err != nil {
+                if err := cs.ExecuteChainWithDependencies(depChainID, depOpts); err != nil {
                     return fmt.Errorf("dependency chain %d failed: %v", depChainID, err)
                 }
             }
@@ -606,7 +801,7 @@ func (cs *CommandStore) ExecuteChainWithDependencies(chainID int) error {
             depSuccess := false
             var lastErr error
             for _, depChainID := range dep.DependsOn {
-                if err := cs.ExecuteChainWithDependencies(depChainID); err == nil {
+                if err := cs.ExecuteChainWithDependencies(depChainID, depOpts); err == nil {
                     depSuccess = true
                     break
                 } else {
@@ -619,17 +814,84 @@ func (cs *CommandStore) ExecuteChainWithDependencies(chainID int) error {
         }
     }
 
-    return cs.executeChainSteps(chain)
+    return cs.executeChainSteps(chain, opts)
 }
 
-func (cs *CommandStore) executeChainSteps(chain *CommandChain) error {
-    // Create a wait group for parallel execution
-    var wg sync.WaitGroup
-    results := make(map[int]error)
-    var resultsMutex sync.Mutex
+func (cs *CommandStore) executeChainSteps(chain *CommandChain, opts ChainRunOptions) error {
+    if _, _, err := stepRange(chain, opts); err != nil {
+        return err
+    }
+    // Resumed runs are confirmed here, other runs already were
+    if err := cs.confirmChain(chain, opts); err != nil {
+        return err
+    }
+    run := &ChainRunRecord{ID: cs.nextChainRunID(), ChainID: chain.ID, Chain: chain.Name, StartedAt: time.Now(), Running: true}
+    err := cs.runChainSteps(chain, run, opts)
+    if saveErr := cs.finishChainRun(chain, run, err); err == nil {
+        err = saveErr
+    }
+    printChainRunReport(run)
+    notifyChainRun(run)
+    return err
+}
+
+func (cs *CommandStore) runChainSteps(chain *CommandChain, run *ChainRunRecord, opts ChainRunOptions) error {
+    var stepIndex int
+    // Conditions see the result of the previous step's main command
+    execContext := &ExecutionContext{ChainID: chain.ID}
+    if previous := cs.lastChainRun(chain.ID); previous != nil {
+        execContext.PreviousRun = previous.StartedAt
+    }
+    // Chain variables: the chain's defaults, then those of a resumed run,
+    // then --var, then captures
+    vars := make(map[string]string)
+    maps.Copy(vars, chain.Vars)
+    if resume := opts.Resume; resume != nil {
+        maps.Copy(vars, resume.Vars)
+        run.ResumedRun = resume.ID
+        execContext.LastExitCode = resume.Checkpoint.ExitCode
+        execContext.LastOutput = resume.Checkpoint.Output
+        if opts.MarkFixed {
+            // The fixed step counts as having succeeded without output
+            run.FixedStep = resume.Checkpoint.NextStep + 1
+            execContext.LastExitCode, execContext.LastOutput = 0, ""
+        }
+    }
+    maps.Copy(vars, opts.Vars)
+    run.Vars = vars
+    first, last, err := stepRange(chain, opts)
+    if err != nil {
+        return err
+    }
+    setContext := func(output string, err error) {
+        execContext.LastExitCode = stepExitCode(err)
+        execContext.LastOutput = output
+        execContext.ExecError = err
+    }
+    // Captures read the stdout of the step's main command; conditions see
+    // its stderr as well
+    var mainStdout string
+
+    // Hooks hear about each finished step and can stop the chain after it;
+    // what they annotate is the step's command
+    stepDone := func(cmdID, exitCode int, duration time.Duration) error {
+        cmd := cs.findCommand(cmdID)
+        if cmd == nil || len(config.Hooks) == 0 {
+            return nil
+        }
+        event := newHookEvent(hookChainStepDone, *cmd).withResult(exitCode, duration)
+        event.ChainID, event.Chain, event.Step = chain.ID, chain.Name, stepIndex+1
+        reply, err := runHooks(event)
+        if err != nil {
+            return fmt.Errorf("chain stopped after step %d: %w", stepIndex+1, err)
+        }
+        cmd.annotate(reply)
+        return nil
+    }
 
-    // Helper function to execute a single command
-    executeCmd := func(cmdID int) error {
+    // Helper function to execute a single command, with env added to its
+    // environment
+    executeCmd := func(cmdID int, role string, env ...string) error {
         var cmd *Command
         for i := range cs.commands {
             if cs.commands[i].ID == cmdID {
@@ -641,84 +903,121 @@ func (cs *CommandStore) executeChainSteps(chain *CommandChain) error {
             return fmt.Errorf("command with ID %d not found", cmdID)
         }
 
-        execCmd := exec.Command("sh", "-c", cmd.Raw)
-        // Either use the output
-        output, err := execCmd.CombinedOutput()
+        text, missing := expandVars(cmd.Raw, vars)
+        warnMissingVars(stepIndex, missing)
+        execCmd, err := buildCommand(cmd.Shell, text, nil)
+        if err != nil {
+            return err
+        }
+        if env = append(varEnv(vars), env...); len(env) > 0 {
+            execCmd.Env = append(os.Environ(), env...)
+        }
+        var stepOpts stepOptions
+        if role == "main" && len(chain.Steps[stepIndex].Capture) > 0 {
+            stepOpts.stdout = &tailBuffer{max: maxCapturedOutput}
+        }
+        start := time.Now()
+        output, err := runStep(execCmd, stepOpts)
+        cs.recordStepRun(run, stepIndex, role, *cmd, err, output, start, time.Since(start))
+        if role == "main" {
+            setContext(output, err)
+            if stepOpts.stdout != nil {
+                mainStdout = normalizeNewlines(stepOpts.stdout.String())
+            }
+        }
         if err != nil {
-            return fmt.Errorf("command failed with output: %s: %v", output, err)
+            return fmt.Errorf("command %d failed: %v", cmdID, err)
         }
         return nil
     }
 
     // Execute steps
-    for _, step := range chain.Steps {
+    for i, step := range chain.Steps {
+        if i < first || i > last {
+            continue
+        }
+        stepIndex = i
+        cs.checkpointChainRun(run, i, execContext)
         // Check conditions before executing
-        execContext := &ExecutionContext{}
-		if !cs.evaluateConditions(step.Conditions, execContext) {
+		if !cs.evaluateConditions(expandConditions(step.Conditions, vars), execContext) {
             continue
         }
 
         // Handle parallel execution
         if len(step.ParallelWith) > 0 {
             // Execute main command and parallel commands concurrently
-            wg.Add(1 + len(step.ParallelWith))
-            
-            // Execute main command
-            go func(cmdID int) {
-                defer wg.Done()
-                if err := executeCmd(cmdID); err != nil {
-                    resultsMutex.Lock()
-                    results[cmdID] = err
-                    resultsMutex.Unlock()
-                }
-            }(step.CommandID)
-
-            // Execute parallel commands
-            for _, parallelCmdID := range step.ParallelWith {
-                go func(cmdID int) {
-                    defer wg.Done()
-                    if err := executeCmd(cmdID); err != nil {
-                        resultsMutex.Lock()
-                        results[cmdID] = err
-                        resultsMutex.Unlock()
-                    }
-                }(parallelCmdID)
+            branches, err := cs.runParallelStep(run, i, step, vars, opts)
+            if err != nil {
+                return err
+            }
+            main := branches[0]
+            setContext(main.Output, main.Err)
+            failures := stepFailures(stepPolicy(step), branches)
+            if err := stepDone(step.CommandID, main.ExitCode, main.Duration); err != nil && failures == nil {
+                return err
             }
 
-            wg.Wait()
-
-            // Check results
-            if err, ok := results[step.CommandID]; ok {
-                // Main command failed, execute OnFailure commands
+            // Check results against the step's policy
+            if failures != nil {
+                // Execute OnFailure commands, telling them what failed
+                env := failureEnv(i, failures)
                 for _, failureCmdID := range step.OnFailure {
-                    if err := executeCmd(failureCmdID); err != nil {
+                    if err := executeCmd(failureCmdID, "on_failure", env...); err != nil {
                         return fmt.Errorf("failure handler command %d failed: %v", failureCmdID, err)
                     }
                 }
-                return fmt.Errorf("main command %d failed: %v", step.CommandID, err)
+                return fmt.Errorf("step %d failed (%s): %s", i+1, stepPolicy(step), describeFailures(failures))
+            }
+            for _, b := range branches {
+                if b.State == branchFailed {
+                    fmt.Fprintf(os.Stderr, "Warning: step %d: %s exited %d, ignored by the %s policy\n", i+1, b.Label, b.ExitCode, stepPolicy(step))
+                }
+            }
+            if main.Err == nil {
+                if err := captureVars(i, step.Capture, main.Stdout, vars); err != nil {
+                    return err
+                }
             }
 
             // Execute OnSuccess commands
             for _, successCmdID := range step.OnSuccess {
-                if err := executeCmd(successCmdID); err != nil {
+                if err := executeCmd(successCmdID, "on_success"); err != nil {
                     return fmt.Errorf("success handler command %d failed: %v", successCmdID, err)
                 }
             }
         } else {
             // Sequential execution
-            if err := executeCmd(step.CommandID); err != nil {
+            start := time.Now()
+            err := executeCmd(step.CommandID, "main")
+            if doneErr := stepDone(step.CommandID, execContext.LastExitCode, time.Since(start)); doneErr != nil && err == nil {
+                return doneErr
+            }
+            if err != nil {
                 // Execute OnFailure commands
+                var env []string
+                if cmd := cs.findCommand(step.CommandID); cmd != nil {
+                    env = failureEnv(i, []*branchResult{{
+                        Role:     "main",
+                        Command:  *cmd,
+                        Label:    stepLabel(*cmd),
+                        State:    branchFailed,
+                        ExitCode: execContext.LastExitCode,
+                    }})
+                }
                 for _, failureCmdID := range step.OnFailure {
-                    if err := executeCmd(failureCmdID); err != nil {
+                    if err := executeCmd(failureCmdID, "on_failure", env...); err != nil {
                         return fmt.Errorf("failure handler command %d failed: %v", failureCmdID, err)
                     }
                 }
                 return err
             }
+            if err := captureVars(i, step.Capture, mainStdout, vars); err != nil {
+                return err
+            }
 
             // Execute OnSuccess commands
             for _, successCmdID := range step.OnSuccess {
-                if err := executeCmd(successCmdID); err != nil {
+                if err := executeCmd(successCmdID, "on_success"); err != nil {
                     return fmt.Errorf("success handler command %d failed: %v", successCmdID, err)
                 }
             }
@@ -728,255 +1027,6 @@ func (cs *CommandStore) executeChainSteps(chain *CommandChain) error {
     return nil
 }
 
-func (cs *CommandStore) evaluateConditions(conditions []CommandCondition, context *ExecutionContext) bool {
-    if len(conditions) == 0 {
-        return true
-    }
-
-    for _, cond := range conditions {
-        satisfied := false
-
-        switch cond.Type {
-        case "exit_code":
-            exitCode, err := strconv.Atoi(cond.Value)
-            if err != nil {
-                fmt.Fprintf(os.Stderr, "Warning: invalid exit code value '%s', condition will fail\n", cond.Value)
-                return false
-            }
-
-            switch cond.Operation {
-            case "equals":
-                satisfied = context.LastExitCode == exitCode
-            case "not_equals":
-                satisfied = context.LastExitCode != exitCode
-            case "less_than":
-                satisfied = context.LastExitCode < exitCode
-            case "greater_than":
-                satisfied = context.LastExitCode > exitCode
-            case "less_equals":
-                satisfied = context.LastExitCode <= exitCode
-            case "greater_equals":
-                satisfied = context.LastExitCode >= exitCode
-            default:
-                fmt.Fprintf(os.Stderr, "Warning: unknown operation '%s' for exit_code condition\n", cond.Operation)
-                return false
-            }
-
-        case "output_contains":
-            switch cond.Operation {
-            case "contains":
-                satisfied = strings.Contains(context.LastOutput, cond.Value)
-            case "not_contains":
-                satisfied = !strings.Contains(context.LastOutput, cond.Value)
-            case "starts_with":
-                satisfied = strings.HasPrefix(context.LastOutput, cond.Value)
-            case "ends_with":
-                satisfied = strings.HasSuffix(context.LastOutput, cond.Value)
-            case "matches":
-                matched, err := regexp.MatchString(cond.Value, context.LastOutput)
-                if err != nil {
-                    fmt.Fprintf(os.Stderr, "Warning: invalid regex pattern '%s': %v\n", cond.Value, err)
-                    return false
-                }
-                satisfied = matched
-            default:
-                fmt.Fprintf(os.Stderr, "Warning: unknown operation '%s' for output_contains condition\n", cond.Operation)
-                return false
-            }
-
-        case "env_var":
-            envValue := os.Getenv(cond.Value)
-            
-            switch cond.Operation {
-            case "exists":
-                satisfied = envValue != ""
-            case "not_exists":
-                satisfied = envValue == ""
-            case "equals":
-                parts := strings.SplitN(cond.Value, "=", 2)
-                if len(parts) != 2 {
-                    fmt.Fprintf(os.Stderr, "Warning: invalid env_var condition format, expected KEY=VALUE\n")
-                    return false
-                }
-                satisfied = os.Getenv(parts[0]) == parts[1]
-            case "contains":
-                parts := strings.SplitN(cond.Value, "=", 2)
-                if len(parts) != 2 {
-                    fmt.Fprintf(os.Stderr, "Warning: invalid env_var condition format, expected KEY=VALUE\n")
-                    return false
-                }
-                satisfied = strings.Contains(os.Getenv(parts[0]), parts[1])
-            default:
-                fmt.Fprintf(os.Stderr, "Warning: unknown operation '%s' for env_var condition\n", cond.Operation)
-                return false
-            }
-
-        case "time_window":
-            // Format: "HH:MM-HH:MM"
-            timeRange := strings.Split(cond.Value, "-")
-            if len(timeRange) != 2 {
-                fmt.Fprintf(os.Stderr, "Warning: invalid time window format, expected HH:MM-HH:MM\n")
-                return false
-            }
-
-            now := time.Now()
-            start, err := time.Parse("15:04", timeRange[0])
-            if err != nil {
-                fmt.Fprintf(os.Stderr, "Warning: invalid start time format: %v\n", err)
-                return false
-            }
-
-            end, err := time.Parse("15:04", timeRange[1])
-            if err != nil {
-                fmt.Fprintf(os.Stderr, "Warning: invalid end time format: %v\n", err)
-                return false
-            }
-
-            // Adjust times to today
-            start = time.Date(now.Year(), now.Month(), now.Day(), start.Hour(), start.Minute(), 0, 0, now.Location())
-            end = time.Date(now.Year(), now.Month(), now.Day(), end.Hour(), end.Minute(), 0, 0, now.Location())
-
-            switch cond.Operation {
-            case "within":
-                satisfied = now.After(start) && now.Before(end)
-            case "outside":
-                satisfied = now.Before(start) || now.After(end)
-            default:
-                fmt.Fprintf(os.Stderr, "Warning: unknown operation '%s' for time_window condition\n", cond.Operation)
-                return false
-            }
-
-        case "file_exists":
-            switch cond.Operation {
-            case "exists":
-                _, err := os.Stat(cond.Value)
-                satisfied = err == nil
-            case "not_exists":
-                _, err := os.Stat(cond.Value)
-                satisfied = os.IsNotExist(err)
-            default:
-                fmt.Fprintf(os.Stderr, "Warning: unknown operation '%s' for file_exists condition\n", cond.Operation)
-                return false
-            }
-
-        default:
-            fmt.Fprintf(os.Stderr, "Warning: unknown condition type '%s'\n", cond.Type)
-            return false
-        }
-
-        if !satisfied {
-            return false
-        }
-    }
-
-    return true
-}
-
-
-// Generate shell completion scripts
-func generateShellCompletion(shell string) string {
-	switch shell {
-	case "bash":
-		return `
-_save_completion() {
-    local cur prev opts
-    COMPREPLY=()
-    cur="${COMP_WORDS[COMP_CWORD]}"
-    prev="${COMP_WORDS[COMP_CWORD-1]}"
-    opts="--dir --list --search --filter-dir --filter-tag --export --import --rerun --tag --desc --favorite --stats --remove --interactive-edit --add-tags --remove-tags --undo --create-chain --create-chain-with-deps --run-chain --list-chains --help --config-path"
-
-    case "${prev}" in
-        --rerun|--favorite|--remove|--interactive-edit|--undo)
-            # Complete with command IDs
-            COMPREPLY=( $(save --list | grep "^#" | cut -d" " -f1 | cut -c2- | grep "^${cur}") )
-            return 0
-            ;;
-        --tag|--add-tags|--remove-tags|--filter-tag)
-            # Complete with existing tags
-            COMPREPLY=( $(save --list-tags | grep "^${cur}") )
-            return 0
-            ;;
-        --filter-dir)
-            # Directory completion
-            COMPREPLY=( $(compgen -d -- "${cur}") )
-            return 0
-            ;;
-        --run-chain)
-            # Complete with chain IDs
-            COMPREPLY=( $(save --list-chains | grep "^#" | cut -d" " -f1 | cut -c2- | grep "^${cur}") )
-            return 0
-            ;;
-        *)
-            COMPREPLY=( $(compgen -W "${opts}" -- ${cur}) )
-            return 0
-            ;;
-    esac
-}
-
-complete -F _save_completion save`
-
-	case "zsh":
-		return `
-#compdef save
-
-_save() {
-    local -a opts
-    opts=(
-        '--dir[Save with directory]'
-        '--list[List commands]'
-        '--search[Search commands]'
-        '--filter-dir[Filter by directory]'
-        '--filter-tag[Filter by tag]'
-        '--export[Export history]'
-        '--import[Import commands]'
-        '--rerun[Re-run command]'
-        '--tag[Add tags]'
-        '--desc[Add description]'
-        '--favorite[Mark as favorite]'
-        '--stats[Show statistics]'
-        '--remove[Remove command(s)]'
-        '--interactive-edit[Edit command interactively]'
-        '--add-tags[Add tags to command]'
-        '--remove-tags[Remove tags from command]'
-        '--undo[Undo last edit]'
-        '--create-chain[Create new command chain]'
-        '--create-chain-with-deps[Create chain with dependencies]'
-        '--run-chain[Run a command chain]'
-        '--list-chains[List all chains]'
-        '--help[Show help]'
-        '--config-path[Show config file location]'
-    )
-
-    _arguments -C \
-        "${opts[@]}" \
-        "*::arg:->args"
-
-    case $state in
-        args)
-            case $words[1] in
-                --rerun|--favorite|--remove|--interactive-edit|--undo)
-                    _values "command IDs" $(save --list | grep "^#" | cut -d" " -f1 | cut -c2-)
-                    ;;
-                --tag|--add-tags|--remove-tags|--filter-tag)
-                    _values "tags" $(save --list-tags)
-                    ;;
-                --filter-dir)
-                    _path_files -/
-                    ;;
-                --run-chain)
-                    _values "chain IDs" $(save --list-chains | grep "^#" | cut -d" " -f1 | cut -c2-)
-                    ;;
-            esac
-            ;;
-    esac
-}
-
-_save`
-
-	default:
-		return ""
-	}
-}
 
 func containsTag(tags []string, query string) bool {
     query = strings.ToLower(query)
@@ -991,33 +1041,6 @@ func containsTag(tags []string, query string) bool {
 var Version string // This will be set during build
 var ConfigPath string // This will be set during build
 
-// Add this function at the top level to maintain a list of valid command flags
-var validCommandFlags = map[string]bool{
-    "--favorite": true,
-    "--remove": true,
-    "--list": true,
-    "--search": true,
-    "--filter-dir": true,
-    "--filter-tag": true,
-    "--stats": true,
-    "--rerun": true,
-    "--interactive-edit": true,
-    "--add-tags": true,
-    "--remove-tags": true,
-    "--undo": true,
-    "--import": true,
-    "--export": true,
-    "--create-chain": true,
-    "--run-chain": true,
-    "--list-chains": true,
-    "--help": true,
-    "--config-path": true,
-    "--version": true,
-    "--install-completion": true,
-    "--verify": true,
-    "--backup": true,
-}
-
 // Add these new types for backup management
 type BackupMetadata struct {
     Version     string    `json:"version"`
@@ -1066,7 +1089,7 @@ func (cs *CommandStore) createBackup(backupPath string) error {
         return fmt.Errorf("failed to write backup file: %w", err)
     }
 
-    return nil
+    return cs.pruneBackups()
 }
 
 func (cs *CommandStore) restoreFromBackup(backupPath string) error {
@@ -1115,6 +1138,18 @@ func (cs *CommandStore) verifyIntegrity() error {
         idMap[cmd.ID] = true
     }
 
+    // Check command names
+    nameMap := make(map[string]int)
+    for _, cmd := range cs.commands {
+        if cmd.Name == "" {
+            continue
+        }
+        if otherID, ok := nameMap[cmd.Name]; ok {
+            return fmt.Errorf("duplicate command name '%s' used by %d and %d", cmd.Name, otherID, cmd.ID)
+        }
+        nameMap[cmd.Name] = cmd.ID
+    }
+
     // Check chain IDs
     chainMap := make(map[int]bool)
     for _, chain := range cs.chains {
@@ -1176,6 +1211,19 @@ func (cs *CommandStore) repairIntegrity() error {
     }
     cs.commands = newCommands
 
+    // Clear duplicate command names (keep the first occurrence)
+    nameMap := make(map[string]bool)
+    for i := range cs.commands {
+        if cs.commands[i].Name == "" {
+            continue
+        }
+        if nameMap[cs.commands[i].Name] {
+            cs.commands[i].Name = ""
+            continue
+        }
+        nameMap[cs.commands[i].Name] = true
+    }
+
     // Remove chains with duplicate IDs
     chainMap := make(map[int]bool)
     newChains := make([]CommandChain, 0, len(cs.chains))
@@ -1248,7 +1296,7 @@ func (cs *CommandStore) printCommandDetails(cmd Command) {
         workDir = "Current directory"
     }
     
-    fmt.Printf("#%d: %s\n", cmd.ID, cmd.Raw)
+    fmt.Printf("%s: %s\n", commandLabel(cmd), cmd.Raw)
     fmt.Printf("   📝 %s\n", description)
     fmt.Printf("   📂 %s\n", workDir)
     if len(cmd.Tags) > 0 {
@@ -1267,9 +1315,73 @@ func calculateSuccessRate(total, success int) float64 {
 }
 
 func main() {
+	cfg, configErr := loadConfig()
+	config = cfg
+
+	// Global options come before the command: save --remote <url> --output json --list
+	remoteURL := os.Getenv("SAVE_REMOTE")
+	var format, tmpl string
+globalOptions:
+	for len(os.Args) > 2 {
+		if os.Args[1] == "--no-color" {
+			config.Color = "never"
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+			continue
+		}
+		switch os.Args[1] {
+		case "--remote":
+			remoteURL = os.Args[2]
+		case "--output", "-o":
+			format = os.Args[2]
+		case "--format":
+			tmpl = os.Args[2]
+		default:
+			break globalOptions
+		}
+		os.Args = append(os.Args[:1], os.Args[3:]...)
+	}
+
 	if len(os.Args) < 2 {
 		printUsage()
-		os.Exit(1)
+		os.Exit(exitUsage)
+	}
+
+	// Subcommands translate to the equivalent flag form handled below
+	if sub := findSubcommand(os.Args[1]); sub != nil {
+		os.Args = append(os.Args[:1], sub.translate(os.Args[2:])...)
+	}
+	// A broken config file must not stop you from fixing it
+	if configErr != nil {
+		if os.Args[1] != "--config" {
+			fmt.Fprintf(os.Stderr, "Error in configuration: %v\n", configErr)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", configErr)
+	}
+
+	// Read commands also take --output and --format after the command
+	if readCommands[os.Args[1]] {
+		rest, f, t, err := extractOutputOptions(os.Args[2:])
+		if err != nil {
+			usageError("", "%v", err)
+		}
+		os.Args = append(os.Args[:2], rest...)
+		if f != "" {
+			format = f
+		}
+		if t != "" {
+			tmpl = t
+		}
+	} else if format != "" || tmpl != "" {
+		usageError("", "--output and --format are not supported by %s", os.Args[1])
+	}
+	// The configured format applies unless a flag picks one; --stats --json
+	// is such a flag too
+	if readCommands[os.Args[1]] && format == "" && tmpl == "" && !slices.Contains(os.Args[2:], "--json") {
+		format = config.Output
+	}
+	if err := setOutputFormat(format, tmpl); err != nil {
+		usageError(fmt.Sprintf("save [--output %s] [--format '<template>'] <command>", strings.Join(outputFormats, "|")), "%v", err)
 	}
 
 	store, err := NewCommandStore()
@@ -1283,67 +1395,174 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Other subcommands may be plugins: save-<name> executables on PATH.
+	// A saved command or chain of the same name runs instead.
+	if plugin := findPlugin(os.Args[1]); plugin != "" {
+		if args := store.savedRunArgs(os.Args[1], os.Args[2:]); args != nil {
+			os.Args = append(os.Args[:1], args...)
+		} else {
+			code, err := runPlugin(plugin, os.Args[2:])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error running plugin %s: %v\n", plugin, err)
+				os.Exit(1)
+			}
+			os.Exit(code)
+		}
+	}
+
+	// Completion reads the local copy; a network round trip per key press
+	// would make it unusable
+	if remoteURL != "" && os.Args[1] != "--serve" && os.Args[1] != "__complete" {
+		remote := newRemoteClient(remoteURL, os.Getenv("SAVE_REMOTE_TOKEN"))
+		if err := remote.Pull(store); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to pull from %s: %v\n", remoteURL, err)
+			os.Exit(1)
+		}
+		store.remote = remote
+	}
+
 	switch os.Args[1] {
 	case "--generate-completion":
 		if len(os.Args) != 3 {
-			fmt.Println("Usage: save --generate-completion <shell>")
-			os.Exit(1)
+			usageError("save --generate-completion <bash|zsh|fish|powershell>", "--generate-completion requires a shell name")
+		}
+		script := generateShellCompletion(os.Args[2])
+		if script == "" {
+			usageError("save --generate-completion <bash|zsh|fish|powershell>", "unsupported shell '%s'", os.Args[2])
+		}
+		fmt.Print(script)
+
+	case "__complete":
+		// Called by the completion scripts: save __complete <position> <words...>
+		if len(os.Args) < 3 {
+			usageError("save __complete <position> [words...]", "missing position")
+		}
+		position, err := strconv.Atoi(os.Args[2])
+		if err != nil {
+			usageError("save __complete <position> [words...]", "invalid position '%s'", os.Args[2])
 		}
-		fmt.Println(generateShellCompletion(os.Args[2]))
+		printCompletions(store.Complete(position, os.Args[3:]))
 
 	case "--stats":
+		opts, err := parseStatsArgs(os.Args[2:], time.Now())
+		if err != nil {
+			usageError("save --stats [--since <time>] [--until <time>] [--by day|week|tag|dir] [--json]", "%v", err)
+		}
 		stats := store.GetStats()
-		fmt.Printf("Command Statistics:\n")
-		fmt.Printf("Total Runs: %d\n", stats.TotalRuns)
-		fmt.Printf("Success Rate: %.2f%%\n", stats.SuccessRate)
-		fmt.Printf("Favorite Commands: %d\n", stats.FavoriteCount)
-		fmt.Printf("\nMost Used Tags:\n")
-		for _, tag := range stats.MostUsedTags {
-			fmt.Printf("  - %s\n", tag)
+		report := store.StatsReport(opts)
+
+		// --json is kept as a shorthand for --output json
+		if opts.JSON && outputFormat == "" {
+			outputFormat = "json"
+		}
+		if outputFormat != "" {
+			report.Lifetime = &stats
+			if outputFormat == "json" {
+				if err := printStatsReport(report, true); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					os.Exit(1)
+				}
+				break
+			}
+			writeOutput([]StatsReport{report}, statsColumns)
+			break
+		}
+
+		// Lifetime totals only make sense without a time window
+		if opts.Since.IsZero() && opts.Until.IsZero() {
+			fmt.Printf("Command Statistics:\n")
+			fmt.Printf("Total Runs: %d\n", stats.TotalRuns)
+			fmt.Printf("Success Rate: %.2f%%\n", stats.SuccessRate)
+			fmt.Printf("Favorite Commands: %d\n", stats.FavoriteCount)
+			fmt.Printf("\nMost Used Tags:\n")
+			for _, tag := range stats.MostUsedTags {
+				fmt.Printf("  - %s\n", tag)
+			}
+			fmt.Printf("\nMost Common Commands:\n")
+			for _, cmd := range stats.CommonCommands {
+				fmt.Printf("  - %s\n", cmd)
+			}
+			fmt.Println()
 		}
-		fmt.Printf("\nMost Common Commands:\n")
-		for _, cmd := range stats.CommonCommands {
-			fmt.Printf("  - %s\n", cmd)
+		printStatsReport(report, false)
+
+	case "--insights":
+		now := time.Now()
+		recent := 7 * 24 * time.Hour
+		if len(os.Args) > 2 {
+			if len(os.Args) != 4 || os.Args[2] != "--recent" {
+				usageError("save --insights [--recent <age>]", "unknown insights option")
+			}
+			since, err := parseTimeArg(os.Args[3], now)
+			if err != nil || !since.Before(now) {
+				usageError("", "invalid --recent value '%s', expected e.g. 3d, 12h or 2w", os.Args[3])
+			}
+			recent = now.Sub(since)
 		}
+		printInsights(store.Insights(now, recent))
 
 	case "--favorite":
 		if len(os.Args) < 3 {
-			fmt.Println("Error: --favorite requires a command ID")
+			usageError("", "--favorite requires a command ID")
+		}
+		id, err := store.resolveCommandRef(os.Args[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
-		id, _ := strconv.Atoi(os.Args[2])
 		if err := store.SetFavorite(id, true); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
 		fmt.Printf("Marked command #%d as favorite\n", id)
 	
-	// Add these cases to main() switch statement
-	case "--interactive-edit":
+	case "--protect":
 		if len(os.Args) < 3 {
-			fmt.Println("Error: --interactive-edit requires a command ID")
-			os.Exit(1)
+			usageError("save --protect <name|id> [--off]", "--protect requires a command ID")
 		}
-		id, err := strconv.Atoi(os.Args[2])
+		off := len(os.Args) == 4 && os.Args[3] == "--off"
+		if len(os.Args) > 4 || (len(os.Args) == 4 && !off) {
+			usageError("save --protect <name|id> [--off]", "unexpected argument '%s'", os.Args[len(os.Args)-1])
+		}
+		id, err := store.resolveCommandRef(os.Args[2])
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: invalid command ID\n")
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
-		if err := store.InteractiveEdit(id); err != nil {
+		if err := store.SetProtected(id, !off); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
-		fmt.Printf("Successfully updated command #%d\n", id)
-
-	case "--add-tags":
-		if len(os.Args) < 4 {
-			fmt.Println("Error: --add-tags requires a command ID and tags")
-			os.Exit(1)
+		if off {
+			fmt.Printf("Command #%d is no longer protected\n", id)
+		} else {
+			fmt.Printf("Protected command #%d, it asks for confirmation before every run\n", id)
 		}
-		id, err := strconv.Atoi(os.Args[2])
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: invalid command ID\n")
-			os.Exit(1)
+
+	// Add these cases to main() switch statement
+	case "--interactive-edit":
+		if len(os.Args) < 3 {
+			usageError("", "--interactive-edit requires a command ID")
+		}
+		id, err := store.resolveCommandRef(os.Args[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := store.InteractiveEdit(id); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Successfully updated command #%d\n", id)
+
+	case "--add-tags":
+		if len(os.Args) < 4 {
+			usageError("", "--add-tags requires a command ID and tags")
+		}
+		id, err := store.resolveCommandRef(os.Args[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
 		}
 		tags := strings.Split(os.Args[3], ",")
 		if err := store.ManipulateTags(id, tags, nil); err != nil {
@@ -1354,12 +1573,11 @@ func main() {
 
 	case "--remove-tags":
 		if len(os.Args) < 4 {
-			fmt.Println("Error: --remove-tags requires a command ID and tags")
-			os.Exit(1)
+			usageError("", "--remove-tags requires a command ID and tags")
 		}
-		id, err := strconv.Atoi(os.Args[2])
+		id, err := store.resolveCommandRef(os.Args[2])
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: invalid command ID\n")
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
 		tags := strings.Split(os.Args[3], ",")
@@ -1371,12 +1589,11 @@ func main() {
 
 	case "--undo":
 		if len(os.Args) < 3 {
-			fmt.Println("Error: --undo requires a command ID")
-			os.Exit(1)
+			usageError("", "--undo requires a command ID")
 		}
-		id, err := strconv.Atoi(os.Args[2])
+		id, err := store.resolveCommandRef(os.Args[2])
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: invalid command ID\n")
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
 		if err := store.UndoLastEdit(id); err != nil {
@@ -1387,9 +1604,7 @@ func main() {
 
 	case "--create-chain-with-deps":
 		if len(os.Args) < 6 {
-			fmt.Println("Error: --create-chain-with-deps requires name, description, steps file, and dependencies file")
-			fmt.Println("Usage: save --create-chain-with-deps <name> <description> <steps.json> <dependencies.json>")
-			os.Exit(1)
+			usageError("save --create-chain-with-deps <name> <description> <steps.json> <dependencies.json>", "--create-chain-with-deps requires name, description, steps file, and dependencies file")
 		}
 		
 		// Read and parse steps and dependencies from JSON files
@@ -1405,6 +1620,11 @@ func main() {
 			os.Exit(1)
 		}
 		
+		if err := store.checkChainName(os.Args[2], 0); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
 		var steps []ChainStep
 		var deps []ChainDependency
 		
@@ -1426,6 +1646,11 @@ func main() {
 			CreatedAt:    time.Now(),
 		}
 		
+		if cycle := store.dependencyCycle(store.lastChainID+1, deps); cycle != nil {
+			fmt.Fprintf(os.Stderr, "Error: dependencies form a cycle through chains %v\n", cycle)
+			os.Exit(1)
+		}
+
 		store.lastChainID++
 		chain.ID = store.lastChainID
 		store.chains = append(store.chains, chain)
@@ -1443,19 +1668,18 @@ func main() {
 	
 	case "--remove":
 		if len(os.Args) < 3 {
-			fmt.Println("Error: --remove requires at least one command ID")
-			os.Exit(1)
+			usageError("", "--remove requires at least one command ID")
 		}
 		
-		// Split the comma-separated IDs
+		// Split the comma-separated IDs or names
 		idStrs := strings.Split(os.Args[2], ",")
 		ids := make([]int, 0, len(idStrs))
 		
-		// Convert each ID string to int
+		// Resolve each reference to an ID
 		for _, idStr := range idStrs {
-			id, err := strconv.Atoi(strings.TrimSpace(idStr))
+			id, err := store.resolveCommandRef(idStr)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error: invalid command ID '%s'\n", idStr)
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 				os.Exit(1)
 			}
 			ids = append(ids, id)
@@ -1469,11 +1693,13 @@ func main() {
 		fmt.Printf("Removed %d command(s)\n", len(ids))
 	
 	case "--list":
-		// Default to showing last 10 commands if n is not specified
-		n := 10
+		// Default to the configured list size if n is not specified
+		n := config.ListSize
 		if len(os.Args) > 2 {
 			if val, err := strconv.Atoi(os.Args[2]); err == nil {
 				n = val
+			} else if os.Args[2] == "all" {
+				n = len(store.commands)
 			}
 		}
 		// Show last n commands in reverse order (newest first)
@@ -1481,15 +1707,32 @@ func main() {
 		if start < 0 {
 			start = 0
 		}
+		if outputFormat != "" {
+			var recent []Command
+			for i := len(store.commands) - 1; i >= start; i-- {
+				recent = append(recent, store.commands[i])
+			}
+			writeOutput(recent, commandColumns)
+			break
+		}
 		for i := len(store.commands) - 1; i >= start; i-- {
 			cmd := store.commands[i]
-			fmt.Printf("#%d [%s] %s\n", cmd.ID, cmd.Timestamp.Format("2006-01-02 15:04:05"), cmd.Raw)
+			fmt.Printf("%s [%s] %s\n", commandLabel(cmd), cmd.Timestamp.Format("2006-01-02 15:04:05"), cmd.Raw)
 			if cmd.Description != "" {
 				fmt.Printf("    Description: %s\n", cmd.Description)
 			}
 			if len(cmd.Tags) > 0 {
 				fmt.Printf("    Tags: %s\n", strings.Join(cmd.Tags, ", "))
 			}
+			if cmd.Shell != "" {
+				fmt.Printf("    Shell: %s\n", cmd.Shell)
+			}
+			if len(cmd.Annotations) > 0 {
+				fmt.Printf("    Annotations: %s\n", formatAnnotations(cmd.Annotations))
+			}
+			if cmd.Protected {
+				fmt.Printf("    Protected: yes\n")
+			}
 			if cmd.Dir != "" {
 				fmt.Printf("    Directory: %s\n", cmd.Dir)
 			}
@@ -1498,41 +1741,81 @@ func main() {
 	
 	case "--search":
 		if len(os.Args) < 3 {
-			fmt.Println("Error: --search requires a query")
-			os.Exit(1)
+			usageError("", "--search requires a query")
 		}
 		query := strings.ToLower(os.Args[2])
+		var matches []Command
 		for _, cmd := range store.commands {
 			if strings.Contains(strings.ToLower(cmd.Raw), query) ||
 			   strings.Contains(strings.ToLower(cmd.Description), query) ||
+			   strings.Contains(strings.ToLower(cmd.Name), query) ||
 			   containsTag(cmd.Tags, query) {
-				fmt.Printf("#%d [%s] %s\n", cmd.ID, cmd.Timestamp.Format("2006-01-02 15:04:05"), cmd.Raw)
+				matches = append(matches, cmd)
 			}
 		}
+		libRefs := store.searchLibraries(query)
+
+		if outputFormat != "" {
+			// Library commands have no ID; their name is the library reference
+			for _, ref := range libRefs {
+				libCmd, _ := store.findLibraryCommand(ref)
+				matches = append(matches, Command{Raw: libCmd.Command, Name: ref, Description: libCmd.Description, Tags: libCmd.Tags})
+			}
+			writeOutput(matches, commandColumns)
+			break
+		}
+		for _, cmd := range matches {
+			fmt.Printf("%s [%s] %s\n", commandLabel(cmd), cmd.Timestamp.Format("2006-01-02 15:04:05"), cmd.Raw)
+		}
+		for _, ref := range libRefs {
+			libCmd, _ := store.findLibraryCommand(ref)
+			fmt.Printf("%s [library] %s\n", ref, libCmd.Command)
+		}
 	
 	case "--filter-dir":
 		if len(os.Args) < 3 {
-			fmt.Println("Error: --filter-dir requires a directory path")
-			os.Exit(1)
+			usageError("", "--filter-dir requires a directory path")
 		}
 		filterDir := os.Args[2]
+		if outputFormat != "" {
+			var matches []Command
+			for _, cmd := range store.commands {
+				if cmd.Dir == filterDir {
+					matches = append(matches, cmd)
+				}
+			}
+			writeOutput(matches, commandColumns)
+			break
+		}
 		for _, cmd := range store.commands {
 			if cmd.Dir == filterDir {
-				fmt.Printf("#%d [%s] %s\n", cmd.ID, cmd.Timestamp.Format("2006-01-02 15:04:05"), cmd.Raw)
+				fmt.Printf("%s [%s] %s\n", commandLabel(cmd), cmd.Timestamp.Format("2006-01-02 15:04:05"), cmd.Raw)
 			}
 		}
 
 	case "--filter-tag":
 		if len(os.Args) < 3 {
-			fmt.Println("Error: --filter-tag requires a tag name")
-			os.Exit(1)
+			usageError("", "--filter-tag requires a tag name")
 		}
 		filterTag := strings.ToLower(os.Args[2])
+		if outputFormat != "" {
+			var matches []Command
+			for _, cmd := range store.commands {
+				for _, tag := range cmd.Tags {
+					if strings.ToLower(tag) == filterTag {
+						matches = append(matches, cmd)
+						break
+					}
+				}
+			}
+			writeOutput(matches, commandColumns)
+			break
+		}
 		for _, cmd := range store.commands {
 			// Check if any of the command's tags match the filter
 			for _, tag := range cmd.Tags {
 				if strings.ToLower(tag) == filterTag {
-					fmt.Printf("#%d [%s] %s\n", cmd.ID, cmd.Timestamp.Format("2006-01-02 15:04:05"), cmd.Raw)
+					fmt.Printf("%s [%s] %s\n", commandLabel(cmd), cmd.Timestamp.Format("2006-01-02 15:04:05"), cmd.Raw)
 					if cmd.Description != "" {
 						fmt.Printf("    Description: %s\n", cmd.Description)
 					}
@@ -1550,8 +1833,7 @@ func main() {
 
 	case "--import":
 		if len(os.Args) < 3 {
-			fmt.Println("Error: --import requires a filename")
-			os.Exit(1)
+			usageError("", "--import requires a filename")
 		}
 		importFile := os.Args[2]
 		if err := store.ImportCommands(importFile); err != nil {
@@ -1562,8 +1844,7 @@ func main() {
 	
 	case "--export":
 		if len(os.Args) < 3 {
-			fmt.Println("Error: --export requires a filename")
-			os.Exit(1)
+			usageError("", "--export requires a filename")
 		}
 		exportFile := os.Args[2]
 		data, err := json.MarshalIndent(store.commands, "", "    ")
@@ -1578,65 +1859,40 @@ func main() {
 		fmt.Printf("Exported %d commands to %s\n", len(store.commands), exportFile)
 	
 	case "--list-tags":
-		// Create a map to count tag occurrences
-		tagCount := make(map[string]int)
-		for _, cmd := range store.commands {
-			for _, tag := range cmd.Tags {
-				tagCount[tag]++
-			}
+		tags := store.tagCounts()
+		if outputFormat != "" {
+			writeOutput(tags, tagColumns)
+			break
 		}
-	
-		// Convert to slice for sorting
-		type tagInfo struct {
-			name  string
-			count int
-		}
-		var tags []tagInfo
-		for tag, count := range tagCount {
-			tags = append(tags, tagInfo{tag, count})
-		}
-	
-		// Sort tags by usage count (descending) and then alphabetically
-		sort.Slice(tags, func(i, j int) bool {
-			if tags[i].count != tags[j].count {
-				return tags[i].count > tags[j].count
-			}
-			return tags[i].name < tags[j].name
-		})
-	
+
 		// Print tags and their usage count
 		fmt.Println("Available tags (with usage count):")
 		for _, t := range tags {
-			fmt.Printf("  %s (%d)\n", t.name, t.count)
+			fmt.Printf("  %s (%d)\n", t.Tag, t.Count)
 		}
 	
 	case "--rerun":
 		if len(os.Args) < 3 {
-			fmt.Println("Error: --rerun requires a command ID")
-			fmt.Println("Usage: save --rerun <id>")
-			os.Exit(1)
+			usageError("save --rerun <id|name>", "--rerun requires a command ID")
 		}
-		id, err := strconv.Atoi(os.Args[2])
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: invalid command ID\n")
-			os.Exit(1)
-		}
-		
-		// Find the command to rerun
-		var cmdToRerun *Command
-		for i := range store.commands {
-			if store.commands[i].ID == id {
-				cmdToRerun = &store.commands[i]
-				break
+		if _, _, ok := splitLibraryRef(os.Args[2]); ok {
+			if err := store.ExecuteLibraryCommand(os.Args[2], nil); err != nil {
+				fmt.Fprintf(os.Stderr, "Error re-running command: %v\n", err)
+				os.Exit(1)
 			}
+			break
 		}
-		if cmdToRerun == nil {
-			fmt.Fprintf(os.Stderr, "Error: command with ID %d not found\n", id)
+
+		id, err := store.resolveCommandRef(os.Args[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
 		
+		cmdToRerun := store.findCommand(id)
+		
 		// Rerun the command with the existing ID
-		if err := store.Execute(cmdToRerun.Raw, cmdToRerun.Dir != "", cmdToRerun.Tags, cmdToRerun.Description, id); err != nil {
+		if err := store.Execute(cmdToRerun.Raw, cmdToRerun.Shell, nil, cmdToRerun.Dir != "", cmdToRerun.Tags, cmdToRerun.Description, id); err != nil {
 			fmt.Fprintf(os.Stderr, "Error re-running command: %v\n", err)
 			os.Exit(1)
 		}
@@ -1650,6 +1906,10 @@ func main() {
 		fmt.Printf("Config file location: %s\n", store.filepath)
 	
 	case "--list-chains":
+		if outputFormat != "" {
+			writeOutput(store.chains, chainColumns)
+			break
+		}
 		if len(store.chains) == 0 {
 			fmt.Println("No command chains found")
 			return
@@ -1667,11 +1927,14 @@ func main() {
 
 	case "--create-chain":
 		if len(os.Args) < 4 {
-			fmt.Println("Error: --create-chain requires name and description")
-			fmt.Println("Usage: save --create-chain <name> <description>")
-			os.Exit(1)
+			usageError("save --create-chain <name> <description>", "--create-chain requires name and description")
 		}
 		
+		if err := store.checkChainName(os.Args[2], 0); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
 		chain := CommandChain{
 			Name:        os.Args[2],
 			Description: os.Args[3],
@@ -1689,26 +1952,120 @@ func main() {
 		}
 		fmt.Printf("Created chain #%d: %s\n", chain.ID, chain.Name)
 
-	case "--run-chain":
+	case "--run-chain", "--resume":
+		resuming := os.Args[1] == "--resume"
+		runUsage := "save --run-chain <chain-id|name> [--continue-on-error] [--max-parallel <n>] [--dashboard] [--var name=value]... [--from-step <n> | --only-step <n>] [--confirmed] [--dry-run] [--explain]"
+		if resuming {
+			runUsage = "save --resume <chain-run-id> [--mark-fixed] [--continue-on-error] [--max-parallel <n>] [--dashboard] [--var name=value]... [--from-step <n> | --only-step <n>] [--confirmed]"
+		}
 		if len(os.Args) < 3 {
-			fmt.Println("Error: --run-chain requires a chain ID")
-			fmt.Println("Usage: save --run-chain <chain-id>")
-			os.Exit(1)
+			if resuming {
+				usageError(runUsage, "--resume requires a chain run ID")
+			}
+			usageError(runUsage, "--run-chain requires a chain ID")
 		}
 		
-		chainID, err := strconv.Atoi(os.Args[2])
+		var chainID int
+		var resumeRun *ChainRunRecord
+		if resuming {
+			resumeRun, err = store.findResumableRun(os.Args[2])
+		} else if _, _, ok := splitLibraryRef(os.Args[2]); ok {
+			// Library chains run from a refreshed local copy
+			chainID, err = store.materializeLibraryChain(os.Args[2])
+		} else {
+			chainID, err = store.resolveChainRef(os.Args[2])
+		}
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: invalid chain ID\n")
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
 		
 		// Check if --continue-on-error flag is present
 		continueOnError := false
-		if len(os.Args) > 3 && os.Args[3] == "--continue-on-error" {
-			continueOnError = true
+		dryRun, explain := false, false
+		var runOpts ChainRunOptions
+		for i := 3; i < len(os.Args); i++ {
+			switch os.Args[i] {
+			case "--mark-fixed":
+				if !resuming {
+					usageError(runUsage, "--mark-fixed only applies to --resume")
+				}
+				runOpts.MarkFixed = true
+			case "--from-step", "--only-step":
+				if i+1 >= len(os.Args) {
+					usageError(runUsage, "%s requires a step number", os.Args[i])
+				}
+				n, err := strconv.Atoi(os.Args[i+1])
+				if err != nil || n < 1 {
+					usageError(runUsage, "%s must be a step number, not '%s'", os.Args[i], os.Args[i+1])
+				}
+				if os.Args[i] == "--from-step" {
+					runOpts.FromStep = n
+				} else {
+					runOpts.OnlyStep = n
+				}
+				i++
+			case "--continue-on-error":
+				continueOnError = true
+			case "--confirmed":
+				runOpts.Confirmed = true
+			case "--dry-run":
+				dryRun = true
+			case "--explain":
+				explain = true
+			case "--dashboard":
+				runOpts.Dashboard = true
+			case "--max-parallel":
+				if i+1 >= len(os.Args) {
+					usageError(runUsage, "--max-parallel requires a number")
+				}
+				i++
+				n, err := strconv.Atoi(os.Args[i])
+				if err != nil || n < 1 {
+					usageError(runUsage, "--max-parallel must be a positive number, not '%s'", os.Args[i])
+				}
+				runOpts.MaxParallel = n
+			case "--var":
+				if i+1 >= len(os.Args) {
+					usageError(runUsage, "--var requires name=value")
+				}
+				i++
+				name, value, err := parseVarAssignment(os.Args[i])
+				if err != nil {
+					usageError(runUsage, "%v", err)
+				}
+				if runOpts.Vars == nil {
+					runOpts.Vars = make(map[string]string)
+				}
+				runOpts.Vars[name] = value
+			default:
+				usageError(runUsage, "unknown option '%s' for %s", os.Args[i], os.Args[1])
+			}
 		}
-		
-		if err := store.ExecuteChainWithDependencies(chainID); err != nil {
+		if runOpts.FromStep > 0 && runOpts.OnlyStep > 0 {
+			usageError(runUsage, "--from-step and --only-step can't be combined")
+		}
+		if runOpts.MarkFixed && (runOpts.FromStep > 0 || runOpts.OnlyStep > 0) {
+			usageError(runUsage, "--mark-fixed can't be combined with --from-step or --only-step")
+		}
+		if resuming && (dryRun || explain) {
+			usageError(runUsage, "--dry-run and --explain only apply to --run-chain")
+		}
+
+		if dryRun || explain {
+			if err := store.PreviewChain(chainID, runOpts, explain); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		if resuming {
+			err = store.ResumeChain(resumeRun, runOpts)
+		} else {
+			err = store.ExecuteChainWithDependencies(chainID, runOpts)
+		}
+		if err != nil {
 			if !continueOnError {
 				fmt.Fprintf(os.Stderr, "Error executing chain: %v\n", err)
 				os.Exit(1)
@@ -1716,46 +2073,338 @@ func main() {
 			fmt.Fprintf(os.Stderr, "Warning: chain execution had errors: %v\n", err)
 		}
 
+	case "--name":
+		if len(os.Args) < 4 {
+			usageError("save --name <name> <id|name>", "--name requires a name and a command ID")
+		}
+		id, err := store.resolveCommandRef(os.Args[3])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := store.SetCommandName(id, os.Args[2]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Named command #%d '%s'\n", id, os.Args[2])
+
+	case "--name-chain":
+		if len(os.Args) < 4 {
+			usageError("save --name-chain <name> <chain-id|name>", "--name-chain requires a name and a chain ID")
+		}
+		chainID, err := store.resolveChainRef(os.Args[3])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := store.SetChainName(chainID, os.Args[2]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Named chain #%d '%s'\n", chainID, os.Args[2])
+
+	case "run":
+		if len(os.Args) < 3 {
+			usageError("save run <name|id> [args...]", "run requires a command name or ID")
+		}
+		if _, _, ok := splitLibraryRef(os.Args[2]); ok {
+			if err := store.ExecuteLibraryCommand(os.Args[2], os.Args[3:]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error running command: %v\n", err)
+				os.Exit(1)
+			}
+			break
+		}
+		id, err := store.resolveCommandRef(os.Args[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		cmdToRun := store.findCommand(id)
+
+		// Extra arguments are passed to the saved command unchanged, quoted
+		// onto it for shells and as argv for interpreters
+		if err := store.Execute(cmdToRun.Raw, cmdToRun.Shell, os.Args[3:], cmdToRun.Dir != "", cmdToRun.Tags, cmdToRun.Description, id); err != nil {
+			fmt.Fprintf(os.Stderr, "Error running command: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "--library":
+		if len(os.Args) < 3 {
+			usageError("save --library add|remove|list|sync|promote [args]", "--library requires an action")
+		}
+
+		switch os.Args[2] {
+		case "add":
+			if len(os.Args) < 5 {
+				usageError("save --library add <name> <directory|git-url>", "library add requires a name and a source")
+			}
+			if err := store.AddLibrary(os.Args[3], os.Args[4]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error adding library: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Added library '%s'\n", os.Args[3])
+
+		case "remove":
+			if len(os.Args) < 4 {
+				usageError("save --library remove <name>", "library remove requires a name")
+			}
+			if err := store.RemoveLibrary(os.Args[3]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error removing library: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Removed library '%s'\n", os.Args[3])
+
+		case "list":
+			store.ListLibraries()
+
+		case "sync":
+			name := ""
+			if len(os.Args) > 3 {
+				name = os.Args[3]
+			}
+			if err := store.SyncLibraries(name); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+
+		case "promote":
+			if len(os.Args) < 5 {
+				usageError("save --library promote <id|name> <library> [file]", "library promote requires a command and a library")
+			}
+			id, err := store.resolveCommandRef(os.Args[3])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			fileName := ""
+			if len(os.Args) > 5 {
+				fileName = os.Args[5]
+			}
+			path, err := store.PromoteCommand(id, os.Args[4], fileName)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error promoting command: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Promoted command #%d to %s\n", id, path)
+
+		default:
+			usageError("save --library add|remove|list|sync|promote [args]", "unknown library action '%s'", os.Args[2])
+		}
+
+	case "--sync":
+		if err := store.Sync(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error syncing: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Synced %d commands and %d chains\n", len(store.commands), len(store.chains))
+
+	case "--serve":
+		addr := "127.0.0.1:8765"
+		if len(os.Args) > 2 {
+			addr = os.Args[2]
+		}
+		token := os.Getenv("SAVE_SERVER_TOKEN")
+		if token == "" {
+			token = newUID()
+			fmt.Printf("No SAVE_SERVER_TOKEN set, using generated token: %s\n", token)
+		}
+		fmt.Printf("Serving %s on http://%s\n", store.filepath, addr)
+		if err := store.Serve(addr, token); err != nil {
+			fmt.Fprintf(os.Stderr, "Error serving: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "--schedule":
+		scheduleUsage := "save --schedule <id|name|chain:<chain>> \"<cron expression>\" [--catch-up once|skip|all]"
+		if len(os.Args) < 4 {
+			usageError(scheduleUsage, "--schedule requires a command or chain and a cron expression")
+		}
+		catchUp := ""
+		for i := 4; i < len(os.Args); i++ {
+			switch os.Args[i] {
+			case "--catch-up":
+				if i+1 >= len(os.Args) {
+					usageError(scheduleUsage, "--catch-up requires a policy")
+				}
+				i++
+				catchUp = os.Args[i]
+			default:
+				usageError(scheduleUsage, "unknown option '%s'", os.Args[i])
+			}
+		}
+		schedule, err := store.AddSchedule(os.Args[2], os.Args[3], catchUp)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error scheduling: %v\n", err)
+			os.Exit(1)
+		}
+		spec, _ := parseCron(schedule.Cron)
+		fmt.Printf("Scheduled #%d: %s, next run %s\n", schedule.ID, store.runTargetLabel(schedule.CommandID, schedule.ChainID),
+			spec.next(time.Now()).Format("2006-01-02 15:04"))
+		fmt.Println("Jobs run while 'save --daemon' is running, or when 'save --run-due' is called")
+
+	case "--unschedule":
+		if len(os.Args) < 3 {
+			usageError("save --unschedule <schedule-id>", "--unschedule requires a schedule ID")
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(os.Args[2], "#"))
+		if err != nil {
+			usageError("save --unschedule <schedule-id>", "invalid schedule ID '%s'", os.Args[2])
+		}
+		if err := store.RemoveSchedule(id); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Removed schedule #%d\n", id)
+
+	case "--list-schedules":
+		entries := store.ScheduleEntries(time.Now())
+		if outputFormat != "" {
+			writeOutput(entries, scheduleColumns)
+			break
+		}
+		printSchedules(entries)
+
+	case "--run-due":
+		if err := store.RunDue(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "--daemon":
+		if err := RunDaemon(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "--watch":
+		watchUsage := "save --watch <id|name|chain:<chain>> <path|glob>... [--debounce <duration>] [--ignore <pattern>]..."
+		if len(os.Args) < 4 {
+			usageError(watchUsage, "--watch requires a command or chain and the paths to watch")
+		}
+		var patterns []string
+		var watchOpts WatchOptions
+		for i := 3; i < len(os.Args); i++ {
+			switch os.Args[i] {
+			case "--debounce":
+				if i+1 >= len(os.Args) {
+					usageError(watchUsage, "--debounce requires a duration")
+				}
+				i++
+				d, err := time.ParseDuration(os.Args[i])
+				if err != nil || d <= 0 {
+					usageError(watchUsage, "--debounce must be a duration such as 500ms, not '%s'", os.Args[i])
+				}
+				watchOpts.Debounce = d
+			case "--ignore":
+				if i+1 >= len(os.Args) {
+					usageError(watchUsage, "--ignore requires a pattern")
+				}
+				i++
+				watchOpts.Ignore = append(watchOpts.Ignore, os.Args[i])
+			default:
+				patterns = append(patterns, os.Args[i])
+			}
+		}
+		if len(patterns) == 0 {
+			usageError(watchUsage, "--watch requires the paths to watch")
+		}
+		if err := store.WatchAndRun(os.Args[2], patterns, watchOpts); err != nil {
+			fmt.Fprintf(os.Stderr, "Error watching: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "--test-notify":
+		success := true
+		for _, arg := range os.Args[2:] {
+			if arg != "--failure" {
+				usageError("save --test-notify [--failure]", "unknown option '%s'", arg)
+			}
+			success = false
+		}
+		if err := TestNotify(success); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "--sync-remote":
+		if len(os.Args) < 3 {
+			usageError("save --sync-remote <url>", "--sync-remote requires a git remote URL")
+		}
+		if err := SetSyncRemote(os.Args[2]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error setting sync remote: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Sync remote set to %s\n", os.Args[2])
+
+	case "--apply-chain":
+		if len(os.Args) < 3 {
+			usageError("save --apply-chain <file.yaml|file.toml|file.json> [--yes] [--dry-run]", "--apply-chain requires a chain definition file")
+		}
+
+		assumeYes, dryRun := false, false
+		for _, arg := range os.Args[3:] {
+			switch arg {
+			case "--yes", "-y":
+				assumeYes = true
+			case "--dry-run":
+				dryRun = true
+			default:
+				usageError("save --apply-chain <file.yaml|file.toml|file.json> [--yes] [--dry-run]", "unknown option '%s' for --apply-chain", arg)
+			}
+		}
+
+		if err := store.ApplyChainFile(os.Args[2], assumeYes, dryRun); err != nil {
+			fmt.Fprintf(os.Stderr, "Error applying chain: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "--export-chain":
+		if len(os.Args) < 4 {
+			usageError("save --export-chain <chain-id|name> <file.yaml|file.toml|file.json>", "--export-chain requires a chain ID and an output file")
+		}
+
+		chainID, err := store.resolveChainRef(os.Args[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		def, err := store.ExportChainDefinition(chainID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error exporting chain: %v\n", err)
+			os.Exit(1)
+		}
+		if err := encodeDefinitionFile(os.Args[3], def); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing chain file: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Exported chain #%d to %s\n", chainID, os.Args[3])
+
 	case "--version":
 		fmt.Printf("save version %s\n", Version)
 		os.Exit(0)
 
 	case "--install-completion":
-		shell := os.Getenv("SHELL")
-		if shell == "" {
-			fmt.Println("Error: Could not detect shell. Please specify: save --generate-completion <bash|zsh>")
-			os.Exit(1)
-		}
-		
-		shellType := filepath.Base(shell) // Gets "bash" or "zsh" from path
-		script := generateShellCompletion(shellType)
-		if script == "" {
-			fmt.Printf("Error: Unsupported shell: %s\n", shellType)
-			os.Exit(1)
+		shell := detectShell()
+		if len(os.Args) > 2 {
+			shell = normalizeShell(os.Args[2])
 		}
-		
-		// Install to appropriate location based on shell
-		var completionPath string
-		switch shellType {
-		case "bash":
-			completionPath = filepath.Join(os.Getenv("HOME"), ".bash_completion.d", "save")
-		case "zsh":
-			completionPath = filepath.Join(os.Getenv("HOME"), ".zsh/completions", "_save")
+		if shell == "" {
+			usageError("save --install-completion [bash|zsh|fish|powershell]", "could not detect your shell, please name it")
 		}
-		
-		// Create directory if it doesn't exist
-		if err := os.MkdirAll(filepath.Dir(completionPath), 0755); err != nil {
-			fmt.Fprintf(os.Stderr, "Error creating completion directory: %v\n", err)
+		path, hint, err := installCompletion(shell)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error installing completion: %v\n", err)
 			os.Exit(1)
 		}
-		
-		if err := os.WriteFile(completionPath, []byte(script), 0644); err != nil {
-			fmt.Fprintf(os.Stderr, "Error writing completion script: %v\n", err)
+		fmt.Printf("Installed %s completion script to %s\n", shell, path)
+		fmt.Println(hint)
+
+	case "--config":
+		if err := runConfigCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
-		
-		fmt.Printf("Installed completion script to %s\n", completionPath)
-		fmt.Printf("Add 'source %s' to your shell's rc file\n", completionPath)
 
 	case "--verify":
 		if err := store.verifyIntegrity(); err != nil {
@@ -1765,7 +2414,8 @@ func main() {
 		fmt.Println("Data integrity verified successfully")
 
 	case "--backup":
-		backupPath := store.filepath + ".backup-" + time.Now().Format("20060102-150405")
+		// Same place as automatic backups, so --list-backups finds it
+		backupPath := filepath.Join(filepath.Dir(store.filepath), "backups", "save-history-"+time.Now().Format("20060102-150405")+".json")
 		if err := store.createBackup(backupPath); err != nil {
 			fmt.Fprintf(os.Stderr, "Error creating backup: %v\n", err)
 			os.Exit(1)
@@ -1786,8 +2436,7 @@ func main() {
 
 	case "--restore":
 		if len(os.Args) < 3 {
-			fmt.Println("Error: --restore requires a backup file path")
-			os.Exit(1)
+			usageError("", "--restore requires a backup file path")
 		}
 		if err := store.restoreFromBackup(os.Args[2]); err != nil {
 			fmt.Fprintf(os.Stderr, "Error restoring from backup: %v\n", err)
@@ -1796,89 +2445,140 @@ func main() {
 		fmt.Println("Successfully restored from backup")
 
 	case "--list-backups":
-		backupDir := filepath.Join(filepath.Dir(store.filepath), "backups")
-		files, err := os.ReadDir(backupDir)
+		backups, err := store.listBackupFiles()
 		if err != nil {
-			if os.IsNotExist(err) {
-				fmt.Println("No backups found")
-				return
-			}
 			fmt.Fprintf(os.Stderr, "Error reading backup directory: %v\n", err)
 			os.Exit(1)
 		}
+		if outputFormat != "" {
+			writeOutput(backups, backupColumns)
+			break
+		}
 
+		if len(backups) == 0 {
+			fmt.Println("No backups found")
+			return
+		}
 		fmt.Println("Available backups:")
-		for _, file := range files {
-			if !file.IsDir() && strings.HasPrefix(file.Name(), "save-history-") {
-				path := filepath.Join(backupDir, file.Name())
-				info, err := file.Info()
-				if err != nil {
-					continue
-				}
-				fmt.Printf("%s (%s, %d bytes)\n", path, info.ModTime().Format("2006-01-02 15:04:05"), info.Size())
-			}
+		for _, b := range backups {
+			fmt.Printf("%s (%s, %d bytes)\n", b.Path, b.Modified.Format("2006-01-02 15:04:05"), b.Size)
 		}
 
 	case "--list-favorites", "-lf":
+		if outputFormat != "" {
+			var favorites []Command
+			for _, cmd := range store.commands {
+				if cmd.IsFavorite {
+					favorites = append(favorites, cmd)
+				}
+			}
+			writeOutput(favorites, commandColumns)
+			break
+		}
 		store.listFavorites()
 
 	default:
-		var tags []string
-		var description string
-		var saveDir bool
+		tags := config.DefaultTags
+		var description, shell, script string
+		saveDir := config.SaveDir
 		cmdArgs := os.Args[1:]
 
 		// Check if the command is just a flag without required arguments
 		if len(cmdArgs) == 1 && validCommandFlags[cmdArgs[0]] {
-			fmt.Fprintf(os.Stderr, "Error: %s requires additional arguments\n", cmdArgs[0])
-			os.Exit(1)
+			usageError("", "%s requires additional arguments", cmdArgs[0])
 		}
 
-		// Parse flags
-		for i := 0; i < len(cmdArgs); i++ {
+		// Save's flags come first. The command starts at the first other
+		// word, so its own flags are never taken, and "--" can mark the
+		// start explicitly
+		hasSeparator := false
+		i := 0
+	saveFlags:
+		for ; i < len(cmdArgs); i++ {
 			switch cmdArgs[i] {
-			case "--tag":
-				if i+1 < len(cmdArgs) {
-					tags = strings.Split(cmdArgs[i+1], ",")
-					cmdArgs = append(cmdArgs[:i], cmdArgs[i+2:]...)
-					i--
+			case "--":
+				hasSeparator = true
+				i++
+				break saveFlags
+			case "--dir", "--no-dir":
+				saveDir = cmdArgs[i] == "--dir"
+			case "--tag", "--desc", "--shell", "--script":
+				if i+1 >= len(cmdArgs) {
+					usageError("save [--tag <tags>] [--desc <text>] [--dir] [--shell <shell>] [--script <file|->] [--] <command>", "%s requires a value", cmdArgs[i])
 				}
-			case "--desc":
-				if i+1 < len(cmdArgs) {
-					description = cmdArgs[i+1]
-					cmdArgs = append(cmdArgs[:i], cmdArgs[i+2:]...)
-					i--
+				value := cmdArgs[i+1]
+				switch cmdArgs[i] {
+				case "--tag":
+					tags = strings.Split(value, ",")
+				case "--desc":
+					description = value
+				case "--shell":
+					shell = value
+				case "--script":
+					script = value
 				}
-			case "--dir":
-				saveDir = true
-				cmdArgs = append(cmdArgs[:i], cmdArgs[i+1:]...)
-				i--
+				i++
+			default:
+				break saveFlags
 			}
 		}
-
-		// Check if the remaining command is just a flag
-		if len(cmdArgs) > 0 && validCommandFlags[cmdArgs[0]] {
-			fmt.Fprintf(os.Stderr, "Error: %s is a command flag and cannot be saved as a command\n", cmdArgs[0])
-			os.Exit(1)
+		cmdArgs = cmdArgs[i:]
+		if err := checkShell(shell); err != nil {
+			usageError("save [--shell <shell>] [--] <command>", "%v", err)
 		}
 
-		cmdString := strings.Join(cmdArgs, " ")
-		if err := store.Execute(cmdString, saveDir, tags, description, 0); err != nil {
+		var cmdString string
+		if script != "" {
+			// A multi-line script from a file or stdin, run with its
+			// #! interpreter unless --shell says otherwise
+			if len(cmdArgs) > 0 || hasSeparator {
+				usageError("save --script <file|-> [--shell <shell>]", "--script cannot be combined with a command")
+			}
+			var data []byte
+			var err error
+			if script == "-" {
+				data, err = io.ReadAll(os.Stdin)
+			} else {
+				data, err = os.ReadFile(script)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading script: %v\n", err)
+				os.Exit(1)
+			}
+			cmdString = string(data)
+			if shell == "" {
+				shell = shebangShell(cmdString)
+			}
+		} else if hasSeparator {
+			cmdString = joinCommandArgs(cmdArgs)
+		} else {
+			// Check if the remaining command is just a flag
+			if len(cmdArgs) > 0 && validCommandFlags[cmdArgs[0]] {
+				usageError("", "%s is a command flag and cannot be saved as a command", cmdArgs[0])
+			}
+			cmdString = strings.Join(cmdArgs, " ")
+		}
+		if strings.TrimSpace(cmdString) == "" {
+			usageError("save [--tag <tags>] [--desc <text>] [--dir] [--] <command>", "no command given")
+		}
+		if err := store.Execute(cmdString, shell, nil, saveDir, tags, description, 0); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
 	}
+
+	// Commands that ran something exit with its status
+	if store.lastExitCode != 0 {
+		os.Exit(store.lastExitCode)
+	}
 }
 
 func printUsage() {
     // ANSI color codes for better readability
-    const (
-        reset  = "\033[0m"
-        bold   = "\033[1m"
-        blue   = "\033[34m"
-        green  = "\033[32m"
-        yellow = "\033[33m"
-    )
+    reset, bold, blue, yellow := "\033[0m", "\033[1m", "\033[34m", "\033[33m"
+    if !config.useColor() {
+        reset, bold, blue, yellow = "", "", "", ""
+    }
 
     // Title and Description
     fmt.Printf("\n%s%sSave Command Manager%s\n", bold, blue, reset)
@@ -1887,22 +2587,41 @@ func printUsage() {
     // Basic Usage
     fmt.Printf("%sUSAGE:%s\n", bold, reset)
     fmt.Printf("  save [flags] <command>     Save and execute a command\n")
+    fmt.Printf("  save [flags] -- <command>  Same, without parsing the command text\n")
     fmt.Printf("  save <subcommand> [args]   Run a specific subcommand\n\n")
 
+    // Subcommands; the flag forms below remain available as aliases
+    fmt.Printf("%sSUBCOMMANDS:%s (save help <subcommand> for details)\n", bold, reset)
+    for _, sub := range subcommands {
+        fmt.Printf("  %-30s %s\n", sub.name, sub.summary)
+    }
+    fmt.Printf("\n  Exit status is 0 on success, 1 on errors and 2 for invalid arguments;\n")
+    fmt.Printf("  commands that run something exit with that command's status.\n\n")
+
     // Flags Section
     fmt.Printf("%sBASIC FLAGS:%s\n", bold, reset)
     fmt.Printf("  %-30s Add a description to the command\n", "--desc <description>")
     fmt.Printf("  %-30s Save with current directory\n", "--dir")
+    fmt.Printf("  %-30s Don't save the directory, even if save_dir is set\n", "--no-dir")
     fmt.Printf("  %-30s Add comma-separated tags\n", "--tag <tags>")
+    fmt.Printf("  %-30s Run with sh, bash, zsh, fish, python3, node..., or exec (no shell)\n", "--shell <shell>")
+    fmt.Printf("  %-30s Save a multi-line script from a file or stdin (-)\n", "--script <file|->")
     fmt.Printf("  %-30s Add a favorite command\n", "--favorite <id>")
 
     // Basic Commands Section
     fmt.Printf("\n%sBASIC COMMANDS:%s\n", bold, reset)
-    fmt.Printf("  %-30s List last n commands (default: 10)\n", "--list [n]")
+    fmt.Printf("  %-30s List last n commands (default: 10)\n", "--list [n|all]")
     fmt.Printf("  %-30s Search commands\n", "--search <query>")
     fmt.Printf("  %-30s Show command statistics\n", "--stats")
-    fmt.Printf("  %-30s Re-run command by ID\n", "--rerun <id>")
+    fmt.Printf("  %-30s Limit statistics to a time window (7d, 12h, 2006-01-02)\n", "  --since/--until <time>")
+    fmt.Printf("  %-30s Break statistics down by day, week, tag or dir\n", "  --by <group>")
+    fmt.Printf("  %-30s Print statistics as JSON\n", "  --json")
+    fmt.Printf("  %-30s Find flaky, failing and slowing commands\n", "--insights [--recent <age>]")
+    fmt.Printf("  %-30s Re-run command by ID or name\n", "--rerun <id|name>")
+    fmt.Printf("  %-30s Run a named command with extra arguments\n", "run <name> [args...]")
+    fmt.Printf("  %-30s Give a command a unique name\n", "--name <name> <id>")
     fmt.Printf("  %-30s Mark command as favorite\n", "--favorite <id>")
+    fmt.Printf("  %-30s Always confirm before running it (--off undoes)\n", "--protect <id> [--off]")
     fmt.Printf("  %-30s Remove command(s) by ID(s)\n", "--remove <id1,id2,...>")
     fmt.Printf("  %-30s Filter commands by directory\n", "--filter-dir <path>")
     fmt.Printf("  %-30s Show config file location\n", "--config-path")
@@ -1925,8 +2644,88 @@ func printUsage() {
     fmt.Printf("  %-30s Create a new command chain\n", "--create-chain <name> <desc>")
     fmt.Printf("  %-30s Create chain with dependencies\n", "--create-chain-with-deps <name> <desc> <steps.json> <deps.json>")
     fmt.Printf("  %-30s List all command chains\n", "--list-chains")
-    fmt.Printf("  %-30s Run a command chain\n", "--run-chain <chain-id>")
+    fmt.Printf("  %-30s Run a command chain\n", "--run-chain <chain-id|name>")
+    fmt.Printf("  %-30s Rename a command chain\n", "--name-chain <name> <chain-id>")
     fmt.Printf("  %-30s Run chain ignoring errors\n", "--run-chain <chain-id> --continue-on-error")
+    fmt.Printf("  %-30s Run at most n commands of a parallel step at once\n", "  --max-parallel <n>")
+    fmt.Printf("  %-30s Show parallel steps as a live status board\n", "  --dashboard")
+    fmt.Printf("  %-30s Set a chain variable, used as {{name}} in steps\n", "  --var <name=value>")
+    fmt.Printf("  %-30s Show what the chain would run, without running it\n", "  --dry-run")
+    fmt.Printf("  %-30s Dry run showing each step's conditions\n", "  --explain")
+    fmt.Printf("  %-30s Start at step n, without dependencies\n", "  --from-step <n>")
+    fmt.Printf("  %-30s Run only step n, without dependencies\n", "  --only-step <n>")
+    fmt.Printf("  %-30s Run dangerous steps without asking to confirm them\n", "  --confirmed")
+    fmt.Printf("  %-30s Continue a failed chain run from the failed step\n", "--resume <chain-run-id>")
+    fmt.Printf("  %-30s Skip the failed step, it was fixed by hand\n", "  --mark-fixed")
+    fmt.Printf("  %-30s Create or update chain from YAML/TOML/JSON file\n", "--apply-chain <file> [--yes] [--dry-run]")
+    fmt.Printf("  %-30s Export chain as a shareable definition file\n", "--export-chain <chain-id> <file>")
+
+    // Libraries
+    fmt.Printf("\n%sLIBRARIES:%s\n", bold, reset)
+    fmt.Printf("  %-30s Add a shared library (directory or git URL)\n", "--library add <name> <source>")
+    fmt.Printf("  %-30s Remove a library\n", "--library remove <name>")
+    fmt.Printf("  %-30s List libraries and their commands\n", "--library list")
+    fmt.Printf("  %-30s Pull latest library definitions\n", "--library sync [name]")
+    fmt.Printf("  %-30s Copy a named command into a library\n", "--library promote <id> <library> [file]")
+
+    // Sync
+    fmt.Printf("\n%sSYNC:%s\n", bold, reset)
+    fmt.Printf("  %-30s Set the git remote used for syncing\n", "--sync-remote <url>")
+    fmt.Printf("  %-30s Merge history with the sync remote\n", "--sync")
+
+    fmt.Printf("\n%sSCHEDULING:%s\n", bold, reset)
+    fmt.Printf("  %-30s Run a command on a cron schedule, in the current dir\n", "--schedule <id> \"<cron>\"")
+    fmt.Printf("  %-30s Schedule a chain instead\n", "--schedule chain:<chain> \"<cron>\"")
+    fmt.Printf("  %-30s Missed runs: run once (default), skip or run all\n", "  --catch-up <policy>")
+    fmt.Printf("  %-30s List schedules with their next and last run\n", "--list-schedules")
+    fmt.Printf("  %-30s Remove a schedule\n", "--unschedule <schedule-id>")
+    fmt.Printf("  %-30s Run scheduled jobs until interrupted\n", "--daemon")
+    fmt.Printf("  %-30s Run the jobs that are due once, for cron or systemd\n", "--run-due")
+
+    fmt.Printf("\n%sWATCHING:%s\n", bold, reset)
+    fmt.Printf("  %-30s Run a command each time files change\n", "--watch <id> <path|glob>...")
+    fmt.Printf("  %-30s Run a chain instead\n", "--watch chain:<chain> <path>...")
+    fmt.Printf("  %-30s Wait until files are quiet this long (default 300ms)\n", "  --debounce <duration>")
+    fmt.Printf("  %-30s Skip more files, as in .gitignore\n", "  --ignore <pattern>")
+
+    fmt.Printf("\n%sNOTIFICATIONS:%s\n", bold, reset)
+    fmt.Printf("  %-30s Notify about long runs (see 'save config list')\n", "config set notify <channels>")
+    fmt.Printf("  %-30s Send a test notification, --failure for a failed run\n", "--test-notify [--failure]")
+
+    fmt.Printf("\n%sPLUGINS AND HOOKS:%s\n", bold, reset)
+    fmt.Printf("  %-30s Runs the save-<name> executable on PATH\n", "<name> [args]")
+    fmt.Printf("  %-30s Send command and chain events to hooks as JSON\n", "config set hooks <commands>")
+    if plugins := listPlugins(nil); len(plugins) > 0 {
+        fmt.Printf("  %-30s %s\n", "Installed plugins:", strings.Join(plugins, ", "))
+    }
+
+    fmt.Printf("\n%sSERVER:%s\n", bold, reset)
+    fmt.Printf("  %-30s Share this store over HTTP (default 127.0.0.1:8765)\n", "--serve [addr]")
+    fmt.Printf("  %-30s Use the store served at url (before any command)\n", "--remote <url> <command>")
+
+    fmt.Printf("\n%sOUTPUT:%s\n", bold, reset)
+    fmt.Printf("  %-30s Output format for list, search, filter and stats\n", "--output <format>")
+    fmt.Printf("  %-30s json, jsonl, table, plain (tab separated) or template\n", "")
+    fmt.Printf("  %-30s Go template applied to each record\n", "--format '<template>'")
+    fmt.Printf("  %-30s Disable colour output (before any command)\n", "--no-color")
+
+    fmt.Printf("\n%sCONFIGURATION:%s\n", bold, reset)
+    fmt.Printf("  %-30s Show settings and where they come from\n", "config list")
+    fmt.Printf("  %-30s Show one setting\n", "config get <key>")
+    fmt.Printf("  %-30s Change a setting in the config file\n", "config set <key> <value...>")
+    fmt.Printf("  %-30s Go back to the default\n", "config unset <key>")
+    fmt.Printf("  %-30s Edit the config file in $EDITOR\n", "config edit")
+
+    fmt.Printf("\n%sBACKUP AND INTEGRITY:%s\n", bold, reset)
+    fmt.Printf("  %-30s Create a backup\n", "--backup")
+    fmt.Printf("  %-30s List backups\n", "--list-backups")
+    fmt.Printf("  %-30s Restore a backup\n", "--restore <file>")
+    fmt.Printf("  %-30s Check data integrity\n", "--verify")
+    fmt.Printf("  %-30s Repair data integrity issues\n", "--repair")
+
+    fmt.Printf("\n%sSHELL COMPLETION:%s\n", bold, reset)
+    fmt.Printf("  %-30s Print the script for bash, zsh, fish or powershell\n", "--generate-completion <shell>")
+    fmt.Printf("  %-30s Install it for your (or the given) shell\n", "--install-completion [shell]")
 
     // Import/Export
     fmt.Printf("\n%sIMPORT/EXPORT:%s\n", bold, reset)
@@ -1941,6 +2740,8 @@ func printUsage() {
     fmt.Printf("    save --desc 'Greeting' 'echo Hello'       # Save with description\n")
     fmt.Printf("    save --tag cli,test 'npm test'            # Save with tags\n")
     fmt.Printf("    save --rerun 42                           # Rerun command #42\n")
+    fmt.Printf("    save --name deploy-api 42                 # Name command #42\n")
+    fmt.Printf("    save run deploy-api --dry-run             # Run it with extra arguments\n")
     fmt.Printf("    save --favorite 42                        # Mark command #42 as favorite\n")
     fmt.Printf("    save --remove 42                          # Remove command #42\n")
     fmt.Printf("    save --config-path                        # Show config file location\n")
@@ -1955,18 +2756,23 @@ func printUsage() {
     fmt.Printf("    save --create-chain 'deploy' 'Deployment process' steps.json    # Create chain\n")
     fmt.Printf("    save --run-chain 1                        # Run chain #1\n")
     fmt.Printf("    save --list-chains                        # List all chains\n")
+    fmt.Printf("    save --apply-chain deploy.yaml            # Create/update chain from file\n")
 
     fmt.Printf("\n%s  Filtering and Organization:%s\n", yellow, reset)
     fmt.Printf("    save --search 'git'                       # Search for git commands\n")
     fmt.Printf("    save --filter-tag docker                  # Show docker commands\n")
     fmt.Printf("    save --filter-dir ~/projects              # Show commands from directory\n")
     fmt.Printf("    save --list-tags                          # Show all tags\n")
+    fmt.Printf("    save --list all --output json             # All commands as JSON\n")
+    fmt.Printf("    save --filter-tag docker --format '{{.ID}} {{.Raw}}'\n")
     fmt.Printf("    save --favorite 42                        # Mark command as favorite\n")
 
     fmt.Printf("\n%s  Backup and Stats:%s\n", yellow, reset)
     fmt.Printf("    save --export backup.json                 # Export commands\n")
     fmt.Printf("    save --import backup.json                 # Import commands\n")
-    fmt.Printf("    save --stats                              # Show statistics\n\n")
+    fmt.Printf("    save --stats                              # Show statistics\n")
+    fmt.Printf("    save --stats --since 7d --by day          # Last week, day by day\n")
+    fmt.Printf("    save --insights                           # Flaky and failing commands\n\n")
 
     fmt.Printf("%sFor more information and documentation, visit: https://github.com/t-rhex/save-go%s\n\n", blue, reset)
 }
\ No newline at end of file
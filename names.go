@@ -0,0 +1,228 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Names must start with a letter so they can never be confused with an ID,
+// and may not contain ':' or '/' which are used for "tag:" references and
+// namespaces.
+var namePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]*$`)
+
+const maxNameLength = 64
+
+func validateName(name string) error {
+	if name == "" {
+		return fmt.Errorf("name cannot be empty")
+	}
+	if len(name) > maxNameLength {
+		return fmt.Errorf("name %q is longer than %d characters", name, maxNameLength)
+	}
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("invalid name %q: must start with a letter and contain only letters, digits, '-', '_' or '.'", name)
+	}
+	return nil
+}
+
+// findCommand returns the saved command with the given ID, or nil.
+func (cs *CommandStore) findCommand(id int) *Command {
+	for i := range cs.commands {
+		if cs.commands[i].ID == id {
+			return &cs.commands[i]
+		}
+	}
+	return nil
+}
+
+// findCommandByName returns the saved command with the given name, or nil.
+func (cs *CommandStore) findCommandByName(name string) *Command {
+	for i := range cs.commands {
+		if cs.commands[i].Name == name {
+			return &cs.commands[i]
+		}
+	}
+	return nil
+}
+
+// findChain returns the chain with the given ID, or nil.
+func (cs *CommandStore) findChain(id int) *CommandChain {
+	for i := range cs.chains {
+		if cs.chains[i].ID == id {
+			return &cs.chains[i]
+		}
+	}
+	return nil
+}
+
+// findChainByName returns the chain with the given name, or nil.
+func (cs *CommandStore) findChainByName(name string) *CommandChain {
+	for i := range cs.chains {
+		if cs.chains[i].Name == name {
+			return &cs.chains[i]
+		}
+	}
+	return nil
+}
+
+// resolveCommandRef resolves a reference to a saved command. Accepted forms
+// are a numeric ID, a command name, or "tag:<tag>" which must match exactly
+// one command.
+func (cs *CommandStore) resolveCommandRef(ref string) (int, error) {
+	ref = strings.TrimSpace(ref)
+	if id, err := strconv.Atoi(ref); err == nil {
+		if cs.findCommand(id) == nil {
+			return 0, fmt.Errorf("command with ID %d not found", id)
+		}
+		return id, nil
+	}
+
+	if tag, ok := strings.CutPrefix(ref, "tag:"); ok {
+		var matches []int
+		for _, cmd := range cs.commands {
+			for _, t := range cmd.Tags {
+				if t == tag {
+					matches = append(matches, cmd.ID)
+					break
+				}
+			}
+		}
+		switch len(matches) {
+		case 0:
+			return 0, fmt.Errorf("no command tagged %q", tag)
+		case 1:
+			return matches[0], nil
+		default:
+			return 0, fmt.Errorf("tag %q is ambiguous, matches commands %v", tag, matches)
+		}
+	}
+
+	if cmd := cs.findCommandByName(ref); cmd != nil {
+		return cmd.ID, nil
+	}
+	if strings.Contains(ref, "/") {
+		return 0, fmt.Errorf("%q is a library command, library commands are read-only", ref)
+	}
+	return 0, fmt.Errorf("no command with ID or name %q", ref)
+}
+
+// resolveChainRef resolves a chain ID or chain name.
+func (cs *CommandStore) resolveChainRef(ref string) (int, error) {
+	ref = strings.TrimSpace(ref)
+	if id, err := strconv.Atoi(ref); err == nil {
+		if cs.findChain(id) == nil {
+			return 0, fmt.Errorf("chain with ID %d not found", id)
+		}
+		return id, nil
+	}
+
+	var matches []int
+	for _, chain := range cs.chains {
+		if chain.Name == ref {
+			matches = append(matches, chain.ID)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return 0, fmt.Errorf("no chain with ID or name %q", ref)
+	case 1:
+		return matches[0], nil
+	default:
+		return 0, fmt.Errorf("chain name %q is ambiguous, matches chains %v (rename one with --name-chain)", ref, matches)
+	}
+}
+
+// SetCommandName gives a command a unique name. An empty name removes it.
+func (cs *CommandStore) SetCommandName(id int, name string) error {
+	cmd := cs.findCommand(id)
+	if cmd == nil {
+		return fmt.Errorf("command with ID %d not found", id)
+	}
+
+	if name != "" {
+		if err := validateName(name); err != nil {
+			return err
+		}
+		if other := cs.findCommandByName(name); other != nil && other.ID != id {
+			return fmt.Errorf("name %q is already used by command #%d", name, other.ID)
+		}
+	}
+
+	cmd.Name = name
+	return cs.save()
+}
+
+// SetChainName renames a chain, keeping chain names unique.
+func (cs *CommandStore) SetChainName(id int, name string) error {
+	chain := cs.findChain(id)
+	if chain == nil {
+		return fmt.Errorf("chain with ID %d not found", id)
+	}
+	if err := cs.checkChainName(name, id); err != nil {
+		return err
+	}
+
+	chain.Name = name
+	return cs.save()
+}
+
+// checkChainName validates a chain name and makes sure no chain other than
+// the one with ID exceptID already uses it.
+func (cs *CommandStore) checkChainName(name string, exceptID int) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	for _, chain := range cs.chains {
+		if chain.Name == name && chain.ID != exceptID {
+			return fmt.Errorf("name %q is already used by chain #%d", name, chain.ID)
+		}
+	}
+	return nil
+}
+
+// shellQuote quotes s for safe use as a single sh word.
+func shellQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n'\"\\$`!*?[]{}()<>|&;#~") {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// commandLabel returns "#<id>" or "#<id> (<name>)" for display.
+func commandLabel(cmd Command) string {
+	if cmd.Name != "" {
+		return fmt.Sprintf("#%d (%s)", cmd.ID, cmd.Name)
+	}
+	return fmt.Sprintf("#%d", cmd.ID)
+}
+
+// resolveRunTarget resolves what a schedule or watch runs: a saved command,
+// or a chain given as "chain:<ref>". One of the IDs is set.
+func (cs *CommandStore) resolveRunTarget(target string) (commandID, chainID int, err error) {
+	if ref, ok := strings.CutPrefix(target, "chain:"); ok {
+		chainID, err = cs.resolveChainRef(ref)
+		return 0, chainID, err
+	}
+	commandID, err = cs.resolveCommandRef(target)
+	return commandID, 0, err
+}
+
+// runTargetLabel describes the command or chain resolveRunTarget returned.
+func (cs *CommandStore) runTargetLabel(commandID, chainID int) string {
+	if chainID != 0 {
+		if chain := cs.findChain(chainID); chain != nil {
+			return "chain " + chainLabel(chain)
+		}
+		return fmt.Sprintf("chain #%d (missing)", chainID)
+	}
+	if cmd := cs.findCommand(commandID); cmd != nil {
+		return stepLabel(*cmd) + ": " + cmd.Raw
+	}
+	return fmt.Sprintf("#%d (missing)", commandID)
+}
@@ -0,0 +1,256 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification channels, as listed in the notify setting.
+const (
+	notifyBell    = "bell"    // Ring the terminal bell
+	notifyDesktop = "desktop" // notify-send, or osascript on macOS
+	notifyWebhook = "webhook" // POST the notification as JSON to notify_webhook
+	notifyHook    = "hook"    // Run notify_hook with the notification in its environment
+)
+
+var notifyChannels = []string{notifyBell, notifyDesktop, notifyWebhook, notifyHook}
+
+const defaultNotifyTemplate = `{{.Name}} {{if .Success}}succeeded{{else}}failed with exit code {{.ExitCode}}{{end}} in {{.Duration}}`
+
+// notifyTimeout bounds each channel, so that a slow webhook doesn't hold up
+// the command that finished.
+const notifyTimeout = 10 * time.Second
+
+// Notification describes a finished command or chain run. It is the JSON
+// payload of webhooks and the data of notify_template.
+type Notification struct {
+	Kind       string    `json:"kind"` // "command" or "chain"
+	ID         int       `json:"id"`
+	Name       string    `json:"name"`              // The command's name or text, or the chain's name
+	Command    string    `json:"command,omitempty"` // Command text, for commands
+	Success    bool      `json:"success"`
+	ExitCode   int       `json:"exit_code"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs int64     `json:"duration_ms"`
+	Duration   string    `json:"duration"` // DurationMs for people, e.g. 2m5s
+	Dir        string    `json:"dir,omitempty"`
+	Host       string    `json:"host,omitempty"`
+	Message    string    `json:"message"` // notify_template applied to the above
+}
+
+// notifyCommandRun notifies about a run of a command, if notifications are
+// on and it took long enough.
+func notifyCommandRun(cmd Command, exitCode int, start time.Time, duration time.Duration) {
+	name := cmd.Raw
+	if cmd.Name != "" {
+		name = cmd.Name
+	}
+	notifyRun(Notification{
+		Kind:      "command",
+		ID:        cmd.ID,
+		Name:      name,
+		Command:   cmd.Raw,
+		Success:   exitCode == 0,
+		ExitCode:  exitCode,
+		StartedAt: start,
+	}, duration)
+}
+
+// notifyChainRun notifies about a finished chain run, like
+// notifyCommandRun. A failed chain reports the exit code of its last step.
+func notifyChainRun(run *ChainRunRecord) {
+	n := Notification{
+		Kind:      "chain",
+		ID:        run.ChainID,
+		Name:      run.Chain,
+		Success:   run.Success,
+		StartedAt: run.StartedAt,
+	}
+	if n.Name == "" {
+		n.Name = fmt.Sprintf("chain #%d", run.ChainID)
+	}
+	if !run.Success {
+		n.ExitCode = 1
+		if len(run.Steps) > 0 && run.Steps[len(run.Steps)-1].ExitCode != 0 {
+			n.ExitCode = run.Steps[len(run.Steps)-1].ExitCode
+		}
+	}
+	notifyRun(n, time.Duration(run.DurationMs)*time.Millisecond)
+}
+
+func notifyRun(n Notification, duration time.Duration) {
+	if len(config.Notify) == 0 || duration < config.notifyAfter || (config.NotifyOn == "failure" && n.Success) {
+		return
+	}
+	n.DurationMs = duration.Milliseconds()
+	n.Duration = duration.Round(time.Second).String()
+	if duration < time.Second {
+		n.Duration = duration.Round(time.Millisecond).String()
+	}
+	n.Dir, _ = os.Getwd()
+	n.Host, _ = os.Hostname()
+	for channel, err := range sendNotification(n) {
+		fmt.Fprintf(os.Stderr, "Warning: %s notification failed: %v\n", channel, err)
+	}
+}
+
+// sendNotification renders the message and sends n through each channel in
+// config.Notify at once. It returns the channels that failed.
+func sendNotification(n Notification) map[string]error {
+	var message bytes.Buffer
+	if err := config.notifyTemplate.Execute(&message, n); err != nil {
+		return map[string]error{"notify_template": err}
+	}
+	n.Message = strings.TrimSpace(message.String())
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failed := make(map[string]error)
+	for _, channel := range config.Notify {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			defer cancel()
+			if err := notifyChannel(ctx, channel, n); err != nil {
+				mu.Lock()
+				failed[channel] = err
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return failed
+}
+
+func notifyChannel(ctx context.Context, channel string, n Notification) error {
+	switch channel {
+	case notifyBell:
+		_, err := os.Stderr.WriteString("\a")
+		return err
+
+	case notifyDesktop:
+		title := "save: " + n.Name
+		if path, err := exec.LookPath("notify-send"); err == nil {
+			urgency := "normal"
+			if !n.Success {
+				urgency = "critical"
+			}
+			return runNotifier(exec.CommandContext(ctx, path, "--app-name=save", "--urgency="+urgency, title, n.Message))
+		}
+		if runtime.GOOS == "darwin" {
+			script := fmt.Sprintf("display notification %s with title %s", strconv.Quote(n.Message), strconv.Quote(title))
+			return runNotifier(exec.CommandContext(ctx, "osascript", "-e", script))
+		}
+		return fmt.Errorf("notify-send not found")
+
+	case notifyWebhook:
+		if config.NotifyWebhook == "" {
+			return fmt.Errorf("notify_webhook is not set")
+		}
+		payload, err := json.Marshal(n)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.NotifyWebhook, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "save/"+Version)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("%s answered %s", config.NotifyWebhook, resp.Status)
+		}
+		return nil
+
+	case notifyHook:
+		if strings.TrimSpace(config.NotifyHook) == "" {
+			return fmt.Errorf("notify_hook is not set")
+		}
+		cmd, err := buildCommandContext(ctx, "", config.NotifyHook, nil)
+		if err != nil {
+			return err
+		}
+		payload, _ := json.Marshal(n)
+		cmd.Stdin = bytes.NewReader(payload)
+		cmd.Env = append(os.Environ(),
+			"SAVE_NOTIFY_KIND="+n.Kind,
+			"SAVE_NOTIFY_ID="+strconv.Itoa(n.ID),
+			"SAVE_NOTIFY_NAME="+n.Name,
+			"SAVE_NOTIFY_SUCCESS="+strconv.FormatBool(n.Success),
+			"SAVE_NOTIFY_EXIT_CODE="+strconv.Itoa(n.ExitCode),
+			"SAVE_NOTIFY_DURATION_MS="+strconv.FormatInt(n.DurationMs, 10),
+			"SAVE_NOTIFY_MESSAGE="+n.Message,
+		)
+		return runNotifier(cmd)
+	}
+	return fmt.Errorf("unknown channel")
+}
+
+// runNotifier runs a notification command, returning its output as the
+// error if it fails.
+func runNotifier(cmd *exec.Cmd) error {
+	out, err := cmd.CombinedOutput()
+	if err != nil && len(bytes.TrimSpace(out)) > 0 {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return err
+}
+
+// TestNotify sends a made-up notification through every configured
+// channel, regardless of notify_after, and reports how each one did.
+func TestNotify(success bool) error {
+	if len(config.Notify) == 0 {
+		return fmt.Errorf("no notification channels set, e.g. save config set notify bell desktop")
+	}
+	n := Notification{
+		Kind:       "command",
+		Name:       "test notification",
+		Command:    "save --test-notify",
+		Success:    success,
+		StartedAt:  time.Now().Add(-42 * time.Second),
+		DurationMs: 42000,
+		Duration:   "42s",
+	}
+	if !success {
+		n.ExitCode = 1
+	}
+	fmt.Printf("Sending a test notification through %s\n", strings.Join(config.Notify, ", "))
+	n.Dir, _ = os.Getwd()
+	n.Host, _ = os.Hostname()
+
+	failed := sendNotification(n)
+	if err, ok := failed["notify_template"]; ok {
+		return fmt.Errorf("notify_template: %w", err)
+	}
+	for _, channel := range config.Notify {
+		if err, ok := failed[channel]; ok {
+			fmt.Printf("  %-8s failed: %v\n", channel, err)
+		} else {
+			fmt.Printf("  %-8s sent\n", channel)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d channels failed", len(failed), len(config.Notify))
+	}
+	return nil
+}
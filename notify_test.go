@@ -0,0 +1,146 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookServer records the notifications posted to it, and answers with
+// status.
+type webhookServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	received []Notification
+	headers  []http.Header
+}
+
+func startWebhook(t *testing.T, status int) *webhookServer {
+	w := &webhookServer{}
+	w.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var n Notification
+		if r.Method != http.MethodPost {
+			t.Errorf("webhook got a %s request", r.Method)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("webhook payload: %v", err)
+		}
+		w.mu.Lock()
+		w.received = append(w.received, n)
+		w.headers = append(w.headers, r.Header)
+		w.mu.Unlock()
+		rw.WriteHeader(status)
+	}))
+	t.Cleanup(w.Close)
+	return w
+}
+
+func (w *webhookServer) notifications() []Notification {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]Notification(nil), w.received...)
+}
+
+// useNotifyConfig makes the webhook the only channel, with settings
+// changed by change, until the test ends.
+func useNotifyConfig(t *testing.T, url string, change func(c *Config)) {
+	t.Helper()
+	saved := config
+	t.Cleanup(func() { config = saved })
+	c := defaultConfig()
+	c.Notify = []string{notifyWebhook}
+	c.NotifyWebhook = url
+	c.NotifyAfter = "1s"
+	if change != nil {
+		change(c)
+	}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	config = c
+}
+
+func TestNotifyWebhookPayload(t *testing.T) {
+	hook := startWebhook(t, http.StatusOK)
+	useNotifyConfig(t, hook.URL, func(c *Config) {
+		c.NotifyTemplate = `{{.Kind}} {{.Name}}: {{if .Success}}ok{{else}}exit {{.ExitCode}}{{end}} after {{.Duration}}`
+	})
+
+	start := time.Now().Add(-3 * time.Second)
+	notifyCommandRun(Command{ID: 7, Name: "deploy", Raw: "make deploy"}, 2, start, 3*time.Second)
+	got := hook.notifications()
+	if len(got) != 1 {
+		t.Fatalf("webhook got %d notifications, want 1", len(got))
+	}
+	n := got[0]
+	if n.Kind != "command" || n.ID != 7 || n.Name != "deploy" || n.Command != "make deploy" {
+		t.Errorf("payload names %s #%d %q (%q), want command #7 deploy (make deploy)", n.Kind, n.ID, n.Name, n.Command)
+	}
+	if n.Success || n.ExitCode != 2 || n.DurationMs != 3000 || n.Duration != "3s" || !n.StartedAt.Equal(start) {
+		t.Errorf("payload result %+v, want a failure with exit code 2 after 3s", n)
+	}
+	if want := "command deploy: exit 2 after 3s"; n.Message != want {
+		t.Errorf("message %q, want %q", n.Message, want)
+	}
+	if ct := hook.headers[0].Get("Content-Type"); ct != "application/json" {
+		t.Errorf("content type %q", ct)
+	}
+
+	// Chains report the exit code of their last step
+	notifyChainRun(&ChainRunRecord{ChainID: 3, Chain: "release", StartedAt: start, DurationMs: 5000,
+		Steps: []StepRunRecord{{ExitCode: 0}, {ExitCode: 4}}})
+	got = hook.notifications()
+	if len(got) != 2 || got[1].Kind != "chain" || got[1].ExitCode != 4 || got[1].Message != "chain release: exit 4 after 5s" {
+		t.Errorf("chain notification %+v", got[len(got)-1])
+	}
+}
+
+func TestNotifyThreshold(t *testing.T) {
+	tests := []struct {
+		name     string
+		notifyOn string
+		duration time.Duration
+		exitCode int
+		want     bool
+	}{
+		{"short run", "always", 999 * time.Millisecond, 1, false},
+		{"at the threshold", "always", time.Second, 0, true},
+		{"long success", "always", time.Minute, 0, true},
+		{"success, failures only", "failure", time.Minute, 0, false},
+		{"failure, failures only", "failure", time.Minute, 1, true},
+		{"short failure, failures only", "failure", 10 * time.Millisecond, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := startWebhook(t, http.StatusNoContent)
+			useNotifyConfig(t, hook.URL, func(c *Config) { c.NotifyOn = tt.notifyOn })
+			notifyCommandRun(Command{ID: 1, Raw: "make"}, tt.exitCode, time.Now(), tt.duration)
+			if sent := len(hook.notifications()) > 0; sent != tt.want {
+				t.Errorf("notified: %v, want %v", sent, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotifyWebhookError(t *testing.T) {
+	hook := startWebhook(t, http.StatusInternalServerError)
+	useNotifyConfig(t, hook.URL, nil)
+	failed := sendNotification(Notification{Kind: "command", Name: "make"})
+	err := failed[notifyWebhook]
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("webhook answering 500: error %v, want one naming the status", err)
+	}
+
+	useNotifyConfig(t, "http://127.0.0.1:1", nil)
+	if failed := sendNotification(Notification{Kind: "command", Name: "make"}); failed[notifyWebhook] == nil {
+		t.Error("unreachable webhook reported no error")
+	}
+}
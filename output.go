@@ -0,0 +1,290 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+)
+
+// outputFormat is the --output format for read commands. The empty format
+// is the regular human-readable output.
+var outputFormat string
+
+// outputTemplate is the parsed --format template.
+var outputTemplate *template.Template
+
+var outputFormats = []string{"json", "jsonl", "table", "plain", "template"}
+
+// readCommands are the commands that honour --output and --format.
+var readCommands = map[string]bool{
+	"--list":           true,
+	"--search":         true,
+	"--filter-dir":     true,
+	"--filter-tag":     true,
+	"--list-tags":      true,
+	"--list-chains":    true,
+	"--stats":          true,
+	"--list-backups":   true,
+	"--list-favorites": true,
+	"-lf":              true,
+	"--list-schedules": true,
+}
+
+// setOutputFormat validates and applies --output and --format. A template
+// on its own implies --output template.
+func setOutputFormat(format, tmpl string) error {
+	if format == "" && tmpl != "" {
+		format = "template"
+	}
+	valid := format == ""
+	for _, f := range outputFormats {
+		valid = valid || f == format
+	}
+	if !valid {
+		return fmt.Errorf("invalid output format '%s', expected one of %s", format, strings.Join(outputFormats, ", "))
+	}
+
+	if format == "template" {
+		if tmpl == "" {
+			return fmt.Errorf("--output template requires --format '<template>'")
+		}
+		t, err := template.New("format").Funcs(template.FuncMap{
+			"join": strings.Join,
+			"json": func(v any) (string, error) {
+				data, err := json.Marshal(v)
+				return string(data), err
+			},
+		}).Parse(tmpl)
+		if err != nil {
+			return fmt.Errorf("invalid --format template: %w", err)
+		}
+		outputTemplate = t
+	} else if tmpl != "" {
+		return fmt.Errorf("--format can only be used with --output template")
+	}
+
+	outputFormat = format
+	return nil
+}
+
+// extractOutputOptions removes --output/-o and --format from args and
+// returns what was given.
+func extractOutputOptions(args []string) (rest []string, format, tmpl string, err error) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		var target *string
+		switch {
+		case arg == "--output" || arg == "-o":
+			target = &format
+		case arg == "--format":
+			target = &tmpl
+		case strings.HasPrefix(arg, "--output="):
+			format = strings.TrimPrefix(arg, "--output=")
+			continue
+		case strings.HasPrefix(arg, "--format="):
+			tmpl = strings.TrimPrefix(arg, "--format=")
+			continue
+		default:
+			rest = append(rest, arg)
+			continue
+		}
+		if i+1 >= len(args) {
+			return nil, "", "", fmt.Errorf("%s requires a value", arg)
+		}
+		i++
+		*target = args[i]
+	}
+	return rest, format, tmpl, nil
+}
+
+// outputColumn is one column of table and plain output.
+type outputColumn[T any] struct {
+	Header string
+	Value  func(T) string
+}
+
+// writeRecords prints records in the selected machine-readable format.
+// It must only be called when outputFormat is set.
+func writeRecords[T any](records []T, columns []outputColumn[T]) error {
+	if records == nil {
+		records = []T{}
+	}
+
+	switch outputFormat {
+	case "json":
+		data, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+
+	case "jsonl":
+		enc := json.NewEncoder(os.Stdout)
+		for _, record := range records {
+			if err := enc.Encode(record); err != nil {
+				return err
+			}
+		}
+
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		headers := make([]string, len(columns))
+		for i, col := range columns {
+			headers[i] = col.Header
+		}
+		fmt.Fprintln(w, strings.Join(headers, "\t"))
+		for _, record := range records {
+			fmt.Fprintln(w, strings.Join(columnValues(record, columns), "\t"))
+		}
+		return w.Flush()
+
+	case "plain":
+		// Tab separated without a header, for cut and friends
+		for _, record := range records {
+			fmt.Println(strings.Join(columnValues(record, columns), "\t"))
+		}
+
+	case "template":
+		for _, record := range records {
+			if err := outputTemplate.Execute(os.Stdout, record); err != nil {
+				return fmt.Errorf("failed to render --format template: %w", err)
+			}
+			fmt.Println()
+		}
+	}
+	return nil
+}
+
+func columnValues[T any](record T, columns []outputColumn[T]) []string {
+	values := make([]string, len(columns))
+	for i, col := range columns {
+		// Keep one record per line even for multi-line values
+		values[i] = strings.NewReplacer("\t", " ", "\n", " ").Replace(col.Value(record))
+	}
+	return values
+}
+
+// writeOutput prints records with writeRecords and exits on failure.
+func writeOutput[T any](records []T, columns []outputColumn[T]) {
+	if err := writeRecords(records, columns); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+var commandColumns = []outputColumn[Command]{
+	{"ID", func(c Command) string { return strconv.Itoa(c.ID) }},
+	{"NAME", func(c Command) string { return c.Name }},
+	{"COMMAND", func(c Command) string { return c.Raw }},
+	{"TAGS", func(c Command) string { return strings.Join(c.Tags, ",") }},
+	{"DIR", func(c Command) string { return c.Dir }},
+	{"RUNS", func(c Command) string { return strconv.Itoa(c.RunCount) }},
+	{"SUCCESS", func(c Command) string {
+		return fmt.Sprintf("%.1f%%", calculateSuccessRate(c.RunCount, c.SuccessCount))
+	}},
+	{"CREATED", func(c Command) string { return c.Timestamp.Format(time.RFC3339) }},
+	{"SHELL", func(c Command) string { return effectiveShell(c.Shell) }},
+}
+
+var chainColumns = []outputColumn[CommandChain]{
+	{"ID", func(c CommandChain) string { return strconv.Itoa(c.ID) }},
+	{"NAME", func(c CommandChain) string { return c.Name }},
+	{"STEPS", func(c CommandChain) string { return strconv.Itoa(len(c.Steps)) }},
+	{"RUNS", func(c CommandChain) string { return strconv.Itoa(c.RunCount) }},
+	{"SUCCESS", func(c CommandChain) string { return fmt.Sprintf("%.1f%%", c.SuccessRate) }},
+	{"DESCRIPTION", func(c CommandChain) string { return c.Description }},
+}
+
+// TagCount is one entry of --list-tags.
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+var tagColumns = []outputColumn[TagCount]{
+	{"TAG", func(t TagCount) string { return t.Tag }},
+	{"COUNT", func(t TagCount) string { return strconv.Itoa(t.Count) }},
+}
+
+// BackupInfo is one entry of --list-backups.
+type BackupInfo struct {
+	Path     string    `json:"path"`
+	Modified time.Time `json:"modified"`
+	Size     int64     `json:"size"`
+}
+
+var backupColumns = []outputColumn[BackupInfo]{
+	{"PATH", func(b BackupInfo) string { return b.Path }},
+	{"MODIFIED", func(b BackupInfo) string { return b.Modified.Format(time.RFC3339) }},
+	{"SIZE", func(b BackupInfo) string { return strconv.FormatInt(b.Size, 10) }},
+}
+
+var statsColumns = []outputColumn[StatsReport]{
+	{"RUNS", func(r StatsReport) string { return strconv.Itoa(r.Runs) }},
+	{"FAILURES", func(r StatsReport) string { return strconv.Itoa(r.Failures) }},
+	{"FAILURE_RATE", func(r StatsReport) string { return fmt.Sprintf("%.2f%%", r.FailureRate) }},
+	{"MEDIAN_MS", func(r StatsReport) string { return strconv.FormatInt(r.MedianMs, 10) }},
+	{"P95_MS", func(r StatsReport) string { return strconv.FormatInt(r.P95Ms, 10) }},
+	{"NEW", func(r StatsReport) string { return strconv.Itoa(r.NewCommands) }},
+	{"REPEATED", func(r StatsReport) string { return strconv.Itoa(r.RepeatedCommands) }},
+}
+
+// tagCounts returns every tag with the number of commands using it, most
+// used first.
+func (cs *CommandStore) tagCounts() []TagCount {
+	counts := make(map[string]int)
+	for _, cmd := range cs.commands {
+		for _, tag := range cmd.Tags {
+			counts[tag]++
+		}
+	}
+
+	tags := make([]TagCount, 0, len(counts))
+	for tag, count := range counts {
+		tags = append(tags, TagCount{Tag: tag, Count: count})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Count != tags[j].Count {
+			return tags[i].Count > tags[j].Count
+		}
+		return tags[i].Tag < tags[j].Tag
+	})
+	return tags
+}
+
+// listBackupFiles returns the backups in the backup directory.
+func (cs *CommandStore) listBackupFiles() ([]BackupInfo, error) {
+	backupDir := filepath.Join(filepath.Dir(cs.filepath), "backups")
+	files, err := os.ReadDir(backupDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var backups []BackupInfo
+	for _, file := range files {
+		if file.IsDir() || !strings.HasPrefix(file.Name(), "save-history-") {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, BackupInfo{
+			Path:     filepath.Join(backupDir, file.Name()),
+			Modified: info.ModTime(),
+			Size:     info.Size(),
+		})
+	}
+	return backups, nil
+}
@@ -0,0 +1,471 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// ChainRunOptions change how a chain runs.
+type ChainRunOptions struct {
+	MaxParallel int               // Commands of a parallel step running at once, 0 for no limit
+	Dashboard   bool              // Show parallel steps as a live status board
+	Vars        map[string]string // Chain variables given with --var
+	FromStep    int               // Start at this step (1-based), 0 for the first
+	OnlyStep    int               // Run only this step (1-based)
+	Resume      *ChainRunRecord   // Continue this failed run from its checkpoint
+	MarkFixed   bool              // Treat the resumed run's failed step as done
+	Confirmed   bool              // Dangerous steps were already confirmed, as by save watch
+
+	dependents []int // Chains waiting for this one's dependencies, to catch cycles
+}
+
+// Parallel step policies decide when a step with parallel commands fails.
+const (
+	policyAllMustSucceed = "all_must_succeed" // Any failing command fails the step (default)
+	policyMainOnly       = "main_only"        // Only the main command counts
+	policyAnySucceeds    = "any_succeeds"     // The step fails only if every command fails
+	policyBestEffort     = "best_effort"      // Failures are reported but never fail the step
+)
+
+var parallelPolicies = []string{policyAllMustSucceed, policyMainOnly, policyAnySucceeds, policyBestEffort}
+
+// dashboardLines is how many of its latest output lines the dashboard
+// shows per command.
+const dashboardLines = 2
+
+// dashboardInterval is how often the dashboard is redrawn.
+const dashboardInterval = 250 * time.Millisecond
+
+// Branch states, in the order a branch goes through them.
+const (
+	branchWaiting   = "waiting"
+	branchRunning   = "running"
+	branchOK        = "ok"
+	branchFailed    = "failed"
+	branchCancelled = "cancelled"
+)
+
+// branchResult is one command of a parallel step.
+type branchResult struct {
+	Role     string // "main" or "parallel"
+	Command  Command
+	Label    string
+	State    string
+	Err      error
+	ExitCode int
+	Output   string
+	Stdout   string // Output without stderr, kept for the main command's captures
+	Started  time.Time
+	Duration time.Duration
+
+	tail *lineTail // Latest output lines, for the dashboard
+}
+
+// runParallelStep runs a step's main command together with its parallel
+// commands, at most opts.MaxParallel at a time. With step.FailFast the
+// first failure that fails the step under its policy stops the others;
+// otherwise all of them finish. Results are in step order, main command
+// first.
+func (cs *CommandStore) runParallelStep(run *ChainRunRecord, stepIndex int, step ChainStep, vars map[string]string, opts ChainRunOptions) ([]*branchResult, error) {
+	var branches []*branchResult
+	for i, id := range append([]int{step.CommandID}, step.ParallelWith...) {
+		cmd := cs.findCommand(id)
+		if cmd == nil {
+			return nil, fmt.Errorf("command with ID %d not found", id)
+		}
+		role := "parallel"
+		if i == 0 {
+			role = "main"
+		}
+		branches = append(branches, &branchResult{
+			Role:    role,
+			Command: *cmd,
+			Label:   stepLabel(*cmd),
+			State:   branchWaiting,
+			tail:    &lineTail{max: dashboardLines},
+		})
+	}
+
+	limit := opts.MaxParallel
+	if limit <= 0 || limit > len(branches) {
+		limit = len(branches)
+	}
+	slots := make(chan struct{}, limit)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex // Guards the state of the branches
+	var board *dashboard
+	if opts.Dashboard && isTerminal(os.Stdout) {
+		board = newDashboard(branches, &mu)
+		board.start()
+	}
+
+	// Commands start in step order as slots free up
+	var wg sync.WaitGroup
+	for _, b := range branches {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		mu.Lock()
+		if ctx.Err() != nil {
+			b.State = branchCancelled
+			mu.Unlock()
+			continue
+		}
+		b.State = branchRunning
+		b.Started = time.Now()
+		mu.Unlock()
+
+		wg.Add(1)
+		go func(b *branchResult) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			stepOpts := stepOptions{label: b.Label}
+			if board != nil {
+				stepOpts = stepOptions{output: b.tail}
+			}
+			if b.Role == "main" && len(step.Capture) > 0 {
+				stepOpts.stdout = &tailBuffer{max: maxCapturedOutput}
+			}
+			text, missing := expandVars(b.Command.Raw, vars)
+			warnMissingVars(stepIndex, missing)
+			execCmd, err := buildCommandContext(ctx, b.Command.Shell, text, nil)
+			var output string
+			if err == nil {
+				if env := varEnv(vars); len(env) > 0 {
+					execCmd.Env = append(os.Environ(), env...)
+				}
+				output, err = runStep(execCmd, stepOpts)
+			}
+			duration := time.Since(b.Started)
+			cs.recordStepRun(run, stepIndex, b.Role, b.Command, err, output, b.Started, duration)
+
+			mu.Lock()
+			defer mu.Unlock()
+			b.Err, b.ExitCode, b.Output, b.Duration = err, stepExitCode(err), output, duration
+			if stepOpts.stdout != nil {
+				b.Stdout = normalizeNewlines(stepOpts.stdout.String())
+			}
+			switch {
+			case err == nil:
+				b.State = branchOK
+			case ctx.Err() != nil:
+				b.State = branchCancelled
+			default:
+				b.State = branchFailed
+				if step.FailFast && decidesFailure(stepPolicy(step), b) {
+					cancel()
+				}
+			}
+		}(b)
+	}
+	wg.Wait()
+
+	if board != nil {
+		board.stop()
+	}
+	printBranchSummary(stepIndex, branches)
+	return branches, nil
+}
+
+// stepLabel names a command in chain output: by name, or "#<id>".
+func stepLabel(cmd Command) string {
+	if cmd.Name != "" {
+		return cmd.Name
+	}
+	return fmt.Sprintf("#%d", cmd.ID)
+}
+
+// stepPolicy returns the policy of a step with parallel commands.
+func stepPolicy(step ChainStep) string {
+	if step.Policy == "" {
+		return policyAllMustSucceed
+	}
+	return step.Policy
+}
+
+// stepFailures returns the failed commands that fail the step under
+// policy, or nil if the step succeeded.
+func stepFailures(policy string, branches []*branchResult) []*branchResult {
+	var failed []*branchResult
+	succeeded := false
+	for _, b := range branches {
+		switch b.State {
+		case branchFailed:
+			failed = append(failed, b)
+		case branchOK:
+			succeeded = true
+		}
+	}
+
+	switch policy {
+	case policyMainOnly:
+		if main := branches[0]; main.State != branchOK {
+			return []*branchResult{main}
+		}
+		return nil
+	case policyAnySucceeds:
+		if succeeded {
+			return nil
+		}
+	case policyBestEffort:
+		return nil
+	}
+	if len(failed) == 0 && !succeeded {
+		// Everything was cancelled
+		return branches[:1]
+	}
+	return failed
+}
+
+// decidesFailure reports whether b failing already fails its step under
+// policy, so that fail_fast can stop the other commands.
+func decidesFailure(policy string, b *branchResult) bool {
+	switch policy {
+	case policyMainOnly:
+		return b.Role == "main"
+	case policyAnySucceeds, policyBestEffort:
+		return false
+	}
+	return true
+}
+
+// describeFailures lists failed commands for an error message.
+func describeFailures(failures []*branchResult) string {
+	parts := make([]string, len(failures))
+	for i, b := range failures {
+		if b.State == branchCancelled {
+			parts[i] = fmt.Sprintf("%s was cancelled", b.Label)
+		} else {
+			parts[i] = fmt.Sprintf("%s (%s) exited %d", b.Label, b.Role, b.ExitCode)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// stepFailure describes a failed command to on_failure handlers.
+type stepFailure struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name,omitempty"`
+	Role     string `json:"role"`
+	ExitCode int    `json:"exit_code"`
+	Command  string `json:"command"`
+}
+
+// failureEnv returns the environment that tells on_failure handlers which
+// commands of a step failed:
+//
+//	SAVE_FAILED_STEP      the step number
+//	SAVE_FAILED_COMMANDS  IDs of the failed commands, space separated
+//	SAVE_FAILED_NAMES     their names, or #<id>, space separated
+//	SAVE_FAILURES         a JSON array with id, name, role, exit_code and command
+func failureEnv(stepIndex int, failures []*branchResult) []string {
+	var ids, names []string
+	details := make([]stepFailure, 0, len(failures))
+	for _, b := range failures {
+		ids = append(ids, fmt.Sprint(b.Command.ID))
+		names = append(names, b.Label)
+		details = append(details, stepFailure{
+			ID:       b.Command.ID,
+			Name:     b.Command.Name,
+			Role:     b.Role,
+			ExitCode: b.ExitCode,
+			Command:  b.Command.Raw,
+		})
+	}
+	data, _ := json.Marshal(details)
+	return []string{
+		fmt.Sprintf("SAVE_FAILED_STEP=%d", stepIndex+1),
+		"SAVE_FAILED_COMMANDS=" + strings.Join(ids, " "),
+		"SAVE_FAILED_NAMES=" + strings.Join(names, " "),
+		"SAVE_FAILURES=" + string(data),
+	}
+}
+
+// printBranchSummary prints the result of every command of a parallel
+// step.
+func printBranchSummary(stepIndex int, branches []*branchResult) {
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
+
+	fmt.Printf("\nStep %d results:\n", stepIndex+1)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  COMMAND\tROLE\tSTATUS\tEXIT\tDURATION\tRUN")
+	for _, b := range branches {
+		exit, duration := "-", "-"
+		if b.State == branchOK || b.State == branchFailed {
+			exit = fmt.Sprint(b.ExitCode)
+		}
+		if !b.Started.IsZero() {
+			duration = formatDuration(b.Duration.Milliseconds())
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\t%s\n", b.Label, b.Role, b.State, exit, duration, firstLine(b.Command.Raw))
+	}
+	w.Flush()
+	fmt.Println()
+}
+
+// firstLine returns the first line of s, marking that more follow.
+func firstLine(s string) string {
+	if line, _, more := strings.Cut(s, "\n"); more {
+		return line + " ..."
+	}
+	return s
+}
+
+// ansiEscape matches terminal escape sequences, which the dashboard drops
+// from command output.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b\][^\x07]*\x07|\x1b[@-_]`)
+
+// lineTail keeps the last max complete or partial lines written to it. A
+// carriage return starts the current line over, as on a terminal.
+type lineTail struct {
+	mu    sync.Mutex
+	max   int
+	lines []string
+	cur   string
+	cr    bool // The current line ended with a carriage return
+}
+
+func (t *lineTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, r := range ansiEscape.ReplaceAllString(string(p), "") {
+		switch r {
+		case '\n':
+			t.lines = append(t.lines, t.cur)
+			if len(t.lines) > t.max {
+				t.lines = t.lines[1:]
+			}
+			t.cur, t.cr = "", false
+		case '\r':
+			// Keep what was drawn until the redraw arrives
+			t.cr = true
+		default:
+			if t.cr {
+				t.cur, t.cr = "", false
+			}
+			t.cur += string(r)
+		}
+	}
+	return len(p), nil
+}
+
+// Lines returns the latest lines, oldest first.
+func (t *lineTail) Lines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lines := append([]string(nil), t.lines...)
+	if t.cur != "" {
+		lines = append(lines, t.cur)
+	}
+	if len(lines) > t.max {
+		lines = lines[len(lines)-t.max:]
+	}
+	return lines
+}
+
+// dashboard redraws the state of parallel commands in place.
+type dashboard struct {
+	branches []*branchResult
+	mu       *sync.Mutex // Guards the state of the branches
+	height   int         // Lines drawn last time
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+func newDashboard(branches []*branchResult, mu *sync.Mutex) *dashboard {
+	return &dashboard{branches: branches, mu: mu, done: make(chan struct{}), stopped: make(chan struct{})}
+}
+
+func (d *dashboard) start() {
+	go func() {
+		defer close(d.stopped)
+		ticker := time.NewTicker(dashboardInterval)
+		defer ticker.Stop()
+		for {
+			d.draw()
+			select {
+			case <-ticker.C:
+			case <-d.done:
+				d.draw()
+				return
+			}
+		}
+	}()
+}
+
+// stop draws the final state and waits for the dashboard to finish.
+func (d *dashboard) stop() {
+	close(d.done)
+	<-d.stopped
+}
+
+func (d *dashboard) draw() {
+	width := terminalWidth()
+	green, red, yellow, dim, reset := "\033[32m", "\033[31m", "\033[33m", "\033[2m", "\033[0m"
+	if !config.useColor() {
+		green, red, yellow, dim, reset = "", "", "", "", ""
+	}
+	// Lines must not wrap, or moving back up would miss some
+	fit := func(s string, room int) string {
+		room = max(room, 10)
+		if runes := []rune(s); len(runes) > room {
+			return string(runes[:room-3]) + "..."
+		}
+		return s
+	}
+
+	d.mu.Lock()
+	var b strings.Builder
+	if d.height > 0 {
+		fmt.Fprintf(&b, "\033[%dA", d.height)
+	}
+	lines := 0
+	for _, branch := range d.branches {
+		var status string
+		switch branch.State {
+		case branchWaiting:
+			status = dim + "… waiting" + reset
+		case branchRunning:
+			status = yellow + "▶ running " + time.Since(branch.Started).Truncate(100*time.Millisecond).String() + reset
+		case branchOK:
+			status = green + "✓ ok " + branch.Duration.Truncate(100*time.Millisecond).String() + reset
+		case branchFailed:
+			status = red + fmt.Sprintf("✗ exit %d %s", branch.ExitCode, branch.Duration.Truncate(100*time.Millisecond)) + reset
+		case branchCancelled:
+			status = dim + "- cancelled" + reset
+		}
+		label := fit(branch.Label, width/3)
+		fmt.Fprintf(&b, "\033[2K%s %s  %s%s%s\n", label, status, dim, fit(firstLine(branch.Command.Raw), width-len(label)-26), reset)
+		output := branch.tail.Lines()
+		for i := 0; i < dashboardLines; i++ {
+			line := ""
+			if i < len(output) {
+				line = fit(output[i], width-5)
+			}
+			fmt.Fprintf(&b, "\033[2K    %s\n", line)
+		}
+		lines += 1 + dashboardLines
+	}
+	d.height = lines
+	d.mu.Unlock()
+
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
+	os.Stdout.WriteString(b.String())
+}
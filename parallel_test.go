@@ -0,0 +1,108 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newChainStore returns a store in a temporary directory holding a chain
+// of one step: main in parallel with parallel, and onFailure as its
+// failure handler. Commands are shell scripts numbered from 1 in that
+// order and named after their role.
+func newChainStore(t *testing.T, policy, main string, parallel []string, onFailure string) (*CommandStore, *CommandChain) {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	cs := &CommandStore{filepath: filepath.Join(t.TempDir(), "history.json")}
+	if err := cs.load(); err != nil {
+		t.Fatal(err)
+	}
+	add := func(name, raw string) int {
+		cs.lastID++
+		cs.commands = append(cs.commands, Command{ID: cs.lastID, Name: name, Raw: raw, Timestamp: time.Now()})
+		return cs.lastID
+	}
+
+	step := ChainStep{CommandID: add("main", main), Policy: policy}
+	for i, raw := range parallel {
+		step.ParallelWith = append(step.ParallelWith, add("side"+string(rune('a'+i)), raw))
+	}
+	if onFailure != "" {
+		step.OnFailure = []int{add("handler", onFailure)}
+	}
+	cs.lastChainID++
+	cs.chains = append(cs.chains, CommandChain{ID: cs.lastChainID, Name: "test", Steps: []ChainStep{step}})
+	if err := cs.save(); err != nil {
+		t.Fatal(err)
+	}
+	return cs, &cs.chains[0]
+}
+
+func TestParallelPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		main     string
+		parallel []string
+		wantErr  bool
+	}{
+		{"all succeed", policyAllMustSucceed, "exit 0", []string{"exit 0", "exit 0"}, false},
+		{"all, side fails", policyAllMustSucceed, "exit 0", []string{"exit 0", "exit 1"}, true},
+		{"all, main fails", policyAllMustSucceed, "exit 1", []string{"exit 0"}, true},
+		{"default is all", "", "exit 0", []string{"exit 1"}, true},
+		{"main only, sides fail", policyMainOnly, "exit 0", []string{"exit 1", "exit 2"}, false},
+		{"main only, main fails", policyMainOnly, "exit 1", []string{"exit 0"}, true},
+		{"any, one side succeeds", policyAnySucceeds, "exit 1", []string{"exit 1", "sleep 0.1; exit 0"}, false},
+		{"any, all fail", policyAnySucceeds, "exit 1", []string{"exit 2"}, true},
+		{"best effort, all fail", policyBestEffort, "exit 1", []string{"exit 2"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs, chain := newChainStore(t, tt.policy, tt.main, tt.parallel, "")
+			err := cs.ExecuteChainWithDependencies(chain.ID, ChainRunOptions{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error %v, want error: %v", err, tt.wantErr)
+			}
+			run := cs.lastChainRun(chain.ID)
+			if run == nil {
+				t.Fatal("no chain run recorded")
+			}
+			if len(run.Steps) != 1+len(tt.parallel) {
+				t.Errorf("recorded %d commands, want every command of the step", len(run.Steps))
+			}
+		})
+	}
+}
+
+func TestOnFailureGetsFailedBranch(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "failed")
+	handler := `echo "$SAVE_FAILED_STEP|$SAVE_FAILED_COMMANDS|$SAVE_FAILED_NAMES" > ` + out
+	cs, chain := newChainStore(t, policyAllMustSucceed, "exit 0", []string{"exit 0", "exit 3"}, handler)
+	if err := cs.ExecuteChainWithDependencies(chain.ID, ChainRunOptions{}); err == nil {
+		t.Error("chain succeeded with a failed parallel command")
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("on_failure did not run: %v", err)
+	}
+	if got, want := strings.TrimSpace(string(data)), "1|3|sideb"; got != want {
+		t.Errorf("on_failure saw %q, want %q", got, want)
+	}
+}
+
+func TestOnFailureSkippedWhenPolicyForgives(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "failed")
+	cs, chain := newChainStore(t, policyMainOnly, "exit 0", []string{"exit 1"}, "touch "+out)
+	if err := cs.ExecuteChainWithDependencies(chain.ID, ChainRunOptions{}); err != nil {
+		t.Errorf("main_only step failed on a parallel command: %v", err)
+	}
+	if _, err := os.Stat(out); err == nil {
+		t.Error("on_failure ran for a step that succeeded")
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Plugins are executables named save-<name> on PATH. Like git's, they run
+// as the subcommand <name>, unless save has a subcommand of that name. A
+// saved command or chain called <name> runs instead of the plugin, so
+// installing one never changes what an existing name refers to.
+const pluginPrefix = "save-"
+
+var pluginNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// findPlugin returns the path of the plugin providing the subcommand name,
+// or "" if there is none.
+func findPlugin(name string) string {
+	if !pluginNameRe.MatchString(name) || findSubcommand(name) != nil {
+		return ""
+	}
+	path, err := exec.LookPath(pluginPrefix + name)
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+// savedRunArgs returns the arguments that run the saved command or chain
+// called name with args, or nil if there is none.
+func (cs *CommandStore) savedRunArgs(name string, args []string) []string {
+	if cmd := cs.findCommandByName(name); cmd != nil {
+		return append([]string{"run", strconv.Itoa(cmd.ID)}, args...)
+	}
+	if chain := cs.findChainByName(name); chain != nil {
+		return append([]string{"--run-chain", strconv.Itoa(chain.ID)}, args...)
+	}
+	return nil
+}
+
+// listPlugins returns the names of the plugins on PATH, sorted. Earlier
+// PATH entries shadow later ones, as they do when a plugin is run. Plugins
+// that the names of saved commands and chains in store hide are left out;
+// store may be nil.
+func listPlugins(store *CommandStore) []string {
+	var names []string
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			name, ok := strings.CutPrefix(entry.Name(), pluginPrefix)
+			if runtime.GOOS == "windows" {
+				name = strings.TrimSuffix(name, filepath.Ext(name))
+			}
+			if !ok || !pluginNameRe.MatchString(name) || findSubcommand(name) != nil || slices.Contains(names, name) || (store != nil && store.savedRunArgs(name, nil) != nil) {
+				continue
+			}
+			if info, err := entry.Info(); err != nil || info.IsDir() || (runtime.GOOS != "windows" && info.Mode()&0111 == 0) {
+				continue
+			}
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// runPlugin runs a plugin with args and the terminal, and returns its exit
+// code. SAVE_BIN, SAVE_VERSION, SAVE_HISTORY_PATH and SAVE_CONFIG_PATH
+// tell it how to call back into save and where its data lives.
+func runPlugin(path string, args []string) (int, error) {
+	cmd := exec.Command(path, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), "SAVE_VERSION="+Version)
+	if self, err := os.Executable(); err == nil {
+		cmd.Env = append(cmd.Env, "SAVE_BIN="+self)
+	}
+	if store, err := NewCommandStore(); err == nil {
+		cmd.Env = append(cmd.Env, "SAVE_HISTORY_PATH="+store.filepath)
+	}
+	if configPath, err := configFilePath(); err == nil {
+		cmd.Env = append(cmd.Env, "SAVE_CONFIG_PATH="+configPath)
+	}
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if exitErr.ExitCode() < 0 {
+			// Killed by a signal
+			return 1, nil
+		}
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
@@ -0,0 +1,292 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// conditionState is what a dry run knows about a condition.
+type conditionState int
+
+const (
+	condFalse conditionState = iota
+	condTrue
+	condUnknown // Only decided when the chain runs
+)
+
+var stepVerbs = map[conditionState]string{
+	condTrue:    "run ",
+	condFalse:   "skip",
+	condUnknown: "run?",
+}
+
+// chainPreview prints the plan of a chain run without running anything.
+type chainPreview struct {
+	cs      *CommandStore
+	opts    ChainRunOptions
+	explain bool
+	stack   []int        // Chains being previewed, to catch cycles
+	planned map[int]bool // Chains that may have run before the current one
+}
+
+// PreviewChain prints what running a chain would do: its dependencies in
+// order, then each step with its parallel commands, handlers and the
+// commands with variables filled in. Conditions are evaluated unless they
+// depend on what earlier steps do; with explain the result of each one is
+// shown.
+func (cs *CommandStore) PreviewChain(chainID int, opts ChainRunOptions, explain bool) error {
+	p := &chainPreview{cs: cs, opts: opts, explain: explain, planned: make(map[int]bool)}
+	fmt.Println("Dry run, nothing is executed.")
+	return p.chain(chainID, "", "")
+}
+
+func chainLabel(chain *CommandChain) string {
+	if chain.Name != "" {
+		return chain.Name
+	}
+	return fmt.Sprintf("#%d", chain.ID)
+}
+
+func (p *chainPreview) chain(chainID int, indent, note string) error {
+	chain := p.cs.findChain(chainID)
+	if chain == nil {
+		return fmt.Errorf("chain with ID %d not found", chainID)
+	}
+	if slices.Contains(p.stack, chainID) {
+		return fmt.Errorf("chain %s depends on itself", chainLabel(chain))
+	}
+	p.stack = append(p.stack, chainID)
+	defer func() { p.stack = p.stack[:len(p.stack)-1] }()
+
+	// Dependencies run first, the same way ExecuteChainWithDependencies
+	// runs them
+	for _, dep := range chain.Dependencies {
+		if p.opts.selectsSteps() {
+			break
+		}
+		switch dep.WaitPolicy {
+		case "all":
+			for _, depID := range dep.DependsOn {
+				if err := p.chain(depID, indent, "dependency of "+chainLabel(chain)); err != nil {
+					return err
+				}
+			}
+		case "any":
+			fmt.Printf("%sFirst to succeed of (dependency of %s):\n", indent, chainLabel(chain))
+			for _, depID := range dep.DependsOn {
+				if err := p.chain(depID, indent+"  ", ""); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if note != "" {
+		note = " (" + note + ")"
+	}
+	first, last, err := stepRange(chain, p.opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%sChain %s%s\n", indent, chainLabel(chain), note)
+	p.steps(chain, first, last, indent+"  ")
+	p.planned[chainID] = true
+	return nil
+}
+
+// steps previews the steps from first to last.
+func (p *chainPreview) steps(chain *CommandChain, first, last int, indent string) {
+	vars := make(map[string]string)
+	maps.Copy(vars, chain.Vars)
+	maps.Copy(vars, p.opts.Vars)
+	// Variables captured by a step are unknown until it has run
+	capturedBy := make(map[string]int)
+	execContext := &ExecutionContext{ChainID: chain.ID}
+	if previous := p.cs.lastChainRun(chain.ID); previous != nil {
+		execContext.PreviousRun = previous.StartedAt
+	}
+
+	resultKnown := true
+	for i, step := range chain.Steps {
+		if i < first || i > last {
+			continue
+		}
+		state := condTrue
+		var reasons []string
+		for _, cond := range step.Conditions {
+			condState, reason := p.condition(cond, resultKnown, vars, capturedBy, execContext)
+			state = andState(state, condState)
+			reasons = append(reasons, conditionMarks[condState]+" "+reason)
+		}
+
+		line := fmt.Sprintf("%s%d. %s %s", indent, i+1, stepVerbs[state], p.command(step.CommandID, vars))
+		if state == condUnknown && !p.explain {
+			line += "  (conditions decided at run time)"
+		}
+		fmt.Println(line)
+		detail := indent + "     "
+		if p.explain {
+			if len(reasons) == 0 {
+				fmt.Printf("%sno conditions\n", detail)
+			}
+			for _, reason := range reasons {
+				fmt.Printf("%s%s\n", detail, reason)
+			}
+		}
+		if state == condFalse {
+			continue
+		}
+		resultKnown = false
+
+		if len(step.ParallelWith) > 0 {
+			settings := []string{"policy " + stepPolicy(step)}
+			if p.opts.MaxParallel > 0 {
+				settings = append(settings, fmt.Sprintf("at most %d at once", p.opts.MaxParallel))
+			}
+			if step.FailFast {
+				settings = append(settings, "fail fast")
+			}
+			fmt.Printf("%salongside (%s):\n", detail, strings.Join(settings, ", "))
+			for _, id := range step.ParallelWith {
+				fmt.Printf("%s  %s\n", detail, p.command(id, vars))
+			}
+		}
+		for _, handler := range []struct {
+			name string
+			ids  []int
+		}{{"on success", step.OnSuccess}, {"on failure", step.OnFailure}} {
+			if len(handler.ids) == 0 {
+				continue
+			}
+			fmt.Printf("%s%s:\n", detail, handler.name)
+			for _, id := range handler.ids {
+				fmt.Printf("%s  %s\n", detail, p.command(id, vars))
+			}
+		}
+		for _, capture := range step.Capture {
+			fmt.Printf("%scaptures {{%s}}\n", detail, capture.Name)
+			delete(vars, capture.Name)
+			capturedBy[capture.Name] = i
+		}
+	}
+}
+
+// command returns a saved command as it would run, with the variables
+// known so far filled in.
+func (p *chainPreview) command(id int, vars map[string]string) string {
+	cmd := p.cs.findCommand(id)
+	if cmd == nil {
+		return fmt.Sprintf("#%d <missing>", id)
+	}
+	text, _ := expandVars(cmd.Raw, vars)
+	if cmd.Shell != "" {
+		text += "  [" + cmd.Shell + "]"
+	}
+	return fmt.Sprintf("#%d %s", id, text)
+}
+
+var conditionMarks = map[conditionState]string{
+	condTrue:    "✓",
+	condFalse:   "✗",
+	condUnknown: "?",
+}
+
+// condition evaluates a condition as far as possible before the chain
+// runs, and describes the result. resultKnown is false once an earlier step
+// may have run.
+func (p *chainPreview) condition(cond CommandCondition, resultKnown bool, vars map[string]string, capturedBy map[string]int, execContext *ExecutionContext) (conditionState, string) {
+	cond.Value, _ = expandVars(cond.Value, vars)
+
+	switch cond.Type {
+	case condAllOf, condAnyOf, condNot:
+		state := condTrue
+		if cond.Type == condAnyOf {
+			state = condFalse
+		}
+		var parts []string
+		for _, sub := range cond.Conditions {
+			subState, reason := p.condition(sub, resultKnown, vars, capturedBy, execContext)
+			if cond.Type == condAnyOf {
+				state = orState(state, subState)
+			} else {
+				state = andState(state, subState)
+			}
+			parts = append(parts, conditionMarks[subState]+" "+reason)
+		}
+		if cond.Type == condNot {
+			state = notState(state)
+		}
+		return state, cond.Type + "(" + strings.Join(parts, ", ") + ")"
+	}
+
+	description := describeCondition(cond)
+	_, missing := expandVars(cond.Value, nil)
+	for _, name := range missing {
+		if step, ok := capturedBy[name]; ok {
+			return condUnknown, fmt.Sprintf("%s: {{%s}} is captured by step %d", description, name, step+1)
+		}
+	}
+
+	switch cond.Type {
+	case "exit_code", "output_contains":
+		// Until a step has run, conditions see an empty result
+		if !resultKnown {
+			return condUnknown, description + ": depends on the previous step"
+		}
+	case "command_succeeds":
+		return condUnknown, description + ": probes don't run in a dry run"
+	case "chain_last_result":
+		chainID := execContext.ChainID
+		if cond.Value != "" {
+			chainID, _ = p.cs.resolveChainRef(cond.Value)
+		}
+		if p.planned[chainID] {
+			return condUnknown, description + ": that chain runs first"
+		}
+	}
+
+	satisfied, err := p.cs.evaluateCondition(cond, execContext)
+	if err != nil {
+		return condFalse, fmt.Sprintf("%s: %v", description, err)
+	}
+	if satisfied {
+		return condTrue, description
+	}
+	return condFalse, description
+}
+
+func andState(a, b conditionState) conditionState {
+	switch {
+	case a == condFalse || b == condFalse:
+		return condFalse
+	case a == condUnknown || b == condUnknown:
+		return condUnknown
+	}
+	return condTrue
+}
+
+func orState(a, b conditionState) conditionState {
+	switch {
+	case a == condTrue || b == condTrue:
+		return condTrue
+	case a == condUnknown || b == condUnknown:
+		return condUnknown
+	}
+	return condFalse
+}
+
+func notState(a conditionState) conditionState {
+	switch a {
+	case condTrue:
+		return condFalse
+	case condFalse:
+		return condTrue
+	}
+	return condUnknown
+}
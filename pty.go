@@ -0,0 +1,171 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// maxCapturedOutput bounds the output kept per step for conditions; the
+// start of longer output is dropped. maxRecordedOutput is the tail kept in
+// the step's run record.
+const (
+	maxCapturedOutput = 64 * 1024
+	maxRecordedOutput = 2 * 1024
+)
+
+// stdoutMu keeps lines of parallel steps from interleaving.
+var stdoutMu sync.Mutex
+
+// usePTY reports whether chain steps run in a pseudo-terminal, so that
+// programs keep their colours, progress bars and prompts.
+func usePTY() bool {
+	switch config.PTY {
+	case "always":
+		return ptySupported
+	case "never":
+		return false
+	}
+	return ptySupported && isTerminal(os.Stdout)
+}
+
+// stepOptions say where the output of a chain step goes. A step with
+// neither a label nor an output writer is interactive: it prints straight
+// to stdout and reads stdin.
+type stepOptions struct {
+	label  string      // Prefix each line with "[label] "
+	output io.Writer   // Write output here instead of stdout
+	stdout *tailBuffer // Also keep what the step writes to stdout alone here, for captures
+}
+
+// runStep runs cmd as a chain step, streaming its output as it arrives.
+// Steps that aren't interactive run in their own process group, so that
+// cancelling them also stops what they started. It returns the step's
+// output, stdout and stderr together, with "\r\n" line endings normalised.
+func runStep(cmd *exec.Cmd, opts stepOptions) (string, error) {
+	capture := &tailBuffer{max: maxCapturedOutput}
+	var out io.Writer = os.Stdout
+	switch {
+	case opts.output != nil:
+		out = opts.output
+	case opts.label != "":
+		prefixed := &prefixWriter{prefix: "[" + opts.label + "] ", w: os.Stdout}
+		defer prefixed.Flush()
+		out = prefixed
+	}
+	w := io.MultiWriter(out, capture)
+	// With opts.stdout, stderr gets a writer of its own so that it stays
+	// out of that buffer; both share the rest under a lock
+	var stderr io.Writer
+	if opts.stdout != nil {
+		shared := &lockedWriter{w: w}
+		w, stderr = io.MultiWriter(shared, opts.stdout), shared
+	}
+	interactive := opts.label == "" && opts.output == nil
+	cmd.Cancel = func() error { return killStep(cmd) }
+
+	var err error
+	if usePTY() {
+		err = runInPTY(cmd, w, stderr, interactive)
+	} else {
+		cmd.Stdout, cmd.Stderr = w, w
+		if stderr != nil {
+			cmd.Stderr = stderr
+		}
+		if interactive {
+			cmd.Stdin = os.Stdin
+		} else {
+			setProcessGroup(cmd)
+		}
+		err = cmd.Run()
+	}
+	return normalizeNewlines(capture.String()), err
+}
+
+// normalizeNewlines turns the "\r\n" line endings of a terminal into "\n".
+func normalizeNewlines(s string) string {
+	return strings.ReplaceAll(s, "\r\n", "\n")
+}
+
+// lockedWriter serializes writes to w from several goroutines.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	max  int
+	data []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.data = append(t.data, p...)
+	if len(t.data) > t.max {
+		t.data = append(t.data[:0], t.data[len(t.data)-t.max:]...)
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	return string(t.data)
+}
+
+// prefixWriter writes whole lines, each starting with prefix. A carriage
+// return that redraws a line (as progress bars do) repeats the prefix.
+type prefixWriter struct {
+	prefix string
+	w      io.Writer
+	line   []byte
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	n := len(data)
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			p.line = append(p.line, data...)
+			break
+		}
+		p.line = append(p.line, data[:i+1]...)
+		data = data[i+1:]
+		if err := p.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// Flush writes the buffered partial line, if any.
+func (p *prefixWriter) Flush() error {
+	if len(p.line) == 0 {
+		return nil
+	}
+	line := p.prefix + string(p.line)
+	p.line = p.line[:0]
+
+	body := strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	end := line[len(body):]
+	body = strings.ReplaceAll(body, "\r", "\r"+p.prefix)
+	if end == "" {
+		end = "\n"
+	}
+
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
+	_, err := io.WriteString(p.w, body+end)
+	return err
+}
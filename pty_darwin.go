@@ -0,0 +1,53 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+//go:build darwin
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Requests that get and set the attributes of a terminal.
+const (
+	ioctlGetTermios = syscall.TIOCGETA
+	ioctlSetTermios = syscall.TIOCSETA
+)
+
+// openPTY allocates a pseudo-terminal pair through /dev/ptmx, doing what
+// grantpt, unlockpt and ptsname do in libc.
+func openPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open a pseudo-terminal: %w", err)
+	}
+
+	if err := ioctl(master, syscall.TIOCPTYGRANT, nil); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to grant pseudo-terminal: %w", err)
+	}
+	if err := ioctl(master, syscall.TIOCPTYUNLK, nil); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to unlock pseudo-terminal: %w", err)
+	}
+	// The name is a NUL-terminated string of at most 128 bytes
+	var name [128]byte
+	if err := ioctl(master, syscall.TIOCPTYGNAME, unsafe.Pointer(&name[0])); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to get pseudo-terminal name: %w", err)
+	}
+	path, _, _ := bytes.Cut(name[:], []byte{0})
+
+	slave, err = os.OpenFile(string(path), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to open pseudo-terminal: %w", err)
+	}
+	return master, slave, nil
+}
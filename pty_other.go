@@ -0,0 +1,38 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+//go:build !darwin && !linux
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// Pseudo-terminals are only implemented for Linux and macOS; elsewhere
+// chain steps stream their output through pipes.
+const ptySupported = false
+
+func runInPTY(cmd *exec.Cmd, w, stderr io.Writer, interactive bool) error {
+	return errors.New("pseudo-terminals are not supported on this platform")
+}
+
+// setProcessGroup does nothing; killStep only stops the step itself.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func killStep(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+// terminalWidth returns $COLUMNS, or 80.
+func terminalWidth() int {
+	if width, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && width > 0 {
+		return width
+	}
+	return 80
+}
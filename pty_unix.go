@@ -0,0 +1,186 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+//go:build darwin || linux
+
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const ptySupported = true
+
+// ptyDrainTimeout is how long output is still read after a step exits.
+// Background processes it started may keep the terminal open.
+const ptyDrainTimeout = 200 * time.Millisecond
+
+// stdinTarget is the terminal of the interactive step currently running;
+// the stdin pump forwards keystrokes to it.
+var (
+	stdinTarget atomic.Pointer[os.File]
+	stdinPump   sync.Once
+)
+
+// runInPTY runs cmd with a new pseudo-terminal as its controlling terminal
+// and copies everything it prints to w. If stderr isn't nil, what cmd
+// writes to its stderr goes there instead, past the pseudo-terminal. An
+// interactive step also gets the user's keystrokes, with the local
+// terminal in raw mode meanwhile.
+func runInPTY(cmd *exec.Cmd, w, stderr io.Writer, interactive bool) error {
+	master, slave, err := openPTY()
+	if err != nil {
+		return err
+	}
+	defer master.Close()
+	copyWindowSize(master)
+
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	if stderr != nil {
+		cmd.Stderr = stderr
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	if interactive && isTerminal(os.Stdin) {
+		if restore, err := makeRaw(os.Stdin); err == nil {
+			defer restore()
+		}
+		stdinTarget.Store(master)
+		defer stdinTarget.Store(nil)
+		startStdinPump()
+	}
+
+	err = cmd.Start()
+	slave.Close()
+	if err != nil {
+		return err
+	}
+
+	copied := make(chan struct{})
+	go func() {
+		// Reading fails with EIO once the step and its children are gone
+		io.Copy(w, master)
+		close(copied)
+	}()
+	err = cmd.Wait()
+	select {
+	case <-copied:
+	case <-time.After(ptyDrainTimeout):
+		master.Close()
+		<-copied
+	}
+	return err
+}
+
+// setProcessGroup makes cmd the leader of a new process group.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// killStep stops a step along with the processes it started, if it leads
+// its own process group or session.
+func killStep(cmd *exec.Cmd) error {
+	attr := cmd.SysProcAttr
+	if attr != nil && (attr.Setpgid || attr.Setsid) {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	return cmd.Process.Kill()
+}
+
+// terminalWidth returns the width of the terminal on stdout, or 80.
+func terminalWidth() int {
+	var size winsize
+	if ioctl(os.Stdout, syscall.TIOCGWINSZ, unsafe.Pointer(&size)) == nil && size.cols > 0 {
+		return int(size.cols)
+	}
+	return 80
+}
+
+// winsize is struct winsize from <sys/ioctl.h>.
+type winsize struct {
+	rows, cols, xpixel, ypixel uint16
+}
+
+// copyWindowSize gives the pseudo-terminal the size of the user's
+// terminal, if there is one.
+func copyWindowSize(pty *os.File) {
+	var size winsize
+	if ioctl(os.Stdout, syscall.TIOCGWINSZ, unsafe.Pointer(&size)) == nil {
+		ioctl(pty, syscall.TIOCSWINSZ, unsafe.Pointer(&size))
+	}
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	var termios syscall.Termios
+	return ioctl(f, ioctlGetTermios, unsafe.Pointer(&termios)) == nil
+}
+
+// makeRaw puts the terminal f in raw mode, so keystrokes including ^C are
+// passed on unprocessed, and returns a function that restores it.
+func makeRaw(f *os.File) (func(), error) {
+	var old syscall.Termios
+	if err := ioctl(f, ioctlGetTermios, unsafe.Pointer(&old)); err != nil {
+		return nil, err
+	}
+	raw := old
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctl(f, ioctlSetTermios, unsafe.Pointer(&raw)); err != nil {
+		return nil, err
+	}
+	return func() { ioctl(f, ioctlSetTermios, unsafe.Pointer(&old)) }, nil
+}
+
+// startStdinPump starts forwarding stdin to the running interactive step.
+// It runs for the rest of the process, as a blocked read can't be undone;
+// input typed between steps is dropped.
+func startStdinPump() {
+	stdinPump.Do(func() {
+		go func() {
+			buf := make([]byte, 4096)
+			for {
+				n, err := os.Stdin.Read(buf)
+				if target := stdinTarget.Load(); target != nil && n > 0 {
+					target.Write(buf[:n])
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	})
+}
+
+// ioctl runs an ioctl on f without switching it to blocking mode, so
+// Close still interrupts a pending Read.
+func ioctl(f *os.File, request uintptr, arg unsafe.Pointer) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err := conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg))
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,371 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// remoteClient keeps the local store in step with a `save --serve`
+// instance. Pull brings in everything that changed on the server since the
+// last pull; Push sends back whatever this process changed.
+type remoteClient struct {
+	baseURL string
+	token   string
+	http    *http.Client
+
+	// State of the store right after Pull, used to work out what changed
+	baselineCommands  map[string]Command
+	baselineChains    map[string]CommandChain
+	baselineRun       *RunRecord   // Last run in the run log, nil if it was empty
+	baselineChainRuns map[int]bool // Finished chain runs
+}
+
+func newRemoteClient(baseURL, token string) *remoteClient {
+	return &remoteClient{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		token:   token,
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// do sends a JSON request and decodes a JSON response into out if given.
+func (rc *remoteClient) do(method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, rc.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+rc.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := rc.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("remote %s: %w", rc.baseURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		if apiErr.Error == "" {
+			apiErr.Error = resp.Status
+		}
+		return fmt.Errorf("%s %s: %s", method, path, apiErr.Error)
+	}
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// Pull applies changes made on the server since the last pull. Server
+// copies replace local ones; local IDs are kept stable.
+func (rc *remoteClient) Pull(cs *CommandStore) error {
+	since := cs.remoteCursors[rc.baseURL]
+	query := "?since=" + url.QueryEscape(fmt.Sprint(since))
+
+	var commands commandsResponse
+	if err := rc.do("GET", "/api/commands"+query, nil, &commands); err != nil {
+		return err
+	}
+	var chains chainsResponse
+	if err := rc.do("GET", "/api/chains"+query, nil, &chains); err != nil {
+		return err
+	}
+
+	for _, remote := range commands.Commands {
+		if local := cs.findCommandByUID(remote.UID); local != nil {
+			remote.ID = local.ID
+			*local = remote
+			continue
+		}
+		// A local command may hold the name the server gave another one
+		if remote.Name != "" {
+			if other := cs.findCommandByName(remote.Name); other != nil {
+				other.Name = ""
+			}
+		}
+		cs.lastID++
+		remote.ID = cs.lastID
+		cs.commands = append(cs.commands, remote)
+	}
+	cs.dropUIDs(commands.Deleted, nil)
+
+	commandIDs := make(map[string]int)
+	for _, cmd := range cs.commands {
+		commandIDs[cmd.UID] = cmd.ID
+	}
+	chainIDs := make(map[string]int)
+	for _, chain := range cs.chains {
+		chainIDs[chain.UID] = chain.ID
+	}
+	for _, record := range chains.Chains {
+		if _, ok := chainIDs[record.Chain.UID]; !ok {
+			cs.lastChainID++
+			chainIDs[record.Chain.UID] = cs.lastChainID
+		}
+	}
+	for _, record := range chains.Chains {
+		remote, err := remapChain(record, commandIDs, chainIDs)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipping chain '%s' from remote: %v\n", record.Chain.Name, err)
+			continue
+		}
+		remote.ID = chainIDs[remote.UID]
+		if local := cs.findChainByUID(remote.UID); local != nil {
+			*local = remote
+		} else {
+			cs.chains = append(cs.chains, remote)
+		}
+	}
+	cs.dropUIDs(nil, chains.Deleted)
+
+	if cs.remoteCursors == nil {
+		cs.remoteCursors = make(map[string]int64)
+	}
+	cs.remoteCursors[rc.baseURL] = min(commands.Version, chains.Version)
+
+	// Pulled records are not local changes; don't stamp them
+	cs.snapshotRecords()
+	cs.updateStats()
+	if err := cs.save(); err != nil {
+		return err
+	}
+
+	rc.captureBaseline(cs)
+
+	// On first contact the server has only what it just sent us; anything
+	// else saved locally is new to it and gets pushed by the next save.
+	if since == 0 {
+		known := make(map[string]bool)
+		for _, cmd := range commands.Commands {
+			known[cmd.UID] = true
+		}
+		for _, record := range chains.Chains {
+			known[record.Chain.UID] = true
+		}
+		for uid := range rc.baselineCommands {
+			if !known[uid] {
+				delete(rc.baselineCommands, uid)
+			}
+		}
+		for uid := range rc.baselineChains {
+			if !known[uid] {
+				delete(rc.baselineChains, uid)
+			}
+		}
+	}
+	return nil
+}
+
+// captureBaseline records the store as the server is known to have it.
+func (rc *remoteClient) captureBaseline(cs *CommandStore) {
+	rc.baselineCommands = make(map[string]Command)
+	for _, cmd := range cs.commands {
+		rc.baselineCommands[cmd.UID] = cmd
+	}
+	rc.baselineChains = make(map[string]CommandChain)
+	for _, chain := range cs.chains {
+		rc.baselineChains[chain.UID] = chain
+	}
+	rc.baselineRun = nil
+	if len(cs.runs) > 0 {
+		last := cs.runs[len(cs.runs)-1]
+		rc.baselineRun = &last
+	}
+	rc.baselineChainRuns = make(map[int]bool)
+	for _, run := range cs.chainRuns {
+		if !run.Running {
+			rc.baselineChainRuns[run.ID] = true
+		}
+	}
+}
+
+// newRuns returns the runs logged since the baseline. If the baseline run
+// was trimmed from the log, every run is new.
+func (rc *remoteClient) newRuns(cs *CommandStore) []RunRecord {
+	if rc.baselineRun == nil {
+		return cs.runs
+	}
+	for i := len(cs.runs) - 1; i >= 0; i-- {
+		if cs.runs[i] == *rc.baselineRun {
+			return cs.runs[i+1:]
+		}
+	}
+	return cs.runs
+}
+
+// pushRuns sends the runs and finished chain runs logged since the
+// baseline. Run counters travel with the commands, so the server only logs
+// these. Runs of commands and chains deleted since are dropped.
+func (rc *remoteClient) pushRuns(cs *CommandStore) []string {
+	var errs []string
+	for _, run := range rc.newRuns(cs) {
+		cmd := cs.findCommand(run.CommandID)
+		if cmd == nil {
+			continue
+		}
+		req := runRequest{
+			ExitCode:   run.ExitCode,
+			StartedAt:  run.StartedAt,
+			DurationMs: run.DurationMs,
+			Dir:        run.Dir,
+			Counted:    true,
+		}
+		if chain := cs.findChain(run.ChainID); chain != nil {
+			req.Chain = chain.UID
+		}
+		if err := rc.do("POST", "/api/commands/"+url.PathEscape(cmd.UID)+"/runs", req, nil); err != nil {
+			return append(errs, err.Error())
+		}
+		pushed := run
+		rc.baselineRun = &pushed
+	}
+
+	for _, run := range cs.chainRuns {
+		if run.Running || rc.baselineChainRuns[run.ID] {
+			continue
+		}
+		chain := cs.findChain(run.ChainID)
+		if chain == nil {
+			continue
+		}
+		req := chainRunRequest{Run: run}
+		for _, step := range run.Steps {
+			uid := ""
+			if cmd := cs.findCommand(step.CommandID); cmd != nil {
+				uid = cmd.UID
+			}
+			req.Commands = append(req.Commands, uid)
+		}
+		if err := rc.do("POST", "/api/chains/"+url.PathEscape(chain.UID)+"/runs", req, nil); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		rc.baselineChainRuns[run.ID] = true
+	}
+	return errs
+}
+
+// dropUIDs removes commands and chains deleted on the server without
+// recording local tombstones for them.
+func (cs *CommandStore) dropUIDs(commandUIDs, chainUIDs []string) {
+	deleted := make(map[string]bool)
+	for _, uid := range append(append([]string{}, commandUIDs...), chainUIDs...) {
+		deleted[uid] = true
+	}
+	if len(deleted) == 0 {
+		return
+	}
+
+	newCommands := make([]Command, 0, len(cs.commands))
+	for _, cmd := range cs.commands {
+		if !deleted[cmd.UID] {
+			newCommands = append(newCommands, cmd)
+		}
+	}
+	cs.commands = newCommands
+
+	newChains := make([]CommandChain, 0, len(cs.chains))
+	for _, chain := range cs.chains {
+		if !deleted[chain.UID] {
+			newChains = append(newChains, chain)
+		}
+	}
+	cs.chains = newChains
+
+	for key := range cs.fingerprints {
+		if _, uid, _ := strings.Cut(key, ":"); deleted[uid] {
+			delete(cs.fingerprints, key)
+		}
+	}
+}
+
+// Push sends every record changed since the last Pull or Push to the
+// server, commands first so chains and runs can refer to them. It runs
+// after every save, so nothing happens until the initial Pull has
+// completed.
+func (rc *remoteClient) Push(cs *CommandStore) error {
+	if rc.baselineCommands == nil {
+		return nil
+	}
+	var errs []string
+
+	present := make(map[string]bool)
+	for _, cmd := range cs.commands {
+		present[cmd.UID] = true
+		base, existed := rc.baselineCommands[cmd.UID]
+		if existed && commandRecordFingerprint(base) == commandRecordFingerprint(cmd) {
+			continue
+		}
+		req := pushCommandRequest{
+			Command:      cmd,
+			RunDelta:     cmd.RunCount - base.RunCount,
+			SuccessDelta: cmd.SuccessCount - base.SuccessCount,
+		}
+		if err := rc.do("PUT", "/api/commands/"+url.PathEscape(cmd.UID), req, nil); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	for _, chain := range cs.chains {
+		present[chain.UID] = true
+		base, existed := rc.baselineChains[chain.UID]
+		if existed && chainRecordFingerprint(base) == chainRecordFingerprint(chain) {
+			continue
+		}
+		if err := rc.do("PUT", "/api/chains/"+url.PathEscape(chain.UID), cs.chainRecord(chain), nil); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	errs = append(errs, rc.pushRuns(cs)...)
+
+	var removed []string
+	for uid := range rc.baselineCommands {
+		if !present[uid] {
+			removed = append(removed, "/api/commands/"+url.PathEscape(uid))
+		}
+	}
+	for uid := range rc.baselineChains {
+		if !present[uid] {
+			removed = append(removed, "/api/chains/"+url.PathEscape(uid))
+		}
+	}
+	sort.Strings(removed)
+	for _, path := range removed {
+		if err := rc.do("DELETE", path, nil, nil); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to push changes: %s", strings.Join(errs, "; "))
+	}
+	rc.captureBaseline(cs)
+	return nil
+}
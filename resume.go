@@ -0,0 +1,140 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ChainCheckpoint is where a chain run stands: the steps before NextStep
+// are done, and the next step's conditions see ExitCode and Output. A run
+// that failed or was interrupted keeps its checkpoint so it can be resumed.
+type ChainCheckpoint struct {
+	NextStep int    `json:"next_step"` // Index into the chain's steps
+	ExitCode int    `json:"exit_code"`
+	Output   string `json:"output,omitempty"` // Tail of the last main command's output
+}
+
+// nextChainRunID returns the ID for a new chain run.
+func (cs *CommandStore) nextChainRunID() int {
+	id := 0
+	for _, run := range cs.chainRuns {
+		id = max(id, run.ID)
+	}
+	return id + 1
+}
+
+// storeChainRun adds run to the chain run log, or updates it if it is
+// already there. Variables are stored with redact applied. The caller
+// saves the store.
+func (cs *CommandStore) storeChainRun(run *ChainRunRecord) {
+	stored := *run
+	stored.Vars = maps.Clone(run.Vars)
+	for name, value := range stored.Vars {
+		stored.Vars[name] = config.redactCommand(value)
+	}
+	stored.Steps = append([]StepRunRecord(nil), run.Steps...)
+
+	for i := range cs.chainRuns {
+		if cs.chainRuns[i].ID == run.ID {
+			cs.chainRuns[i] = stored
+			return
+		}
+	}
+	cs.chainRuns = append(cs.chainRuns, stored)
+	if len(cs.chainRuns) > maxChainRunRecords {
+		cs.chainRuns = append([]ChainRunRecord(nil), cs.chainRuns[len(cs.chainRuns)-maxChainRunRecords:]...)
+	}
+}
+
+// checkpointChainRun saves run before step next starts, so that it can be
+// resumed from there if it fails or is interrupted.
+func (cs *CommandStore) checkpointChainRun(run *ChainRunRecord, next int, execContext *ExecutionContext) {
+	output := execContext.LastOutput
+	if len(output) > maxRecordedOutput {
+		output = output[len(output)-maxRecordedOutput:]
+	}
+	run.Checkpoint = &ChainCheckpoint{NextStep: next, ExitCode: execContext.LastExitCode, Output: output}
+	cs.storeChainRun(run)
+	if err := cs.save(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to save chain run checkpoint: %v\n", err)
+	}
+}
+
+// findResumableRun returns the failed or interrupted chain run with the
+// given ID.
+func (cs *CommandStore) findResumableRun(ref string) (*ChainRunRecord, error) {
+	id, err := strconv.Atoi(strings.TrimPrefix(ref, "#"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid chain run ID '%s'", ref)
+	}
+	for i := range cs.chainRuns {
+		run := &cs.chainRuns[i]
+		if run.ID != id {
+			continue
+		}
+		if run.Success {
+			return nil, fmt.Errorf("chain run #%d succeeded, there is nothing to resume", id)
+		}
+		if run.Checkpoint == nil {
+			return nil, fmt.Errorf("chain run #%d has no checkpoint to resume from", id)
+		}
+		if cs.findChain(run.ChainID) == nil {
+			return nil, fmt.Errorf("chain run #%d: chain %s no longer exists", id, run.Chain)
+		}
+		return run, nil
+	}
+	return nil, fmt.Errorf("no chain run with ID %d", id)
+}
+
+// ResumeChain runs a chain again from where a failed or interrupted run
+// stopped, with that run's variables. Its dependencies are not run again.
+func (cs *CommandStore) ResumeChain(resume *ChainRunRecord, opts ChainRunOptions) error {
+	opts.Resume = resume
+	for name, value := range resume.Vars {
+		if _, given := opts.Vars[name]; !given && strings.Contains(value, "[REDACTED]") {
+			fmt.Fprintf(os.Stderr, "Warning: variable %s was redacted when the run was saved, set it again with --var %s=...\n", name, name)
+		}
+	}
+	return cs.executeChainSteps(cs.findChain(resume.ChainID), opts)
+}
+
+// selectsSteps reports whether opts run part of a chain only, in which case
+// its dependencies are not run.
+func (opts ChainRunOptions) selectsSteps() bool {
+	return opts.Resume != nil || opts.FromStep > 0 || opts.OnlyStep > 0
+}
+
+// stepRange returns the indexes of the first and last step a run of chain
+// executes.
+func stepRange(chain *CommandChain, opts ChainRunOptions) (int, int, error) {
+	first, last := 0, len(chain.Steps)-1
+	if opts.Resume != nil {
+		first = opts.Resume.Checkpoint.NextStep
+		if opts.MarkFixed {
+			first++
+		}
+		if first > len(chain.Steps) || (first == len(chain.Steps) && !opts.MarkFixed) {
+			return 0, 0, fmt.Errorf("chain %s has %d steps and no longer matches run #%d, use --from-step", chainLabel(chain), len(chain.Steps), opts.Resume.ID)
+		}
+	}
+
+	for _, step := range []int{opts.FromStep, opts.OnlyStep} {
+		if step > len(chain.Steps) {
+			return 0, 0, fmt.Errorf("chain %s has only %d steps", chainLabel(chain), len(chain.Steps))
+		}
+	}
+	if opts.FromStep > 0 {
+		first = opts.FromStep - 1
+	}
+	if opts.OnlyStep > 0 {
+		first, last = opts.OnlyStep-1, opts.OnlyStep-1
+	}
+	return first, last, nil
+}
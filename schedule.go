@@ -0,0 +1,446 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// Catch-up policies decide what happens to runs that were missed because
+// nothing checked the schedule, e.g. while the machine was asleep.
+const (
+	catchUpOnce = "once" // One run makes up for all missed ones (default)
+	catchUpSkip = "skip" // Missed runs are dropped
+	catchUpAll  = "all"  // Every missed run happens, up to maxCatchUpRuns
+)
+
+var catchUpPolicies = []string{catchUpOnce, catchUpSkip, catchUpAll}
+
+// maxCatchUpRuns bounds the runs the "all" policy makes up for at once.
+const maxCatchUpRuns = 24
+
+// catchUpGrace is how late a run may start before it counts as missed.
+const catchUpGrace = 5 * time.Minute
+
+// Schedule runs a saved command or chain at the times of a cron
+// expression.
+type Schedule struct {
+	ID        int       `json:"id"`
+	CommandID int       `json:"command_id,omitempty"`
+	ChainID   int       `json:"chain_id,omitempty"`
+	Cron      string    `json:"cron"`
+	CatchUp   string    `json:"catch_up,omitempty"`
+	Dir       string    `json:"dir,omitempty"` // Where the job runs
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// scheduleState is what the scheduler remembers about a job. It is kept
+// next to the job's lock rather than in the history file, which the job's
+// own runs write to.
+type scheduleState struct {
+	LastFire     time.Time `json:"last_fire"` // Scheduled time of the latest run, or skipped run
+	LastStarted  time.Time `json:"last_started,omitempty"`
+	LastExitCode int       `json:"last_exit_code"`
+	LastDuration int64     `json:"last_duration_ms,omitempty"`
+}
+
+// ScheduleEntry is one line of --list-schedules.
+type ScheduleEntry struct {
+	ID           int        `json:"id"`
+	Target       string     `json:"target"`
+	Cron         string     `json:"cron"`
+	CatchUp      string     `json:"catch_up"`
+	Dir          string     `json:"dir"`
+	Next         *time.Time `json:"next,omitempty"`
+	LastRun      *time.Time `json:"last_run,omitempty"`
+	LastExitCode *int       `json:"last_exit_code,omitempty"`
+	Running      bool       `json:"running"`
+}
+
+var scheduleColumns = []outputColumn[ScheduleEntry]{
+	{"ID", func(e ScheduleEntry) string { return strconv.Itoa(e.ID) }},
+	{"TARGET", func(e ScheduleEntry) string { return e.Target }},
+	{"CRON", func(e ScheduleEntry) string { return e.Cron }},
+	{"NEXT", func(e ScheduleEntry) string { return formatScheduleTime(e.Next) }},
+	{"LAST", func(e ScheduleEntry) string { return formatScheduleTime(e.LastRun) }},
+	{"RESULT", func(e ScheduleEntry) string {
+		switch {
+		case e.Running:
+			return "running"
+		case e.LastExitCode == nil:
+			return "-"
+		}
+		return fmt.Sprintf("exit %d", *e.LastExitCode)
+	}},
+	{"CATCH-UP", func(e ScheduleEntry) string { return e.CatchUp }},
+	{"DIR", func(e ScheduleEntry) string { return e.Dir }},
+}
+
+func formatScheduleTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+// scheduleDir holds the locks and state of scheduled jobs.
+func scheduleDir() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "schedules")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create schedule directory: %w", err)
+	}
+	return dir, nil
+}
+
+// AddSchedule schedules a saved command, or a chain given as chain:<ref>.
+// The job will run in the current directory.
+func (cs *CommandStore) AddSchedule(target, expr, catchUp string) (*Schedule, error) {
+	spec, err := parseCron(expr)
+	if err != nil {
+		return nil, err
+	}
+	if spec.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("cron expression %q never matches", expr)
+	}
+	if catchUp == "" {
+		catchUp = catchUpOnce
+	}
+	if !slices.Contains(catchUpPolicies, catchUp) {
+		return nil, fmt.Errorf("invalid catch-up policy '%s', expected one of %s", catchUp, strings.Join(catchUpPolicies, ", "))
+	}
+
+	s := Schedule{Cron: expr, CatchUp: catchUp, CreatedAt: time.Now()}
+	if s.CommandID, s.ChainID, err = cs.resolveRunTarget(target); err != nil {
+		return nil, err
+	}
+	if s.Dir, err = os.Getwd(); err != nil {
+		return nil, err
+	}
+	for _, existing := range cs.schedules {
+		s.ID = max(s.ID, existing.ID)
+	}
+	s.ID++
+
+	cs.schedules = append(cs.schedules, s)
+	return &cs.schedules[len(cs.schedules)-1], cs.save()
+}
+
+// RemoveSchedule deletes a schedule and what the scheduler remembers of it.
+func (cs *CommandStore) RemoveSchedule(id int) error {
+	i := slices.IndexFunc(cs.schedules, func(s Schedule) bool { return s.ID == id })
+	if i < 0 {
+		return fmt.Errorf("schedule with ID %d not found", id)
+	}
+	cs.schedules = slices.Delete(cs.schedules, i, i+1)
+	if dir, err := scheduleDir(); err == nil {
+		os.Remove(filepath.Join(dir, fmt.Sprintf("%d.json", id)))
+	}
+	return cs.save()
+}
+
+// ScheduleEntries lists the schedules with their next and last run.
+func (cs *CommandStore) ScheduleEntries(now time.Time) []ScheduleEntry {
+	dir, _ := scheduleDir()
+	var entries []ScheduleEntry
+	for _, s := range cs.schedules {
+		entry := ScheduleEntry{ID: s.ID, Target: cs.runTargetLabel(s.CommandID, s.ChainID), Cron: s.Cron, CatchUp: s.CatchUp, Dir: s.Dir}
+		if spec, err := parseCron(s.Cron); err == nil {
+			if next := spec.next(now); !next.IsZero() {
+				entry.Next = &next
+			}
+		}
+		if state, err := loadScheduleState(dir, s.ID); err == nil && !state.LastStarted.IsZero() {
+			entry.LastRun = &state.LastStarted
+			entry.LastExitCode = &state.LastExitCode
+		}
+		if unlock, ok, err := tryLock(filepath.Join(dir, fmt.Sprintf("%d.lock", s.ID))); err == nil {
+			entry.Running = !ok
+			if ok {
+				unlock()
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// printSchedules prints the schedules as a table.
+func printSchedules(entries []ScheduleEntry) {
+	if len(entries) == 0 {
+		fmt.Println("No schedules found")
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTARGET\tCRON\tNEXT\tLAST\tRESULT")
+	for _, e := range entries {
+		row := make([]string, 6)
+		for i := range row {
+			row[i] = scheduleColumns[i].Value(e)
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	tw.Flush()
+}
+
+func loadScheduleState(dir string, id int) (scheduleState, error) {
+	var state scheduleState
+	data, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("%d.json", id)))
+	if err != nil {
+		return state, err
+	}
+	return state, json.Unmarshal(data, &state)
+}
+
+func saveScheduleState(dir string, id int, state scheduleState) error {
+	data, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%d.json", id))
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// since returns the time after which s next fires, given the scheduled
+// time of its latest run.
+func (s Schedule) since(lastFire time.Time) time.Time {
+	if lastFire.IsZero() {
+		return s.CreatedAt
+	}
+	return lastFire
+}
+
+// passedRuns returns the scheduled times of s after lastFire up to now,
+// the latest maxCatchUpRuns of them at most, and how many there were.
+func (s Schedule) passedRuns(spec *cronSpec, lastFire, now time.Time) ([]time.Time, int) {
+	var passed []time.Time
+	count := 0
+	for t := spec.next(s.since(lastFire)); !t.IsZero() && !t.After(now); t = spec.next(t) {
+		passed = append(passed, t)
+		if len(passed) > maxCatchUpRuns {
+			passed = passed[1:]
+		}
+		count++
+	}
+	return passed, count
+}
+
+// dueRuns picks the runs to make now out of the passed ones, by the
+// catch-up policy of s.
+func (s Schedule) dueRuns(passed []time.Time, now time.Time) []time.Time {
+	if len(passed) == 0 {
+		return nil
+	}
+	latest := passed[len(passed)-1]
+	switch s.CatchUp {
+	case catchUpAll:
+		return passed
+	case catchUpSkip:
+		if now.Sub(latest) > catchUpGrace {
+			return nil
+		}
+	}
+	return []time.Time{latest}
+}
+
+// startDueJobs starts the jobs that are due at now in the background.
+// Each job holds a lock while it runs, so a job never overlaps with
+// itself, even across processes, and jobs take turns running, see
+// runScheduledJob. Failed jobs are counted in failures.
+func (cs *CommandStore) startDueJobs(now time.Time, wg *sync.WaitGroup, failures *atomic.Int32) {
+	dir, err := scheduleDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		failures.Add(1)
+		return
+	}
+	for _, s := range cs.schedules {
+		spec, err := parseCron(s.Cron)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: schedule %d: %v\n", s.ID, err)
+			continue
+		}
+		if state, _ := loadScheduleState(dir, s.ID); !spec.next(s.since(state.LastFire)).After(now) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := cs.runScheduledJob(s, spec, dir, now); err != nil {
+					fmt.Fprintf(os.Stderr, "[job %d] %v\n", s.ID, err)
+					failures.Add(1)
+				}
+			}()
+		}
+	}
+}
+
+// runScheduledJob runs the due runs of a job under its lock.
+func (cs *CommandStore) runScheduledJob(s Schedule, spec *cronSpec, dir string, now time.Time) error {
+	unlock, ok, err := tryLock(filepath.Join(dir, fmt.Sprintf("%d.lock", s.ID)))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Printf("[job %d] still running, not started again\n", s.ID)
+		return nil
+	}
+	defer unlock()
+
+	// Read the state again now that nobody else can change it
+	state, err := loadScheduleState(dir, s.ID)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	passed, count := s.passedRuns(spec, state.LastFire, now)
+	if len(passed) == 0 {
+		return nil
+	}
+	latest := passed[len(passed)-1]
+	runs := s.dueRuns(passed, now)
+	if missed := count - len(runs); missed > 0 {
+		first := spec.next(s.since(state.LastFire))
+		fmt.Printf("[job %d] %d runs due since %s, running %d of them (catch-up: %s)\n",
+			s.ID, count, first.Format("2006-01-02 15:04"), len(runs), s.CatchUp)
+	}
+
+	// Each job run loads the history, runs and saves it again, so two jobs
+	// running at once would lose one's records. Jobs wait for their turn.
+	unlockRuns, err := lock(filepath.Join(dir, "run.lock"))
+	if err != nil {
+		return err
+	}
+	defer unlockRuns()
+
+	var runErr error
+	for _, fire := range runs {
+		state.LastStarted = time.Now()
+		exitCode, err := cs.execScheduledJob(s, fire)
+		if exitCode < 0 {
+			runErr = err
+		} else if exitCode != 0 {
+			runErr = fmt.Errorf("exited with status %d", exitCode)
+		}
+		state.LastFire = fire
+		state.LastExitCode = exitCode
+		state.LastDuration = time.Since(state.LastStarted).Milliseconds()
+		if err := saveScheduleState(dir, s.ID, state); err != nil {
+			return err
+		}
+	}
+	state.LastFire = latest
+	if err := saveScheduleState(dir, s.ID, state); err != nil {
+		return err
+	}
+	return runErr
+}
+
+// execScheduledJob runs a job as a separate save process, which records
+// the run in the history like any other, and returns its exit code.
+func (cs *CommandStore) execScheduledJob(s Schedule, fire time.Time) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return -1, err
+	}
+	args := []string{"--rerun", strconv.Itoa(s.CommandID)}
+	if s.ChainID != 0 {
+		args = []string{"--run-chain", strconv.Itoa(s.ChainID)}
+	}
+
+	cmd := exec.Command(exe, args...)
+	cmd.Dir = s.Dir
+	cmd.Env = append(os.Environ(),
+		"SAVE_SCHEDULE_ID="+strconv.Itoa(s.ID),
+		"SAVE_SCHEDULED_TIME="+fire.Format(time.RFC3339),
+	)
+	out := &prefixWriter{prefix: fmt.Sprintf("[job %d] ", s.ID), w: os.Stdout}
+	defer out.Flush()
+	cmd.Stdout, cmd.Stderr = out, out
+
+	fmt.Printf("[job %d] starting %s (due %s)\n", s.ID, cs.runTargetLabel(s.CommandID, s.ChainID), fire.Format("2006-01-02 15:04"))
+	start := time.Now()
+	err = cmd.Run()
+	exitCode := stepExitCode(err)
+	out.Flush()
+	fmt.Printf("[job %d] finished with exit code %d in %s\n", s.ID, exitCode, formatDuration(time.Since(start).Milliseconds()))
+	return exitCode, err
+}
+
+// RunDue runs the jobs that are due and waits for them. It is meant to be
+// called every few minutes by an external timer such as cron or a systemd
+// timer. It returns an error if a job failed.
+func (cs *CommandStore) RunDue() error {
+	var wg sync.WaitGroup
+	var failures atomic.Int32
+	cs.startDueJobs(time.Now(), &wg, &failures)
+	wg.Wait()
+	if n := failures.Load(); n > 0 {
+		return fmt.Errorf("%d scheduled jobs failed", n)
+	}
+	return nil
+}
+
+// RunDaemon checks the schedules at the start of every minute until it is
+// interrupted, reloading them each time so changes apply without a
+// restart. Only one daemon runs at a time.
+func RunDaemon() error {
+	dir, err := scheduleDir()
+	if err != nil {
+		return err
+	}
+	unlock, ok, err := tryLock(filepath.Join(dir, "daemon.lock"))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("another save daemon is already running")
+	}
+	defer unlock()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	fmt.Printf("save daemon started (pid %d), checking schedules every minute\n", os.Getpid())
+
+	var wg sync.WaitGroup
+	var failures atomic.Int32
+	for {
+		store, err := NewCommandStore()
+		if err == nil {
+			err = store.load()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading schedules: %v\n", err)
+		} else {
+			store.startDueJobs(time.Now(), &wg, &failures)
+		}
+
+		// Timers don't count time asleep; the next check catches up
+		now := time.Now()
+		select {
+		case <-time.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now)):
+		case <-signals:
+			fmt.Println("Stopping, waiting for running jobs to finish")
+			wg.Wait()
+			return nil
+		}
+	}
+}
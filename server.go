@@ -0,0 +1,533 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiServer exposes a CommandStore over HTTP. Every request reloads the
+// store from disk so changes made with the CLI on the server host are
+// picked up, and is serialised by mu.
+type apiServer struct {
+	mu    sync.Mutex
+	store *CommandStore
+	token string
+}
+
+type commandsResponse struct {
+	Version  int64     `json:"version"`
+	Commands []Command `json:"commands"`
+	Deleted  []string  `json:"deleted,omitempty"` // UIDs deleted since the requested version
+}
+
+type chainsResponse struct {
+	Version int64             `json:"version"`
+	Chains  []syncChainRecord `json:"chains"`
+	Deleted []string          `json:"deleted,omitempty"`
+}
+
+type createCommandRequest struct {
+	Command     string   `json:"command"`
+	Name        string   `json:"name,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Dir         string   `json:"working_dir,omitempty"`
+	Shell       string   `json:"shell,omitempty"`
+}
+
+// pushCommandRequest carries a command changed by a client. Run counters
+// are sent as deltas so concurrent runs on several machines add up.
+type pushCommandRequest struct {
+	Command      Command `json:"command"`
+	RunDelta     int     `json:"run_delta"`
+	SuccessDelta int     `json:"success_delta"`
+}
+
+type runRequest struct {
+	ExitCode   int       `json:"exit_code"`
+	StartedAt  time.Time `json:"started_at,omitempty"`
+	DurationMs int64     `json:"duration_ms,omitempty"`
+	Dir        string    `json:"dir,omitempty"`
+	Chain      string    `json:"chain,omitempty"`   // UID of the chain the command ran in
+	Counted    bool      `json:"counted,omitempty"` // Run counters were already pushed with the command
+}
+
+// chainRunRequest carries a chain run made on a client. Commands holds the
+// UID of each step's command, in order, as client IDs mean nothing here.
+type chainRunRequest struct {
+	Run      ChainRunRecord `json:"run"`
+	Commands []string       `json:"commands"`
+}
+
+// Serve runs the HTTP API on addr until it fails. Clients must send
+// "Authorization: Bearer <token>".
+func (cs *CommandStore) Serve(addr, token string) error {
+	srv := &apiServer{store: cs, token: token}
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           srv.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return server.ListenAndServe()
+}
+
+func (s *apiServer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/commands", s.listCommands)
+	mux.HandleFunc("POST /api/commands", s.createCommand)
+	mux.HandleFunc("GET /api/commands/{ref}", s.getCommand)
+	mux.HandleFunc("PUT /api/commands/{uid}", s.putCommand)
+	mux.HandleFunc("DELETE /api/commands/{uid}", s.deleteCommand)
+	mux.HandleFunc("POST /api/commands/{ref}/runs", s.recordRun)
+	mux.HandleFunc("GET /api/chains", s.listChains)
+	mux.HandleFunc("GET /api/chains/{ref}", s.getChain)
+	mux.HandleFunc("PUT /api/chains/{uid}", s.putChain)
+	mux.HandleFunc("DELETE /api/chains/{uid}", s.deleteChain)
+	mux.HandleFunc("POST /api/chains/{ref}/runs", s.recordChainRun)
+	return s.authenticate(mux)
+}
+
+func (s *apiServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "invalid or missing token")
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err := s.store.load(); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to load history: %v", err))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// sinceParam parses the optional ?since=<version> query parameter.
+func sinceParam(r *http.Request) (int64, error) {
+	value := r.URL.Query().Get("since")
+	if value == "" {
+		return 0, nil
+	}
+	since, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid since parameter %q", value)
+	}
+	return since, nil
+}
+
+// deletedSince returns the UIDs of records of kind deleted after version.
+func (cs *CommandStore) deletedSince(kind string, version int64) []string {
+	var uids []string
+	for _, t := range cs.tombstones {
+		if t.Kind == kind && t.Version > version {
+			uids = append(uids, t.UID)
+		}
+	}
+	return uids
+}
+
+func (cs *CommandStore) findCommandByUID(uid string) *Command {
+	for i := range cs.commands {
+		if cs.commands[i].UID == uid {
+			return &cs.commands[i]
+		}
+	}
+	return nil
+}
+
+func (cs *CommandStore) findChainByUID(uid string) *CommandChain {
+	for i := range cs.chains {
+		if cs.chains[i].UID == uid {
+			return &cs.chains[i]
+		}
+	}
+	return nil
+}
+
+// listCommands supports ?since=<version> for incremental pulls and the
+// same filters as the CLI: ?q=<search>, ?tag=<tag> and ?dir=<directory>.
+func (s *apiServer) listCommands(w http.ResponseWriter, r *http.Request) {
+	since, err := sinceParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	query := strings.ToLower(r.URL.Query().Get("q"))
+	tag := strings.ToLower(r.URL.Query().Get("tag"))
+	dir := r.URL.Query().Get("dir")
+
+	resp := commandsResponse{Version: s.store.version, Commands: []Command{}}
+	for _, cmd := range s.store.commands {
+		if cmd.Version <= since {
+			continue
+		}
+		if query != "" && !strings.Contains(strings.ToLower(cmd.Raw), query) &&
+			!strings.Contains(strings.ToLower(cmd.Description), query) &&
+			!strings.Contains(strings.ToLower(cmd.Name), query) &&
+			!containsTag(cmd.Tags, query) {
+			continue
+		}
+		if tag != "" {
+			found := false
+			for _, t := range cmd.Tags {
+				if strings.ToLower(t) == tag {
+					found = true
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		if dir != "" && cmd.Dir != dir {
+			continue
+		}
+		resp.Commands = append(resp.Commands, cmd)
+	}
+	resp.Deleted = s.store.deletedSince("command", since)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// getCommand accepts an ID, name or UID.
+func (s *apiServer) getCommand(w http.ResponseWriter, r *http.Request) {
+	ref := r.PathValue("ref")
+	if cmd := s.store.findCommandByUID(ref); cmd != nil {
+		writeJSON(w, http.StatusOK, cmd)
+		return
+	}
+	id, err := s.store.resolveCommandRef(ref)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, s.store.findCommand(id))
+}
+
+// createCommand saves a new command without running it.
+func (s *apiServer) createCommand(w http.ResponseWriter, r *http.Request) {
+	var req createCommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if err := checkShell(req.Shell); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateScript(req.Shell, req.Command); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Name != "" {
+		if err := validateName(req.Name); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if other := s.store.findCommandByName(req.Name); other != nil {
+			writeError(w, http.StatusConflict, fmt.Sprintf("name %q is already used by command #%d", req.Name, other.ID))
+			return
+		}
+	}
+
+	s.store.lastID++
+	s.store.commands = append(s.store.commands, Command{
+		Raw:         req.Command,
+		Timestamp:   time.Now(),
+		Dir:         req.Dir,
+		ID:          s.store.lastID,
+		Name:        req.Name,
+		Tags:        req.Tags,
+		Description: req.Description,
+		Shell:       req.Shell,
+	})
+	s.store.updateStats()
+	if err := s.store.save(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, s.store.findCommand(s.store.lastID))
+}
+
+// putCommand creates or updates a command by UID on behalf of a client.
+// The client's edit wins if it is newer; run counters are added.
+func (s *apiServer) putCommand(w http.ResponseWriter, r *http.Request) {
+	uid := r.PathValue("uid")
+	var req pushCommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	incoming := req.Command
+	incoming.UID = uid
+	if strings.TrimSpace(incoming.Raw) == "" {
+		writeError(w, http.StatusBadRequest, "command must not be empty")
+		return
+	}
+	if req.RunDelta < 0 || req.SuccessDelta < 0 {
+		writeError(w, http.StatusBadRequest, "run_delta and success_delta must not be negative")
+		return
+	}
+
+	if incoming.Name != "" {
+		if err := validateName(incoming.Name); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if other := s.store.findCommandByName(incoming.Name); other != nil && other.UID != uid {
+			writeError(w, http.StatusConflict, fmt.Sprintf("name %q is already used by command #%d", incoming.Name, other.ID))
+			return
+		}
+	}
+
+	existing := s.store.findCommandByUID(uid)
+	if existing == nil {
+		s.store.lastID++
+		incoming.ID = s.store.lastID
+		incoming.RunCount = req.RunDelta
+		incoming.SuccessCount = req.SuccessDelta
+		s.store.commands = append(s.store.commands, incoming)
+		existing = &s.store.commands[len(s.store.commands)-1]
+	} else {
+		runs, successes := existing.RunCount+req.RunDelta, existing.SuccessCount+req.SuccessDelta
+		if incoming.UpdatedAt.After(existing.UpdatedAt) {
+			incoming.ID = existing.ID
+			incoming.Origin = existing.Origin
+			*existing = incoming
+		}
+		existing.RunCount = runs
+		existing.SuccessCount = min(successes, runs)
+		if req.RunDelta > 0 {
+			existing.ExitCode = incoming.ExitCode
+		}
+	}
+
+	s.store.updateStats()
+	if err := s.store.save(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, existing)
+}
+
+func (s *apiServer) deleteCommand(w http.ResponseWriter, r *http.Request) {
+	cmd := s.store.findCommandByUID(r.PathValue("uid"))
+	if cmd == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err := s.store.RemoveCommand(cmd.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// recordRun records the result of running a command on a client.
+func (s *apiServer) recordRun(w http.ResponseWriter, r *http.Request) {
+	var req runRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	ref := r.PathValue("ref")
+	cmd := s.store.findCommandByUID(ref)
+	if cmd == nil {
+		id, err := s.store.resolveCommandRef(ref)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		cmd = s.store.findCommand(id)
+	}
+	if req.StartedAt.IsZero() {
+		req.StartedAt = time.Now()
+	}
+	run := RunRecord{
+		CommandID:  cmd.ID,
+		Command:    cmd.Raw,
+		Dir:        req.Dir,
+		StartedAt:  req.StartedAt,
+		DurationMs: req.DurationMs,
+		ExitCode:   req.ExitCode,
+	}
+	if req.Chain != "" {
+		if chain := s.store.findChainByUID(req.Chain); chain != nil {
+			run.ChainID = chain.ID
+		}
+	}
+	s.store.appendRun(run)
+	if req.Counted {
+		if err := s.store.save(); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, cmd)
+		return
+	}
+	cmd.ExitCode = req.ExitCode
+	if err := s.store.updateCommandStats(cmd.ID, req.ExitCode); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, cmd)
+}
+
+// recordChainRun adds a chain run made on a client to the chain run log.
+func (s *apiServer) recordChainRun(w http.ResponseWriter, r *http.Request) {
+	var req chainRunRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	ref := r.PathValue("ref")
+	chain := s.store.findChainByUID(ref)
+	if chain == nil {
+		id, err := s.store.resolveChainRef(ref)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		chain = s.store.findChain(id)
+	}
+
+	run := req.Run
+	run.ID = s.store.nextChainRunID()
+	run.ChainID = chain.ID
+	run.Chain = chain.Name
+	run.Running = false
+	run.ResumedRun = 0
+	run.Steps = append([]StepRunRecord(nil), run.Steps...)
+	for i := range run.Steps {
+		run.Steps[i].CommandID = 0
+		if i < len(req.Commands) {
+			if cmd := s.store.findCommandByUID(req.Commands[i]); cmd != nil {
+				run.Steps[i].CommandID = cmd.ID
+			}
+		}
+	}
+	s.store.storeChainRun(&run)
+	if err := s.store.save(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, run)
+}
+
+func (s *apiServer) listChains(w http.ResponseWriter, r *http.Request) {
+	since, err := sinceParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	resp := chainsResponse{Version: s.store.version, Chains: []syncChainRecord{}}
+	for _, chain := range s.store.chains {
+		if chain.Version > since {
+			resp.Chains = append(resp.Chains, s.store.chainRecord(chain))
+		}
+	}
+	resp.Deleted = s.store.deletedSince("chain", since)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *apiServer) getChain(w http.ResponseWriter, r *http.Request) {
+	ref := r.PathValue("ref")
+	chain := s.store.findChainByUID(ref)
+	if chain == nil {
+		id, err := s.store.resolveChainRef(ref)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		chain = s.store.findChain(id)
+	}
+	writeJSON(w, http.StatusOK, s.store.chainRecord(*chain))
+}
+
+// putChain creates or replaces a chain by UID. Referenced commands must
+// have been pushed first.
+func (s *apiServer) putChain(w http.ResponseWriter, r *http.Request) {
+	uid := r.PathValue("uid")
+	var record syncChainRecord
+	if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+
+	commandIDs := make(map[string]int)
+	for _, cmd := range s.store.commands {
+		commandIDs[cmd.UID] = cmd.ID
+	}
+	chainIDs := make(map[string]int)
+	for _, chain := range s.store.chains {
+		chainIDs[chain.UID] = chain.ID
+	}
+	existing := s.store.findChainByUID(uid)
+	if existing == nil {
+		s.store.lastChainID++
+		chainIDs[uid] = s.store.lastChainID
+	}
+
+	chain, err := remapChain(record, commandIDs, chainIDs)
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	chain.UID = uid
+	chain.ID = chainIDs[uid]
+	if other := s.store.findChainByName(chain.Name); other != nil && other.UID != uid {
+		writeError(w, http.StatusConflict, fmt.Sprintf("name %q is already used by chain #%d", chain.Name, other.ID))
+		return
+	}
+
+	if existing == nil {
+		s.store.chains = append(s.store.chains, chain)
+	} else if chain.UpdatedAt.After(existing.UpdatedAt) {
+		chain.Origin = existing.Origin
+		*existing = chain
+	}
+	if err := s.store.save(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, s.store.chainRecord(*s.store.findChainByUID(uid)))
+}
+
+func (s *apiServer) deleteChain(w http.ResponseWriter, r *http.Request) {
+	uid := r.PathValue("uid")
+	newChains := make([]CommandChain, 0, len(s.store.chains))
+	for _, chain := range s.store.chains {
+		if chain.UID != uid {
+			newChains = append(newChains, chain)
+		}
+	}
+	if len(newChains) != len(s.store.chains) {
+		s.store.chains = newChains
+		if err := s.store.save(); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
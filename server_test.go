@@ -0,0 +1,273 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testToken = "s3cret"
+
+// startTestServer serves a fresh store on localhost.
+func startTestServer(t *testing.T) (*httptest.Server, *CommandStore) {
+	store := &CommandStore{filepath: filepath.Join(t.TempDir(), "server.json")}
+	if err := store.load(); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer((&apiServer{store: store, token: testToken}).routes())
+	t.Cleanup(server.Close)
+	return server, store
+}
+
+// newTestClient returns a store that works against the server, like
+// save --remote does.
+func newTestClient(t *testing.T, url string) *CommandStore {
+	t.Helper()
+	cs := &CommandStore{filepath: filepath.Join(t.TempDir(), "client.json")}
+	if err := cs.load(); err != nil {
+		t.Fatal(err)
+	}
+	remote := newRemoteClient(url, testToken)
+	if err := remote.Pull(cs); err != nil {
+		t.Fatalf("Pull: %v", err)
+	}
+	cs.remote = remote
+	return cs
+}
+
+// addFrom saves a new command as if it was first saved on origin.
+func addFrom(t *testing.T, cs *CommandStore, raw, origin string) {
+	t.Helper()
+	cs.lastID++
+	cs.commands = append(cs.commands, Command{Raw: raw, ID: cs.lastID, Timestamp: time.Now(), Origin: origin})
+	if err := cs.save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+}
+
+func TestServerRejectsBadTokens(t *testing.T) {
+	server, _ := startTestServer(t)
+	for name, header := range map[string]string{
+		"missing": "",
+		"wrong":   "Bearer nope",
+		"scheme":  "Basic " + testToken,
+	} {
+		req, _ := http.NewRequest("GET", server.URL+"/api/commands", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s token: status %d, want 401", name, resp.StatusCode)
+		}
+	}
+
+	err := newRemoteClient(server.URL, "nope").Pull(&CommandStore{filepath: filepath.Join(t.TempDir(), "h.json")})
+	if err == nil || !strings.Contains(err.Error(), "invalid or missing token") {
+		t.Errorf("Pull with a wrong token: %v, want the server's error", err)
+	}
+}
+
+func TestServerCreateAndRecordRun(t *testing.T) {
+	server, store := startTestServer(t)
+	rc := newRemoteClient(server.URL, testToken)
+
+	var created Command
+	err := rc.do("POST", "/api/commands", createCommandRequest{Command: "make test", Name: "test", Tags: []string{"ci"}}, &created)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if created.ID == 0 || created.UID == "" || created.Name != "test" {
+		t.Fatalf("created %+v, want an ID, a UID and the name", created)
+	}
+	if err := rc.do("POST", "/api/commands", createCommandRequest{Command: "make other", Name: "test"}, nil); err == nil {
+		t.Error("creating a second command named test succeeded")
+	}
+
+	var ran Command
+	if err := rc.do("POST", "/api/commands/test/runs", runRequest{ExitCode: 2, DurationMs: 1500}, &ran); err != nil {
+		t.Fatalf("record run: %v", err)
+	}
+	if err := store.load(); err != nil {
+		t.Fatal(err)
+	}
+	cmd := store.findCommand(created.ID)
+	if cmd.RunCount != 1 || cmd.SuccessCount != 0 || cmd.ExitCode != 2 {
+		t.Errorf("after a failed run: runs %d, successes %d, exit code %d", cmd.RunCount, cmd.SuccessCount, cmd.ExitCode)
+	}
+	if len(store.runs) != 1 || store.runs[0].DurationMs != 1500 || store.runs[0].CommandID != created.ID {
+		t.Errorf("run log %+v, want the recorded run", store.runs)
+	}
+}
+
+func TestRemoteIncrementalPull(t *testing.T) {
+	server, _ := startTestServer(t)
+	laptop := newTestClient(t, server.URL)
+	desktop := newTestClient(t, server.URL)
+
+	addFrom(t, laptop, "echo from-laptop", "laptop")
+	if err := desktop.remote.Pull(desktop); err != nil {
+		t.Fatal(err)
+	}
+	got := findRaw(desktop, "echo from-laptop")
+	if got == nil || got.Origin != "laptop" {
+		t.Fatalf("desktop has %+v, want the laptop's command", got)
+	}
+
+	// Like every save command, the laptop pulls before its next change; its
+	// cursor then only lets the desktop's new command through
+	if err := laptop.remote.Pull(laptop); err != nil {
+		t.Fatal(err)
+	}
+	addFrom(t, desktop, "echo from-desktop", "desktop")
+	cursor := laptop.remoteCursors[server.URL]
+	var changes commandsResponse
+	if err := laptop.remote.do("GET", "/api/commands?since="+strconv.FormatInt(cursor, 10), nil, &changes); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.Commands) != 1 || changes.Commands[0].Raw != "echo from-desktop" || changes.Commands[0].Origin != "desktop" {
+		t.Errorf("changes since %d: %+v, want only the desktop's command", cursor, changes.Commands)
+	}
+	if changes.Version <= cursor {
+		t.Errorf("version %d did not move past the cursor %d", changes.Version, cursor)
+	}
+
+	if err := laptop.remote.Pull(laptop); err != nil {
+		t.Fatal(err)
+	}
+	if len(laptop.commands) != 2 || laptop.remoteCursors[server.URL] != changes.Version {
+		t.Errorf("laptop has %v at cursor %d, want both commands at %d", raws(laptop), laptop.remoteCursors[server.URL], changes.Version)
+	}
+
+	// Deletions travel as well
+	if err := laptop.RemoveCommand(findRaw(laptop, "echo from-desktop").ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := desktop.remote.Pull(desktop); err != nil {
+		t.Fatal(err)
+	}
+	if got := raws(desktop); len(got) != 1 || got[0] != "echo from-laptop" {
+		t.Errorf("desktop has %v after the laptop deleted its command", got)
+	}
+}
+
+func TestRemotePushesRuns(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	server, store := startTestServer(t)
+	// The server numbers the commands it already has differently
+	addFrom(t, store, "echo server-only", "server")
+	laptop := newTestClient(t, server.URL)
+
+	addFrom(t, laptop, "exit 3", "laptop")
+	failing := *findRaw(laptop, "exit 3")
+	laptop.recordRun(failing, 3, time.Now(), 1500*time.Millisecond)
+	if err := laptop.updateCommandStats(failing.ID, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	addFrom(t, laptop, "true", "laptop")
+	step := findRaw(laptop, "true").ID
+	laptop.lastChainID++
+	laptop.chains = append(laptop.chains, CommandChain{ID: laptop.lastChainID, Name: "check", Steps: []ChainStep{{CommandID: step}}})
+	if err := laptop.save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := laptop.ExecuteChainWithDependencies(laptop.lastChainID, ChainRunOptions{}); err != nil {
+		t.Fatalf("chain failed: %v", err)
+	}
+
+	if err := store.load(); err != nil {
+		t.Fatal(err)
+	}
+	cmd, onServer := findRaw(store, "exit 3"), findRaw(store, "true")
+	if cmd == nil || onServer == nil {
+		t.Fatalf("server has %v, want the laptop's commands", raws(store))
+	}
+	if cmd.RunCount != 1 || cmd.SuccessCount != 0 {
+		t.Errorf("server counts %d runs, %d successes, want the one failed run counted once", cmd.RunCount, cmd.SuccessCount)
+	}
+	chain := store.findChainByName("check")
+	if chain == nil {
+		t.Fatal("server is missing the chain")
+	}
+	if len(store.runs) != 2 {
+		t.Fatalf("server run log %+v, want the command run and the chain step", store.runs)
+	}
+	if run := store.runs[0]; run.CommandID != cmd.ID || run.ExitCode != 3 || run.DurationMs != 1500 || run.ChainID != 0 {
+		t.Errorf("command run %+v, want exit 3 after 1.5s of #%d", run, cmd.ID)
+	}
+	if run := store.runs[1]; run.CommandID != onServer.ID || run.ChainID != chain.ID {
+		t.Errorf("step run %+v, want #%d in chain #%d", run, onServer.ID, chain.ID)
+	}
+	if len(store.chainRuns) != 1 {
+		t.Fatalf("server chain runs %+v, want the laptop's run", store.chainRuns)
+	}
+	run := store.chainRuns[0]
+	if run.ChainID != chain.ID || !run.Success || run.Running || len(run.Steps) != 1 || run.Steps[0].CommandID != onServer.ID {
+		t.Errorf("chain run %+v, want a finished run of chain #%d running #%d", run, chain.ID, onServer.ID)
+	}
+
+	// Later saves do not send the same runs again
+	if err := laptop.save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.runs) != 2 || len(store.chainRuns) != 1 {
+		t.Errorf("server has %d runs and %d chain runs after another save, want 2 and 1", len(store.runs), len(store.chainRuns))
+	}
+}
+
+func TestServerValidatesPushedCommands(t *testing.T) {
+	server, store := startTestServer(t)
+	rc := newRemoteClient(server.URL, testToken)
+
+	tests := []struct {
+		name string
+		req  pushCommandRequest
+	}{
+		{"empty command", pushCommandRequest{Command: Command{Raw: "  "}}},
+		{"bad name", pushCommandRequest{Command: Command{Raw: "make", Name: "two words"}}},
+		{"numeric name", pushCommandRequest{Command: Command{Raw: "make", Name: "42"}}},
+		{"negative runs", pushCommandRequest{Command: Command{Raw: "make"}, RunDelta: -1}},
+		{"negative successes", pushCommandRequest{Command: Command{Raw: "make"}, SuccessDelta: -5}},
+	}
+	for _, tt := range tests {
+		body, _ := json.Marshal(tt.req)
+		req, _ := http.NewRequest("PUT", server.URL+"/api/commands/uid-"+strings.ReplaceAll(tt.name, " ", "-"), bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", tt.name, resp.StatusCode)
+		}
+	}
+	if err := store.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.commands) != 0 {
+		t.Errorf("server saved %v from invalid pushes", raws(store))
+	}
+
+	if err := rc.do("PUT", "/api/commands/uid-ok", pushCommandRequest{Command: Command{Raw: "make", Name: "build"}, RunDelta: 1, SuccessDelta: 1}, nil); err != nil {
+		t.Errorf("valid push: %v", err)
+	}
+}
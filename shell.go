@@ -0,0 +1,239 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// execShell runs a command's words directly, without any shell.
+const execShell = "exec"
+
+// runner describes how command text is handed to a shell or interpreter.
+type runner struct {
+	run   []string // Program and flags; the command text follows
+	check []string // Syntax check, the command text follows; nil if the program has none
+	shell bool     // Extra arguments are quoted onto the text instead of passed as argv
+}
+
+// Syntax checks for interpreters without a check flag. They print only the
+// error message, not a stack trace.
+const (
+	pythonCheck = "import ast, sys\ntry:\n    ast.parse(sys.argv[1])\nexcept SyntaxError as e:\n    sys.exit(f'line {e.lineno}: {e.msg}')"
+	nodeCheck   = "try { new Function(process.argv[1]) } catch (e) { console.error(e.message); process.exit(1) }"
+)
+
+// runners are the shells and interpreters save knows how to run and
+// check. They are looked up by program base name, so "/usr/local/bin/bash"
+// behaves like "bash".
+var runners = map[string]runner{
+	"sh":      {run: []string{"sh", "-c"}, check: []string{"sh", "-n", "-c"}, shell: true},
+	"bash":    {run: []string{"bash", "-c"}, check: []string{"bash", "-n", "-c"}, shell: true},
+	"zsh":     {run: []string{"zsh", "-c"}, check: []string{"zsh", "-n", "-c"}, shell: true},
+	"dash":    {run: []string{"dash", "-c"}, check: []string{"dash", "-n", "-c"}, shell: true},
+	"ksh":     {run: []string{"ksh", "-c"}, check: []string{"ksh", "-n", "-c"}, shell: true},
+	"fish":    {run: []string{"fish", "-c"}, check: []string{"fish", "--no-execute", "-c"}, shell: true},
+	"python":  {run: []string{"python", "-c"}, check: []string{"python", "-c", pythonCheck}},
+	"python3": {run: []string{"python3", "-c"}, check: []string{"python3", "-c", pythonCheck}},
+	"node":    {run: []string{"node", "-e"}, check: []string{"node", "-e", nodeCheck}},
+	"ruby":    {run: []string{"ruby", "-e"}, check: []string{"ruby", "-c", "-e"}},
+	"perl":    {run: []string{"perl", "-e"}, check: []string{"perl", "-c", "-e"}},
+}
+
+// shellChoices are the values offered for --shell.
+var shellChoices = []string{"sh", "bash", "zsh", "fish", execShell, "python3", "node", "ruby", "perl"}
+
+// effectiveShell returns the shell a command runs with: its own, or the
+// configured default.
+func effectiveShell(shell string) string {
+	if shell == "" {
+		return config.Shell
+	}
+	return shell
+}
+
+// lookupRunner returns the runner for shell. Unknown programs are assumed
+// to take the text with -c like a POSIX shell, without a syntax check.
+func lookupRunner(shell string) runner {
+	r, ok := runners[filepath.Base(shell)]
+	if !ok {
+		return runner{run: []string{shell, "-c"}, shell: true}
+	}
+	// Keep the program as given, it may be a full path
+	r.run = append([]string{shell}, r.run[1:]...)
+	if r.check != nil {
+		r.check = append([]string{shell}, r.check[1:]...)
+	}
+	return r
+}
+
+// buildCommand returns a command that runs text with shell ("" for the
+// configured default), passing args to it.
+func buildCommand(shell, text string, args []string) (*exec.Cmd, error) {
+	return buildCommandContext(context.Background(), shell, text, args)
+}
+
+// buildCommandContext is buildCommand for a command that is stopped when
+// ctx is done.
+func buildCommandContext(ctx context.Context, shell, text string, args []string) (*exec.Cmd, error) {
+	shell = effectiveShell(shell)
+	if shell == execShell {
+		argv, err := splitCommandLine(text)
+		if err != nil {
+			return nil, err
+		}
+		if len(argv) == 0 {
+			return nil, fmt.Errorf("command cannot be empty")
+		}
+		return exec.CommandContext(ctx, argv[0], append(argv[1:], args...)...), nil
+	}
+
+	r := lookupRunner(shell)
+	if r.shell {
+		for _, arg := range args {
+			text += " " + shellQuote(arg)
+		}
+		args = nil
+	}
+	argv := append(append(r.run[1:len(r.run):len(r.run)], text), args...)
+	return exec.CommandContext(ctx, r.run[0], argv...), nil
+}
+
+// validateScript checks text with the syntax check of shell ("" for the
+// configured default). Programs without a check accept anything.
+func validateScript(shell, text string) error {
+	if strings.TrimSpace(text) == "" {
+		return fmt.Errorf("command cannot be empty")
+	}
+
+	shell = effectiveShell(shell)
+	if shell == execShell {
+		_, err := splitCommandLine(text)
+		return err
+	}
+
+	r := lookupRunner(shell)
+	if r.check == nil {
+		return nil
+	}
+	argv := append(r.check[1:len(r.check):len(r.check)], text)
+	output, err := exec.Command(r.check[0], argv...).CombinedOutput()
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return fmt.Errorf("%s is not installed", r.check[0])
+		}
+		if msg := strings.TrimSpace(string(output)); msg != "" {
+			return fmt.Errorf("invalid %s syntax: %s", filepath.Base(shell), msg)
+		}
+		return fmt.Errorf("invalid %s syntax: %v", filepath.Base(shell), err)
+	}
+	return nil
+}
+
+// checkShell reports whether shell can be used: exec, or a program on PATH.
+func checkShell(shell string) error {
+	if shell == "" || shell == execShell {
+		return nil
+	}
+	if _, err := exec.LookPath(shell); err != nil {
+		return fmt.Errorf("shell '%s' not found (expected one of %s, or a program on PATH)", shell, strings.Join(shellChoices, ", "))
+	}
+	return nil
+}
+
+// shebangShell returns the known shell or interpreter named by a script's
+// #! line, or "" if there is none.
+func shebangShell(script string) string {
+	line, _, _ := strings.Cut(script, "\n")
+	if !strings.HasPrefix(line, "#!") {
+		return ""
+	}
+	fields := strings.Fields(strings.TrimPrefix(line, "#!"))
+	if len(fields) == 0 {
+		return ""
+	}
+	program := filepath.Base(fields[0])
+	if program == "env" {
+		// #!/usr/bin/env [-S] python3
+		program = ""
+		for _, field := range fields[1:] {
+			if !strings.HasPrefix(field, "-") {
+				program = filepath.Base(field)
+				break
+			}
+		}
+	}
+	if _, ok := runners[program]; !ok {
+		return ""
+	}
+	return program
+}
+
+// splitCommandLine splits text into words for exec. Single quotes, double
+// quotes and backslashes work as in a POSIX shell, but nothing is expanded.
+func splitCommandLine(text string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case quote == '"':
+			switch {
+			case r == '"':
+				quote = 0
+			case r == '\\' && i+1 < len(runes) && strings.ContainsRune("\"\\$`\n", runes[i+1]):
+				i++
+				if runes[i] != '\n' {
+					word.WriteRune(runes[i])
+				}
+			default:
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == '\\':
+			if i+1 >= len(runes) {
+				return nil, fmt.Errorf("trailing backslash")
+			}
+			i++
+			if runes[i] != '\n' {
+				word.WriteRune(runes[i])
+				inWord = true
+			}
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
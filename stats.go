@@ -0,0 +1,595 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRunRecords and maxChainRunRecords bound the run logs kept in the
+// history file; the oldest runs are dropped first.
+const (
+	maxRunRecords      = 10000
+	maxChainRunRecords = 2000
+)
+
+// runLogMu guards the run logs while parallel chain steps finish.
+var runLogMu sync.Mutex
+
+// RunRecord is one execution of a saved command, kept for --stats.
+type RunRecord struct {
+	CommandID  int       `json:"command_id"`
+	Command    string    `json:"command"`
+	Dir        string    `json:"dir,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs int64     `json:"duration_ms"`
+	ExitCode   int       `json:"exit_code"`
+	ChainID    int       `json:"chain_id,omitempty"` // Set when run as a chain step
+}
+
+// ChainRunRecord is one execution of a chain and the steps it ran.
+type ChainRunRecord struct {
+	ID         int               `json:"id,omitempty"`
+	ChainID    int               `json:"chain_id"`
+	Chain      string            `json:"chain"`
+	StartedAt  time.Time         `json:"started_at"`
+	DurationMs int64             `json:"duration_ms"`
+	Success    bool              `json:"success"`
+	Steps      []StepRunRecord   `json:"steps"`
+	Vars       map[string]string `json:"vars,omitempty"`        // Chain variables at the end of the run
+	Running    bool              `json:"running,omitempty"`     // Not finished; left set if it was interrupted
+	Checkpoint *ChainCheckpoint  `json:"checkpoint,omitempty"`  // Where to resume a failed run
+	ResumedRun int               `json:"resumed_run,omitempty"` // The run this one resumed
+	FixedStep  int               `json:"fixed_step,omitempty"`  // Failed step (1-based) marked as fixed on resume
+}
+
+// StepRunRecord is one command run as part of a chain run.
+type StepRunRecord struct {
+	Step       int    `json:"step"` // Index into the chain's steps
+	Role       string `json:"role"` // "main", "parallel", "on_success" or "on_failure"
+	CommandID  int    `json:"command_id"`
+	Command    string `json:"command"`
+	ExitCode   int    `json:"exit_code"`
+	DurationMs int64  `json:"duration_ms"`
+	Output     string `json:"output,omitempty"` // Tail of what the step printed
+}
+
+// recordRun adds a run of cmd to the run log. The caller saves the store.
+func (cs *CommandStore) recordRun(cmd Command, exitCode int, start time.Time, duration time.Duration) {
+	dir, _ := os.Getwd()
+	cs.appendRun(RunRecord{
+		CommandID:  cmd.ID,
+		Command:    cmd.Raw,
+		Dir:        dir,
+		StartedAt:  start,
+		DurationMs: duration.Milliseconds(),
+		ExitCode:   exitCode,
+	})
+}
+
+// recordStepRun logs a command run as a chain step, both in the chain run
+// and in the command run log. It is safe to call from parallel steps.
+func (cs *CommandStore) recordStepRun(chainRun *ChainRunRecord, step int, role string, cmd Command, err error, output string, start time.Time, duration time.Duration) {
+	exitCode := stepExitCode(err)
+	dir, _ := os.Getwd()
+	if len(output) > maxRecordedOutput {
+		output = output[len(output)-maxRecordedOutput:]
+	}
+
+	runLogMu.Lock()
+	defer runLogMu.Unlock()
+	chainRun.Steps = append(chainRun.Steps, StepRunRecord{
+		Step:       step,
+		Role:       role,
+		CommandID:  cmd.ID,
+		Command:    cmd.Raw,
+		ExitCode:   exitCode,
+		DurationMs: duration.Milliseconds(),
+		Output:     output,
+	})
+	cs.appendRun(RunRecord{
+		CommandID:  cmd.ID,
+		Command:    cmd.Raw,
+		Dir:        dir,
+		StartedAt:  start,
+		DurationMs: duration.Milliseconds(),
+		ExitCode:   exitCode,
+		ChainID:    chainRun.ChainID,
+	})
+}
+
+// stepExitCode returns the exit code of a step that ended with err, or -1
+// if it could not be run at all.
+func stepExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// lastChainRun returns the latest finished run of a chain, or nil.
+func (cs *CommandStore) lastChainRun(chainID int) *ChainRunRecord {
+	for i := len(cs.chainRuns) - 1; i >= 0; i-- {
+		if cs.chainRuns[i].ChainID == chainID && !cs.chainRuns[i].Running {
+			return &cs.chainRuns[i]
+		}
+	}
+	return nil
+}
+
+// finishChainRun logs a finished chain run, updates the chain's run
+// statistics and saves the store.
+func (cs *CommandStore) finishChainRun(chain *CommandChain, run *ChainRunRecord, runErr error) error {
+	run.DurationMs = time.Since(run.StartedAt).Milliseconds()
+	run.Success = runErr == nil
+	run.Running = false
+	if run.Success {
+		run.Checkpoint = nil
+	}
+	for name, value := range run.Vars {
+		run.Vars[name] = config.redactCommand(value)
+	}
+	cs.storeChainRun(run)
+
+	successes := chain.SuccessRate / 100 * float64(chain.RunCount)
+	if run.Success {
+		successes++
+	}
+	chain.RunCount++
+	chain.SuccessRate = successes / float64(chain.RunCount) * 100
+	chain.LastRun = run.StartedAt
+	return cs.save()
+}
+
+func (cs *CommandStore) appendRun(run RunRecord) {
+	cs.runs = append(cs.runs, run)
+	if len(cs.runs) > maxRunRecords {
+		cs.runs = append([]RunRecord(nil), cs.runs[len(cs.runs)-maxRunRecords:]...)
+	}
+}
+
+// StatsOptions selects the runs --stats reports on and how.
+type StatsOptions struct {
+	Since time.Time
+	Until time.Time
+	By    string // "", "day", "week", "tag" or "dir"
+	JSON  bool
+}
+
+// StatsGroup summarizes the runs sharing one key (a day, a tag, ...).
+type StatsGroup struct {
+	Key         string  `json:"key"`
+	Runs        int     `json:"runs"`
+	Failures    int     `json:"failures"`
+	FailureRate float64 `json:"failure_rate"`
+	MedianMs    int64   `json:"median_ms"`
+	P95Ms       int64   `json:"p95_ms"`
+}
+
+// CommandFailures counts the failed runs of one command.
+type CommandFailures struct {
+	ID       int    `json:"id"`
+	Command  string `json:"command"`
+	Runs     int    `json:"runs"`
+	Failures int    `json:"failures"`
+}
+
+// StatsReport is the result of --stats over a time window.
+type StatsReport struct {
+	Since            *time.Time        `json:"since,omitempty"`
+	Until            *time.Time        `json:"until,omitempty"`
+	Runs             int               `json:"runs"`
+	Failures         int               `json:"failures"`
+	FailureRate      float64           `json:"failure_rate"`
+	MedianMs         int64             `json:"median_ms"`
+	P95Ms            int64             `json:"p95_ms"`
+	NewCommands      int               `json:"new_commands"`
+	RepeatedCommands int               `json:"repeated_commands"`
+	MostFailing      []CommandFailures `json:"most_failing"`
+	RunsByHour       [24]int           `json:"runs_by_hour"`
+	Timeline         []StatsGroup      `json:"timeline"`
+	Directories      []StatsGroup      `json:"directories"`
+	GroupedBy        string            `json:"grouped_by,omitempty"`
+	Groups           []StatsGroup      `json:"groups,omitempty"`
+	Lifetime         *Statistics       `json:"lifetime,omitempty"`
+}
+
+// parseStatsArgs parses the options following --stats.
+func parseStatsArgs(args []string, now time.Time) (StatsOptions, error) {
+	var opts StatsOptions
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch arg {
+		case "--json":
+			opts.JSON = true
+			continue
+		case "--since", "--until", "--by":
+		default:
+			return opts, fmt.Errorf("unknown stats option '%s'", arg)
+		}
+
+		if i+1 >= len(args) {
+			return opts, fmt.Errorf("%s requires a value", arg)
+		}
+		i++
+		value := args[i]
+
+		switch arg {
+		case "--since", "--until":
+			t, err := parseTimeArg(value, now)
+			if err != nil {
+				return opts, err
+			}
+			if arg == "--since" {
+				opts.Since = t
+			} else {
+				opts.Until = t
+			}
+		case "--by":
+			switch value {
+			case "day", "week", "tag", "dir":
+				opts.By = value
+			default:
+				return opts, fmt.Errorf("invalid --by value '%s', expected day, week, tag or dir", value)
+			}
+		}
+	}
+
+	if !opts.Since.IsZero() && !opts.Until.IsZero() && !opts.Until.After(opts.Since) {
+		return opts, fmt.Errorf("--until must be after --since")
+	}
+	return opts, nil
+}
+
+// parseTimeArg accepts a relative age such as "30m", "12h", "7d" or "2w",
+// a date (2006-01-02) or an RFC 3339 timestamp.
+func parseTimeArg(value string, now time.Time) (time.Time, error) {
+	if len(value) > 1 {
+		units := map[byte]time.Duration{
+			'm': time.Minute,
+			'h': time.Hour,
+			'd': 24 * time.Hour,
+			'w': 7 * 24 * time.Hour,
+		}
+		if unit, ok := units[value[len(value)-1]]; ok {
+			if n, err := strconv.Atoi(value[:len(value)-1]); err == nil && n >= 0 {
+				return now.Add(-time.Duration(n) * unit), nil
+			}
+		}
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, now.Location()); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time '%s', expected e.g. 7d, 12h, 2006-01-02 or an RFC 3339 timestamp", value)
+}
+
+// StatsReport computes run analytics for the runs inside the window.
+func (cs *CommandStore) StatsReport(opts StatsOptions) StatsReport {
+	report := StatsReport{GroupedBy: opts.By}
+	if !opts.Since.IsZero() {
+		report.Since = &opts.Since
+	}
+	if !opts.Until.IsZero() {
+		report.Until = &opts.Until
+	}
+
+	// A command is new if its first recorded run falls inside the window
+	firstRun := make(map[int]time.Time)
+	for _, run := range cs.runs {
+		if first, ok := firstRun[run.CommandID]; !ok || run.StartedAt.Before(first) {
+			firstRun[run.CommandID] = run.StartedAt
+		}
+	}
+
+	var runs []RunRecord
+	for _, run := range cs.runs {
+		if !opts.Since.IsZero() && run.StartedAt.Before(opts.Since) {
+			continue
+		}
+		if !opts.Until.IsZero() && !run.StartedAt.Before(opts.Until) {
+			continue
+		}
+		runs = append(runs, run)
+	}
+
+	report.Runs = len(runs)
+	overall := summarizeRuns("", runs)
+	report.Failures = overall.Failures
+	report.FailureRate = overall.FailureRate
+	report.MedianMs = overall.MedianMs
+	report.P95Ms = overall.P95Ms
+
+	seen := make(map[int]bool)
+	failing := make(map[int]*CommandFailures)
+	for _, run := range runs {
+		report.RunsByHour[run.StartedAt.Local().Hour()]++
+
+		if !seen[run.CommandID] {
+			seen[run.CommandID] = true
+			first := firstRun[run.CommandID]
+			if opts.Since.IsZero() || !first.Before(opts.Since) {
+				report.NewCommands++
+			} else {
+				report.RepeatedCommands++
+			}
+		}
+
+		entry, ok := failing[run.CommandID]
+		if !ok {
+			entry = &CommandFailures{ID: run.CommandID, Command: run.Command}
+			failing[run.CommandID] = entry
+		}
+		entry.Runs++
+		if run.ExitCode != 0 {
+			entry.Failures++
+		}
+	}
+
+	report.MostFailing = []CommandFailures{}
+	for _, entry := range failing {
+		if entry.Failures > 0 {
+			report.MostFailing = append(report.MostFailing, *entry)
+		}
+	}
+	sort.Slice(report.MostFailing, func(i, j int) bool {
+		a, b := report.MostFailing[i], report.MostFailing[j]
+		if a.Failures != b.Failures {
+			return a.Failures > b.Failures
+		}
+		return a.ID < b.ID
+	})
+	if len(report.MostFailing) > 5 {
+		report.MostFailing = report.MostFailing[:5]
+	}
+
+	report.Timeline = fillDays(groupRuns(runs, func(run RunRecord) []string {
+		return []string{run.StartedAt.Local().Format("2006-01-02")}
+	}))
+	report.Directories = groupRuns(runs, func(run RunRecord) []string {
+		return []string{runDir(run)}
+	})
+	sortGroupsByRuns(report.Directories)
+
+	switch opts.By {
+	case "day":
+		report.Groups = report.Timeline
+	case "week":
+		report.Groups = groupRuns(runs, func(run RunRecord) []string {
+			year, week := run.StartedAt.Local().ISOWeek()
+			return []string{fmt.Sprintf("%d-W%02d", year, week)}
+		})
+	case "tag":
+		tags := make(map[int][]string)
+		for _, cmd := range cs.commands {
+			tags[cmd.ID] = cmd.Tags
+		}
+		report.Groups = groupRuns(runs, func(run RunRecord) []string {
+			if len(tags[run.CommandID]) == 0 {
+				return []string{"(untagged)"}
+			}
+			return tags[run.CommandID]
+		})
+		sortGroupsByRuns(report.Groups)
+	case "dir":
+		report.Groups = report.Directories
+	}
+
+	return report
+}
+
+func runDir(run RunRecord) string {
+	if run.Dir == "" {
+		return "(unknown)"
+	}
+	return run.Dir
+}
+
+// groupRuns summarizes runs per key, sorted by key. A run may belong to
+// several groups, e.g. one per tag.
+func groupRuns(runs []RunRecord, keys func(RunRecord) []string) []StatsGroup {
+	grouped := make(map[string][]RunRecord)
+	for _, run := range runs {
+		for _, key := range keys(run) {
+			grouped[key] = append(grouped[key], run)
+		}
+	}
+
+	groups := make([]StatsGroup, 0, len(grouped))
+	for key, group := range grouped {
+		groups = append(groups, summarizeRuns(key, group))
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Key < groups[j].Key })
+	return groups
+}
+
+// fillDays adds empty groups for days without runs between the first and
+// last day of a timeline.
+func fillDays(days []StatsGroup) []StatsGroup {
+	if len(days) < 2 {
+		return days
+	}
+	first, err1 := time.Parse("2006-01-02", days[0].Key)
+	last, err2 := time.Parse("2006-01-02", days[len(days)-1].Key)
+	if err1 != nil || err2 != nil {
+		return days
+	}
+
+	byKey := make(map[string]StatsGroup)
+	for _, day := range days {
+		byKey[day.Key] = day
+	}
+	var filled []StatsGroup
+	for d := first; !d.After(last); d = d.AddDate(0, 0, 1) {
+		key := d.Format("2006-01-02")
+		if day, ok := byKey[key]; ok {
+			filled = append(filled, day)
+		} else {
+			filled = append(filled, StatsGroup{Key: key})
+		}
+	}
+	return filled
+}
+
+func sortGroupsByRuns(groups []StatsGroup) {
+	sort.SliceStable(groups, func(i, j int) bool { return groups[i].Runs > groups[j].Runs })
+}
+
+func summarizeRuns(key string, runs []RunRecord) StatsGroup {
+	group := StatsGroup{Key: key, Runs: len(runs)}
+	durations := make([]int64, 0, len(runs))
+	for _, run := range runs {
+		if run.ExitCode != 0 {
+			group.Failures++
+		}
+		durations = append(durations, run.DurationMs)
+	}
+	if group.Runs > 0 {
+		group.FailureRate = float64(group.Failures) / float64(group.Runs) * 100
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	group.MedianMs = percentile(durations, 50)
+	group.P95Ms = percentile(durations, 95)
+	return group
+}
+
+// percentile returns the nearest-rank percentile of sorted values.
+func percentile(sorted []int64, p int) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// sparkline renders values as a row of block characters.
+func sparkline(values []int) string {
+	const blocks = "▁▂▃▄▅▆▇█"
+	levels := []rune(blocks)
+	peak := 0
+	for _, v := range values {
+		peak = max(peak, v)
+	}
+
+	var b strings.Builder
+	for _, v := range values {
+		if peak == 0 || v == 0 {
+			b.WriteRune(' ')
+			continue
+		}
+		b.WriteRune(levels[(v*(len(levels)-1)+peak-1)/peak])
+	}
+	return b.String()
+}
+
+// bar renders value as a horizontal bar relative to peak.
+func bar(value, peak, width int) string {
+	if peak == 0 {
+		return ""
+	}
+	n := value * width / peak
+	if n == 0 && value > 0 {
+		n = 1
+	}
+	return strings.Repeat("█", n)
+}
+
+func formatDuration(ms int64) string {
+	return (time.Duration(ms) * time.Millisecond).String()
+}
+
+// printStatsReport renders a report for the terminal, or as JSON.
+func printStatsReport(report StatsReport, asJSON bool) error {
+	if asJSON {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	window := "all recorded runs"
+	switch {
+	case report.Since != nil && report.Until != nil:
+		window = fmt.Sprintf("%s to %s", report.Since.Format("2006-01-02 15:04"), report.Until.Format("2006-01-02 15:04"))
+	case report.Since != nil:
+		window = "since " + report.Since.Format("2006-01-02 15:04")
+	case report.Until != nil:
+		window = "until " + report.Until.Format("2006-01-02 15:04")
+	}
+
+	fmt.Printf("Run Statistics (%s):\n", window)
+	if report.Runs == 0 {
+		fmt.Println("No runs recorded in this period")
+		return nil
+	}
+	fmt.Printf("Runs: %d, Failures: %d (%.2f%%)\n", report.Runs, report.Failures, report.FailureRate)
+	fmt.Printf("Duration: median %s, p95 %s\n", formatDuration(report.MedianMs), formatDuration(report.P95Ms))
+	fmt.Printf("Commands: %d new, %d repeated\n", report.NewCommands, report.RepeatedCommands)
+
+	daily := make([]int, len(report.Timeline))
+	for i, day := range report.Timeline {
+		daily[i] = day.Runs
+	}
+	fmt.Printf("\nRuns per day (%s to %s):\n", report.Timeline[0].Key, report.Timeline[len(report.Timeline)-1].Key)
+	fmt.Printf("  %s\n", sparkline(daily))
+
+	fmt.Printf("\nBusiest hours:\n")
+	fmt.Printf("  %s\n", sparkline(report.RunsByHour[:]))
+	fmt.Printf("  0     6     12    18   23\n")
+
+	if len(report.MostFailing) > 0 {
+		fmt.Printf("\nMost failing commands:\n")
+		for _, cmd := range report.MostFailing {
+			fmt.Printf("  #%-4d %d/%d failed  %s\n", cmd.ID, cmd.Failures, cmd.Runs, cmd.Command)
+		}
+	}
+
+	printStatsGroups("Directories", report.Directories, 10)
+
+	if report.GroupedBy != "" && report.GroupedBy != "dir" {
+		printStatsGroups("By "+report.GroupedBy, report.Groups, 0)
+	}
+	return nil
+}
+
+// printStatsGroups prints one row with a bar per group; limit 0 prints all.
+func printStatsGroups(title string, groups []StatsGroup, limit int) {
+	if len(groups) == 0 {
+		return
+	}
+	if limit > 0 && len(groups) > limit {
+		groups = groups[:limit]
+	}
+
+	peak, width := 0, 0
+	for _, g := range groups {
+		peak = max(peak, g.Runs)
+		width = max(width, len(g.Key))
+	}
+
+	fmt.Printf("\n%s:\n", title)
+	for _, g := range groups {
+		fmt.Printf("  %-*s %5d runs %6.2f%% failed  median %-8s p95 %-8s %s\n",
+			width, g.Key, g.Runs, g.FailureRate, formatDuration(g.MedianMs), formatDuration(g.P95Ms), bar(g.Runs, peak, 20))
+	}
+}
@@ -0,0 +1,717 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const syncBranch = "main"
+
+// syncChainRecord is how a chain is stored in the sync repository. Chains
+// reference commands and other chains by local ID, so the record carries
+// the UIDs needed to remap them on another machine.
+type syncChainRecord struct {
+	Chain       CommandChain   `json:"chain"`
+	CommandUIDs map[int]string `json:"command_uids"`
+	ChainUIDs   map[int]string `json:"chain_uids,omitempty"`
+}
+
+// newUID returns a random identifier that is stable across machines.
+func newUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("failed to generate UID: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// commandFingerprint returns a representation of a command that changes
+// whenever it is edited. Run counters are left out: they are merged
+// separately and running a command is not an edit.
+func commandFingerprint(cmd Command) string {
+	cmd.UpdatedAt, cmd.Version = time.Time{}, 0
+	cmd.RunCount, cmd.SuccessCount, cmd.ExitCode = 0, 0, 0
+	data, _ := json.Marshal(cmd)
+	return string(data)
+}
+
+func chainFingerprint(chain CommandChain) string {
+	chain.UpdatedAt, chain.Version = time.Time{}, 0
+	chain.RunCount, chain.SuccessRate, chain.LastRun = 0, 0, time.Time{}
+	data, _ := json.Marshal(chain)
+	return string(data)
+}
+
+// commandRecordFingerprint changes whenever anything but the bookkeeping
+// fields changes, including run counters. It decides version bumps.
+func commandRecordFingerprint(cmd Command) string {
+	cmd.UpdatedAt, cmd.Version = time.Time{}, 0
+	data, _ := json.Marshal(cmd)
+	return string(data)
+}
+
+func chainRecordFingerprint(chain CommandChain) string {
+	chain.UpdatedAt, chain.Version = time.Time{}, 0
+	data, _ := json.Marshal(chain)
+	return string(data)
+}
+
+// machineID identifies this machine as the origin of new records.
+func machineID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "unknown"
+	}
+	return host
+}
+
+// snapshotRecords remembers the current content of every record so the
+// next save can tell which records changed.
+func (cs *CommandStore) snapshotRecords() {
+	cs.fingerprints = make(map[string]string, 2*(len(cs.commands)+len(cs.chains)))
+	for _, cmd := range cs.commands {
+		if cmd.UID != "" {
+			cs.fingerprints["command:"+cmd.UID] = commandFingerprint(cmd)
+			cs.fingerprints["command-record:"+cmd.UID] = commandRecordFingerprint(cmd)
+		}
+	}
+	for _, chain := range cs.chains {
+		if chain.UID != "" {
+			cs.fingerprints["chain:"+chain.UID] = chainFingerprint(chain)
+			cs.fingerprints["chain-record:"+chain.UID] = chainRecordFingerprint(chain)
+		}
+	}
+}
+
+// stampChanges gives new records a UID and origin, marks records whose
+// content was edited since the last snapshot with the current time, gives
+// every changed record a new version and leaves a tombstone for records
+// that were deleted.
+func (cs *CommandStore) stampChanges() {
+	now := time.Now()
+	present := make(map[string]bool)
+	for i := range cs.commands {
+		cmd := &cs.commands[i]
+		if cmd.UID == "" {
+			cmd.UID = newUID()
+		}
+		if cmd.Origin == "" {
+			cmd.Origin = machineID()
+		}
+		present["command:"+cmd.UID] = true
+		if cs.fingerprints["command:"+cmd.UID] != commandFingerprint(*cmd) {
+			cmd.UpdatedAt = now
+		}
+		if cs.fingerprints["command-record:"+cmd.UID] != commandRecordFingerprint(*cmd) {
+			cs.version++
+			cmd.Version = cs.version
+		}
+	}
+	for i := range cs.chains {
+		chain := &cs.chains[i]
+		if chain.UID == "" {
+			chain.UID = newUID()
+		}
+		if chain.Origin == "" {
+			chain.Origin = machineID()
+		}
+		present["chain:"+chain.UID] = true
+		if cs.fingerprints["chain:"+chain.UID] != chainFingerprint(*chain) {
+			chain.UpdatedAt = now
+		}
+		if cs.fingerprints["chain-record:"+chain.UID] != chainRecordFingerprint(*chain) {
+			cs.version++
+			chain.Version = cs.version
+		}
+	}
+
+	keys := make([]string, 0, len(cs.fingerprints))
+	for key := range cs.fingerprints {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		kind, uid, _ := strings.Cut(key, ":")
+		if (kind == "command" || kind == "chain") && !present[key] {
+			cs.version++
+			cs.tombstones = append(cs.tombstones, Tombstone{UID: uid, Kind: kind, Version: cs.version, DeletedAt: now})
+		}
+	}
+}
+
+// mergeCommand combines two versions of the same command: tags are merged,
+// counters take the maximum and editable fields come from the version that
+// was updated last.
+func mergeCommand(local, remote Command) Command {
+	merged := local
+	if remote.UpdatedAt.After(local.UpdatedAt) {
+		merged = remote
+		merged.ID = local.ID
+	}
+
+	tagSet := make(map[string]bool)
+	for _, tag := range append(append([]string{}, local.Tags...), remote.Tags...) {
+		tagSet[tag] = true
+	}
+	merged.Tags = nil
+	for tag := range tagSet {
+		merged.Tags = append(merged.Tags, tag)
+	}
+	sort.Strings(merged.Tags)
+
+	merged.RunCount = max(local.RunCount, remote.RunCount)
+	merged.SuccessCount = min(max(local.SuccessCount, remote.SuccessCount), merged.RunCount)
+	if !remote.Timestamp.IsZero() && remote.Timestamp.Before(local.Timestamp) {
+		merged.Timestamp = remote.Timestamp
+	}
+	return merged
+}
+
+// mergeChain keeps the most recently updated definition of a chain and the
+// highest run count.
+func mergeChain(local, remote CommandChain) CommandChain {
+	merged := local
+	if remote.UpdatedAt.After(local.UpdatedAt) {
+		merged = remote
+		merged.ID = local.ID
+	}
+	merged.RunCount = max(local.RunCount, remote.RunCount)
+	if remote.LastRun.After(merged.LastRun) {
+		merged.LastRun = remote.LastRun
+	}
+	return merged
+}
+
+// syncDir returns the local git checkout used for syncing.
+func syncDir() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "sync"), nil
+}
+
+// git runs a git command in the sync checkout and returns its trimmed output.
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %s", strings.Join(args, " "), strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// initSyncRepo creates the sync checkout on first use.
+func initSyncRepo(dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create sync directory: %w", err)
+	}
+	if _, err := git(dir, "init", "--quiet"); err != nil {
+		return err
+	}
+	_, err := git(dir, "symbolic-ref", "HEAD", "refs/heads/"+syncBranch)
+	return err
+}
+
+// SetSyncRemote configures the git remote that --sync pulls from and
+// pushes to.
+func SetSyncRemote(url string) error {
+	dir, err := syncDir()
+	if err != nil {
+		return err
+	}
+	if err := initSyncRepo(dir); err != nil {
+		return err
+	}
+	if _, err := git(dir, "remote", "get-url", "origin"); err == nil {
+		_, err = git(dir, "remote", "set-url", "origin", url)
+		return err
+	}
+	_, err = git(dir, "remote", "add", "origin", url)
+	return err
+}
+
+// readSyncFiles reads every record under prefix ("commands/", "chains/",
+// "deleted/") either from the working tree (rev == "") or from a git
+// revision. Keys are UIDs.
+func readSyncFiles(dir, rev, prefix string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	if rev == "" {
+		entries, err := os.ReadDir(filepath.Join(dir, prefix))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return files, nil
+			}
+			return nil, err
+		}
+		for _, entry := range entries {
+			data, err := os.ReadFile(filepath.Join(dir, prefix, entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+			files[strings.TrimSuffix(entry.Name(), ".json")] = data
+		}
+		return files, nil
+	}
+
+	list, err := git(dir, "ls-tree", "-r", "--name-only", rev, "--", prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range strings.Split(list, "\n") {
+		if path == "" {
+			continue
+		}
+		data, err := exec.Command("git", "-C", dir, "show", rev+":"+path).Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s from %s: %w", path, rev, err)
+		}
+		files[strings.TrimSuffix(filepath.Base(path), ".json")] = data
+	}
+	return files, nil
+}
+
+// Sync merges the history with the sync repository and its remote. Each
+// command and chain is stored in its own file so concurrent edits on
+// different machines rarely touch the same file; when they do, the
+// records are merged field by field instead of by git.
+func (cs *CommandStore) Sync() error {
+	dir, err := syncDir()
+	if err != nil {
+		return err
+	}
+	if err := initSyncRepo(dir); err != nil {
+		return err
+	}
+	// Make sure every record has a UID before it is written out
+	if err := cs.save(); err != nil {
+		return err
+	}
+
+	_, remoteErr := git(dir, "remote", "get-url", "origin")
+	hasRemote := remoteErr == nil
+	remoteRef := ""
+	if hasRemote {
+		if _, err := git(dir, "fetch", "--quiet", "origin"); err != nil {
+			return err
+		}
+		if _, err := git(dir, "rev-parse", "--verify", "--quiet", "origin/"+syncBranch); err == nil {
+			remoteRef = "origin/" + syncBranch
+		}
+	}
+
+	// Records written by the previous sync but no longer in the store were
+	// deleted locally
+	tombstones, err := readSyncFiles(dir, "", "deleted")
+	if err != nil {
+		return err
+	}
+	localUIDs := make(map[string]bool)
+	for _, cmd := range cs.commands {
+		localUIDs[cmd.UID] = true
+	}
+	for _, chain := range cs.chains {
+		localUIDs[chain.UID] = true
+	}
+	for _, t := range cs.tombstones {
+		if !localUIDs[t.UID] {
+			localUIDs[t.UID] = false
+		}
+	}
+	for _, prefix := range []string{"commands", "chains"} {
+		previous, err := readSyncFiles(dir, "", prefix)
+		if err != nil {
+			return err
+		}
+		for uid, data := range previous {
+			if localUIDs[uid] {
+				continue
+			}
+			// Chains the store could not take in were carried through,
+			// unless they were deleted here after all
+			if _, deleted := localUIDs[uid]; !deleted && prefix == "chains" && !cs.canMapChain(data) {
+				continue
+			}
+			tombstones[uid] = nil
+		}
+	}
+
+	var carried map[string][]byte
+	if remoteRef != "" {
+		if carried, err = cs.mergeRemote(dir, remoteRef, tombstones); err != nil {
+			return err
+		}
+		// Merging is not an edit, keep the merged update times
+		cs.snapshotRecords()
+	}
+
+	if err := cs.writeSyncFiles(dir, tombstones, carried); err != nil {
+		return err
+	}
+	// Save before touching git history so the store never lags behind the
+	// checkout, which would make merged records look locally deleted
+	cs.updateStats()
+	if err := cs.save(); err != nil {
+		return err
+	}
+
+	if _, err := git(dir, "add", "-A"); err != nil {
+		return err
+	}
+	if status, _ := git(dir, "status", "--porcelain"); status != "" {
+		host, _ := os.Hostname()
+		if _, err := gitCommit(dir, fmt.Sprintf("save: sync from %s", host)); err != nil {
+			return err
+		}
+	}
+	if remoteRef != "" {
+		// The merged records are already in our tree, the merge only records
+		// that the remote history has been incorporated
+		if _, err := git(dir, append(gitIdentity(dir), "merge", "--quiet", "-s", "ours", "--no-edit", "--allow-unrelated-histories", remoteRef)...); err != nil {
+			return err
+		}
+	}
+	if hasRemote {
+		if _, err := git(dir, "rev-parse", "--verify", "--quiet", "HEAD"); err == nil {
+			if _, err := git(dir, "push", "--quiet", "origin", "HEAD:"+syncBranch); err != nil {
+				return fmt.Errorf("%v (another machine may have synced meanwhile, run --sync again)", err)
+			}
+		}
+	}
+	return nil
+}
+
+// gitCommit commits staged changes, supplying an identity when the user
+// has not configured one.
+func gitCommit(dir, message string) (string, error) {
+	return git(dir, append(gitIdentity(dir), "commit", "--quiet", "-m", message)...)
+}
+
+// gitIdentity returns options that give commits an author when git has no
+// identity configured, as on fresh machines and in containers.
+func gitIdentity(dir string) []string {
+	if email, _ := git(dir, "config", "user.email"); email != "" {
+		return nil
+	}
+	host, _ := os.Hostname()
+	return []string{"-c", "user.name=save", "-c", "user.email=save@" + host}
+}
+
+// mergeRemote folds the records of remoteRef into the store. Remote chains
+// that refer to records the store does not have are returned as they are,
+// to be written back untouched.
+func (cs *CommandStore) mergeRemote(dir, remoteRef string, tombstones map[string][]byte) (map[string][]byte, error) {
+	remoteTombstones, err := readSyncFiles(dir, remoteRef, "deleted")
+	if err != nil {
+		return nil, err
+	}
+	for uid := range remoteTombstones {
+		tombstones[uid] = nil
+	}
+
+	remoteCommands, err := readSyncFiles(dir, remoteRef, "commands")
+	if err != nil {
+		return nil, err
+	}
+	uids := make([]string, 0, len(remoteCommands))
+	for uid := range remoteCommands {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+
+	for _, uid := range uids {
+		if _, deleted := tombstones[uid]; deleted {
+			continue
+		}
+		var remote Command
+		if err := json.Unmarshal(remoteCommands[uid], &remote); err != nil {
+			return nil, fmt.Errorf("invalid command record %s: %w", uid, err)
+		}
+
+		merged := false
+		for i := range cs.commands {
+			if cs.commands[i].UID == uid {
+				cs.commands[i] = mergeCommand(cs.commands[i], remote)
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			cs.lastID++
+			remote.ID = cs.lastID
+			cs.commands = append(cs.commands, remote)
+		}
+	}
+
+	// Names must stay unique; if two machines picked the same name for
+	// different commands, the one that was named first keeps it
+	nameOwner := make(map[string]int)
+	for i := range cs.commands {
+		name := cs.commands[i].Name
+		if name == "" {
+			continue
+		}
+		if j, taken := nameOwner[name]; taken {
+			loser := i
+			if cs.commands[i].Timestamp.Before(cs.commands[j].Timestamp) {
+				loser = j
+				nameOwner[name] = i
+			}
+			fmt.Fprintf(os.Stderr, "Warning: name '%s' used on several machines, removed it from command #%d\n", name, cs.commands[loser].ID)
+			cs.commands[loser].Name = ""
+			continue
+		}
+		nameOwner[name] = i
+	}
+
+	// Drop local records deleted elsewhere
+	newCommands := make([]Command, 0, len(cs.commands))
+	for _, cmd := range cs.commands {
+		if _, deleted := tombstones[cmd.UID]; !deleted {
+			newCommands = append(newCommands, cmd)
+		}
+	}
+	cs.commands = newCommands
+
+	remoteChains, err := readSyncFiles(dir, remoteRef, "chains")
+	if err != nil {
+		return nil, err
+	}
+	commandIDs := make(map[string]int)
+	for _, cmd := range cs.commands {
+		commandIDs[cmd.UID] = cmd.ID
+	}
+
+	// First pass: give every remote chain a local ID so dependencies between
+	// chains can be remapped
+	records := make(map[string]syncChainRecord)
+	chainIDs := make(map[string]int)
+	for _, chain := range cs.chains {
+		chainIDs[chain.UID] = chain.ID
+	}
+	uids = uids[:0]
+	for uid := range remoteChains {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+	for _, uid := range uids {
+		if _, deleted := tombstones[uid]; deleted {
+			continue
+		}
+		var record syncChainRecord
+		if err := json.Unmarshal(remoteChains[uid], &record); err != nil {
+			return nil, fmt.Errorf("invalid chain record %s: %w", uid, err)
+		}
+		records[uid] = record
+		if _, ok := chainIDs[uid]; !ok {
+			cs.lastChainID++
+			chainIDs[uid] = cs.lastChainID
+		}
+	}
+
+	carried := make(map[string][]byte)
+	for _, uid := range uids {
+		record, ok := records[uid]
+		if !ok {
+			continue
+		}
+		remote, err := remapChain(record, commandIDs, chainIDs)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipping chain '%s' from remote: %v\n", record.Chain.Name, err)
+			if cs.findChainByUID(uid) == nil {
+				carried[uid] = remoteChains[uid]
+			}
+			continue
+		}
+		remote.ID = chainIDs[uid]
+
+		merged := false
+		for i := range cs.chains {
+			if cs.chains[i].UID == uid {
+				cs.chains[i] = mergeChain(cs.chains[i], remote)
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			cs.chains = append(cs.chains, remote)
+		}
+	}
+
+	newChains := make([]CommandChain, 0, len(cs.chains))
+	for _, chain := range cs.chains {
+		if _, deleted := tombstones[chain.UID]; !deleted {
+			newChains = append(newChains, chain)
+		}
+	}
+	cs.chains = newChains
+	return carried, nil
+}
+
+// remapChain translates the IDs in a remote chain record to local IDs.
+func remapChain(record syncChainRecord, commandIDs, chainIDs map[string]int) (CommandChain, error) {
+	chain := record.Chain
+	mapCmd := func(id int) (int, error) {
+		uid, ok := record.CommandUIDs[id]
+		if !ok {
+			return 0, fmt.Errorf("no UID recorded for command %d", id)
+		}
+		localID, ok := commandIDs[uid]
+		if !ok {
+			return 0, fmt.Errorf("command %s is not available", uid)
+		}
+		return localID, nil
+	}
+	mapCmds := func(ids []int) ([]int, error) {
+		var mapped []int
+		for _, id := range ids {
+			localID, err := mapCmd(id)
+			if err != nil {
+				return nil, err
+			}
+			mapped = append(mapped, localID)
+		}
+		return mapped, nil
+	}
+
+	steps := make([]ChainStep, len(chain.Steps))
+	for i, step := range chain.Steps {
+		var err error
+		if step.CommandID, err = mapCmd(step.CommandID); err != nil {
+			return chain, err
+		}
+		if step.ParallelWith, err = mapCmds(step.ParallelWith); err != nil {
+			return chain, err
+		}
+		if step.OnSuccess, err = mapCmds(step.OnSuccess); err != nil {
+			return chain, err
+		}
+		if step.OnFailure, err = mapCmds(step.OnFailure); err != nil {
+			return chain, err
+		}
+		steps[i] = step
+	}
+	chain.Steps = steps
+
+	deps := make([]ChainDependency, len(chain.Dependencies))
+	for i, dep := range chain.Dependencies {
+		dep.ChainID = chainIDs[record.ChainUIDs[dep.ChainID]]
+		var dependsOn []int
+		for _, id := range dep.DependsOn {
+			localID, ok := chainIDs[record.ChainUIDs[id]]
+			if !ok {
+				return chain, fmt.Errorf("dependency chain %d is not available", id)
+			}
+			dependsOn = append(dependsOn, localID)
+		}
+		dep.DependsOn = dependsOn
+		deps[i] = dep
+	}
+	chain.Dependencies = deps
+	return chain, nil
+}
+
+// canMapChain reports whether the chain record in data only refers to
+// records the store has.
+func (cs *CommandStore) canMapChain(data []byte) bool {
+	var record syncChainRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return false
+	}
+	commandIDs := make(map[string]int)
+	for _, cmd := range cs.commands {
+		commandIDs[cmd.UID] = cmd.ID
+	}
+	chainIDs := map[string]int{record.Chain.UID: 0}
+	for _, chain := range cs.chains {
+		chainIDs[chain.UID] = chain.ID
+	}
+	_, err := remapChain(record, commandIDs, chainIDs)
+	return err == nil
+}
+
+// chainRecord wraps a chain with the UIDs of the commands and chains it
+// references.
+func (cs *CommandStore) chainRecord(chain CommandChain) syncChainRecord {
+	record := syncChainRecord{
+		Chain:       chain,
+		CommandUIDs: make(map[int]string),
+		ChainUIDs:   make(map[int]string),
+	}
+	for _, step := range chain.Steps {
+		for _, id := range append(append(append([]int{step.CommandID}, step.ParallelWith...), step.OnSuccess...), step.OnFailure...) {
+			if cmd := cs.findCommand(id); cmd != nil {
+				record.CommandUIDs[id] = cmd.UID
+			}
+		}
+	}
+	for _, dep := range chain.Dependencies {
+		for _, id := range append([]int{dep.ChainID}, dep.DependsOn...) {
+			if c := cs.findChain(id); c != nil {
+				record.ChainUIDs[id] = c.UID
+			}
+		}
+	}
+	return record
+}
+
+// writeSyncFiles replaces the records in the working tree with the
+// current store contents and the carried chain records.
+func (cs *CommandStore) writeSyncFiles(dir string, tombstones, carried map[string][]byte) error {
+	for _, prefix := range []string{"commands", "chains", "deleted"} {
+		if err := os.RemoveAll(filepath.Join(dir, prefix)); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Join(dir, prefix), 0755); err != nil {
+			return err
+		}
+	}
+
+	for _, cmd := range cs.commands {
+		data, err := json.MarshalIndent(cmd, "", "    ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, "commands", cmd.UID+".json"), data, 0644); err != nil {
+			return err
+		}
+	}
+
+	for _, chain := range cs.chains {
+		data, err := json.MarshalIndent(cs.chainRecord(chain), "", "    ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, "chains", chain.UID+".json"), data, 0644); err != nil {
+			return err
+		}
+	}
+
+	for uid, data := range carried {
+		if err := os.WriteFile(filepath.Join(dir, "chains", uid+".json"), data, 0644); err != nil {
+			return err
+		}
+	}
+
+	for uid := range tombstones {
+		if err := os.WriteFile(filepath.Join(dir, "deleted", uid), nil, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// syncMachine is one machine syncing through a shared remote, with its own
+// config directory and history.
+type syncMachine struct {
+	t   *testing.T
+	dir string
+}
+
+func newSyncMachine(t *testing.T, remote string) *syncMachine {
+	m := &syncMachine{t: t, dir: t.TempDir()}
+	m.use()
+	if err := SetSyncRemote(remote); err != nil {
+		t.Fatalf("SetSyncRemote: %v", err)
+	}
+	return m
+}
+
+// use makes this machine's directory the config directory of the process.
+func (m *syncMachine) use() {
+	ConfigPath = m.dir
+}
+
+// store loads this machine's history.
+func (m *syncMachine) store() *CommandStore {
+	m.t.Helper()
+	m.use()
+	cs, err := NewCommandStore()
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	if err := cs.load(); err != nil {
+		m.t.Fatal(err)
+	}
+	return cs
+}
+
+func (m *syncMachine) sync() *CommandStore {
+	m.t.Helper()
+	cs := m.store()
+	if err := cs.Sync(); err != nil {
+		m.t.Fatalf("Sync: %v", err)
+	}
+	return m.store()
+}
+
+func (m *syncMachine) add(raw string) {
+	m.t.Helper()
+	cs := m.store()
+	cs.lastID++
+	cs.commands = append(cs.commands, Command{Raw: raw, ID: cs.lastID, Timestamp: time.Now()})
+	if err := cs.save(); err != nil {
+		m.t.Fatal(err)
+	}
+}
+
+// edit changes a synced command, found by its text.
+func (m *syncMachine) edit(raw string, change func(cmd *Command)) {
+	m.t.Helper()
+	cs := m.store()
+	cmd := findRaw(cs, raw)
+	if cmd == nil {
+		m.t.Fatalf("%s: no command %q", m.dir, raw)
+	}
+	change(cmd)
+	if err := cs.save(); err != nil {
+		m.t.Fatal(err)
+	}
+}
+
+func findRaw(cs *CommandStore, raw string) *Command {
+	for i := range cs.commands {
+		if cs.commands[i].Raw == raw {
+			return &cs.commands[i]
+		}
+	}
+	return nil
+}
+
+func raws(cs *CommandStore) []string {
+	var list []string
+	for _, cmd := range cs.commands {
+		list = append(list, cmd.Raw)
+	}
+	slices.Sort(list)
+	return list
+}
+
+// setupSync returns two machines sharing a bare remote. Git has no
+// identity configured, like on a fresh machine.
+func setupSync(t *testing.T) (*syncMachine, *syncMachine) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(home, ".gitconfig"))
+	for _, name := range []string{"GIT_AUTHOR_NAME", "GIT_AUTHOR_EMAIL", "GIT_COMMITTER_NAME", "GIT_COMMITTER_EMAIL", "EMAIL"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+	saved := ConfigPath
+	t.Cleanup(func() { ConfigPath = saved })
+
+	remote := filepath.Join(t.TempDir(), "remote.git")
+	if out, err := exec.Command("git", "init", "--quiet", "--bare", remote).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v: %s", err, out)
+	}
+	return newSyncMachine(t, remote), newSyncMachine(t, remote)
+}
+
+func TestSyncSharesCommands(t *testing.T) {
+	a, b := setupSync(t)
+	a.add("echo from-a")
+	a.sync()
+	b.add("echo from-b")
+	b.sync()
+	got := a.sync()
+
+	want := []string{"echo from-a", "echo from-b"}
+	if !slices.Equal(raws(got), want) {
+		t.Errorf("a has %v, want %v", raws(got), want)
+	}
+	if got := raws(b.store()); !slices.Equal(got, want) {
+		t.Errorf("b has %v, want %v", got, want)
+	}
+}
+
+func TestSyncConcurrentEdits(t *testing.T) {
+	a, b := setupSync(t)
+	a.add("make deploy")
+	a.sync()
+	b.sync()
+
+	// Both machines edit the command before syncing again; b edits last
+	a.edit("make deploy", func(cmd *Command) {
+		cmd.Description = "from a"
+		cmd.Tags = []string{"a"}
+	})
+	time.Sleep(10 * time.Millisecond)
+	b.edit("make deploy", func(cmd *Command) {
+		cmd.Description = "from b"
+		cmd.Tags = []string{"b"}
+	})
+	a.sync()
+	b.sync()
+	final := a.sync()
+
+	for name, cs := range map[string]*CommandStore{"a": final, "b": b.store()} {
+		cmd := findRaw(cs, "make deploy")
+		if cmd == nil {
+			t.Fatalf("%s lost the command", name)
+		}
+		if cmd.Description != "from b" {
+			t.Errorf("%s: description %q, want the later edit %q", name, cmd.Description, "from b")
+		}
+		if !slices.Equal(cmd.Tags, []string{"a", "b"}) {
+			t.Errorf("%s: tags %v, want both machines' tags", name, cmd.Tags)
+		}
+		if len(cs.commands) != 1 {
+			t.Errorf("%s: %d commands, want 1", name, len(cs.commands))
+		}
+	}
+}
+
+func TestSyncDeletions(t *testing.T) {
+	a, b := setupSync(t)
+	a.add("echo keep")
+	a.add("echo drop")
+	a.sync()
+	b.sync()
+
+	// b deletes a command while a adds one
+	cs := b.store()
+	if err := cs.RemoveCommand(findRaw(cs, "echo drop").ID); err != nil {
+		t.Fatal(err)
+	}
+	a.add("echo new")
+	b.sync()
+	a.sync()
+	final := b.sync()
+
+	want := []string{"echo keep", "echo new"}
+	if got := raws(a.store()); !slices.Equal(got, want) {
+		t.Errorf("a has %v, want %v", got, want)
+	}
+	if got := raws(final); !slices.Equal(got, want) {
+		t.Errorf("b has %v, want %v", got, want)
+	}
+
+	// The deletion must stick after further syncs
+	a.sync()
+	if got := raws(b.sync()); !slices.Equal(got, want) {
+		t.Errorf("after another sync b has %v, want %v", got, want)
+	}
+}
+
+func TestSyncKeepsChainsItCannotMap(t *testing.T) {
+	a, b := setupSync(t)
+	a.add("echo step")
+	cs := a.store()
+	// The second step's command was deleted, so other machines cannot
+	// resolve it
+	cs.chains = append(cs.chains, CommandChain{ID: 1, Name: "broken", Steps: []ChainStep{{CommandID: findRaw(cs, "echo step").ID}, {CommandID: 99}}})
+	cs.lastChainID = 1
+	if err := cs.save(); err != nil {
+		t.Fatal(err)
+	}
+	a.sync()
+
+	uid := a.store().chains[0].UID
+	onRemote := func() bool {
+		t.Helper()
+		dir, err := syncDir()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files, err := git(dir, "ls-tree", "-r", "--name-only", "origin/"+syncBranch, "chains", "deleted")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return slices.Contains(strings.Split(files, "\n"), "chains/"+uid+".json")
+	}
+
+	// b cannot take the chain in, but must not delete it from the remote,
+	// neither on this sync nor on the next
+	if got := b.sync(); len(got.chains) != 0 {
+		t.Errorf("b took in %+v", got.chains)
+	}
+	if !onRemote() {
+		t.Error("b's sync removed the chain from the remote")
+	}
+	b.add("echo from-b")
+	b.sync()
+	if !onRemote() {
+		t.Error("b's second sync removed the chain from the remote")
+	}
+
+	got := a.sync()
+	if len(got.chains) != 1 || got.chains[0].Name != "broken" {
+		t.Errorf("a has chains %+v after b synced twice, want its chain kept", got.chains)
+	}
+	if findRaw(got, "echo from-b") == nil {
+		t.Errorf("a has %v, want b's command", raws(got))
+	}
+}
@@ -0,0 +1,16 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package main
+
+import "os"
+
+// isTerminal reports false: without a way to tell a terminal from other
+// character devices here, confirmations fail safe instead of reading from
+// something like /dev/null.
+func isTerminal(f *os.File) bool {
+	return false
+}
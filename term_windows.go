@@ -0,0 +1,19 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// isTerminal reports whether f is a console. Other character devices such
+// as NUL have no console mode.
+func isTerminal(f *os.File) bool {
+	var mode uint32
+	return syscall.GetConsoleMode(syscall.Handle(f.Fd()), &mode) == nil
+}
@@ -0,0 +1,253 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// VariableCapture stores the output of a step's main command, or part of
+// it, in a chain variable.
+type VariableCapture struct {
+	Name     string `json:"name" yaml:"name" toml:"name"`
+	Regex    string `json:"regex,omitempty" yaml:"regex,omitempty" toml:"regex,omitempty"`             // First group, or the whole match
+	JSONPath string `json:"json_path,omitempty" yaml:"json_path,omitempty" toml:"json_path,omitempty"` // e.g. "items[0].id"
+}
+
+var (
+	varNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	varPlaceholder = regexp.MustCompile(`\{\{([A-Za-z_][A-Za-z0-9_]*)\}\}`)
+)
+
+func validateVarName(name string) error {
+	if !varNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid variable name %q: use letters, digits and _, not starting with a digit", name)
+	}
+	return nil
+}
+
+// parseVarAssignment parses a --var "name=value" argument.
+func parseVarAssignment(arg string) (string, string, error) {
+	name, value, ok := strings.Cut(arg, "=")
+	if !ok {
+		return "", "", fmt.Errorf("--var expects name=value, got %q", arg)
+	}
+	if err := validateVarName(name); err != nil {
+		return "", "", err
+	}
+	return name, value, nil
+}
+
+// expandVars replaces {{name}} placeholders with the values of chain
+// variables. Placeholders of unknown variables are left as they are and
+// returned, so they can be reported.
+func expandVars(text string, vars map[string]string) (string, []string) {
+	var missing []string
+	expanded := varPlaceholder.ReplaceAllStringFunc(text, func(match string) string {
+		name := match[2 : len(match)-2]
+		if value, ok := vars[name]; ok {
+			return value
+		}
+		if !slices.Contains(missing, name) {
+			missing = append(missing, name)
+		}
+		return match
+	})
+	return expanded, missing
+}
+
+// expandConditions returns conditions with placeholders in their values,
+// and those of the conditions they combine, replaced.
+func expandConditions(conditions []CommandCondition, vars map[string]string) []CommandCondition {
+	if len(vars) == 0 {
+		return conditions
+	}
+	expanded := make([]CommandCondition, len(conditions))
+	for i, cond := range conditions {
+		cond.Value, _ = expandVars(cond.Value, vars)
+		cond.Conditions = expandConditions(cond.Conditions, vars)
+		expanded[i] = cond
+	}
+	return expanded
+}
+
+// varEnv returns the variables as SAVE_VAR_<NAME> environment variables,
+// which unlike placeholders need no quoting in shell commands.
+func varEnv(vars map[string]string) []string {
+	var env []string
+	for _, name := range slices.Sorted(maps.Keys(vars)) {
+		env = append(env, "SAVE_VAR_"+strings.ToUpper(name)+"="+vars[name])
+	}
+	return env
+}
+
+func (c VariableCapture) validate() error {
+	if err := validateVarName(c.Name); err != nil {
+		return err
+	}
+	if c.Regex != "" && c.JSONPath != "" {
+		return fmt.Errorf("capture %s: only one of regex or json_path may be set", c.Name)
+	}
+	if c.Regex != "" {
+		if _, err := regexp.Compile(c.Regex); err != nil {
+			return fmt.Errorf("capture %s: invalid regex: %v", c.Name, err)
+		}
+	}
+	if c.JSONPath != "" {
+		if _, err := parseJSONPath(c.JSONPath); err != nil {
+			return fmt.Errorf("capture %s: %v", c.Name, err)
+		}
+	}
+	return nil
+}
+
+// extract returns the captured value from a command's output. The whole
+// output is captured without its trailing newline.
+func (c VariableCapture) extract(output string) (string, error) {
+	switch {
+	case c.Regex != "":
+		re, err := regexp.Compile(c.Regex)
+		if err != nil {
+			return "", err
+		}
+		match := re.FindStringSubmatch(output)
+		if match == nil {
+			return "", fmt.Errorf("regex %q does not match the output", c.Regex)
+		}
+		if len(match) > 1 {
+			return match[1], nil
+		}
+		return match[0], nil
+
+	case c.JSONPath != "":
+		var data any
+		if err := json.Unmarshal([]byte(output), &data); err != nil {
+			return "", fmt.Errorf("output is not JSON: %v", err)
+		}
+		value, err := lookupJSONPath(data, c.JSONPath)
+		if err != nil {
+			return "", err
+		}
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	}
+	return strings.TrimRight(output, "\r\n"), nil
+}
+
+// parseJSONPath splits a path like "$.items[0].name" into keys and
+// indexes. The leading "$" or "$." is optional.
+func parseJSONPath(path string) ([]any, error) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	var parts []any
+	for rest != "" {
+		if rest[0] == '[' {
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid JSON path %q: missing ]", path)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid JSON path %q: bad index %q", path, rest[1:end])
+			}
+			parts = append(parts, index)
+			rest = strings.TrimPrefix(rest[end+1:], ".")
+			continue
+		}
+		end := strings.IndexAny(rest, ".[")
+		if end < 0 {
+			end = len(rest)
+		}
+		if end == 0 {
+			return nil, fmt.Errorf("invalid JSON path %q: empty key", path)
+		}
+		parts = append(parts, rest[:end])
+		rest = strings.TrimPrefix(rest[end:], ".")
+	}
+	return parts, nil
+}
+
+// lookupJSONPath returns the value at path in decoded JSON data.
+func lookupJSONPath(data any, path string) (any, error) {
+	parts, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range parts {
+		switch key := part.(type) {
+		case string:
+			object, ok := data.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("%s: %q is not in an object", path, key)
+			}
+			if data, ok = object[key]; !ok {
+				return nil, fmt.Errorf("%s: no key %q", path, key)
+			}
+		case int:
+			array, ok := data.([]any)
+			if !ok || key >= len(array) {
+				return nil, fmt.Errorf("%s: no element %d", path, key)
+			}
+			data = array[key]
+		}
+	}
+	return data, nil
+}
+
+// printChainRunReport summarises a finished chain run with the final
+// values of its variables.
+func printChainRunReport(run *ChainRunRecord) {
+	result := "succeeded"
+	if !run.Success {
+		result = "failed"
+		if run.Checkpoint != nil {
+			result += fmt.Sprintf(" at step %d", run.Checkpoint.NextStep+1)
+		}
+	}
+	fmt.Printf("Chain %s %s in %s (run #%d, %d commands run)\n", run.Chain, result, formatDuration(run.DurationMs), run.ID, len(run.Steps))
+	if !run.Success && run.Checkpoint != nil {
+		fmt.Printf("Resume it with: save --resume %d (add --mark-fixed if you fixed step %d by hand)\n", run.ID, run.Checkpoint.NextStep+1)
+	}
+	if len(run.Vars) == 0 {
+		return
+	}
+	fmt.Println("Variables:")
+	for _, name := range slices.Sorted(maps.Keys(run.Vars)) {
+		value := run.Vars[name]
+		if strings.Contains(value, "\n") {
+			value = strconv.Quote(value)
+		}
+		fmt.Printf("  %s = %s\n", name, value)
+	}
+}
+
+// warnMissingVars reports placeholders of undefined variables.
+func warnMissingVars(stepIndex int, missing []string) {
+	for _, name := range missing {
+		fmt.Fprintf(os.Stderr, "Warning: step %d: {{%s}} is not a chain variable and was left as is\n", stepIndex+1, name)
+	}
+}
+
+// captureVars sets the variables a step captures from the output of its
+// main command.
+func captureVars(stepIndex int, captures []VariableCapture, output string, vars map[string]string) error {
+	for _, capture := range captures {
+		value, err := capture.extract(output)
+		if err != nil {
+			return fmt.Errorf("step %d: capture %s: %v", stepIndex+1, capture.Name, err)
+		}
+		vars[capture.Name] = value
+	}
+	return nil
+}
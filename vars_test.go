@@ -0,0 +1,108 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// noisyJSON prints an update notice on stderr before its JSON, like gh.
+const noisyJSON = `echo 'warning: update available' >&2; echo '{"tag":"v1"}'`
+
+// runCaptureChain runs a chain whose first step captures tag from main,
+// with parallel running next to it if given, and returns what the second
+// step got for {{tag}}.
+func runCaptureChain(t *testing.T, main string, parallel ...string) string {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	out := filepath.Join(t.TempDir(), "tag")
+	cs := &CommandStore{filepath: filepath.Join(t.TempDir(), "history.json")}
+	if err := cs.load(); err != nil {
+		t.Fatal(err)
+	}
+	add := func(raw string) int {
+		cs.lastID++
+		cs.commands = append(cs.commands, Command{ID: cs.lastID, Raw: raw, Timestamp: time.Now()})
+		return cs.lastID
+	}
+
+	first := ChainStep{CommandID: add(main), Capture: []VariableCapture{{Name: "tag", JSONPath: "tag"}}}
+	for _, raw := range parallel {
+		first.ParallelWith = append(first.ParallelWith, add(raw))
+	}
+	second := ChainStep{CommandID: add("printf %s {{tag}} > " + out)}
+	cs.chains = append(cs.chains, CommandChain{ID: 1, Name: "release", Steps: []ChainStep{first, second}})
+	cs.lastChainID = 1
+	if err := cs.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cs.ExecuteChainWithDependencies(1, ChainRunOptions{}); err != nil {
+		t.Fatalf("chain failed: %v", err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// usePTYSetting sets the pty setting until the test ends.
+func usePTYSetting(t *testing.T, value string) {
+	t.Helper()
+	saved := config
+	t.Cleanup(func() { config = saved })
+	c := defaultConfig()
+	c.PTY = value
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	config = c
+}
+
+func TestCaptureIgnoresStderr(t *testing.T) {
+	modes := []string{"never"}
+	if ptySupported {
+		modes = append(modes, "always")
+	}
+	for _, mode := range modes {
+		t.Run("pty "+mode, func(t *testing.T) {
+			usePTYSetting(t, mode)
+			if got := runCaptureChain(t, noisyJSON); got != "v1" {
+				t.Errorf("sequential step captured %q, want v1", got)
+			}
+			if got := runCaptureChain(t, noisyJSON, "echo side; echo side-noise >&2"); got != "v1" {
+				t.Errorf("parallel step captured %q, want v1", got)
+			}
+		})
+	}
+}
+
+func TestCaptureKeepsOutputForConditions(t *testing.T) {
+	usePTYSetting(t, "never")
+	t.Setenv("HOME", t.TempDir())
+	cs := &CommandStore{filepath: filepath.Join(t.TempDir(), "history.json")}
+	if err := cs.load(); err != nil {
+		t.Fatal(err)
+	}
+	cs.commands = []Command{{ID: 1, Raw: noisyJSON, Timestamp: time.Now()}}
+	cs.lastID = 1
+	run := &ChainRunRecord{}
+	chain := &CommandChain{ID: 1, Steps: []ChainStep{{CommandID: 1, Capture: []VariableCapture{{Name: "tag", JSONPath: "tag"}}}}}
+	if err := cs.runChainSteps(chain, run, ChainRunOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// The recorded output, which conditions also see, still has stderr
+	if len(run.Steps) != 1 || !strings.Contains(run.Steps[0].Output, "warning: update available") {
+		t.Errorf("recorded output %+v, want stderr included", run.Steps)
+	}
+	if run.Vars["tag"] != "v1" {
+		t.Errorf("captured %q, want v1", run.Vars["tag"])
+	}
+}
@@ -0,0 +1,356 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// defaultDebounce is how long the files must stay unchanged before a
+// watched command runs, so that a burst of saves starts one run.
+const defaultDebounce = 300 * time.Millisecond
+
+// pollInterval is how often the polling watcher looks for changes.
+const pollInterval = time.Second
+
+// WatchOptions configure --watch.
+type WatchOptions struct {
+	Debounce time.Duration
+	Ignore   []string // Extra patterns in .gitignore syntax, relative to the current directory
+}
+
+// fileWatcher reports paths that may have changed under the roots it was
+// created for. The channel is closed if watching fails.
+type fileWatcher interface {
+	Changes() <-chan string
+	Close() error
+}
+
+// watchRoot is a file or directory to watch; directories are watched with
+// everything inside them.
+type watchRoot struct {
+	path string
+	glob string // Pattern the changed path, or one of its parents, must match
+}
+
+// watchRoots turns the paths and glob patterns given to --watch into the
+// files and directories to watch. A pattern is watched from the directory
+// before its first wildcard.
+func watchRoots(patterns []string) ([]watchRoot, error) {
+	var roots []watchRoot
+	for _, pattern := range patterns {
+		abs, err := filepath.Abs(pattern)
+		if err != nil {
+			return nil, err
+		}
+		root := watchRoot{path: abs}
+		if strings.ContainsAny(pattern, "*?[") {
+			if _, err := filepath.Match(abs, ""); err != nil {
+				return nil, fmt.Errorf("invalid file pattern %q", pattern)
+			}
+			root.glob = abs
+			for strings.ContainsAny(root.path, "*?[") {
+				root.path = filepath.Dir(root.path)
+			}
+		}
+		if _, err := os.Stat(root.path); err != nil {
+			return nil, fmt.Errorf("nothing to watch at %s: %w", pattern, err)
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+// matches reports whether a change to path concerns root.
+func (root watchRoot) matches(path string) bool {
+	if root.glob == "" {
+		return path == root.path || strings.HasPrefix(path, root.path+string(filepath.Separator))
+	}
+	for p := path; ; p = filepath.Dir(p) {
+		if ok, _ := filepath.Match(root.glob, p); ok {
+			return true
+		}
+		if p == filepath.Dir(p) {
+			return false
+		}
+	}
+}
+
+// WatchAndRun runs a saved command, or a chain given as chain:<ref>, each
+// time files matching patterns change, until interrupted. A change while
+// it runs stops the run and starts it again once the changes settle.
+// Files ignored by .gitignore don't count.
+func (cs *CommandStore) WatchAndRun(target string, patterns []string, opts WatchOptions) error {
+	commandID, chainID, err := cs.resolveRunTarget(target)
+	if err != nil {
+		return err
+	}
+	roots, err := watchRoots(patterns)
+	if err != nil {
+		return err
+	}
+	ignore, err := newIgnoreMatcher(opts.Ignore)
+	if err != nil {
+		return err
+	}
+	if opts.Debounce <= 0 {
+		opts.Debounce = defaultDebounce
+	}
+
+	// Confirm dangerous commands once, not on every change
+	if chain := cs.findChain(chainID); chain != nil {
+		err = cs.confirmChain(chain, ChainRunOptions{})
+	} else {
+		err = confirmCommand(*cs.findCommand(commandID), nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	watcher, err := newNativeWatcher(roots, ignore.ignored)
+	how := nativeWatcherName
+	if err != nil {
+		if !errors.Is(err, errNoNativeWatcher) {
+			fmt.Fprintf(os.Stderr, "Warning: %v, polling for changes instead\n", err)
+		}
+		watcher = newPollWatcher(roots, ignore.ignored, pollInterval)
+		how = "polling every " + pollInterval.String()
+	}
+	defer watcher.Close()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	label := cs.runTargetLabel(commandID, chainID)
+	fmt.Printf("Watching %s for %s (%s), press Ctrl-C to stop\n", strings.Join(patterns, " "), label, how)
+
+	type result struct {
+		exitCode int
+		duration time.Duration
+	}
+	var (
+		cancel  context.CancelFunc
+		done    chan result
+		changed []string
+		settle  = time.NewTimer(0)
+	)
+	<-settle.C
+	stop := func() result {
+		cancel()
+		res := <-done
+		done = nil
+		return res
+	}
+
+	for {
+		select {
+		case path, ok := <-watcher.Changes():
+			if !ok {
+				if done != nil {
+					stop()
+				}
+				return fmt.Errorf("watching stopped")
+			}
+			relevant := false
+			for _, root := range roots {
+				relevant = relevant || root.matches(path)
+			}
+			if !relevant || ignore.ignored(path, isDir(path)) {
+				continue
+			}
+			if done != nil {
+				fmt.Printf("[watch] %s changed, stopping the current run\n", relativePath(path))
+				stop()
+			}
+			if !slices.Contains(changed, path) {
+				changed = append(changed, path)
+			}
+			settle.Reset(opts.Debounce)
+
+		case <-settle.C:
+			message := relativePath(changed[0]) + " changed"
+			if len(changed) > 1 {
+				message = fmt.Sprintf("%d files changed", len(changed))
+			}
+			fmt.Printf("[watch] %s, running %s\n", message, label)
+			changed = nil
+
+			ctx, cancelRun := context.WithCancel(context.Background())
+			cancel, done = cancelRun, make(chan result, 1)
+			go func(done chan<- result) {
+				start := time.Now()
+				exitCode := cs.runWatched(ctx, commandID, chainID, start)
+				done <- result{exitCode, time.Since(start)}
+			}(done)
+
+		case res := <-done:
+			done = nil
+			cancel()
+			fmt.Printf("[watch] finished with exit code %d in %s, waiting for changes\n", res.exitCode, formatDuration(res.duration.Milliseconds()))
+
+		case <-signals:
+			if done != nil {
+				stop()
+			}
+			fmt.Println("[watch] stopped")
+			return nil
+		}
+	}
+}
+
+// runWatched runs the command or chain until ctx is cancelled, and
+// returns its exit code. Command runs are recorded here; a chain records
+// its own runs, and a cancelled one is left as interrupted.
+func (cs *CommandStore) runWatched(ctx context.Context, commandID, chainID int, start time.Time) int {
+	if chainID != 0 {
+		exe, err := os.Executable()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return -1
+		}
+		// Confirmed when the watch started
+		cmd := exec.CommandContext(ctx, exe, "--run-chain", strconv.Itoa(chainID), "--confirmed")
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		setProcessGroup(cmd)
+		cmd.Cancel = func() error { return killStep(cmd) }
+		return stepExitCode(cmd.Run())
+	}
+
+	command := cs.findCommand(commandID)
+	cmd, err := buildCommandContext(ctx, command.Shell, command.Raw, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return -1
+	}
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	// In its own process group, so stopping it stops what it started
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error { return killStep(cmd) }
+	exitCode := stepExitCode(cmd.Run())
+
+	// Other save commands may have written the history meanwhile
+	store, err := NewCommandStore()
+	if err == nil {
+		err = store.load()
+	}
+	if err == nil && store.findCommand(commandID) != nil {
+		store.recordRun(*store.findCommand(commandID), exitCode, start, time.Since(start))
+		err = store.updateCommandStats(commandID, exitCode)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to record the run: %v\n", err)
+	}
+	return exitCode
+}
+
+// newPollWatcher returns a fileWatcher that compares the modification
+// times and sizes of the files under roots every interval. It works
+// everywhere, at the cost of some latency and disk reads.
+func newPollWatcher(roots []watchRoot, ignored func(path string, dir bool) bool, interval time.Duration) fileWatcher {
+	w := &pollWatcher{changes: make(chan string), stop: make(chan struct{})}
+	go w.run(roots, ignored, interval)
+	return w
+}
+
+type pollWatcher struct {
+	changes chan string
+	stop    chan struct{}
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func (w *pollWatcher) Changes() <-chan string { return w.changes }
+
+func (w *pollWatcher) Close() error {
+	close(w.stop)
+	return nil
+}
+
+func (w *pollWatcher) run(roots []watchRoot, ignored func(path string, dir bool) bool, interval time.Duration) {
+	scan := func() map[string]fileStamp {
+		stamps := make(map[string]fileStamp)
+		for _, root := range roots {
+			filepath.WalkDir(root.path, func(path string, entry fs.DirEntry, err error) error {
+				if err != nil {
+					return nil
+				}
+				if path != root.path && ignored(path, entry.IsDir()) {
+					if entry.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if info, err := entry.Info(); err == nil {
+					stamps[path] = fileStamp{info.ModTime(), info.Size()}
+				}
+				return nil
+			})
+		}
+		return stamps
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := scan()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+		current := scan()
+		var changed []string
+		for path, stamp := range current {
+			if previous, ok := last[path]; !ok || previous != stamp {
+				changed = append(changed, path)
+			}
+		}
+		for path := range last {
+			if _, ok := current[path]; !ok {
+				changed = append(changed, path)
+			}
+		}
+		last = current
+		for _, path := range changed {
+			select {
+			case w.changes <- path:
+			case <-w.stop:
+				return
+			}
+		}
+	}
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// relativePath returns path relative to the current directory when it is
+// inside it.
+func relativePath(path string) string {
+	if wd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(wd, path); err == nil && !strings.HasPrefix(rel, "..") {
+			return rel
+		}
+	}
+	return path
+}
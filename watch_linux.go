@@ -0,0 +1,156 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const nativeWatcherName = "inotify"
+
+var errNoNativeWatcher = errors.New("inotify is not available")
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// inotifyWatcher watches directories with inotify. Directories created
+// under a watched tree are watched as they appear.
+type inotifyWatcher struct {
+	fd      int
+	file    *os.File // fd, read through the runtime poller so Close interrupts reads
+	roots   []watchRoot
+	ignored func(path string, dir bool) bool
+	dirs    map[int32]string // Watched directories by watch descriptor
+	changes chan string
+	stop    chan struct{}
+}
+
+func newNativeWatcher(roots []watchRoot, ignored func(path string, dir bool) bool) (fileWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNoNativeWatcher, err)
+	}
+	w := &inotifyWatcher{
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		roots:   roots,
+		ignored: ignored,
+		dirs:    make(map[int32]string),
+		changes: make(chan string),
+		stop:    make(chan struct{}),
+	}
+	for _, root := range roots {
+		if isDir(root.path) {
+			err = w.addTree(root.path)
+		} else {
+			// Files are replaced rather than rewritten by many editors
+			err = w.add(filepath.Dir(root.path))
+		}
+		if err != nil {
+			w.file.Close()
+			return nil, err
+		}
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *inotifyWatcher) Changes() <-chan string { return w.changes }
+
+func (w *inotifyWatcher) Close() error {
+	close(w.stop)
+	return w.file.Close()
+}
+
+func (w *inotifyWatcher) add(dir string) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask)
+	if errors.Is(err, syscall.ENOSPC) {
+		return fmt.Errorf("too many directories to watch with inotify, raise fs.inotify.max_user_watches")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to watch %s: %w", dir, err)
+	}
+	w.dirs[int32(wd)] = dir
+	return nil
+}
+
+// addTree watches root and the directories under it that aren't ignored.
+func (w *inotifyWatcher) addTree(root string) error {
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() {
+			// Directories that vanished or can't be read are left out
+			return nil
+		}
+		if path != root && w.ignored(path, true) {
+			return filepath.SkipDir
+		}
+		return w.add(path)
+	})
+}
+
+func (w *inotifyWatcher) read() {
+	defer close(w.changes)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			select {
+			case <-w.stop:
+			default:
+				fmt.Fprintf(os.Stderr, "Error reading inotify events: %v\n", err)
+			}
+			return
+		}
+
+		var changed []string
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			wd := int32(binary.NativeEndian.Uint32(buf[offset:]))
+			mask := binary.NativeEndian.Uint32(buf[offset+4:])
+			nameLen := int(binary.NativeEndian.Uint32(buf[offset+12:]))
+			name := strings.TrimRight(string(buf[offset+syscall.SizeofInotifyEvent:offset+syscall.SizeofInotifyEvent+nameLen]), "\x00")
+			offset += syscall.SizeofInotifyEvent + nameLen
+
+			switch {
+			case mask&syscall.IN_Q_OVERFLOW != 0:
+				// Events were lost, so anything may have changed
+				for _, root := range w.roots {
+					changed = append(changed, root.path)
+				}
+				continue
+			case mask&syscall.IN_IGNORED != 0:
+				delete(w.dirs, wd)
+				continue
+			}
+			dir, ok := w.dirs[wd]
+			if !ok {
+				continue
+			}
+			path := filepath.Join(dir, name)
+			if mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 && !w.ignored(path, true) {
+				if err := w.addTree(path); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+				}
+			}
+			changed = append(changed, path)
+		}
+
+		for _, path := range changed {
+			select {
+			case w.changes <- path:
+			case <-w.stop:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,19 @@
+// Copyright (c) 2024 Andrew Adhikari
+// This file is licensed under the MIT License.
+// See LICENSE in the project root for license information.
+
+//go:build !linux
+
+package main
+
+import "errors"
+
+// Native file watching is only implemented for Linux; elsewhere --watch
+// polls.
+const nativeWatcherName = ""
+
+var errNoNativeWatcher = errors.New("native file watching is not supported on this platform")
+
+func newNativeWatcher(roots []watchRoot, ignored func(path string, dir bool) bool) (fileWatcher, error) {
+	return nil, errNoNativeWatcher
+}